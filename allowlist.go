@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cyverse-de/road-runner/model"
+)
+
+// parseImageAllowlist turns "name:tag@digest" entries into a map from
+// "name:tag" to digest. The entries are a list rather than a map in the config
+// because viper would split image names containing dots into nested keys.
+func parseImageAllowlist(entries []string) (map[string]string, error) {
+	allowlist := make(map[string]string)
+	for _, entry := range entries {
+		idx := strings.LastIndex(entry, "@")
+		if idx <= 0 || idx == len(entry)-1 {
+			return nil, fmt.Errorf("image allowlist entry %q isn't in the form name:tag@digest", entry)
+		}
+		allowlist[entry[:idx]] = entry[idx+1:]
+	}
+	return allowlist, nil
+}
+
+// verifyImage returns an error if the allowlist is set and the local image
+// name:tag isn't on it with a matching digest.
+func (r *JobRunner) verifyImage(name, tag string) error {
+	if len(r.allowlist) == 0 {
+		return nil
+	}
+	ref := fmt.Sprintf("%s:%s", name, tag)
+	expected, ok := r.allowlist[ref]
+	if !ok {
+		return fmt.Errorf("image %s is not on the image allowlist", ref)
+	}
+	return r.checkDigest(ref, name, expected)
+}
+
+// checkDigest returns an error if none of the repo digests of the local image
+// ref are name@digest. The repository has to match as well as the digest, so
+// an image that was pulled from somewhere else isn't accepted just because it
+// has the same content.
+func (r *JobRunner) checkDigest(ref, name, digest string) error {
+	inspection, err := r.dckr.InspectImage(ref)
+	if err != nil {
+		return err
+	}
+	expected := fmt.Sprintf("%s@%s", name, digest)
+	for _, rd := range inspection.RepoDigests {
+		if rd == expected {
+			return nil
+		}
+	}
+	return fmt.Errorf("image %s does not have the repo digest %s", ref, expected)
+}
+
+// verifyDataImage returns an error if the image pulled for a digest-locked
+// data container doesn't resolve to its digest. When the allowlist is set, the
+// data container's name:tag must be on it with the same digest.
+func (r *JobRunner) verifyDataImage(vf *model.VolumesFrom) error {
+	if len(r.allowlist) > 0 {
+		key := fmt.Sprintf("%s:%s", vf.Name, vf.Tag)
+		if expected, ok := r.allowlist[key]; !ok || expected != vf.Digest {
+			return fmt.Errorf("image %s@%s is not on the image allowlist", vf.Name, vf.Digest)
+		}
+	}
+	return r.checkDigest(vf.ImageRef(), vf.Name, vf.Digest)
+}
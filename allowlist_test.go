@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cyverse-de/road-runner/messaging"
+)
+
+func TestParseImageAllowlist(t *testing.T) {
+	actual, err := parseImageAllowlist([]string{
+		"discoenv/porklock:latest@sha256:abc",
+		"harbor.example.org:5000/de/wc:1.0@sha256:def",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"discoenv/porklock:latest":          "sha256:abc",
+		"harbor.example.org:5000/de/wc:1.0": "sha256:def",
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("allowlist was %#v instead of %#v", actual, expected)
+	}
+
+	for _, bad := range []string{"discoenv/porklock:latest", "@sha256:abc", "discoenv/porklock:latest@"} {
+		if _, err = parseImageAllowlist([]string{bad}); err == nil {
+			t.Errorf("entry %q didn't return an error", bad)
+		}
+	}
+}
+
+func TestPullStepImagesAllowlist(t *testing.T) {
+	runner, d, _ := newTestRunner(t)
+	var refs []string
+	for _, ci := range runner.job.ContainerImages() {
+		refs = append(refs, ci.Name+":"+ci.Tag)
+	}
+
+	runner.allowlist = make(map[string]string)
+	d.repoDigests = make(map[string][]string)
+	for _, ref := range refs {
+		runner.allowlist[ref] = "sha256:approved"
+		d.repoDigests[ref] = []string{strings.Split(ref, ":")[0] + "@sha256:approved"}
+	}
+	if err := runner.pullStepImages(); err != nil {
+		t.Errorf("images on the allowlist were rejected: %s", err)
+	}
+	if runner.status != messaging.Success {
+		t.Errorf("status was %d instead of %d", runner.status, messaging.Success)
+	}
+
+	name := strings.Split(refs[0], ":")[0]
+	d.repoDigests[refs[0]] = []string{"mirror.example.org/" + name + "@sha256:approved"}
+	if err := runner.pullStepImages(); err == nil {
+		t.Error("image with the approved digest from another repository was accepted")
+	}
+
+	runner.status = messaging.Success
+	d.repoDigests[refs[0]] = []string{name + "@sha256:unapproved"}
+	if err := runner.pullStepImages(); err == nil {
+		t.Error("image with a digest that isn't on the allowlist was accepted")
+	}
+	if runner.status != messaging.StatusDockerPullFailed {
+		t.Errorf("status was %d instead of %d", runner.status, messaging.StatusDockerPullFailed)
+	}
+}
+
+func TestVerifyImageWithoutAllowlist(t *testing.T) {
+	runner, _, _ := newTestRunner(t)
+	if err := runner.verifyImage("anything", "latest"); err != nil {
+		t.Errorf("image was rejected without an allowlist: %s", err)
+	}
+	runner.allowlist = map[string]string{"discoenv/wc:1.0": "sha256:abc"}
+	if err := runner.verifyImage("anything", "latest"); err == nil {
+		t.Error("image missing from the allowlist was accepted")
+	}
+}
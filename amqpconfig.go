@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// amqpURI returns amqp.uri if it's set. Otherwise the URI is assembled from
+// amqp.host, amqp.port, amqp.user, amqp.password, and amqp.vhost, which lets
+// the credentials be rotated without rewriting the URI. The port and vhost
+// are left out when they aren't set so the broker's defaults are used.
+func amqpURI(cfg *viper.Viper) string {
+	if uri := cfg.GetString("amqp.uri"); uri != "" {
+		return uri
+	}
+
+	host := cfg.GetString("amqp.host")
+	if port := cfg.GetString("amqp.port"); port != "" {
+		host = net.JoinHostPort(host, port)
+	}
+
+	var userinfo string
+	if user := cfg.GetString("amqp.user"); user != "" {
+		if password := cfg.GetString("amqp.password"); password != "" {
+			userinfo = url.UserPassword(user, password).String() + "@"
+		} else {
+			userinfo = url.User(user).String() + "@"
+		}
+	}
+
+	var vhost string
+	if v := cfg.GetString("amqp.vhost"); v != "" {
+		// The vhost is a single path segment, so slashes in it have to be
+		// escaped, and spaces are %20 rather than the + QueryEscape uses.
+		vhost = "/" + strings.Replace(url.QueryEscape(v), "+", "%20", -1)
+	}
+
+	return fmt.Sprintf("amqp://%s%s%s", userinfo, host, vhost)
+}
+
+// redactedPassword replaces the password in URIs that are logged.
+const redactedPassword = "xxxxx"
+
+// redactURI returns uri with the password replaced so that it's safe to log.
+// URIs that can't be parsed are redacted completely, since there's no telling
+// where the password is in them.
+func redactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "<unparseable URI>"
+	}
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redactedPassword)
+		}
+	}
+	return u.String()
+}
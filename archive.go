@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/logcabin"
+	"github.com/cyverse-de/road-runner/model"
+)
+
+// archiveTimeout is how long each upload to the archive may take.
+var archiveTimeout = 30 * time.Second
+
+// objectUploader stores objects under keys in an object store.
+type objectUploader interface {
+	PutObject(key string, body []byte, contentType string) error
+}
+
+// s3Uploader uploads objects to a bucket in an S3-compatible object store.
+// Requests are signed with AWS signature version 4 and use path-style URLs,
+// which every S3-compatible store understands.
+type s3Uploader struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+	now       func() time.Time
+}
+
+// newS3Uploader returns an *s3Uploader for the bucket at the endpoint. The
+// region defaults to us-east-1, which is what most S3-compatible stores
+// expect when they don't have regions.
+func newS3Uploader(endpoint, bucket, region, accessKey, secretKey string) *s3Uploader {
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &s3Uploader{
+		endpoint:  strings.TrimRight(endpoint, "/"),
+		bucket:    bucket,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: archiveTimeout},
+		now:       time.Now,
+	}
+}
+
+// s3Escape percent-encodes everything in s except the characters that S3
+// leaves alone in object paths.
+func s3Escape(s string) string {
+	var buf bytes.Buffer
+	for _, b := range []byte(s) {
+		if b >= 'A' && b <= 'Z' || b >= 'a' && b <= 'z' || b >= '0' && b <= '9' || strings.IndexByte("-_.~/", b) >= 0 {
+			buf.WriteByte(b)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// sign adds the AWS signature version 4 headers to req, which must not have a
+// query string.
+func (u *s3Uploader) sign(req *http.Request, body []byte) {
+	now := u.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		"",
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, u.region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+u.secretKey), date)
+	key = hmacSHA256(key, u.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		u.accessKey, scope, signedHeaders, signature,
+	))
+}
+
+// PutObject uploads body to the bucket under key.
+func (u *s3Uploader) PutObject(key string, body []byte, contentType string) error {
+	escaped := s3Escape(fmt.Sprintf("/%s/%s", u.bucket, key))
+	objectURL, err := url.Parse(u.endpoint + escaped)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, objectURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	u.sign(req, body)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("uploading %s to the archive failed with status %s", key, resp.Status)
+	}
+	return nil
+}
+
+// archiveJob uploads the job file as it was submitted and the job as
+// road-runner is going to run it, with the config and any overrides applied,
+// under the job's invocation ID. The uploads happen in the background so that
+// a slow archive doesn't hold up the job. The returned channel is closed once
+// they're done. Failures are only warned about, since the archive is for
+// auditing and shouldn't stop the job.
+func archiveJob(u objectUploader, jobJSON []byte, job *model.Job) chan struct{} {
+	// The job is marshalled before this returns, since the job gets changed
+	// while it runs.
+	resolved, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		logcabin.Warning.Printf("not archiving the resolved job: %s", err)
+	}
+	objects := []struct {
+		key  string
+		body []byte
+	}{
+		{job.InvocationID + "/job.json", jobJSON},
+		{job.InvocationID + "/resolved-job.json", resolved},
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, o := range objects {
+			if o.body == nil {
+				continue
+			}
+			if err := u.PutObject(o.key, o.body, "application/json"); err != nil {
+				logcabin.Warning.Printf("failed to archive %s: %s", o.key, err)
+				continue
+			}
+			logcabin.Info.Printf("Archived %s", o.key)
+		}
+	}()
+	return done
+}
+
+// waitForArchive waits for the uploads started by archiveJob to finish so
+// that exiting doesn't cut them off. It gives up after timeout and returns
+// false. A nil done channel means nothing was archived.
+func waitForArchive(done chan struct{}, timeout time.Duration) bool {
+	if done == nil {
+		return true
+	}
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// normalizeCapability returns the capability name in upper case without the
+// CAP_ prefix, which is how Docker accepts it.
+func normalizeCapability(c string) string {
+	return strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(c)), "CAP_")
+}
+
+// parseCapabilities returns the set of normalized capability names.
+func parseCapabilities(caps []string) map[string]bool {
+	retval := make(map[string]bool)
+	for _, c := range caps {
+		if n := normalizeCapability(c); n != "" {
+			retval[n] = true
+		}
+	}
+	return retval
+}
+
+// verifyCapabilities returns an error if any of the job's steps adds a
+// capability that isn't in the runner's allowlist. Dropping capabilities is
+// always allowed.
+func (r *JobRunner) verifyCapabilities() error {
+	for idx, step := range r.job.Steps {
+		for _, c := range step.Component.Container.CapAdd {
+			if !r.caps[normalizeCapability(c)] {
+				return fmt.Errorf("step %d requests capability %s, which isn't allowed", idx, c)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCapabilities(t *testing.T) {
+	actual := parseCapabilities([]string{"NET_ADMIN", "cap_sys_ptrace", " chown ", ""})
+	expected := map[string]bool{"NET_ADMIN": true, "SYS_PTRACE": true, "CHOWN": true}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("capabilities were %#v instead of %#v", actual, expected)
+	}
+}
+
+func TestVerifyCapabilities(t *testing.T) {
+	t.Run("allowed capability passes", func(t *testing.T) {
+		runner, _, _ := newTestRunner(t)
+		runner.caps = parseCapabilities([]string{"NET_ADMIN"})
+		runner.job.Steps[0].Component.Container.CapAdd = []string{"CAP_NET_ADMIN"}
+		runner.job.Steps[0].Component.Container.CapDrop = []string{"SYS_ADMIN"}
+		if err := runner.verifyCapabilities(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("disallowed capability fails", func(t *testing.T) {
+		runner, _, _ := newTestRunner(t)
+		runner.caps = parseCapabilities([]string{"NET_ADMIN"})
+		runner.job.Steps[0].Component.Container.CapAdd = []string{"SYS_ADMIN"}
+		if err := runner.verifyCapabilities(); err == nil {
+			t.Error("SYS_ADMIN was allowed")
+		}
+	})
+
+	t.Run("nothing is allowed without an allowlist", func(t *testing.T) {
+		runner, _, _ := newTestRunner(t)
+		runner.job.Steps[0].Component.Container.CapAdd = []string{"NET_ADMIN"}
+		if err := runner.verifyCapabilities(); err == nil {
+			t.Error("NET_ADMIN was allowed without an allowlist")
+		}
+	})
+}
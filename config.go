@@ -0,0 +1,211 @@
+package main
+
+import (
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// runConfig holds the settings from the config file that change how a job is
+// run and cleaned up after. main builds it once with newRunConfig and keeps it
+// on the RunContext, and each JobRunner gets a copy.
+type runConfig struct {
+	debug debugOptions
+
+	// allowlist maps "name:tag" to the digest the image must have. It's empty
+	// when the allowlist isn't configured, in which case any image may be
+	// used.
+	allowlist map[string]string
+
+	// caps holds the normalized names of the Linux capabilities that steps
+	// may add. Steps can't add any capabilities when it's empty.
+	caps map[string]bool
+
+	// tailLines is the number of lines from the end of a failed step's stderr
+	// to include in the failure message. Zero turns the feature off.
+	tailLines int
+
+	// logsAddr is the address the stdout and stderr logs of the job's steps
+	// are served on over HTTP, so that operators can watch a running step
+	// without AMQP. They aren't served when it's empty.
+	logsAddr string
+
+	// reuse makes the runner reuse a working directory volume left behind by
+	// an earlier attempt at the job instead of replacing it.
+	reuse bool
+
+	// preserveExit makes road-runner exit with the step's exit code instead
+	// of -1 when it's stopped by a signal after the running step's container
+	// has exited with a non-zero code.
+	preserveExit bool
+
+	// allowEmpty lets jobs without any steps run. They only move data, so
+	// they're allowed by default. Sites where they're usually a broken
+	// submission can turn it off to reject them up front.
+	allowEmpty bool
+
+	// limits caps the number of inputs and steps. Each of them gets its own
+	// container, so a malformed job with thousands of them could overwhelm
+	// the node.
+	limits jobLimits
+
+	// volumesPath is the directory whose file system must have room for the
+	// job. The working directory is checked when it's empty.
+	volumesPath string
+
+	// deadline is how long the output upload of a job that has already
+	// failed may take before it's abandoned. Zero means there's no limit.
+	deadline time.Duration
+
+	// jitter is the longest random delay before any images are pulled, so
+	// that jobs starting together don't all hit the registry at once. Zero
+	// disables it.
+	jitter time.Duration
+
+	// strictMemory fails jobs with a step that asks for more memory than the
+	// node has instead of just warning about them.
+	strictMemory bool
+
+	// stageInputs downloads the inputs into the dockerops.INPUTSDIR
+	// subdirectory of the working directory instead of the working directory
+	// itself.
+	stageInputs bool
+
+	// dlAttempts is the number of times each input is tried before the job
+	// fails. Values of 1 or less turn the retries off.
+	dlAttempts int
+
+	// requireHosts fails jobs with a volume whose host path is missing or
+	// isn't a directory before anything runs instead of just warning about
+	// them.
+	requireHosts bool
+
+	// hostPathRoots are the directories that host path inputs have to be
+	// in. Host path inputs aren't allowed when it's empty.
+	hostPathRoots []string
+
+	// lockGlobs are patterns, relative to the working directory, of lock
+	// files that tools leave behind. Matching files are removed from a reused
+	// working directory volume before the inputs are downloaded so that they
+	// don't block the new run.
+	lockGlobs []string
+
+	// uploadOnFail uploads the outputs of a job whose inputs failed to
+	// download. Turning it off skips that upload, since the steps never ran
+	// and there's little to upload.
+	uploadOnFail bool
+
+	// metricsURL is the Prometheus Pushgateway that the job's final metrics
+	// are pushed to when it finishes, including when it's killed or times
+	// out. They aren't pushed when it's empty.
+	metricsURL string
+
+	// oomRetry is what the memory limit of a step that ran out of memory is
+	// multiplied by for a single retry. Values of 1 or less turn the retry
+	// off.
+	oomRetry float64
+
+	// deadman lets an external watcher force a clean failure when a job
+	// hangs. It's off when its file is empty.
+	deadman deadmanSwitch
+
+	// serviceWait is how long a step waits for a service data container to
+	// become ready before the step fails.
+	serviceWait time.Duration
+
+	cleanup cleanupOptions
+}
+
+// cleanupOptions are the settings for cleaning up after a job.
+type cleanupOptions struct {
+	grace gracePeriods
+
+	// retries is the number of times a failed removal is retried, which
+	// gives a busy Docker daemon a chance to catch up.
+	retries int
+
+	// pruneDangling removes dangling images from the node after each job so
+	// they don't pile up and fill its disk.
+	pruneDangling bool
+}
+
+// defaultRunConfig returns the settings used for anything the config file
+// doesn't set.
+func defaultRunConfig() runConfig {
+	return runConfig{
+		debug:        debugOptions{maxSize: defaultWorkdirMaxSize},
+		allowEmpty:   true,
+		uploadOnFail: true,
+		deadman:      deadmanSwitch{interval: 5 * time.Minute},
+		serviceWait:  5 * time.Minute,
+		cleanup: cleanupOptions{
+			grace:   gracePeriods{step: 10 * time.Second, other: time.Second},
+			retries: 3,
+		},
+	}
+}
+
+// newRunConfig returns the settings in cfg, with the defaults filled in.
+func newRunConfig(cfg *viper.Viper) (runConfig, error) {
+	c := defaultRunConfig()
+
+	allowlist, err := parseImageAllowlist(cfg.GetStringSlice("security.image_allowlist"))
+	if err != nil {
+		return c, err
+	}
+	c.allowlist = allowlist
+	c.caps = parseCapabilities(cfg.GetStringSlice("security.allowed_caps"))
+
+	c.debug.uploadWorkdir = cfg.GetBool("debug.upload_workdir_on_failure")
+	c.debug.irodsPath = cfg.GetString("debug.irods_path")
+	if maxSize := int64(cfg.GetSizeInBytes("debug.workdir_max_size")); maxSize > 0 {
+		c.debug.maxSize = maxSize
+	}
+
+	c.tailLines = cfg.GetInt("logs.fail_tail_lines")
+	c.logsAddr = cfg.GetString("logs.listen_addr")
+	c.reuse = cfg.GetBool("job.reuse_volume")
+	c.preserveExit = cfg.GetBool("job.preserve_step_exit_on_signal")
+	if cfg.IsSet("job.allow_zero_steps") {
+		c.allowEmpty = cfg.GetBool("job.allow_zero_steps")
+	}
+	c.limits = jobLimits{
+		inputs: cfg.GetInt("limits.max_inputs"),
+		steps:  cfg.GetInt("limits.max_steps"),
+	}
+	c.volumesPath = cfg.GetString("condor.volumespath")
+	c.deadline = cfg.GetDuration("transfer.upload_deadline")
+	c.jitter = cfg.GetDuration("docker.pull_jitter_max")
+	c.strictMemory = cfg.GetBool("resources.strict_memory_limits")
+	c.stageInputs = cfg.GetBool("transfer.stage_inputs")
+	c.dlAttempts = cfg.GetInt("transfer.download_attempts")
+	c.requireHosts = cfg.GetBool("volume.require_host_paths")
+	c.hostPathRoots = cfg.GetStringSlice("volume.host_path_roots")
+	c.lockGlobs = cfg.GetStringSlice("job.stale_lock_globs")
+	if cfg.IsSet("transfer.upload_on_input_failure") {
+		c.uploadOnFail = cfg.GetBool("transfer.upload_on_input_failure")
+	}
+	c.metricsURL = cfg.GetString("metrics.pushgateway_url")
+	c.oomRetry = cfg.GetFloat64("job.oom_retry_multiplier")
+
+	c.deadman.file = cfg.GetString("job.deadman_file")
+	if interval := cfg.GetDuration("job.deadman_interval"); interval > 0 {
+		c.deadman.interval = interval
+	}
+	if timeout := cfg.GetDuration("job.service_start_timeout"); timeout > 0 {
+		c.serviceWait = timeout
+	}
+
+	if grace := cfg.GetDuration("cleanup.step_grace_period"); grace > 0 {
+		c.cleanup.grace.step = grace
+	}
+	if grace := cfg.GetDuration("cleanup.grace_period"); grace > 0 {
+		c.cleanup.grace.other = grace
+	}
+	if cfg.IsSet("cleanup.retries") {
+		c.cleanup.retries = cfg.GetInt("cleanup.retries")
+	}
+	c.cleanup.pruneDangling = cfg.GetBool("cleanup.prune_dangling")
+
+	return c, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestNewRunConfig(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		c, err := newRunConfig(viper.New())
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := defaultRunConfig()
+		expected.allowlist = map[string]string{}
+		expected.caps = map[string]bool{}
+		if !reflect.DeepEqual(c, expected) {
+			t.Errorf("config was %#v instead of %#v", c, expected)
+		}
+	})
+
+	t.Run("settings", func(t *testing.T) {
+		cfg := viper.New()
+		cfg.Set("job.allow_zero_steps", false)
+		cfg.Set("transfer.upload_on_input_failure", false)
+		cfg.Set("cleanup.retries", 0)
+		cfg.Set("cleanup.step_grace_period", "30s")
+		cfg.Set("job.service_start_timeout", "1m")
+		cfg.Set("limits.max_steps", 5)
+		cfg.Set("logs.listen_addr", ":8080")
+		cfg.Set("volume.host_path_roots", []string{"/data"})
+		c, err := newRunConfig(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.allowEmpty {
+			t.Error("jobs without steps are allowed")
+		}
+		if c.uploadOnFail {
+			t.Error("outputs are uploaded after input failures")
+		}
+		if c.cleanup.retries != 0 {
+			t.Errorf("cleanup retries were %d instead of 0", c.cleanup.retries)
+		}
+		if c.cleanup.grace.step != 30*time.Second {
+			t.Errorf("step grace period was %s instead of 30s", c.cleanup.grace.step)
+		}
+		if c.cleanup.grace.other != time.Second {
+			t.Errorf("grace period was %s instead of 1s", c.cleanup.grace.other)
+		}
+		if c.serviceWait != time.Minute {
+			t.Errorf("service wait was %s instead of 1m", c.serviceWait)
+		}
+		if c.limits.steps != 5 {
+			t.Errorf("step limit was %d instead of 5", c.limits.steps)
+		}
+		if c.logsAddr != ":8080" {
+			t.Errorf("logs address was %q instead of :8080", c.logsAddr)
+		}
+		if !reflect.DeepEqual(c.hostPathRoots, []string{"/data"}) {
+			t.Errorf("host path roots were %#v instead of /data", c.hostPathRoots)
+		}
+	})
+
+	t.Run("bad allowlist", func(t *testing.T) {
+		cfg := viper.New()
+		cfg.Set("security.image_allowlist", []string{"no-digest"})
+		if _, err := newRunConfig(cfg); err == nil {
+			t.Error("err was nil")
+		}
+	})
+}
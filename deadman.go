@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/cyverse-de/road-runner/messaging"
+)
+
+// deadmanSwitch is the dead man's switch file a runner watches while a step
+// runs and how often it has to be touched. An empty file turns it off.
+type deadmanSwitch struct {
+	file     string
+	interval time.Duration
+}
+
+// deadmanPollInterval is how often the dead man's switch file is checked.
+var deadmanPollInterval = 10 * time.Second
+
+// deadmanNow returns the current time. Tests replace it to move the clock.
+var deadmanNow = time.Now
+
+// deadmanExpired returns true if the file at path hasn't been touched within
+// interval as of now. The interval is counted from since if the file doesn't
+// exist or was last touched before since, so the watcher gets a full interval
+// to refresh the file after each step starts.
+func deadmanExpired(path string, since, now time.Time, interval time.Duration) (bool, error) {
+	last := since
+	info, err := os.Stat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err == nil && info.ModTime().After(last) {
+		last = info.ModTime()
+	}
+	return now.Sub(last) > interval, nil
+}
+
+// watchDeadman checks the dead man's switch file until it expires or a
+// message is sent on the returned channel. When it expires, a stop with
+// StatusKilled is requested, so the outputs are still uploaded.
+func (r *JobRunner) watchDeadman(sw deadmanSwitch) chan int {
+	path, interval := sw.file, sw.interval
+	quit := make(chan int, 1)
+	since := deadmanNow()
+	log := r.log.WithField("phase", PhaseRunning)
+
+	go func() {
+		ticker := time.NewTicker(deadmanPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quit:
+				log.Info("received message to stop watching the dead man's switch file")
+				return
+			case <-ticker.C:
+			}
+
+			expired, err := deadmanExpired(path, since, deadmanNow(), interval)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			if expired {
+				r.running(fmt.Sprintf("Canceling the job because %s wasn't refreshed within %s", path, interval))
+				requestStop(r.stop, messaging.StatusKilled)
+				return
+			}
+		}
+	}()
+
+	return quit
+}
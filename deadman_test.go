@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/road-runner/messaging"
+)
+
+func TestDeadmanExpired(t *testing.T) {
+	dir, err := ioutil.TempDir("", "road-runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "deadman")
+	if err = ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	touched := time.Now().Add(-time.Hour)
+	if err = os.Chtimes(file, touched, touched); err != nil {
+		t.Fatal(err)
+	}
+	since := touched.Add(-time.Hour)
+
+	tests := []struct {
+		name    string
+		path    string
+		since   time.Time
+		now     time.Time
+		expired bool
+	}{
+		{"refreshed", file, since, touched.Add(time.Minute), false},
+		{"not refreshed", file, since, touched.Add(10 * time.Minute), true},
+		{"touched before the step started", file, touched.Add(time.Minute), touched.Add(5 * time.Minute), false},
+		{"missing", path.Join(dir, "missing"), since, since.Add(time.Minute), false},
+		{"missing too long", path.Join(dir, "missing"), since, since.Add(10 * time.Minute), true},
+	}
+	for _, test := range tests {
+		expired, err := deadmanExpired(test.path, test.since, test.now, 5*time.Minute)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		if expired != test.expired {
+			t.Errorf("%s: expired was %t instead of %t", test.name, expired, test.expired)
+		}
+	}
+}
+
+func TestRunAllStepsCancelsWhenDeadmanExpires(t *testing.T) {
+	defer func(poll time.Duration, now func() time.Time) {
+		deadmanPollInterval, deadmanNow = poll, now
+	}(deadmanPollInterval, deadmanNow)
+
+	dir, err := ioutil.TempDir("", "road-runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "deadman")
+	if err = ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadmanPollInterval = time.Millisecond
+
+	// The clock jumps past the interval once the watcher has started, and the
+	// file is never touched again.
+	start := time.Now()
+	calls := 0
+	deadmanNow = func() time.Time {
+		calls++
+		if calls == 1 {
+			return start
+		}
+		return start.Add(time.Hour)
+	}
+
+	runner, d, _ := newTestRunner(t)
+	runner.deadman = deadmanSwitch{file: file, interval: time.Minute}
+	d.runStepDelay = 200 * time.Millisecond
+	runner.runAllSteps(runner.exit)
+
+	select {
+	case status := <-runner.stop:
+		if status != messaging.StatusKilled {
+			t.Errorf("status was %d instead of %d", status, messaging.StatusKilled)
+		}
+	default:
+		t.Error("the job wasn't canceled")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/cyverse-de/road-runner/messaging"
+)
+
+// defaultWorkdirMaxSize is the largest working directory, in bytes, that gets
+// archived and uploaded when debug.workdir_max_size isn't set.
+const defaultWorkdirMaxSize = 1 << 30
+
+// debugOptions control uploading the working directory when a job fails. They
+// come from the debug section of the config.
+type debugOptions struct {
+	uploadWorkdir bool
+	maxSize       int64
+	irodsPath     string
+}
+
+// workdirArchiveName returns the name of the working directory archive.
+func workdirArchiveName(invID string) string {
+	return fmt.Sprintf("workdir-%s.tar.gz", invID)
+}
+
+// workdirSize returns the total size of the regular files under dir.
+func workdirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// writeWorkdirArchive writes a gzipped tarball of everything under dir to the
+// file name in dir. The archive leaves itself out.
+func writeWorkdirArchive(dir, name string) error {
+	archivePath := path.Join(dir, name)
+	out, err := os.Create(archivePath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	gw := gzip.NewWriter(out)
+	tw := tar.NewWriter(gw)
+
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dir || p == archivePath {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// debugDestination returns the iRODS collection that the working directory
+// archive is uploaded to.
+func (r *JobRunner) debugDestination() string {
+	if r.debug.irodsPath != "" {
+		return path.Join(r.debug.irodsPath, r.job.InvocationID)
+	}
+	return path.Join(r.job.OutputDirectory(), "debug")
+}
+
+// uploadWorkdir archives the working directory and uploads it to the debug
+// destination if the job failed and debug.upload_workdir_on_failure is set.
+// Interactive jobs and working directories larger than the size cap are
+// skipped. The archive is added to the job's filter files so that it isn't
+// uploaded again with the rest of the outputs.
+func (r *JobRunner) uploadWorkdir() error {
+	if r.status == messaging.Success || !r.debug.uploadWorkdir || r.job.Interactive {
+		return nil
+	}
+
+	size, err := workdirSize(r.volumeDir)
+	if err != nil {
+		return err
+	}
+	if size > r.debug.maxSize {
+		r.running(fmt.Sprintf("Not uploading the working directory for debugging, its size of %d bytes is over the limit of %d bytes", size, r.debug.maxSize))
+		return nil
+	}
+
+	name := workdirArchiveName(r.job.InvocationID)
+	if err = writeWorkdirArchive(r.volumeDir, name); err != nil {
+		return err
+	}
+	r.job.FilterFiles = append(r.job.FilterFiles, name)
+
+	dest := r.debugDestination()
+	r.running(fmt.Sprintf("Uploading the working directory to %s for debugging", dest))
+	exitCode, err := r.dckr.UploadDebugArchive(r.job, name, dest)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("transfer utility exited with a code of %d when uploading the working directory to %s", exitCode, dest)
+	}
+	r.running(fmt.Sprintf("Done uploading the working directory to %s", dest))
+	return nil
+}
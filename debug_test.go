@@ -0,0 +1,136 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/cyverse-de/road-runner/messaging"
+)
+
+// newDebugRunner returns a test runner whose working directory contains a
+// single small file.
+func newDebugRunner(t *testing.T) (*JobRunner, *fakeDocker, string) {
+	runner, d, _ := newTestRunner(t)
+	dir, err := ioutil.TempDir("", "road-runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(path.Join(dir, "logs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(path.Join(dir, "logs", "stderr"), []byte("segfault"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runner.volumeDir = dir
+	runner.debug = debugOptions{uploadWorkdir: true, maxSize: defaultWorkdirMaxSize}
+	return runner, d, dir
+}
+
+func TestUploadWorkdirOnlyOnFailure(t *testing.T) {
+	runner, d, dir := newDebugRunner(t)
+	defer os.RemoveAll(dir)
+
+	if err := runner.uploadWorkdir(); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.calls) != 0 {
+		t.Errorf("successful job uploaded its working directory: %#v", d.calls)
+	}
+
+	runner.status = messaging.StatusStepFailed
+	if err := runner.uploadWorkdir(); err != nil {
+		t.Fatal(err)
+	}
+	name := workdirArchiveName(runner.job.InvocationID)
+	expected := []string{
+		fmt.Sprintf("UploadDebugArchive %s %s", name, path.Join(runner.job.OutputDirectory(), "debug")),
+	}
+	if !reflect.DeepEqual(d.calls, expected) {
+		t.Errorf("calls were %#v instead of %#v", d.calls, expected)
+	}
+	if _, err := os.Stat(path.Join(dir, name)); err != nil {
+		t.Error(err)
+	}
+
+	var filtered bool
+	for _, f := range runner.job.FilterFiles {
+		if f == name {
+			filtered = true
+		}
+	}
+	if !filtered {
+		t.Error("archive wasn't excluded from the final upload")
+	}
+}
+
+func TestUploadWorkdirDisabled(t *testing.T) {
+	runner, d, dir := newDebugRunner(t)
+	defer os.RemoveAll(dir)
+	runner.status = messaging.StatusStepFailed
+	runner.debug.uploadWorkdir = false
+
+	if err := runner.uploadWorkdir(); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.calls) != 0 {
+		t.Errorf("working directory was uploaded while disabled: %#v", d.calls)
+	}
+}
+
+func TestUploadWorkdirSizeCap(t *testing.T) {
+	runner, d, dir := newDebugRunner(t)
+	defer os.RemoveAll(dir)
+	runner.status = messaging.StatusStepFailed
+	runner.debug.maxSize = 4
+
+	if err := runner.uploadWorkdir(); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.calls) != 0 {
+		t.Errorf("working directory over the size cap was uploaded: %#v", d.calls)
+	}
+}
+
+func TestWriteWorkdirArchive(t *testing.T) {
+	_, _, dir := newDebugRunner(t)
+	defer os.RemoveAll(dir)
+
+	if err := writeWorkdirArchive(dir, "workdir.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path.Join(dir, "workdir.tar.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	sort.Strings(names)
+	expected := []string{"logs", "logs/stderr"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("archive contained %#v instead of %#v", names, expected)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/logcabin"
+	"github.com/cyverse-de/road-runner/dockerops"
+	"github.com/cyverse-de/road-runner/model"
+	"github.com/docker/docker/api/types"
+)
+
+// diagnosticsFile is the name of the archive written into the logs directory
+// when a job fails.
+const diagnosticsFile = "diagnostics.tar.gz"
+
+// containerInspector is the subset of *dockerops.Docker needed to gather the
+// container states for the diagnostics bundle.
+type containerInspector interface {
+	ContainersWithLabel(key, value string, all bool) ([]string, error)
+	InspectContainer(containerID string) (types.ContainerJSON, error)
+	StepLogs(step *model.Step, idx int) (string, string)
+}
+
+// tarEntry adds a file with the given name and contents to the archive.
+func tarEntry(tw *tar.Writer, name string, contents []byte) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(contents)),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(contents)
+	return err
+}
+
+// stepContainers returns the inspection results for all of the step containers
+// associated with the job.
+func stepContainers(d containerInspector, job *model.Job) ([]types.ContainerJSON, error) {
+	ids, err := d.ContainersWithLabel(dockerops.JobLabelKey(), job.InvocationID, true)
+	if err != nil {
+		return nil, err
+	}
+	stepType := strconv.Itoa(dockerops.StepContainer)
+	var retval []types.ContainerJSON
+	for _, id := range ids {
+		inspection, err := d.InspectContainer(id)
+		if err != nil {
+			logcabin.Error.Print(err)
+			continue
+		}
+		if inspection.Config == nil || inspection.Config.Labels[dockerops.TypeLabelKey()] != stepType {
+			continue
+		}
+		retval = append(retval, inspection)
+	}
+	return retval, nil
+}
+
+// writeDiagnostics assembles an archive in the logs directory of volumeDir
+// containing the job JSON, the step logs, and the state of each of the step
+// containers. Missing logs and containers that can't be inspected are logged
+// and skipped so that the bundle contains as much as possible.
+func writeDiagnostics(fs FileSystem, d containerInspector, volumeDir string, job *model.Job) error {
+	outputPath := path.Join(volumeDir, "logs", diagnosticsFile)
+
+	fileWriter, err := fs.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer fileWriter.Close()
+
+	gw := gzip.NewWriter(fileWriter)
+	tw := tar.NewWriter(gw)
+
+	jobJSON, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = tarEntry(tw, "job.json", jobJSON); err != nil {
+		return err
+	}
+
+	for idx, step := range job.Steps {
+		stdoutLog, stderrLog := d.StepLogs(&step, idx)
+		for _, logPath := range []string{stdoutLog, stderrLog} {
+			reader, err := fs.Open(path.Join(volumeDir, logPath))
+			if err != nil {
+				logcabin.Error.Print(err)
+				continue
+			}
+			contents, err := ioutil.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				logcabin.Error.Print(err)
+				continue
+			}
+			if err = tarEntry(tw, logPath, contents); err != nil {
+				return err
+			}
+		}
+	}
+
+	containers, err := stepContainers(d, job)
+	if err != nil {
+		logcabin.Error.Print(err)
+	}
+	for _, c := range containers {
+		if c.ContainerJSONBase == nil {
+			continue
+		}
+		name := strings.TrimPrefix(c.Name, "/")
+		if name == "" {
+			name = c.ID
+		}
+		inspectJSON, err := json.MarshalIndent(c, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err = tarEntry(tw, path.Join("containers", name+".json"), inspectJSON); err != nil {
+			return err
+		}
+	}
+
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
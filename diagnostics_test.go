@@ -0,0 +1,101 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/cyverse-de/road-runner/dockerops"
+	"github.com/cyverse-de/road-runner/model"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+type fakeInspector struct {
+	containers map[string]types.ContainerJSON
+}
+
+func (f *fakeInspector) ContainersWithLabel(key, value string, all bool) ([]string, error) {
+	var ids []string
+	for id := range f.containers {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (f *fakeInspector) InspectContainer(id string) (types.ContainerJSON, error) {
+	return f.containers[id], nil
+}
+
+func (f *fakeInspector) StepLogs(step *model.Step, idx int) (string, string) {
+	return dockerops.StepLogs(step, idx, false)
+}
+
+func fakeContainer(id, name string, containerType int) types.ContainerJSON {
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{ID: id, Name: "/" + name},
+		Config: &container.Config{
+			Labels: map[string]string{dockerops.TypeLabelKey(): strconv.Itoa(containerType)},
+		},
+	}
+}
+
+func TestWriteDiagnostics(t *testing.T) {
+	job := inittests(t)
+	fs := newMemFileSystem()
+	fs.files[path.Join("vol", "logs", "condor-stdout-0")] = []byte("stdout")
+	fs.files[path.Join("vol", "logs", "condor-stderr-0")] = []byte("stderr")
+	inspector := &fakeInspector{
+		containers: map[string]types.ContainerJSON{
+			"step":  fakeContainer("step", "test-name", dockerops.StepContainer),
+			"input": fakeContainer("input", "input-0", dockerops.InputContainer),
+		},
+	}
+
+	if err := writeDiagnostics(fs, inspector, "vol", job); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, ok := fs.files[path.Join("vol", "logs", diagnosticsFile)]
+	if !ok {
+		t.Fatalf("%s was not written", diagnosticsFile)
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	var actual []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual = append(actual, hdr.Name)
+	}
+	sort.Strings(actual)
+
+	expected := []string{
+		"containers/test-name.json",
+		"job.json",
+		"logs/condor-stderr-0",
+		"logs/condor-stdout-0",
+	}
+	if len(actual) != len(expected) {
+		t.Fatalf("archive contained %v instead of %v", actual, expected)
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Errorf("archive contained %v instead of %v", actual, expected)
+			break
+		}
+	}
+}
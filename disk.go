@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/cyverse-de/road-runner/model"
+)
+
+// freeSpace returns the number of bytes available to unprivileged users on
+// the file system containing path. It's a variable so that tests can replace
+// it.
+var freeSpace = func(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// requestedDisk returns the disk space requested by the job in bytes. Like
+// HTCondor's request_disk, the job's value is in KiB. Zero is returned if the
+// job didn't request any space.
+func requestedDisk(job *model.Job) (int64, error) {
+	rd := strings.TrimSpace(job.RequestDisk)
+	if rd == "" {
+		return 0, nil
+	}
+	kib, err := strconv.ParseInt(rd, 10, 64)
+	if err != nil || kib < 0 {
+		return 0, fmt.Errorf("request_disk %q isn't a number of KiB", job.RequestDisk)
+	}
+	return kib * 1024, nil
+}
+
+// checkDiskSpace returns an error if the file system containing path has less
+// than required bytes free.
+func checkDiskSpace(path string, required int64) error {
+	free, err := freeSpace(path)
+	if err != nil {
+		return err
+	}
+	if free < required {
+		return fmt.Errorf("%s has %d bytes free, but the job requested %d bytes", path, free, required)
+	}
+	return nil
+}
+
+// checkJobDiskSpace makes sure that the file system backing dir has room for
+// the disk space the job requested. The working directory is checked when dir
+// is empty.
+func checkJobDiskSpace(job *model.Job, dir string) error {
+	required, err := requestedDisk(job)
+	if err != nil || required == 0 {
+		return err
+	}
+	if dir == "" {
+		if dir, err = os.Getwd(); err != nil {
+			return err
+		}
+	}
+	return checkDiskSpace(dir, required)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cyverse-de/road-runner/model"
+)
+
+// withFreeSpace replaces freeSpace for the duration of a test.
+func withFreeSpace(free int64, err error) func() {
+	old := freeSpace
+	freeSpace = func(path string) (int64, error) {
+		return free, err
+	}
+	return func() {
+		freeSpace = old
+	}
+}
+
+func TestRequestedDisk(t *testing.T) {
+	cases := map[string]int64{
+		"":     0,
+		"0":    0,
+		"1024": 1024 * 1024,
+	}
+	for rd, expected := range cases {
+		actual, err := requestedDisk(&model.Job{RequestDisk: rd})
+		if err != nil {
+			t.Errorf("request_disk %q returned an error: %s", rd, err)
+		}
+		if actual != expected {
+			t.Errorf("request_disk %q was %d bytes instead of %d", rd, actual, expected)
+		}
+	}
+	for _, bad := range []string{"10GB", "-1"} {
+		if _, err := requestedDisk(&model.Job{RequestDisk: bad}); err == nil {
+			t.Errorf("request_disk %q didn't return an error", bad)
+		}
+	}
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	t.Run("sufficient space", func(t *testing.T) {
+		defer withFreeSpace(2048, nil)()
+		if err := checkDiskSpace("/volumes", 2048); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("insufficient space", func(t *testing.T) {
+		defer withFreeSpace(1024, nil)()
+		if err := checkDiskSpace("/volumes", 2048); err == nil {
+			t.Error("no error was returned when there wasn't enough space")
+		}
+	})
+
+	t.Run("stat errors are returned", func(t *testing.T) {
+		defer withFreeSpace(0, errors.New("no such file or directory"))()
+		if err := checkDiskSpace("/volumes", 1); err == nil {
+			t.Error("the stat error wasn't returned")
+		}
+	})
+}
+
+func TestCheckJobDiskSpace(t *testing.T) {
+	defer withFreeSpace(1024, nil)()
+	if err := checkJobDiskSpace(&model.Job{RequestDisk: "0"}, ""); err != nil {
+		t.Errorf("a job that didn't request space was rejected: %s", err)
+	}
+	if err := checkJobDiskSpace(&model.Job{RequestDisk: "2"}, ""); err == nil {
+		t.Error("a job that requested more than the free space wasn't rejected")
+	}
+}
@@ -0,0 +1,112 @@
+package dockerops
+
+import (
+	"io"
+	"sync"
+)
+
+// boundedWriter decouples a container's output stream from a possibly slow
+// destination. Writes are copied into an in-memory buffer and never block;
+// a separate goroutine drains the buffer into the destination. When the
+// buffer is full the oldest unwritten bytes are dropped and counted, so a
+// slow disk costs log output instead of stalling the container.
+type boundedWriter struct {
+	dst     io.Writer
+	max     int
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	buf     []byte
+	dropped int64
+	closed  bool
+	err     error
+	done    chan struct{}
+}
+
+// newBoundedWriter returns a *boundedWriter that buffers at most max bytes
+// for dst. Close must be called to flush the buffer and stop the goroutine
+// that writes to dst.
+func newBoundedWriter(dst io.Writer, max int) *boundedWriter {
+	w := &boundedWriter{
+		dst:  dst,
+		max:  max,
+		done: make(chan struct{}),
+	}
+	w.cond = sync.NewCond(&w.mutex)
+	go w.drain()
+	return w
+}
+
+// Write buffers p, dropping the oldest buffered bytes if there isn't room for
+// all of it. It always reports that all of p was written.
+func (w *boundedWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		w.dropped += int64(len(p))
+		return len(p), nil
+	}
+
+	if len(p) >= w.max {
+		w.dropped += int64(len(w.buf) + len(p) - w.max)
+		w.buf = append([]byte(nil), p[len(p)-w.max:]...)
+	} else {
+		if over := len(w.buf) + len(p) - w.max; over > 0 {
+			w.dropped += int64(over)
+			w.buf = w.buf[over:]
+		}
+		w.buf = append(w.buf, p...)
+	}
+	w.cond.Signal()
+	return len(p), nil
+}
+
+// drain copies the buffered bytes to the destination until the writer is
+// closed and the buffer is empty.
+func (w *boundedWriter) drain() {
+	defer close(w.done)
+	for {
+		w.mutex.Lock()
+		for len(w.buf) == 0 && !w.closed {
+			w.cond.Wait()
+		}
+		if len(w.buf) == 0 {
+			w.mutex.Unlock()
+			return
+		}
+		chunk := w.buf
+		w.buf = nil
+		w.mutex.Unlock()
+
+		if _, err := w.dst.Write(chunk); err != nil {
+			w.mutex.Lock()
+			if w.err == nil {
+				w.err = err
+			}
+			w.mutex.Unlock()
+		}
+	}
+}
+
+// Close waits for the buffered bytes to be written to the destination. Bytes
+// written after Close are dropped. It returns the first error returned by
+// the destination, if any.
+func (w *boundedWriter) Close() error {
+	w.mutex.Lock()
+	w.closed = true
+	w.cond.Broadcast()
+	w.mutex.Unlock()
+	<-w.done
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.err
+}
+
+// Dropped returns the number of bytes that were discarded because the
+// buffer was full.
+func (w *boundedWriter) Dropped() int64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.dropped
+}
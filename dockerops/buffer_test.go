@@ -0,0 +1,108 @@
+package dockerops
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowWriter blocks every write until release is closed.
+type slowWriter struct {
+	release chan struct{}
+	mutex   sync.Mutex
+	written bytes.Buffer
+}
+
+func (s *slowWriter) Write(p []byte) (int, error) {
+	<-s.release
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.written.Write(p)
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestBoundedWriter(t *testing.T) {
+	t.Run("slow destination doesn't block writes", func(t *testing.T) {
+		dst := &slowWriter{release: make(chan struct{})}
+		w := newBoundedWriter(dst, 16)
+
+		line := []byte("0123456789\n")
+		total := 0
+		finished := make(chan bool)
+		go func() {
+			for i := 0; i < 1000; i++ {
+				n, _ := w.Write(line)
+				total += n
+			}
+			finished <- true
+		}()
+		select {
+		case <-finished:
+		case <-time.After(3 * time.Second):
+			t.Fatal("writes blocked on the slow destination")
+		}
+
+		close(dst.release)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		written := dst.written.String()
+		if w.Dropped() == 0 {
+			t.Error("no bytes were counted as dropped")
+		}
+		if int64(len(written))+w.Dropped() != int64(total) {
+			t.Errorf("%d bytes written and %d dropped out of %d", len(written), w.Dropped(), total)
+		}
+		if !strings.HasSuffix(written, "0123456789\n") {
+			t.Errorf("the newest output wasn't kept: %q", written)
+		}
+	})
+
+	t.Run("everything is written when there's room", func(t *testing.T) {
+		var dst bytes.Buffer
+		w := newBoundedWriter(&dst, 1024)
+		for i := 0; i < 10; i++ {
+			w.Write([]byte("line\n"))
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if dst.String() != strings.Repeat("line\n", 10) {
+			t.Errorf("destination contained %q", dst.String())
+		}
+		if w.Dropped() != 0 {
+			t.Errorf("%d bytes were dropped", w.Dropped())
+		}
+	})
+
+	t.Run("oversized writes keep their tail", func(t *testing.T) {
+		var dst bytes.Buffer
+		w := newBoundedWriter(&dst, 4)
+		w.Write([]byte("ab"))
+		w.Write([]byte("0123456789"))
+		w.Close()
+		if w.Dropped()+int64(dst.Len()) != 12 {
+			t.Errorf("%d bytes written and %d dropped out of 12", dst.Len(), w.Dropped())
+		}
+		if !strings.HasSuffix(dst.String(), "6789") {
+			t.Errorf("destination contained %q", dst.String())
+		}
+	})
+
+	t.Run("destination errors are returned by Close", func(t *testing.T) {
+		w := newBoundedWriter(failingWriter{}, 16)
+		w.Write([]byte("output"))
+		if err := w.Close(); err == nil {
+			t.Error("Close didn't return the destination's error")
+		}
+	})
+}
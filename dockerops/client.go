@@ -0,0 +1,92 @@
+package dockerops
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/sockets"
+	"golang.org/x/net/context"
+)
+
+// DockerClient is the subset of the Docker API client used by Docker. It's
+// satisfied by *client.Client and lets the operations be tested against a
+// fake instead of a running daemon.
+type DockerClient interface {
+	ContainerAttach(ctx context.Context, container string, options types.ContainerAttachOptions) (types.HijackedResponse, error)
+	ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, containerName string) (container.ContainerCreateCreatedBody, error)
+	ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error)
+	ContainerKill(ctx context.Context, containerID, signal string) error
+	ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error)
+	ContainerRemove(ctx context.Context, containerID string, options types.ContainerRemoveOptions) error
+	ContainerStart(ctx context.Context, containerID string, options types.ContainerStartOptions) error
+	ContainerStop(ctx context.Context, containerID string, timeout *time.Duration) error
+	ContainerWait(ctx context.Context, containerID string) (int64, error)
+	ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error)
+	ImageList(ctx context.Context, options types.ImageListOptions) ([]types.ImageSummary, error)
+	ImagePull(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error)
+	ImageRemove(ctx context.Context, imageID string, options types.ImageRemoveOptions) ([]types.ImageDelete, error)
+	Info(ctx context.Context) (types.Info, error)
+	NetworkInspect(ctx context.Context, networkID string) (types.NetworkResource, error)
+	NetworkRemove(ctx context.Context, networkID string) error
+	Ping(ctx context.Context) (types.Ping, error)
+	ServerVersion(ctx context.Context) (types.Version, error)
+	VolumeCreate(ctx context.Context, options volume.VolumesCreateBody) (types.Volume, error)
+	VolumeInspect(ctx context.Context, volumeID string) (types.Volume, error)
+	VolumeList(ctx context.Context, filter filters.Args) (volume.VolumesListOKBody, error)
+	VolumeRemove(ctx context.Context, volumeID string, force bool) error
+}
+
+// dialTimeout matches the connect timeout the Docker client uses by default.
+const dialTimeout = 32 * time.Second
+
+// NewDockerClient returns a DockerClient that connects to the Docker daemon
+// listening at 'uri'. Idle connections to the daemon are closed after
+// 'idleTimeout' and TCP connections send keep-alive probes every 'keepAlive'.
+// Zero leaves the corresponding transport default in place.
+func NewDockerClient(uri string, idleTimeout, keepAlive time.Duration) (DockerClient, error) {
+	defaultHeaders := map[string]string{"User-Agent": "cyverse-road-runner-1.0"}
+	transport, err := newTransport(uri, idleTimeout, keepAlive)
+	if err != nil {
+		return nil, err
+	}
+	return client.NewClient(uri, "v1.23", &http.Client{Transport: transport}, defaultHeaders)
+}
+
+// newTransport builds the HTTP transport the Docker client talks through. It
+// starts from the same socket configuration the client would use on its own
+// and layers the idle and keep-alive settings on top.
+func newTransport(uri string, idleTimeout, keepAlive time.Duration) (*http.Transport, error) {
+	proto, addr, _, err := client.ParseHost(uri)
+	if err != nil {
+		return nil, err
+	}
+	transport := new(http.Transport)
+	if err = sockets.ConfigureTransport(transport, proto, addr); err != nil {
+		return nil, err
+	}
+	transport.IdleConnTimeout = idleTimeout
+	if keepAlive > 0 && proto == "tcp" {
+		dialer, err := sockets.DialerFromEnvironment(newDialer(keepAlive))
+		if err != nil {
+			return nil, err
+		}
+		transport.Dial = dialer.Dial
+	}
+	return transport, nil
+}
+
+// newDialer returns the dialer used for TCP connections to the daemon.
+func newDialer(keepAlive time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: keepAlive,
+	}
+}
@@ -0,0 +1,1504 @@
+package dockerops
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/road-runner/model"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-connections/nat"
+	"github.com/spf13/viper"
+	netcontext "golang.org/x/net/context"
+)
+
+// fakeClient is a DockerClient that records the containers it's asked to
+// create. Calling any method it doesn't override panics, which makes
+// unexpected calls to the daemon obvious.
+type fakeClient struct {
+	DockerClient
+	volumes    []*types.Volume
+	config     *container.Config
+	hostConfig *container.HostConfig
+	name       string
+	containers []types.Container
+	removed    []string
+	rmImages   []string
+	memTotal   int64
+	osType     string
+	arch       string
+	attached   []byte
+	detached   chan struct{}
+	imageCfg   *container.Config
+	exitCode   int64
+	oomKilled  bool
+	ports      nat.PortMap
+	version    types.Version
+	pullBlocks bool
+	createErr  error
+	exitsEarly bool
+}
+
+// fakeConn is the connection of a fake attach response. Closing it signals
+// that the container's output has been copied.
+type fakeConn struct {
+	net.Conn
+	closed chan struct{}
+}
+
+func (c *fakeConn) Close() error {
+	close(c.closed)
+	return c.Conn.Close()
+}
+
+// ContainerAttach returns the multiplexed output in f.attached.
+func (f *fakeClient) ContainerAttach(ctx netcontext.Context, container string, options types.ContainerAttachOptions) (types.HijackedResponse, error) {
+	conn, _ := net.Pipe()
+	f.detached = make(chan struct{})
+	return types.HijackedResponse{
+		Conn:   &fakeConn{Conn: conn, closed: f.detached},
+		Reader: bufio.NewReader(bytes.NewReader(f.attached)),
+	}, nil
+}
+
+func (f *fakeClient) ContainerStart(ctx netcontext.Context, containerID string, options types.ContainerStartOptions) error {
+	return nil
+}
+
+// ContainerWait returns once the attached output has been copied, unless
+// f.exitsEarly is set, in which case it returns right away like a daemon that
+// reports the exit before the last of the output has been read.
+func (f *fakeClient) ContainerWait(ctx netcontext.Context, containerID string) (int64, error) {
+	if !f.exitsEarly {
+		<-f.detached
+	}
+	return f.exitCode, nil
+}
+
+func (f *fakeClient) ContainerInspect(ctx netcontext.Context, containerID string) (types.ContainerJSON, error) {
+	state := &types.ContainerState{ExitCode: int(f.exitCode), OOMKilled: f.oomKilled}
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{ID: containerID, State: state},
+		NetworkSettings:   &types.NetworkSettings{NetworkSettingsBase: types.NetworkSettingsBase{Ports: f.ports}},
+	}, nil
+}
+
+func (f *fakeClient) ContainerCreate(ctx netcontext.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, containerName string) (container.ContainerCreateCreatedBody, error) {
+	f.config = config
+	f.hostConfig = hostConfig
+	f.name = containerName
+	if f.createErr != nil {
+		return container.ContainerCreateCreatedBody{}, f.createErr
+	}
+	return container.ContainerCreateCreatedBody{ID: "created"}, nil
+}
+
+// ContainerList returns the containers that have all of the labels in the
+// label filters.
+func (f *fakeClient) ContainerList(ctx netcontext.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	var retval []types.Container
+	for _, c := range f.containers {
+		matches := true
+		for _, l := range options.Filters.Get("label") {
+			parts := strings.SplitN(l, "=", 2)
+			if len(parts) != 2 || c.Labels[parts[0]] != parts[1] {
+				matches = false
+			}
+		}
+		if matches {
+			retval = append(retval, c)
+		}
+	}
+	return retval, nil
+}
+
+func (f *fakeClient) ContainerRemove(ctx netcontext.Context, containerID string, options types.ContainerRemoveOptions) error {
+	f.removed = append(f.removed, containerID)
+	return nil
+}
+
+func (f *fakeClient) ImageRemove(ctx netcontext.Context, imageID string, options types.ImageRemoveOptions) ([]types.ImageDelete, error) {
+	f.rmImages = append(f.rmImages, imageID)
+	return nil, nil
+}
+
+func (f *fakeClient) Info(ctx netcontext.Context) (types.Info, error) {
+	return types.Info{MemTotal: f.memTotal, OSType: f.osType, Architecture: f.arch}, nil
+}
+
+func (f *fakeClient) ServerVersion(ctx netcontext.Context) (types.Version, error) {
+	return f.version, nil
+}
+
+func (f *fakeClient) ImageInspectWithRaw(ctx netcontext.Context, imageID string) (types.ImageInspect, []byte, error) {
+	return types.ImageInspect{ID: imageID, Config: f.imageCfg}, nil, nil
+}
+
+func (f *fakeClient) ImagePull(ctx netcontext.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+	if f.pullBlocks {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return ioutil.NopCloser(strings.NewReader("")), nil
+}
+
+func (f *fakeClient) VolumeList(ctx netcontext.Context, filter filters.Args) (volume.VolumesListOKBody, error) {
+	return volume.VolumesListOKBody{Volumes: f.volumes}, nil
+}
+
+// newFakeClientDocker returns a *Docker backed by a new fakeClient.
+func newFakeClientDocker(cfg *viper.Viper) (*Docker, *fakeClient) {
+	if cfg == nil {
+		cfg = viper.New()
+	}
+	cl := &fakeClient{}
+	return NewDocker(context.Background(), cfg, cl), cl
+}
+
+func TestCreateContainerFromStepConfig(t *testing.T) {
+	d, cl := newFakeClientDocker(nil)
+	cl.volumes = []*types.Volume{{Name: "invocation"}}
+
+	step := &model.Step{
+		Component: model.StepComponent{
+			Container: model.Container{
+				Name:       "step-name",
+				EntryPoint: "/bin/echo",
+				Image:      model.ContainerImage{Name: "discoenv/echo", Tag: "latest"},
+				WorkingDir: "/work",
+			},
+		},
+	}
+
+	id, err := d.CreateContainerFromStep(&model.Job{InvocationID: "invocation"}, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "created" {
+		t.Errorf("id was %q instead of %q", id, "created")
+	}
+	if cl.name != "step-name" {
+		t.Errorf("container name was %q instead of %q", cl.name, "step-name")
+	}
+	if cl.config.Image != "discoenv/echo:latest" {
+		t.Errorf("image was %q instead of %q", cl.config.Image, "discoenv/echo:latest")
+	}
+	if len(cl.config.Entrypoint) != 1 || cl.config.Entrypoint[0] != "/bin/echo" {
+		t.Errorf("entrypoint was %#v", cl.config.Entrypoint)
+	}
+	if cl.config.WorkingDir != "/work" {
+		t.Errorf("working directory was %q instead of %q", cl.config.WorkingDir, "/work")
+	}
+	if cl.config.Labels[JobLabelKey()] != "invocation" {
+		t.Errorf("job label was %q", cl.config.Labels[JobLabelKey()])
+	}
+	if cl.config.Labels[TypeLabelKey()] != strconv.Itoa(StepContainer) {
+		t.Errorf("type label was %q", cl.config.Labels[TypeLabelKey()])
+	}
+	expectedBinds := []string{"invocation:/work:rw"}
+	if !reflect.DeepEqual(cl.hostConfig.Binds, expectedBinds) {
+		t.Errorf("binds were %#v instead of %#v", cl.hostConfig.Binds, expectedBinds)
+	}
+	if cl.hostConfig.LogConfig.Type != "none" {
+		t.Errorf("log driver was %q instead of %q", cl.hostConfig.LogConfig.Type, "none")
+	}
+}
+
+func TestContainerLogConfig(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("docker.log_driver", "syslog")
+	cfg.Set("docker.log_opts", map[string]string{"syslog-address": "udp://logs:514"})
+	expected := map[string]string{"syslog-address": "udp://logs:514"}
+
+	t.Run("step containers", func(t *testing.T) {
+		d, cl := newFakeClientDocker(cfg)
+		if _, err := d.CreateContainerFromStep(&model.Job{InvocationID: "invocation"}, &model.Step{}); err != nil {
+			t.Fatal(err)
+		}
+		if cl.hostConfig.LogConfig.Type != "syslog" {
+			t.Errorf("log driver was %q instead of %q", cl.hostConfig.LogConfig.Type, "syslog")
+		}
+		if !reflect.DeepEqual(cl.hostConfig.LogConfig.Config, expected) {
+			t.Errorf("log options were %#v instead of %#v", cl.hostConfig.LogConfig.Config, expected)
+		}
+	})
+
+	t.Run("transfer containers", func(t *testing.T) {
+		d, cl := newFakeClientDocker(cfg)
+		job := &model.Job{InvocationID: "invocation"}
+		if _, err := d.CreateDownloadContainer(job, &model.StepInput{}, "0", 1); err != nil {
+			t.Fatal(err)
+		}
+		if cl.hostConfig.LogConfig.Type != "syslog" {
+			t.Errorf("download log driver was %q instead of %q", cl.hostConfig.LogConfig.Type, "syslog")
+		}
+		if _, err := d.CreateUploadContainer(job); err != nil {
+			t.Fatal(err)
+		}
+		if cl.hostConfig.LogConfig.Type != "syslog" {
+			t.Errorf("upload log driver was %q instead of %q", cl.hostConfig.LogConfig.Type, "syslog")
+		}
+		if !reflect.DeepEqual(cl.hostConfig.LogConfig.Config, expected) {
+			t.Errorf("upload log options were %#v instead of %#v", cl.hostConfig.LogConfig.Config, expected)
+		}
+	})
+}
+
+func TestCreateContainerFromStepCapabilities(t *testing.T) {
+	d, cl := newFakeClientDocker(nil)
+	step := &model.Step{}
+	step.Component.Container.CapAdd = []string{"NET_ADMIN"}
+	step.Component.Container.CapDrop = []string{"MKNOD"}
+	if _, err := d.CreateContainerFromStep(&model.Job{InvocationID: "invocation"}, step); err != nil {
+		t.Fatal(err)
+	}
+	if len(cl.hostConfig.CapAdd) != 1 || cl.hostConfig.CapAdd[0] != "NET_ADMIN" {
+		t.Errorf("CapAdd was %#v", cl.hostConfig.CapAdd)
+	}
+	if len(cl.hostConfig.CapDrop) != 1 || cl.hostConfig.CapDrop[0] != "MKNOD" {
+		t.Errorf("CapDrop was %#v", cl.hostConfig.CapDrop)
+	}
+}
+
+func TestPorklockExtraArgs(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("porklock.extra_args", []string{"--retries", "3"})
+	d, cl := newFakeClientDocker(cfg)
+	job := &model.Job{InvocationID: "invocation", Submitter: "ipcdev"}
+	extra := []string{"--retries", "3"}
+
+	input := &model.StepInput{Value: "/iplant/home/ipcdev/in.txt"}
+	if _, err := d.CreateDownloadContainer(job, input, "0", 1); err != nil {
+		t.Fatal(err)
+	}
+	cmd := []string(cl.config.Cmd)
+	if len(cmd) <= len(extra) || !reflect.DeepEqual(cmd[len(cmd)-len(extra):], extra) {
+		t.Errorf("download command %#v doesn't end with %#v", cmd, extra)
+	}
+
+	if _, err := d.CreateStepOutputContainer(job, "out.txt", "0-0"); err != nil {
+		t.Fatal(err)
+	}
+	expected := append(stepOutputArguments(job, "out.txt"), extra...)
+	if !reflect.DeepEqual([]string(cl.config.Cmd), expected) {
+		t.Errorf("upload command was %#v instead of %#v", cl.config.Cmd, expected)
+	}
+}
+
+func TestPorklockLogLevel(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("porklock.log_level", "debug")
+	cfg.Set("porklock.extra_args", []string{"--retries", "3"})
+	d, cl := newFakeClientDocker(cfg)
+	job := &model.Job{InvocationID: "invocation", Submitter: "ipcdev"}
+	flags := []string{"--log-level", "debug", "--retries", "3"}
+
+	input := &model.StepInput{Value: "/iplant/home/ipcdev/in.txt"}
+	if _, err := d.CreateDownloadContainer(job, input, "0", 1); err != nil {
+		t.Fatal(err)
+	}
+	cmd := []string(cl.config.Cmd)
+	if len(cmd) <= len(flags) || !reflect.DeepEqual(cmd[len(cmd)-len(flags):], flags) {
+		t.Errorf("download command %#v doesn't end with %#v", cmd, flags)
+	}
+
+	if _, err := d.CreateUploadContainer(job); err != nil {
+		t.Fatal(err)
+	}
+	cmd = []string(cl.config.Cmd)
+	if len(cmd) <= len(flags) || !reflect.DeepEqual(cmd[len(cmd)-len(flags):], flags) {
+		t.Errorf("upload command %#v doesn't end with %#v", cmd, flags)
+	}
+}
+
+func TestValidatePorklockLogLevel(t *testing.T) {
+	for _, level := range []string{"", "debug", " info ", "error"} {
+		if err := ValidatePorklockLogLevel(level); err != nil {
+			t.Errorf("%q: %s", level, err)
+		}
+	}
+	for _, level := range []string{"DEBUG", "verbose", "--debug"} {
+		if err := ValidatePorklockLogLevel(level); err == nil {
+			t.Errorf("%q: err was nil", level)
+		}
+	}
+}
+
+func TestCreateContainerFromStepGPUs(t *testing.T) {
+	d, cl := newFakeClientDocker(nil)
+	d.cfg.Set("gpu.assigned_env", "ROAD_RUNNER_TEST_GPUS")
+	os.Setenv("ROAD_RUNNER_TEST_GPUS", "CUDA2,CUDA3")
+	defer os.Unsetenv("ROAD_RUNNER_TEST_GPUS")
+	step := &model.Step{}
+	step.Component.Container.GPUs = 2
+	if _, err := d.CreateContainerFromStep(&model.Job{InvocationID: "invocation"}, step); err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, e := range cl.config.Env {
+		if e == "NVIDIA_VISIBLE_DEVICES=2,3" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("NVIDIA_VISIBLE_DEVICES=2,3 wasn't in %#v", cl.config.Env)
+	}
+	if cl.hostConfig.Runtime != "nvidia" {
+		t.Errorf("runtime was %q instead of %q", cl.hostConfig.Runtime, "nvidia")
+	}
+
+	d, cl = newFakeClientDocker(nil)
+	if _, err := d.CreateContainerFromStep(&model.Job{InvocationID: "invocation"}, &model.Step{}); err != nil {
+		t.Fatal(err)
+	}
+	if cl.hostConfig.Runtime != "" || len(cl.config.Env) != 0 {
+		t.Errorf("step without GPUs got runtime %q and environment %#v", cl.hostConfig.Runtime, cl.config.Env)
+	}
+}
+
+func TestCreateContainerFromStepDockerSocket(t *testing.T) {
+	socketBind := "/var/run/docker.sock:/var/run/docker.sock"
+	hasSocket := func(binds []string) bool {
+		for _, b := range binds {
+			if b == socketBind {
+				return true
+			}
+		}
+		return false
+	}
+
+	t.Run("allowed", func(t *testing.T) {
+		cfg := viper.New()
+		cfg.Set("security.allow_docker_socket", true)
+		d, cl := newFakeClientDocker(cfg)
+		step := &model.Step{}
+		step.Component.Container.MountDockerSocket = true
+		if _, err := d.CreateContainerFromStep(&model.Job{InvocationID: "invocation"}, step); err != nil {
+			t.Fatal(err)
+		}
+		if !hasSocket(cl.hostConfig.Binds) {
+			t.Errorf("the socket wasn't mounted: %#v", cl.hostConfig.Binds)
+		}
+	})
+
+	t.Run("disallowed", func(t *testing.T) {
+		d, cl := newFakeClientDocker(nil)
+		step := &model.Step{}
+		step.Component.Container.MountDockerSocket = true
+		if _, err := d.CreateContainerFromStep(&model.Job{InvocationID: "invocation"}, step); err != ErrDockerSocketNotAllowed {
+			t.Errorf("error was %v instead of %v", err, ErrDockerSocketNotAllowed)
+		}
+		if cl.config != nil {
+			t.Error("the container was created anyway")
+		}
+	})
+
+	t.Run("mounted through a volume or input", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "socket")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		link := path.Join(dir, "docker.sock")
+		if err = os.Symlink(dockerSocket, link); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := viper.New()
+		cfg.Set("volume.host_path_roots", []string{"/var/run", dir})
+		d, cl := newFakeClientDocker(cfg)
+		for _, hostPath := range []string{dockerSocket, "/var/run", "/", link} {
+			step := &model.Step{}
+			step.Component.Container.Volumes = []model.Volume{{HostPath: hostPath, ContainerPath: "/data"}}
+			if _, err = d.CreateContainerFromStep(&model.Job{InvocationID: "invocation"}, step); err != ErrDockerSocketNotAllowed {
+				t.Errorf("volume %s: error was %v instead of %v", hostPath, err, ErrDockerSocketNotAllowed)
+			}
+
+			step = &model.Step{}
+			step.Config.Inputs = []model.StepInput{{Type: model.HostPathType, Value: hostPath}}
+			if _, err = d.CreateContainerFromStep(&model.Job{InvocationID: "invocation"}, step); err == nil {
+				t.Errorf("input %s: the socket was mounted", hostPath)
+			}
+		}
+		if cl.config != nil {
+			t.Error("a container was created anyway")
+		}
+	})
+
+	t.Run("not requested", func(t *testing.T) {
+		cfg := viper.New()
+		cfg.Set("security.allow_docker_socket", true)
+		d, cl := newFakeClientDocker(cfg)
+		if _, err := d.CreateContainerFromStep(&model.Job{InvocationID: "invocation"}, &model.Step{}); err != nil {
+			t.Fatal(err)
+		}
+		if hasSocket(cl.hostConfig.Binds) {
+			t.Errorf("the socket was mounted without being requested: %#v", cl.hostConfig.Binds)
+		}
+	})
+}
+
+func TestCreateDataContainerDockerSocket(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("volume.host_path_roots", []string{"/var/run"})
+	d, cl := newFakeClientDocker(cfg)
+	for _, hostPath := range []string{dockerSocket, "/var/run"} {
+		vf := &model.VolumesFrom{Name: "discoenv/data", HostPath: hostPath, ContainerPath: "/data"}
+		if _, err := d.CreateDataContainer(vf, "invocation"); err != ErrDockerSocketNotAllowed {
+			t.Errorf("%s: error was %v instead of %v", hostPath, err, ErrDockerSocketNotAllowed)
+		}
+	}
+	if cl.config != nil {
+		t.Error("a data container was created anyway")
+	}
+}
+
+func TestCreateDataContainerError(t *testing.T) {
+	d, cl := newFakeClientDocker(nil)
+	cl.createErr = errors.New("Error response from daemon: No such image: discoenv/blast-db:1.0")
+	id, err := d.CreateDataContainer(&model.VolumesFrom{Name: "discoenv/blast-db", Tag: "1.0"}, "invocation")
+	if err != cl.createErr {
+		t.Errorf("error was %v instead of %v", err, cl.createErr)
+	}
+	if id != "" {
+		t.Errorf("the container ID was %q", id)
+	}
+}
+
+func TestTransferConfigDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := viper.New()
+	cfg.Set("porklock.config_dir", dir)
+	d, cl := newFakeClientDocker(cfg)
+	job := &model.Job{InvocationID: "invocation"}
+	expected := dir + ":/configs:rw"
+
+	if _, err = d.CreateDownloadContainer(job, &model.StepInput{}, "0", 1); err != nil {
+		t.Fatal(err)
+	}
+	if !containsString(cl.hostConfig.Binds, expected) {
+		t.Errorf("download binds %#v don't include %s", cl.hostConfig.Binds, expected)
+	}
+	if _, err = d.CreateUploadContainer(job); err != nil {
+		t.Fatal(err)
+	}
+	if !containsString(cl.hostConfig.Binds, expected) {
+		t.Errorf("upload binds %#v don't include %s", cl.hostConfig.Binds, expected)
+	}
+
+	cfg.Set("porklock.config_dir", path.Join(dir, "missing"))
+	if _, err = d.CreateUploadContainer(job); err == nil {
+		t.Error("a missing config directory didn't return an error")
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestNukeContainersBySubmitter(t *testing.T) {
+	d, cl := newFakeClientDocker(nil)
+	cl.containers = []types.Container{
+		{ID: "alice-1", Labels: map[string]string{SubmitterLabelKey(): "alice"}},
+		{ID: "bob-1", Labels: map[string]string{SubmitterLabelKey(): "bob"}},
+		{ID: "alice-2", Labels: map[string]string{SubmitterLabelKey(): "alice"}},
+		{ID: "unlabeled"},
+	}
+	if err := d.NukeContainersBySubmitter("alice"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"alice-1", "alice-2"}
+	if !reflect.DeepEqual(cl.removed, expected) {
+		t.Errorf("removed %#v instead of %#v", cl.removed, expected)
+	}
+}
+
+func TestSubmitterLabel(t *testing.T) {
+	d, cl := newFakeClientDocker(nil)
+	step := &model.Step{Environment: model.StepEnvironment{"IPLANT_USER": "alice"}}
+	if _, err := d.CreateContainerFromStep(&model.Job{InvocationID: "invocation"}, step); err != nil {
+		t.Fatal(err)
+	}
+	if cl.config.Labels[SubmitterLabelKey()] != "alice" {
+		t.Errorf("step submitter label was %q", cl.config.Labels[SubmitterLabelKey()])
+	}
+	job := &model.Job{InvocationID: "invocation", Submitter: "alice"}
+	if _, err := d.CreateUploadContainer(job); err != nil {
+		t.Fatal(err)
+	}
+	if cl.config.Labels[SubmitterLabelKey()] != "alice" {
+		t.Errorf("upload submitter label was %q", cl.config.Labels[SubmitterLabelKey()])
+	}
+}
+
+func TestCreateContainerFromStepRelativeHostPath(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := viper.New()
+	cfg.Set("volume.strict_host_paths", true)
+	d, cl := newFakeClientDocker(cfg)
+
+	step := &model.Step{}
+	step.Component.Container.Volumes = []model.Volume{
+		{HostPath: "refs", ContainerPath: "/refs", ReadOnly: true},
+		{HostPath: "/scratch", ContainerPath: "/scratch"},
+	}
+	if _, err = d.CreateContainerFromStep(&model.Job{InvocationID: "invocation"}, step); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{path.Join(wd, "refs") + ":/refs:ro", "/scratch:/scratch:rw"} {
+		if !containsString(cl.hostConfig.Binds, expected) {
+			t.Errorf("binds %#v don't include %s", cl.hostConfig.Binds, expected)
+		}
+	}
+
+	step.Component.Container.Volumes = []model.Volume{{HostPath: "../secrets", ContainerPath: "/secrets"}}
+	if _, err = d.CreateContainerFromStep(&model.Job{InvocationID: "invocation"}, step); err == nil {
+		t.Error("a host path outside of the working directory wasn't rejected")
+	}
+}
+
+func TestUploadMode(t *testing.T) {
+	cfg := viper.New()
+	d, cl := newFakeClientDocker(cfg)
+	job := &model.Job{InvocationID: "invocation", Submitter: "ipcdev"}
+	base := job.FinalOutputArguments()
+
+	tests := []struct {
+		mode     string
+		expected []string
+	}{
+		{"", base},
+		{"overwrite", base},
+		{"skip-existing", append(append([]string(nil), base...), "--skip-existing")},
+		{"versioned", append(append([]string(nil), base...), "--versioned")},
+	}
+	for _, test := range tests {
+		cfg.Set("transfer.upload_mode", test.mode)
+		if _, err := d.CreateUploadContainer(job); err != nil {
+			t.Fatalf("mode %q: %s", test.mode, err)
+		}
+		if !reflect.DeepEqual([]string(cl.config.Cmd), test.expected) {
+			t.Errorf("mode %q: upload command was %#v instead of %#v", test.mode, cl.config.Cmd, test.expected)
+		}
+	}
+
+	cfg.Set("transfer.upload_mode", "append")
+	if _, err := d.CreateUploadContainer(job); err == nil {
+		t.Error("an unsupported upload mode didn't return an error")
+	}
+}
+
+func TestNodeMemory(t *testing.T) {
+	d, cl := newFakeClientDocker(nil)
+	cl.memTotal = 512 * 1024 * 1024
+	mem, err := d.NodeMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mem != cl.memTotal {
+		t.Errorf("node memory was %d instead of %d", mem, cl.memTotal)
+	}
+}
+
+func TestStageInputs(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := viper.New()
+	cfg.Set("transfer.stage_inputs", true)
+	d, cl := newFakeClientDocker(cfg)
+	job := &model.Job{InvocationID: "invocation", Submitter: "ipcdev"}
+
+	input := &model.StepInput{Value: "/iplant/home/ipcdev/in.txt"}
+	if _, err = d.CreateDownloadContainer(job, input, "0", 1); err != nil {
+		t.Fatal(err)
+	}
+	if cl.config.WorkingDir != "/de-app-work/inputs" {
+		t.Errorf("download working directory was %s instead of /de-app-work/inputs", cl.config.WorkingDir)
+	}
+
+	step := &model.Step{}
+	if _, err = d.CreateContainerFromStep(&model.Job{InvocationID: "invocation"}, step); err != nil {
+		t.Fatal(err)
+	}
+	expected := path.Join(wd, "inputs") + ":/de-app-work/inputs:ro"
+	if !containsString(cl.hostConfig.Binds, expected) {
+		t.Errorf("step binds %#v don't include %s", cl.hostConfig.Binds, expected)
+	}
+
+	cl.volumes = []*types.Volume{{Name: "invocation"}}
+	if _, err = d.CreateContainerFromStep(&model.Job{InvocationID: "invocation"}, step); err != nil {
+		t.Fatal(err)
+	}
+	expected = path.Join(wd, VOLUMEDIR, "inputs") + ":/de-app-work/inputs:ro"
+	if !containsString(cl.hostConfig.Binds, expected) {
+		t.Errorf("step binds %#v don't include %s", cl.hostConfig.Binds, expected)
+	}
+
+	if _, err = d.CreateUploadContainer(job); err != nil {
+		t.Fatal(err)
+	}
+	cmd := []string(cl.config.Cmd)
+	if cmd[len(cmd)-2] != "--exclude" || !strings.HasSuffix(cmd[len(cmd)-1], "inputs") {
+		t.Errorf("upload command %#v doesn't exclude the inputs directory", cmd)
+	}
+}
+
+func TestExcludeArguments(t *testing.T) {
+	actual := excludeArguments([]string{"put", "--exclude", "logs", "--skip-parent-meta"}, "inputs")
+	expected := []string{"put", "--exclude", "logs,inputs", "--skip-parent-meta"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("arguments were %#v instead of %#v", actual, expected)
+	}
+	actual = excludeArguments([]string{"put"}, "inputs")
+	expected = []string{"put", "--exclude", "inputs"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("arguments were %#v instead of %#v", actual, expected)
+	}
+}
+
+func TestContainerNamePrefix(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("naming.prefix", "de-prod-")
+	d, cl := newFakeClientDocker(cfg)
+	job := &model.Job{InvocationID: "invocation", Submitter: "ipcdev"}
+
+	input := &model.StepInput{Value: "/iplant/home/ipcdev/in.txt"}
+	if _, err := d.CreateDownloadContainer(job, input, "0", 1); err != nil {
+		t.Fatal(err)
+	}
+	if cl.name != "de-prod-input-0-invocation" {
+		t.Errorf("download container name was %s", cl.name)
+	}
+
+	if _, err := d.CreateUploadContainer(job); err != nil {
+		t.Fatal(err)
+	}
+	if cl.name != "de-prod-output-invocation" {
+		t.Errorf("upload container name was %s", cl.name)
+	}
+
+	step := &model.Step{}
+	step.Component.Container.Name = "wc"
+	step.Component.Container.VolumesFrom = []model.VolumesFrom{{NamePrefix: "ref-genome"}}
+	if _, err := d.CreateContainerFromStep(&model.Job{InvocationID: "invocation"}, step); err != nil {
+		t.Fatal(err)
+	}
+	if cl.name != "de-prod-wc" {
+		t.Errorf("step container name was %s", cl.name)
+	}
+	expected := []string{"de-prod-ref-genome-invocation"}
+	if !reflect.DeepEqual(cl.hostConfig.VolumesFrom, expected) {
+		t.Errorf("step volumes from were %#v instead of %#v", cl.hostConfig.VolumesFrom, expected)
+	}
+
+	cl.containers = []types.Container{
+		{ID: "other", Names: []string{"/output-invocation"}},
+		{ID: "mine", Names: []string{"/de-prod-output-invocation"}},
+	}
+	if err := d.NukeContainerByName("output-invocation"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cl.removed, []string{"mine"}) {
+		t.Errorf("removed %#v instead of [mine]", cl.removed)
+	}
+}
+
+func TestContainerNameWithoutPrefix(t *testing.T) {
+	d, _ := newFakeClientDocker(nil)
+	if name := d.containerName("output-invocation"); name != "output-invocation" {
+		t.Errorf("name was %s", name)
+	}
+	cfg := viper.New()
+	cfg.Set("naming.prefix", "de-prod-")
+	d, _ = newFakeClientDocker(cfg)
+	if name := d.containerName(""); name != "" {
+		t.Errorf("empty name became %s", name)
+	}
+}
+
+// multiplexed returns the stdout and stderr chunks in the format used by the
+// attach API.
+func multiplexed(t *testing.T, chunks ...string) []byte {
+	var buf bytes.Buffer
+	stdout := stdcopy.NewStdWriter(&buf, stdcopy.Stdout)
+	stderr := stdcopy.NewStdWriter(&buf, stdcopy.Stderr)
+	for i, c := range chunks {
+		w := stdout
+		if i%2 == 1 {
+			w = stderr
+		}
+		if _, err := w.Write([]byte(c)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestRunStepCombineOutput(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "combine-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = os.MkdirAll(path.Join(dir, VOLUMEDIR, "logs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	d, cl := newFakeClientDocker(nil)
+	cl.attached = multiplexed(t, "out 1\n", "err 1\n", "out 2\n")
+	stdoutPath := path.Join(dir, VOLUMEDIR, "logs", "condor-stdout-0")
+	stderrPath := path.Join(dir, VOLUMEDIR, "logs", "condor-stderr-0")
+
+	t.Run("separate", func(t *testing.T) {
+		if _, err := d.RunStep(&model.Job{InvocationID: "invocation"}, &model.Step{}, 0, 1, nil); err != nil {
+			t.Fatal(err)
+		}
+		stdout, err := ioutil.ReadFile(stdoutPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(stdout) != "out 1\nout 2\n" {
+			t.Errorf("stdout was %q", stdout)
+		}
+		stderr, err := ioutil.ReadFile(stderrPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(stderr) != "err 1\n" {
+			t.Errorf("stderr was %q", stderr)
+		}
+	})
+
+	t.Run("combined", func(t *testing.T) {
+		if err := os.Remove(stderrPath); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.RunStep(&model.Job{InvocationID: "invocation"}, &model.Step{CombineOutput: true}, 0, 1, nil); err != nil {
+			t.Fatal(err)
+		}
+		stdout, err := ioutil.ReadFile(stdoutPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(stdout) != "out 1\nerr 1\nout 2\n" {
+			t.Errorf("combined output was %q", stdout)
+		}
+		if _, err := os.Stat(stderrPath); !os.IsNotExist(err) {
+			t.Errorf("a stderr log was created for a step that combines its output")
+		}
+	})
+}
+
+func TestRunContainerCopiesAllOutput(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("logs.buffer_bytes", 1<<20)
+	d, cl := newFakeClientDocker(cfg)
+	out := strings.Repeat("output\n", 1<<15)
+	cl.attached = multiplexed(t, out, "done\n")
+	cl.exitsEarly = true
+
+	var stdout, stderr bytes.Buffer
+	if _, err := d.runContainer("container", &stdout, &stderr, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != out {
+		t.Errorf("%d of %d bytes of stdout were copied", stdout.Len(), len(out))
+	}
+	if stderr.String() != "done\n" {
+		t.Errorf("stderr was %q", stderr.String())
+	}
+}
+
+func TestRunStepPerStepLogDirs(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "per-step-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = os.MkdirAll(path.Join(dir, VOLUMEDIR, "logs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	cfg := viper.New()
+	cfg.Set("logs.per_step_dirs", true)
+	d, cl := newFakeClientDocker(cfg)
+	cl.attached = multiplexed(t, "out 1\n", "err 1\n")
+	step := &model.Step{}
+	step.Component.Name = "Word Count"
+
+	if _, err = d.RunStep(&model.Job{InvocationID: "invocation"}, step, 3, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{"stdout": "out 1\n", "stderr": "err 1\n"} {
+		contents, err := ioutil.ReadFile(path.Join(dir, VOLUMEDIR, "logs", "step-3-Word_Count", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != expected {
+			t.Errorf("%s was %q instead of %q", name, contents, expected)
+		}
+	}
+}
+
+func TestStepLogs(t *testing.T) {
+	tests := []struct {
+		name           string
+		tool           string
+		stdoutPath     string
+		perStep        bool
+		stdout, stderr string
+	}{
+		{"flat", "wc", "", false, "logs/condor-stdout-1", "logs/condor-stderr-1"},
+		{"per step", "wc", "", true, "logs/step-1-wc/stdout", "logs/step-1-wc/stderr"},
+		{"unnamed tool", "", "", true, "logs/step-1/stdout", "logs/step-1/stderr"},
+		{"unsafe tool name", "../bin/wc tool", "", true, "logs/step-1-bin_wc_tool/stdout", "logs/step-1-bin_wc_tool/stderr"},
+		{"step's own path", "wc", "out.txt", true, "out.txt", "logs/step-1-wc/stderr"},
+	}
+	for _, test := range tests {
+		step := &model.Step{StdoutPath: test.stdoutPath}
+		step.Component.Name = test.tool
+		stdout, stderr := StepLogs(step, 1, test.perStep)
+		if stdout != test.stdout || stderr != test.stderr {
+			t.Errorf("%s: logs were %s and %s instead of %s and %s", test.name, stdout, stderr, test.stdout, test.stderr)
+		}
+	}
+}
+
+func TestNodePlatform(t *testing.T) {
+	d, cl := newFakeClientDocker(nil)
+	cl.osType = "linux"
+	for _, c := range []struct{ reported, expected string }{
+		{"x86_64", "amd64"},
+		{"aarch64", "arm64"},
+		{"s390x", "s390x"},
+	} {
+		cl.arch = c.reported
+		os, arch, err := d.NodePlatform()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if os != "linux" || arch != c.expected {
+			t.Errorf("platform for %s was %s/%s instead of linux/%s", c.reported, os, arch, c.expected)
+		}
+	}
+}
+
+func TestPullTimeout(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("docker.pull_timeout", "10ms")
+	d, cl := newFakeClientDocker(cfg)
+
+	if err := d.Pull(context.Background(), "discoenv/wc", "latest"); err != nil {
+		t.Errorf("pull that finished in time failed: %s", err)
+	}
+
+	cl.pullBlocks = true
+	if err := d.Pull(context.Background(), "discoenv/wc", "latest"); err != ErrPullTimeout {
+		t.Errorf("err was %v instead of %v", err, ErrPullTimeout)
+	}
+
+	// Cancelling the caller's context isn't reported as a timeout.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := d.Pull(ctx, "discoenv/wc", "latest"); err != context.Canceled {
+		t.Errorf("err was %v instead of %v", err, context.Canceled)
+	}
+}
+
+func TestRunStepPlatformMismatch(t *testing.T) {
+	d, cl := newFakeClientDocker(nil)
+	cl.createErr = errors.New("Error response from daemon: image with reference discoenv/wc:latest was found but does not match the specified platform: wanted linux/arm64, actual: linux/amd64")
+	job := &model.Job{InvocationID: "invocation"}
+	step := &model.Step{}
+
+	if _, err := d.RunStep(job, step, 0, 1, nil); !IsPlatformMismatch(err) {
+		t.Errorf("err was %v, which isn't a platform mismatch", err)
+	}
+
+	cl.createErr = errors.New("Conflict. The container name \"/wc\" is already in use")
+	if _, err := d.RunStep(job, step, 0, 1, nil); err == nil || IsPlatformMismatch(err) {
+		t.Errorf("err was %v instead of an error that isn't a platform mismatch", err)
+	}
+}
+
+func TestTransferNetwork(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("porklock.network", "transfers")
+	cfg.Set("job.default_network_mode", "bridge")
+	d, cl := newFakeClientDocker(cfg)
+	job := &model.Job{InvocationID: "invocation", Submitter: "ipcdev"}
+
+	input := &model.StepInput{Value: "/iplant/home/ipcdev/in.txt"}
+	if _, err := d.CreateDownloadContainer(job, input, "0", 1); err != nil {
+		t.Fatal(err)
+	}
+	if cl.hostConfig.NetworkMode != "transfers" {
+		t.Errorf("download container network was %q instead of %q", cl.hostConfig.NetworkMode, "transfers")
+	}
+
+	if _, err := d.CreateUploadContainer(job); err != nil {
+		t.Fatal(err)
+	}
+	if cl.hostConfig.NetworkMode != "transfers" {
+		t.Errorf("upload container network was %q instead of %q", cl.hostConfig.NetworkMode, "transfers")
+	}
+
+	if _, err := d.CreateContainerFromStep(&model.Job{InvocationID: "invocation"}, &model.Step{}); err != nil {
+		t.Fatal(err)
+	}
+	if cl.hostConfig.NetworkMode != "bridge" {
+		t.Errorf("step container network was %q instead of %q", cl.hostConfig.NetworkMode, "bridge")
+	}
+}
+
+func TestDaemonVersion(t *testing.T) {
+	d, cl := newFakeClientDocker(nil)
+	cl.version = types.Version{Version: "17.03.1-ce", Os: "linux", Arch: "amd64"}
+	v, err := d.DaemonVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(v, cl.version) {
+		t.Errorf("version was %#v instead of %#v", v, cl.version)
+	}
+}
+
+func TestAutoRemoveTransferContainers(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "autoremove")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = os.MkdirAll(path.Join(dir, VOLUMEDIR, "logs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	job := &model.Job{InvocationID: "invocation", Submitter: "ipcdev"}
+	input := &model.StepInput{Value: "/iplant/home/ipcdev/in.txt"}
+
+	for _, enabled := range []bool{false, true} {
+		cfg := viper.New()
+		cfg.Set("docker.autoremove_transfer_containers", enabled)
+		d, cl := newFakeClientDocker(cfg)
+
+		if _, err = d.DownloadInputs(job, input, 0, 1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = d.UploadOutputs(job); err != nil {
+			t.Fatal(err)
+		}
+		var expected []string
+		if enabled {
+			expected = []string{"created", "created"}
+		}
+		if !reflect.DeepEqual(cl.removed, expected) {
+			t.Errorf("removed %#v with the setting %t", cl.removed, enabled)
+		}
+		if cl.hostConfig.AutoRemove {
+			t.Errorf("upload AutoRemove was set with the setting %t", enabled)
+		}
+
+		if _, err = d.CreateDataContainer(&model.VolumesFrom{Name: "discoenv/blast-db", Tag: "1.0"}, "invocation"); err != nil {
+			t.Fatal(err)
+		}
+		if cl.hostConfig.AutoRemove {
+			t.Errorf("data container AutoRemove was set with the setting %t", enabled)
+		}
+	}
+}
+
+func TestCreateContainerFromStepStripEnv(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("job.strip_env", []string{"http_proxy", "HTTPS_PROXY"})
+	d, cl := newFakeClientDocker(cfg)
+	step := &model.Step{Environment: model.StepEnvironment{
+		"http_proxy":  "http://proxy:3128",
+		"HTTPS_PROXY": "http://proxy:3128",
+		"IPLANT_USER": "ipcdev",
+	}}
+	if _, err := d.CreateContainerFromStep(&model.Job{InvocationID: "invocation"}, step); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range cl.config.Env {
+		if strings.HasPrefix(e, "http_proxy=") || strings.HasPrefix(e, "HTTPS_PROXY=") {
+			t.Errorf("stripped variable %s was set", e)
+		}
+	}
+	if !containsString(cl.config.Env, "IPLANT_USER=ipcdev") {
+		t.Errorf("env %#v doesn't include IPLANT_USER", cl.config.Env)
+	}
+	if len(step.Environment) != 3 {
+		t.Errorf("the step's environment was changed: %#v", step.Environment)
+	}
+}
+
+func TestCreateContainerFromStepEntrypoint(t *testing.T) {
+	d, cl := newFakeClientDocker(nil)
+	newStep := func(entrypoint string) *model.Step {
+		step := &model.Step{}
+		step.Component.Container.EntryPoint = entrypoint
+		step.Config.Params = []model.StepParam{
+			{Name: "-l", Order: 0},
+			{Value: "input.txt", Order: 1},
+		}
+		return step
+	}
+
+	t.Run("explicit entrypoint", func(t *testing.T) {
+		step := newStep("/usr/bin/wc")
+		if _, err := d.CreateContainerFromStep(&model.Job{InvocationID: "invocation"}, step); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual([]string(cl.config.Entrypoint), []string{"/usr/bin/wc"}) {
+			t.Errorf("entrypoint was %#v", cl.config.Entrypoint)
+		}
+		if !reflect.DeepEqual([]string(cl.config.Cmd), []string{"-l", "input.txt"}) {
+			t.Errorf("command was %#v", cl.config.Cmd)
+		}
+		expected := []string{"/usr/bin/wc", "-l", "input.txt"}
+		if argv := StepCommand(step); !reflect.DeepEqual(argv, expected) {
+			t.Errorf("step command was %#v instead of %#v", argv, expected)
+		}
+	})
+
+	t.Run("image entrypoint", func(t *testing.T) {
+		for _, entrypoint := range []string{"", "  "} {
+			step := newStep(entrypoint)
+			if _, err := d.CreateContainerFromStep(&model.Job{InvocationID: "invocation"}, step); err != nil {
+				t.Fatal(err)
+			}
+			if cl.config.Entrypoint != nil {
+				t.Errorf("entrypoint %q overrode the image's with %#v", entrypoint, cl.config.Entrypoint)
+			}
+			if !reflect.DeepEqual([]string(cl.config.Cmd), []string{"-l", "input.txt"}) {
+				t.Errorf("command was %#v", cl.config.Cmd)
+			}
+			expected := []string{"-l", "input.txt"}
+			if argv := StepCommand(step); !reflect.DeepEqual(argv, expected) {
+				t.Errorf("step command was %#v instead of %#v", argv, expected)
+			}
+		}
+	})
+}
+
+func TestNewTransport(t *testing.T) {
+	transport, err := newTransport("tcp://127.0.0.1:2375", 90*time.Second, 15*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transport.IdleConnTimeout != 90*time.Second {
+		t.Errorf("IdleConnTimeout was %s rather than 1m30s", transport.IdleConnTimeout)
+	}
+	if transport.Dial == nil {
+		t.Error("Dial was not set")
+	}
+}
+
+func TestNewTransportUnix(t *testing.T) {
+	transport, err := newTransport("unix:///var/run/docker.sock", time.Minute, 15*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transport.IdleConnTimeout != time.Minute {
+		t.Errorf("IdleConnTimeout was %s rather than 1m0s", transport.IdleConnTimeout)
+	}
+	if !transport.DisableCompression {
+		t.Error("DisableCompression was false for a unix socket")
+	}
+}
+
+func TestNewTransportDefaults(t *testing.T) {
+	transport, err := newTransport("unix:///var/run/docker.sock", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transport.IdleConnTimeout != 0 {
+		t.Errorf("IdleConnTimeout was %s rather than 0", transport.IdleConnTimeout)
+	}
+}
+
+func TestNewTransportBadURI(t *testing.T) {
+	if _, err := newTransport("not a uri", time.Minute, 0); err == nil {
+		t.Error("err was nil")
+	}
+}
+
+func TestNewDialer(t *testing.T) {
+	dialer := newDialer(15 * time.Second)
+	if dialer.KeepAlive != 15*time.Second {
+		t.Errorf("KeepAlive was %s rather than 15s", dialer.KeepAlive)
+	}
+	if dialer.Timeout != dialTimeout {
+		t.Errorf("Timeout was %s rather than %s", dialer.Timeout, dialTimeout)
+	}
+}
+
+func TestCreatePreCommandContainer(t *testing.T) {
+	d, cl := newFakeClientDocker(nil)
+	step := &model.Step{}
+	step.Component.Container.Name = "step-name"
+	step.Component.Container.EntryPoint = "/usr/bin/wc"
+	step.Component.Container.Image.Name = "alpine"
+	step.Environment = model.StepEnvironment{"DIR": "out"}
+	step.PreCommand = []string{"mkdir", "-p", "${DIR}"}
+
+	if _, err := d.CreatePreCommandContainer(&model.Job{InvocationID: "invocation"}, step); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"mkdir", "-p", "out"}
+	if !reflect.DeepEqual([]string(cl.config.Entrypoint), expected) {
+		t.Errorf("entrypoint was %#v instead of %#v", cl.config.Entrypoint, expected)
+	}
+	if len(cl.config.Cmd) != 0 {
+		t.Errorf("command was %#v", cl.config.Cmd)
+	}
+	if cl.config.Image != "alpine" {
+		t.Errorf("image was %s rather than alpine", cl.config.Image)
+	}
+	if cl.name != "step-name-pre" {
+		t.Errorf("name was %s rather than step-name-pre", cl.name)
+	}
+
+	step.Component.Container.Name = ""
+	if _, err := d.CreatePreCommandContainer(&model.Job{InvocationID: "invocation"}, step); err != nil {
+		t.Fatal(err)
+	}
+	if cl.name != "" {
+		t.Errorf("name was %s rather than empty", cl.name)
+	}
+}
+
+func TestCreateContainerFromStepUmask(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("job.umask", "027")
+	d, cl := newFakeClientDocker(cfg)
+	wrapper := []string{"/bin/sh", "-c", `umask 027 && exec "$@"`, "sh"}
+	newStep := func(entrypoint string) *model.Step {
+		step := &model.Step{}
+		step.Component.Container.EntryPoint = entrypoint
+		step.Component.Container.Image.Name = "wc"
+		step.Config.Params = []model.StepParam{
+			{Name: "-l", Order: 0},
+			{Value: "input.txt", Order: 1},
+		}
+		return step
+	}
+
+	t.Run("explicit entrypoint", func(t *testing.T) {
+		if _, err := d.CreateContainerFromStep(&model.Job{InvocationID: "invocation"}, newStep("/usr/bin/wc")); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual([]string(cl.config.Entrypoint), wrapper) {
+			t.Errorf("entrypoint was %#v instead of %#v", cl.config.Entrypoint, wrapper)
+		}
+		expected := []string{"/usr/bin/wc", "-l", "input.txt"}
+		if !reflect.DeepEqual([]string(cl.config.Cmd), expected) {
+			t.Errorf("command was %#v instead of %#v", cl.config.Cmd, expected)
+		}
+	})
+
+	t.Run("image entrypoint", func(t *testing.T) {
+		cl.imageCfg = &container.Config{Entrypoint: []string{"/usr/bin/wc"}, Cmd: []string{"--help"}}
+		defer func() { cl.imageCfg = nil }()
+		if _, err := d.CreateContainerFromStep(&model.Job{InvocationID: "invocation"}, newStep("")); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual([]string(cl.config.Entrypoint), wrapper) {
+			t.Errorf("entrypoint was %#v instead of %#v", cl.config.Entrypoint, wrapper)
+		}
+		expected := []string{"/usr/bin/wc", "-l", "input.txt"}
+		if !reflect.DeepEqual([]string(cl.config.Cmd), expected) {
+			t.Errorf("command was %#v instead of %#v", cl.config.Cmd, expected)
+		}
+	})
+
+	t.Run("image command", func(t *testing.T) {
+		cl.imageCfg = &container.Config{Cmd: []string{"redis-server"}}
+		defer func() { cl.imageCfg = nil }()
+		step := &model.Step{}
+		step.Component.Container.Image.Name = "redis"
+		if _, err := d.CreateContainerFromStep(&model.Job{InvocationID: "invocation"}, step); err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{"redis-server"}
+		if !reflect.DeepEqual([]string(cl.config.Cmd), expected) {
+			t.Errorf("command was %#v instead of %#v", cl.config.Cmd, expected)
+		}
+	})
+
+	t.Run("invalid umask", func(t *testing.T) {
+		cfg.Set("job.umask", "u=rwx")
+		defer cfg.Set("job.umask", "027")
+		if _, err := d.CreateContainerFromStep(&model.Job{InvocationID: "invocation"}, newStep("/usr/bin/wc")); err == nil {
+			t.Error("err was nil")
+		}
+	})
+}
+
+func TestValidateUmask(t *testing.T) {
+	for _, umask := range []string{"", "022", "0027", "777"} {
+		if err := ValidateUmask(umask); err != nil {
+			t.Errorf("umask %q was rejected: %s", umask, err)
+		}
+	}
+	for _, umask := range []string{"22", "0o22", "089", "00022", "u=rwx"} {
+		if err := ValidateUmask(umask); err == nil {
+			t.Errorf("umask %q was accepted", umask)
+		}
+	}
+}
+
+func TestRunStepOOMKilled(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "oom-killed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = os.MkdirAll(path.Join(dir, VOLUMEDIR, "logs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	job := &model.Job{InvocationID: "invocation"}
+	d, cl := newFakeClientDocker(nil)
+	cl.exitCode = 137
+
+	cl.oomKilled = true
+	exitCode, err := d.RunStep(job, &model.Step{}, 0, 1, nil)
+	if err != ErrOOMKilled {
+		t.Errorf("err was %v instead of %v", err, ErrOOMKilled)
+	}
+	if exitCode != 137 {
+		t.Errorf("exit code was %d instead of 137", exitCode)
+	}
+
+	cl.oomKilled = false
+	var started bool
+	if _, err = d.RunStep(job, &model.Step{}, 0, 1, func() { started = true }); err != nil {
+		t.Errorf("a step that wasn't OOM killed returned %v", err)
+	}
+	if !started {
+		t.Error("started wasn't called")
+	}
+}
+
+func TestRunStepRetryKeepsLogs(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "step-retry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = os.MkdirAll(path.Join(dir, VOLUMEDIR, "logs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	job := &model.Job{InvocationID: "invocation"}
+	d, cl := newFakeClientDocker(nil)
+	stdoutPath := path.Join(dir, VOLUMEDIR, "logs", "condor-stdout-0")
+
+	for attempt, out := range []string{"first\n", "second\n"} {
+		cl.attached = multiplexed(t, out)
+		if _, err = d.RunStep(job, &model.Step{}, 0, attempt+1, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stdout, err := ioutil.ReadFile(stdoutPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stdout) != "first\nsecond\n" {
+		t.Errorf("stdout was %q", stdout)
+	}
+
+	cl.attached = multiplexed(t, "third\n")
+	if _, err = d.RunStep(job, &model.Step{}, 0, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if stdout, err = ioutil.ReadFile(stdoutPath); err != nil {
+		t.Fatal(err)
+	}
+	if string(stdout) != "third\n" {
+		t.Errorf("the first attempt didn't replace the log, stdout was %q", stdout)
+	}
+}
+
+func TestRunInteractiveStep(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "interactive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = os.MkdirAll(path.Join(dir, VOLUMEDIR, "logs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	d, cl := newFakeClientDocker(nil)
+	cl.ports = nat.PortMap{"8888/tcp": []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: "32768"}}}
+
+	var reported nat.PortMap
+	job := &model.Job{InvocationID: "invocation", Interactive: true}
+	if _, err = d.RunInteractiveStep(job, &model.Step{}, 0, 1, func(ports nat.PortMap) { reported = ports }); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reported, cl.ports) {
+		t.Errorf("reported ports were %#v instead of %#v", reported, cl.ports)
+	}
+}
+
+func TestCreateContainerFromStepDevicePermissions(t *testing.T) {
+	step := &model.Step{}
+	step.Component.Container.Devices = []model.Device{
+		{HostPath: "/dev/fuse", ContainerPath: "/dev/fuse"},
+		{HostPath: "/dev/nvidia0", ContainerPath: "/dev/nvidia0", CgroupPermissions: "rw"},
+	}
+
+	t.Run("built-in default", func(t *testing.T) {
+		d, cl := newFakeClientDocker(nil)
+		if _, err := d.CreateContainerFromStep(&model.Job{InvocationID: "invocation"}, step); err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{"rwm", "rw"}
+		for i, dev := range cl.hostConfig.Devices {
+			if dev.CgroupPermissions != expected[i] {
+				t.Errorf("permissions for %s were %q instead of %q", dev.PathOnHost, dev.CgroupPermissions, expected[i])
+			}
+		}
+	})
+
+	t.Run("configured default", func(t *testing.T) {
+		cfg := viper.New()
+		cfg.Set("job.default_device_perms", "r")
+		d, cl := newFakeClientDocker(cfg)
+		if _, err := d.CreateContainerFromStep(&model.Job{InvocationID: "invocation"}, step); err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{"r", "rw"}
+		for i, dev := range cl.hostConfig.Devices {
+			if dev.CgroupPermissions != expected[i] {
+				t.Errorf("permissions for %s were %q instead of %q", dev.PathOnHost, dev.CgroupPermissions, expected[i])
+			}
+		}
+	})
+}
+
+func TestCreateDownloadContainerResume(t *testing.T) {
+	job := &model.Job{InvocationID: "invocation", Submitter: "ipcdev"}
+	input := &model.StepInput{Value: "/iplant/home/ipcdev/in.txt"}
+
+	tests := []struct {
+		resume  bool
+		attempt int
+		flag    bool
+		name    string
+	}{
+		{true, 1, false, "input-0-invocation"},
+		{true, 2, true, "input-0-invocation-retry-2"},
+		{false, 2, false, "input-0-invocation-retry-2"},
+	}
+	for _, test := range tests {
+		cfg := viper.New()
+		cfg.Set("transfer.resume_downloads", test.resume)
+		d, cl := newFakeClientDocker(cfg)
+
+		if _, err := d.CreateDownloadContainer(job, input, "0", test.attempt); err != nil {
+			t.Fatal(err)
+		}
+		if containsString(cl.config.Cmd, "--resume") != test.flag {
+			t.Errorf("resume %t, attempt %d: command was %#v", test.resume, test.attempt, cl.config.Cmd)
+		}
+		if cl.name != test.name {
+			t.Errorf("resume %t, attempt %d: name was %q instead of %q", test.resume, test.attempt, cl.name, test.name)
+		}
+	}
+}
+
+func TestNukeImageByReference(t *testing.T) {
+	d, cl := newFakeClientDocker(nil)
+	refs := []string{"discoenv/ref-genome@sha256:locked", "discoenv/blast-db:1.0", "sha256:0123abcd"}
+	for _, ref := range refs {
+		if err := d.NukeImage(ref); err != nil {
+			t.Error(err)
+		}
+	}
+	if !reflect.DeepEqual(cl.rmImages, refs) {
+		t.Errorf("removed images were %#v instead of %#v", cl.rmImages, refs)
+	}
+}
@@ -0,0 +1,2124 @@
+package dockerops
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"context"
+
+	"github.com/cyverse-de/logcabin"
+	"github.com/cyverse-de/road-runner/model"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/pkg/stdcopy"
+	nat "github.com/docker/go-connections/nat"
+	"github.com/spf13/viper"
+)
+
+// Docker provides operations that runner needs from the docker client.
+type Docker struct {
+	Client        DockerClient
+	TransferImage string
+	cfg           *viper.Viper
+	ctx           context.Context
+}
+
+// WORKDIR is the path to the working directory inside all of the containers
+// that are run as part of a job.
+const WORKDIR = "/de-app-work"
+
+// CONFIGDIR is the path to the local configs inside the containers that are
+// used to transfer files into and out of the job.
+const CONFIGDIR = "/configs"
+
+// VOLUMEDIR is the name of the directory that is used for the working directory
+// volume.
+const VOLUMEDIR = "workingvolume"
+
+// INPUTSDIR is the subdirectory of the working directory that inputs are
+// downloaded into when transfer.stage_inputs is set. It's mounted read-only in
+// the step containers and left out of the final upload.
+const INPUTSDIR = "inputs"
+
+// The values used in the container type label. They start at one to match
+// the values used before the label keys could be namespaced.
+const (
+	// InputContainer is the value used in the type label for input containers.
+	InputContainer = iota + 1
+
+	// DataContainer is the value used in the type label for data containers.
+	DataContainer
+
+	// StepContainer is the value used in the type label for step containers.
+	StepContainer
+
+	// OutputContainer is the value used in the type label for output containers.
+	OutputContainer
+)
+
+// NewDocker returns a *Docker that performs its operations with cl.
+func NewDocker(ctx context.Context, cfg *viper.Viper, cl DockerClient) *Docker {
+	return &Docker{
+		Client: cl,
+		cfg:    cfg,
+		ctx:    ctx,
+	}
+}
+
+// containerName returns name with the naming.prefix setting prepended, which
+// keeps the containers of deployments that share a node from colliding. Empty
+// names are left alone so that Docker picks one.
+func (d *Docker) containerName(name string) string {
+	if name == "" {
+		return name
+	}
+	return d.cfg.GetString("naming.prefix") + name
+}
+
+// IsContainer returns true if the provided 'name' is a container on the system
+func (d *Docker) IsContainer(name string) (bool, error) {
+	name = d.containerName(name)
+	opts := types.ContainerListOptions{All: true}
+	list, err := d.Client.ContainerList(d.ctx, opts)
+	if err != nil {
+		return false, err
+	}
+	for _, c := range list {
+		for _, n := range c.Names {
+			if strings.TrimPrefix(n, "/") == name {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// IsRunning returns true if the contain with 'name' is running.
+func (d *Docker) IsRunning(name string) (bool, error) {
+	name = d.containerName(name)
+	opts := types.ContainerListOptions{}
+	list, err := d.Client.ContainerList(d.ctx, opts)
+	if err != nil {
+		return false, err
+	}
+	for _, c := range list {
+		for _, n := range c.Names {
+			if strings.TrimPrefix(n, "/") == name {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// ContainersWithLabel returns the id of all containers that have the label
+// "key=value" applied to it.
+func (d *Docker) ContainersWithLabel(key, value string, all bool) ([]string, error) {
+	f := filters.NewArgs()
+	f.Add("label", fmt.Sprintf("%s=%s", key, value))
+	opts := types.ContainerListOptions{
+		All:     all,
+		Filters: f,
+	}
+	list, err := d.Client.ContainerList(d.ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	var retval []string
+	for _, c := range list {
+		retval = append(retval, c.ID)
+	}
+	return retval, nil
+}
+
+// StopContainer asks the container with the provided id to stop, killing it
+// if it's still running after the grace period.
+func (d *Docker) StopContainer(id string, grace time.Duration) error {
+	return d.Client.ContainerStop(d.ctx, id, &grace)
+}
+
+// NukeContainer kills the container with the provided id.
+func (d *Docker) NukeContainer(id string) error {
+	fmt.Printf("Nuking container %s", id)
+	return d.Client.ContainerRemove(d.ctx, id, types.ContainerRemoveOptions{
+		RemoveVolumes: true,
+		RemoveLinks:   false,
+		Force:         true,
+	})
+}
+
+// NukeContainersByLabel kills all running containers that have the provided
+// label applied to them.
+func (d *Docker) NukeContainersByLabel(key, value string) error {
+	containers, err := d.ContainersWithLabel(key, value, false)
+	if err != nil {
+		return err
+	}
+	for _, container := range containers {
+		err = d.NukeContainer(container)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NukeContainersBySubmitter removes all of the containers, running or not,
+// that were created for jobs submitted by user. Data containers aren't
+// labeled with the submitter and have to be removed by job.
+func (d *Docker) NukeContainersBySubmitter(user string) error {
+	containers, err := d.ContainersWithLabel(SubmitterLabelKey(), user, true)
+	if err != nil {
+		return err
+	}
+	for _, container := range containers {
+		if err = d.NukeContainer(container); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NukeContainerByName kills and remove the named container. The naming.prefix
+// setting is prepended to name.
+func (d *Docker) NukeContainerByName(name string) error {
+	name = d.containerName(name)
+	list, err := d.Client.ContainerList(d.ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		return err
+	}
+	for _, container := range list {
+		for _, n := range container.Names {
+			if strings.TrimPrefix(n, "/") == name {
+				return d.NukeContainer(container.ID)
+			}
+		}
+	}
+	return nil
+}
+
+// ImageID returns the image ID as a string for image with the given name and tag.
+func (d *Docker) ImageID(name, tag string) (string, error) {
+	images, err := d.Client.ImageList(d.ctx, types.ImageListOptions{
+		All: true,
+	})
+	if err != nil {
+		return "", nil
+	}
+	repoTag := fmt.Sprintf("%s:%s", name, tag)
+	found := ""
+	for _, img := range images {
+		for _, rt := range img.RepoTags {
+			if rt == repoTag {
+				found = img.ID
+			}
+		}
+	}
+	return found, err
+}
+
+func (d *Docker) removeImage(id string, force, prune bool) error {
+	removed, err := d.Client.ImageRemove(d.ctx, id, types.ImageRemoveOptions{
+		Force:         force,
+		PruneChildren: prune,
+	})
+	if err != nil {
+		return err
+	}
+	for _, rm := range removed {
+		logcabin.Info.Printf("untagged: %s\tdeleted: %s\n", rm.Untagged, rm.Deleted)
+	}
+	return err
+}
+
+// SafelyRemoveImageByID will delete the image referenced by its ID.
+func (d *Docker) SafelyRemoveImageByID(id string) error {
+	return d.removeImage(id, false, false)
+}
+
+// InspectImage will return a types.ImageInspect instance filled out for the
+// image with the provided ID.
+func (d *Docker) InspectImage(id string) (types.ImageInspect, error) {
+	retval, _, err := d.Client.ImageInspectWithRaw(d.ctx, id)
+	return retval, err
+}
+
+// NodeMemory returns the total memory in bytes that the Docker daemon reports
+// for the node.
+func (d *Docker) NodeMemory() (int64, error) {
+	info, err := d.Client.Info(d.ctx)
+	if err != nil {
+		return 0, err
+	}
+	return info.MemTotal, nil
+}
+
+// DaemonVersion returns the version of the Docker daemon along with the
+// operating system and kernel of the node it runs on.
+func (d *Docker) DaemonVersion() (types.Version, error) {
+	return d.Client.ServerVersion(d.ctx)
+}
+
+// nodeArchitectures maps the machine names the Docker daemon reports for the
+// node to the architecture names used in images.
+var nodeArchitectures = map[string]string{
+	"x86_64":  "amd64",
+	"aarch64": "arm64",
+	"armv7l":  "arm",
+	"i386":    "386",
+	"i686":    "386",
+}
+
+// NodePlatform returns the operating system and architecture of the node the
+// Docker daemon runs on, using the names that images use for them.
+func (d *Docker) NodePlatform() (string, string, error) {
+	info, err := d.Client.Info(d.ctx)
+	if err != nil {
+		return "", "", err
+	}
+	arch := info.Architecture
+	if a, ok := nodeArchitectures[arch]; ok {
+		arch = a
+	}
+	return info.OSType, arch, nil
+}
+
+// ExposedPortsForImage returns a nat.PortSet for the image with the given ID.
+// Convenience function that uses InspectImage().
+func (d *Docker) ExposedPortsForImage(id string) (nat.PortSet, error) {
+	inspection, err := d.InspectImage(id)
+	if err != nil {
+		return nil, err
+	}
+	return inspection.Config.ExposedPorts, err
+}
+
+// SafelyRemoveImage will delete the image with force set to false
+func (d *Docker) SafelyRemoveImage(name, tag string) error {
+	imageID, err := d.ImageID(name, tag)
+	if err != nil {
+		return err
+	}
+	if imageID == "" {
+		return fmt.Errorf("image not found: %s:%s", name, tag)
+	}
+	return d.SafelyRemoveImageByID(imageID)
+}
+
+// NukeImage will delete the image with force set to true. ref is the image's
+// ID or the reference it was pulled with, either name:tag or name@digest.
+func (d *Docker) NukeImage(ref string) error {
+	return d.removeImage(ref, true, true)
+}
+
+// Images will returns a list of the repo tags for all the images currently
+// downloaded.
+func (d *Docker) Images() ([]string, error) {
+	images, err := d.Client.ImageList(d.ctx, types.ImageListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+	var retval []string
+	for _, img := range images {
+		repos := img.RepoTags
+		for _, r := range repos {
+			retval = append(retval, r)
+		}
+	}
+	return retval, nil
+}
+
+// DanglingImages will return a list of IDs for all dangling images.
+func (d *Docker) DanglingImages() ([]string, error) {
+	var err error
+	imageFilter := filters.NewArgs()
+	imageFilter.Add("dangling", "true")
+	images, err := d.Client.ImageList(d.ctx, types.ImageListOptions{
+		Filters: imageFilter,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var retval []string
+	for _, img := range images {
+		retval = append(retval, img.ID)
+	}
+	return retval, nil
+}
+
+// ErrPullTimeout is returned when an image pull doesn't finish within the
+// docker.pull_timeout setting.
+var ErrPullTimeout = errors.New("the image pull didn't finish within docker.pull_timeout")
+
+// basePull pulls imageRef. If docker.pull_timeout is set, the pull is aborted
+// and ErrPullTimeout is returned once it has taken that long, so a hung
+// registry connection can't block the job forever.
+func (d *Docker) basePull(ctx context.Context, imageRef string, opts types.ImagePullOptions) error {
+	pullCtx := ctx
+	if timeout := d.cfg.GetDuration("docker.pull_timeout"); timeout > 0 {
+		var cancel context.CancelFunc
+		pullCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	timedOut := func(err error) error {
+		if err != nil && ctx.Err() == nil && pullCtx.Err() == context.DeadlineExceeded {
+			return ErrPullTimeout
+		}
+		return err
+	}
+
+	body, err := d.Client.ImagePull(pullCtx, imageRef, opts)
+	if err != nil {
+		return timedOut(err)
+	}
+	defer body.Close()
+
+	_, err = io.Copy(os.Stdout, body)
+	return timedOut(err)
+}
+
+// Pull will pull an image indicated by name and tag. Name is in the format
+// "registry/repository". If the name doesn't contain a / then the registry
+// is assumed to be "base" and the provided name will be set to repository.
+// This assumes that no authentication is required. Cancelling ctx aborts the
+// pull.
+func (d *Docker) Pull(ctx context.Context, name, tag string) error {
+	return d.basePull(ctx, fmt.Sprintf("%s:%s", name, tag), types.ImagePullOptions{})
+}
+
+// PullAuthenticated is Pull, but with an additional argument 'auth' which
+// should be the RegistryAuth needed by docker: base64(username + ':' + password)
+func (d *Docker) PullAuthenticated(ctx context.Context, name, tag, auth string) error {
+	return d.basePull(ctx, fmt.Sprintf("%s:%s", name, tag), types.ImagePullOptions{
+		RegistryAuth: auth,
+	})
+}
+
+// PullDigest pulls the image name@digest. auth is used as the RegistryAuth if
+// it isn't empty.
+func (d *Docker) PullDigest(ctx context.Context, name, digest, auth string) error {
+	return d.basePull(ctx, fmt.Sprintf("%s@%s", name, digest), types.ImagePullOptions{
+		RegistryAuth: auth,
+	})
+}
+
+func pathExists(p string) (bool, error) {
+	_, err := os.Stat(p)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return true, err
+}
+
+// defaultDirMode is the file mode used for the working directory when
+// volume.dir_mode isn't set.
+const defaultDirMode os.FileMode = 0755
+
+// dirMode parses the octal string in the volume.dir_mode config setting.
+func dirMode(cfg *viper.Viper) (os.FileMode, error) {
+	setting := strings.TrimSpace(cfg.GetString("volume.dir_mode"))
+	if setting == "" {
+		return defaultDirMode, nil
+	}
+	mode, err := strconv.ParseUint(setting, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("volume.dir_mode %q is not an octal file mode", setting)
+	}
+	if os.FileMode(mode)&^os.ModePerm != 0 {
+		return 0, fmt.Errorf("volume.dir_mode %q must be between 0000 and 0777", setting)
+	}
+	return os.FileMode(mode), nil
+}
+
+// makeVolumeDir creates the directory at p with the given mode. The mode is
+// applied after the directory is created so that the umask doesn't mask off
+// the group bits.
+func makeVolumeDir(p string, mode os.FileMode) error {
+	if err := os.MkdirAll(p, mode); err != nil {
+		return err
+	}
+	return os.Chmod(p, mode)
+}
+
+// CreateWorkingDirVolume creates a new volume that is used to contain the
+// working directory for a job.
+func (d *Docker) CreateWorkingDirVolume(volumeID string) (types.Volume, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return types.Volume{}, err
+	}
+
+	mode, err := dirMode(d.cfg)
+	if err != nil {
+		return types.Volume{}, err
+	}
+
+	path := path.Join(wd, VOLUMEDIR)
+
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			logcabin.Info.Printf("creating volume directory: %s\n", path)
+			if err = makeVolumeDir(path, mode); err != nil {
+				logcabin.Info.Printf("error creating path %s: %s", path, err)
+				return types.Volume{}, err
+			}
+		}
+	}
+
+	return d.createVolume(workingDirVolumeBody(d.cfg, volumeID, path))
+}
+
+// workingDirVolumeBody returns the request for creating the working directory
+// volume. By default it's a local volume bound to dir. Sites that keep working
+// directories on other storage can set volume.driver and volume.driver_opts
+// instead, which are passed to Docker as they are.
+func workingDirVolumeBody(cfg *viper.Viper, volumeID, dir string) volume.VolumesCreateBody {
+	driver := strings.TrimSpace(cfg.GetString("volume.driver"))
+	if driver == "" {
+		return volume.VolumesCreateBody{
+			Driver: "local",
+			DriverOpts: map[string]string{
+				"type":   "none",
+				"device": dir,
+				"o":      "bind",
+			},
+			Name: volumeID,
+		}
+	}
+	return volume.VolumesCreateBody{
+		Driver:     driver,
+		DriverOpts: cfg.GetStringMapString("volume.driver_opts"),
+		Name:       volumeID,
+	}
+}
+
+// volumeCreateAttempts is the number of times VolumeCreate is tried before
+// giving up.
+const volumeCreateAttempts = 3
+
+// volumeCreateBackoff is how long to wait after the first failed VolumeCreate.
+// It doubles after each failure.
+var volumeCreateBackoff = 500 * time.Millisecond
+
+// createVolume creates the volume, retrying with a backoff when the volume
+// driver returns an error. A volume that already exists is returned as-is.
+func (d *Docker) createVolume(body volume.VolumesCreateBody) (types.Volume, error) {
+	var (
+		v   types.Volume
+		err error
+	)
+	backoff := volumeCreateBackoff
+	for attempt := 1; ; attempt++ {
+		v, err = d.Client.VolumeCreate(d.ctx, body)
+		if err == nil {
+			return v, nil
+		}
+		if strings.Contains(err.Error(), "already exists") {
+			logcabin.Info.Printf("volume %s already exists", body.Name)
+			return d.Client.VolumeInspect(d.ctx, body.Name)
+		}
+		if attempt == volumeCreateAttempts {
+			return v, err
+		}
+		logcabin.Warning.Printf("error creating volume %s, retrying in %s: %s", body.Name, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// VolumeExists return true if the volume exists.
+func (d *Docker) VolumeExists(volumeID string) (bool, error) {
+	list, err := d.Client.VolumeList(d.ctx, filters.NewArgs())
+	if err != nil {
+		return false, err
+	}
+	for _, l := range list.Volumes {
+		if l.Name == volumeID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// RemoveVolume deletes the working directory volume.
+func (d *Docker) RemoveVolume(volumeID string) error {
+	return d.Client.VolumeRemove(d.ctx, volumeID, true)
+}
+
+// envReference matches ${VAR} references in step arguments.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// interpolateArguments returns a copy of args with the ${VAR} references
+// expanded using the values in env. References to variables that aren't set in
+// env are left untouched.
+func interpolateArguments(args []string, env model.StepEnvironment) []string {
+	retval := make([]string, len(args))
+	for i, arg := range args {
+		retval[i] = envReference.ReplaceAllStringFunc(arg, func(ref string) string {
+			name := envReference.FindStringSubmatch(ref)[1]
+			value, ok := env[name]
+			if !ok {
+				logcabin.Warning.Printf("environment variable %s is not set for the step, leaving %s as is", name, ref)
+				return ref
+			}
+			return value
+		})
+	}
+	return retval
+}
+
+// stripEnvironment returns a copy of env without the variables named in
+// strip. It's used for the job.strip_env setting, which keeps variables that
+// break some tools, like proxy settings, out of the step containers.
+func stripEnvironment(env model.StepEnvironment, strip []string) model.StepEnvironment {
+	retval := make(model.StepEnvironment, len(env))
+	for k, v := range env {
+		retval[k] = v
+	}
+	for _, k := range strip {
+		delete(retval, strings.TrimSpace(k))
+	}
+	return retval
+}
+
+// stepEntrypoint returns the entrypoint that overrides the image's, or nil if
+// the step doesn't set one. Without an override, the image's entrypoint runs
+// with the step's arguments as its command, so the arguments must not repeat
+// it.
+func stepEntrypoint(step *model.Step) []string {
+	if ep := strings.TrimSpace(step.Component.Container.EntryPoint); ep != "" {
+		return []string{ep}
+	}
+	return nil
+}
+
+// StepCommand returns the full command line run in the step's container: the
+// entrypoint, if the step sets one, followed by the step's arguments with the
+// environment references expanded.
+func StepCommand(step *model.Step) []string {
+	argv := stepEntrypoint(step)
+	return append(argv, interpolateArguments(step.Arguments(), step.Environment)...)
+}
+
+// umaskValue matches a file mode creation mask written in octal.
+var umaskValue = regexp.MustCompile(`^0?[0-7]{3}$`)
+
+// ValidateUmask returns an error if umask isn't empty or an octal file mode
+// creation mask, like 022 or 0027.
+func ValidateUmask(umask string) error {
+	if umask != "" && !umaskValue.MatchString(umask) {
+		return fmt.Errorf("invalid job.umask %q, must be an octal value like 022", umask)
+	}
+	return nil
+}
+
+// withUmask returns the entrypoint and command that run the given entrypoint
+// and command under a shell that sets the umask first. A nil entrypoint means
+// the image's own entrypoint, so the image is inspected to find it, along
+// with the image's command if cmd is empty.
+func (d *Docker) withUmask(umask, image string, entrypoint, cmd []string) ([]string, []string, error) {
+	if err := ValidateUmask(umask); err != nil {
+		return nil, nil, err
+	}
+	if entrypoint == nil {
+		inspection, _, err := d.Client.ImageInspectWithRaw(d.ctx, image)
+		if err != nil {
+			return nil, nil, err
+		}
+		if inspection.Config != nil {
+			entrypoint = inspection.Config.Entrypoint
+			if len(cmd) == 0 {
+				cmd = inspection.Config.Cmd
+			}
+		}
+	}
+	argv := append(append([]string{}, entrypoint...), cmd...)
+	wrapper := []string{"/bin/sh", "-c", fmt.Sprintf(`umask %s && exec "$@"`, umask), "sh"}
+	return wrapper, argv, nil
+}
+
+// defaultDevicePermissions are the cgroup permissions given to a device that
+// the job doesn't set any for when job.default_device_perms isn't set.
+const defaultDevicePermissions = "rwm"
+
+// devicePermissions returns perms, or the default cgroup permissions for
+// devices if perms is empty. Docker rejects device mappings without any.
+func (d *Docker) devicePermissions(perms string) string {
+	if perms = strings.TrimSpace(perms); perms != "" {
+		return perms
+	}
+	if perms = strings.TrimSpace(d.cfg.GetString("job.default_device_perms")); perms != "" {
+		return perms
+	}
+	return defaultDevicePermissions
+}
+
+// defaultLogDriver is the log driver used for containers when
+// docker.log_driver isn't set. The step logs are already captured by
+// attaching to the container, so Docker doesn't need to keep a copy.
+const defaultLogDriver = "none"
+
+// logConfig returns the logging configuration for the containers created for
+// the job, built from the docker.log_driver and docker.log_opts settings.
+func logConfig(cfg *viper.Viper) container.LogConfig {
+	driver := strings.TrimSpace(cfg.GetString("docker.log_driver"))
+	if driver == "" {
+		driver = defaultLogDriver
+	}
+	lc := container.LogConfig{Type: driver}
+	if opts := cfg.GetStringMapString("docker.log_opts"); len(opts) > 0 && driver != defaultLogDriver {
+		lc.Config = opts
+	}
+	return lc
+}
+
+// stepNetworkMode returns the network mode for the step, falling back to
+// defaultMode when the step doesn't set one.
+func stepNetworkMode(step *model.Step, defaultMode string) string {
+	if step.Component.Container.NetworkMode != "" {
+		return step.Component.Container.NetworkMode
+	}
+	return defaultMode
+}
+
+// applyNetworkMode sets up the container's networking for the given mode. An
+// empty mode leaves Docker's default bridge network in place. Ports are only
+// published when networking is enabled.
+func applyNetworkMode(config *container.Config, hostConfig *container.HostConfig, mode string) {
+	if mode != "" {
+		if mode == "none" {
+			config.NetworkDisabled = true
+		}
+		hostConfig.NetworkMode = container.NetworkMode(mode)
+	}
+	hostConfig.PublishAllPorts = !config.NetworkDisabled
+}
+
+// gpuDevicesEnv is the environment variable the NVIDIA container runtime
+// reads to decide which GPUs to expose to the container.
+const gpuDevicesEnv = "NVIDIA_VISIBLE_DEVICES"
+
+// defaultGPURuntime is the container runtime used for steps that request GPUs
+// when gpu.runtime isn't set.
+const defaultGPURuntime = "nvidia"
+
+// defaultGPUAssignedEnv is the variable in road-runner's own environment that
+// lists the GPUs the scheduler assigned to the job when gpu.assigned_env isn't
+// set. HTCondor sets it to the assigned device indices or UUIDs.
+const defaultGPUAssignedEnv = "CUDA_VISIBLE_DEVICES"
+
+// gpuAssigned returns the GPU IDs the scheduler assigned to the job, read from
+// the variable named by gpu.assigned_env.
+func gpuAssigned(cfg *viper.Viper) string {
+	name := strings.TrimSpace(cfg.GetString("gpu.assigned_env"))
+	if name == "" {
+		name = defaultGPUAssignedEnv
+	}
+	return os.Getenv(name)
+}
+
+// gpuDevices returns the comma separated IDs of the first count GPUs in
+// assigned, which is a comma separated list of the GPUs the scheduler assigned
+// to the job. HTCondor's CUDA prefix is dropped from the IDs. When nothing was
+// assigned, the indices of the first count GPUs on the node are used instead.
+func gpuDevices(count int, assigned string) (string, error) {
+	var ids []string
+	for _, id := range strings.Split(assigned, ",") {
+		if id = strings.TrimPrefix(strings.TrimSpace(id), "CUDA"); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		for i := 0; i < count; i++ {
+			ids = append(ids, strconv.Itoa(i))
+		}
+	}
+	if len(ids) < count {
+		return "", fmt.Errorf("%d GPUs were requested but only %d were assigned to the job", count, len(ids))
+	}
+	return strings.Join(ids[:count], ","), nil
+}
+
+// gpuRuntime returns the container runtime for steps that use GPUs.
+func gpuRuntime(cfg *viper.Viper) string {
+	if runtime := strings.TrimSpace(cfg.GetString("gpu.runtime")); runtime != "" {
+		return runtime
+	}
+	return defaultGPURuntime
+}
+
+// resolveHostPath returns the absolute host path for a volume. Docker rejects
+// relative host paths, so they're resolved against the job's working
+// directory. When volume.strict_host_paths is set, relative paths that lead
+// out of the working directory are rejected.
+func (d *Docker) resolveHostPath(hostPath string) (string, error) {
+	if filepath.IsAbs(hostPath) {
+		return hostPath, nil
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	return resolveRelativeHostPath(hostPath, wd, d.cfg.GetBool("volume.strict_host_paths"))
+}
+
+// resolveRelativeHostPath joins the relative hostPath to wd. If strict is
+// true, an error is returned if the result is outside of wd.
+func resolveRelativeHostPath(hostPath, wd string, strict bool) (string, error) {
+	resolved := filepath.Join(wd, hostPath)
+	if strict {
+		rel, err := filepath.Rel(wd, resolved)
+		if err != nil {
+			return "", err
+		}
+		if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", fmt.Errorf("host path %s is outside of the working directory", hostPath)
+		}
+	}
+	return resolved, nil
+}
+
+// maxSymlinkHops is how many symlinks resolveBindSource follows before giving
+// up, which is the same limit Linux uses.
+const maxSymlinkHops = 40
+
+// resolveBindSource returns the absolute path p with every symlink in it
+// resolved. Unlike filepath.EvalSymlinks, it works for paths that don't exist
+// yet, since Docker creates missing bind sources, and for dangling symlinks.
+func resolveBindSource(p string) (string, error) {
+	return resolveSymlinks(filepath.Clean(p), 0)
+}
+
+func resolveSymlinks(p string, hops int) (string, error) {
+	parent := filepath.Dir(p)
+	if parent == p {
+		return p, nil
+	}
+	dir, err := resolveSymlinks(parent, hops)
+	if err != nil {
+		return "", err
+	}
+	resolved := filepath.Join(dir, filepath.Base(p))
+	info, err := os.Lstat(resolved)
+	if os.IsNotExist(err) {
+		return resolved, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return resolved, nil
+	}
+	if hops >= maxSymlinkHops {
+		return "", fmt.Errorf("too many levels of symbolic links in %s", p)
+	}
+	target, err := os.Readlink(resolved)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(dir, target)
+	}
+	return resolveSymlinks(filepath.Clean(target), hops+1)
+}
+
+// pathWithin returns true if p is root or is inside of it.
+func pathWithin(p, root string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// dockerSocket is the path to the Docker daemon's socket on the host and in
+// the step containers that are allowed to use it.
+const dockerSocket = "/var/run/docker.sock"
+
+// ErrDockerSocketNotAllowed is returned when a step asks for the Docker
+// socket, or mounts a host path that leads to it, but
+// security.allow_docker_socket isn't set.
+var ErrDockerSocketNotAllowed = errors.New("the step requested the Docker socket, which isn't allowed on this node")
+
+// dockerSocketBinds returns the bind mount for the Docker socket if the step
+// requested it. It returns ErrDockerSocketNotAllowed if the step requested it
+// and allowed is false. Mounting the socket read-only doesn't stop anything
+// from talking to the daemon, so it's mounted as is.
+func dockerSocketBinds(step *model.Step, allowed bool) ([]string, error) {
+	if !step.Component.Container.MountDockerSocket {
+		return nil, nil
+	}
+	if !allowed {
+		return nil, ErrDockerSocketNotAllowed
+	}
+	return []string{fmt.Sprintf("%s:%s", dockerSocket, dockerSocket)}, nil
+}
+
+// checkSocketBinds returns ErrDockerSocketNotAllowed if any of the host paths
+// in binds is the Docker socket or a directory that contains it, once
+// symlinks are resolved. Named volumes are skipped.
+func checkSocketBinds(binds []string, allowed bool) error {
+	if allowed {
+		return nil
+	}
+	socket, err := resolveBindSource(dockerSocket)
+	if err != nil {
+		return err
+	}
+	for _, bind := range binds {
+		source := strings.SplitN(bind, ":", 2)[0]
+		if !filepath.IsAbs(source) {
+			continue
+		}
+		resolved, err := resolveBindSource(source)
+		if err != nil {
+			return err
+		}
+		if pathWithin(socket, resolved) {
+			return ErrDockerSocketNotAllowed
+		}
+	}
+	return nil
+}
+
+// hostPathBinds returns the read-only bind mounts that place the step's host
+// path inputs into the container's working directory. The inputs are bound
+// with their symlinks resolved, and an error is returned for any that aren't
+// inside one of roots, the volume.host_path_roots setting.
+func hostPathBinds(step *model.Step, roots []string) ([]string, error) {
+	var binds []string
+	for _, input := range step.Config.Inputs {
+		if !input.IsHostPath() {
+			continue
+		}
+		source, err := CheckHostPathInput(input.Value, roots)
+		if err != nil {
+			return nil, err
+		}
+		binds = append(binds, fmt.Sprintf(
+			"%s:%s:%s",
+			source,
+			path.Join(step.Component.Container.WorkingDirectory(), input.Source()),
+			"ro",
+		))
+	}
+	return binds, nil
+}
+
+// CheckHostPathInput returns the host path input p with its symlinks resolved.
+// It returns an error if the resolved path isn't inside one of roots, the
+// volume.host_path_roots setting.
+func CheckHostPathInput(p string, roots []string) (string, error) {
+	source, err := resolveBindSource(p)
+	if err != nil {
+		return "", err
+	}
+	if !withinRoots(source, roots) {
+		return "", fmt.Errorf("host path input %s isn't in any of the directories in volume.host_path_roots", p)
+	}
+	return source, nil
+}
+
+// dataContainerBinds returns the bind mount for the data container's host
+// path. The data container's volumes end up in the steps through VolumesFrom,
+// so its host path gets the same checks as the steps' own binds: it can't
+// lead to the Docker socket unless allowSocket is true, and it has to be
+// inside one of roots, the volume.host_path_roots setting, once symlinks are
+// resolved.
+func dataContainerBinds(vf *model.VolumesFrom, roots []string, allowSocket bool) ([]string, error) {
+	if vf.HostPath == "" && vf.ContainerPath == "" {
+		return nil, nil
+	}
+	rw := "rw"
+	if vf.ReadOnly {
+		rw = "ro"
+	}
+	source := vf.HostPath
+	if filepath.IsAbs(source) {
+		if err := checkSocketBinds([]string{source}, allowSocket); err != nil {
+			return nil, err
+		}
+		resolved, err := resolveBindSource(source)
+		if err != nil {
+			return nil, err
+		}
+		if !withinRoots(resolved, roots) {
+			return nil, fmt.Errorf("data container host path %s isn't in any of the directories in volume.host_path_roots", vf.HostPath)
+		}
+		source = resolved
+	}
+	return []string{fmt.Sprintf("%s:%s:%s", source, vf.ContainerPath, rw)}, nil
+}
+
+// withinRoots returns true if the resolved path p is inside one of roots.
+// Roots that can't be resolved are skipped.
+func withinRoots(p string, roots []string) bool {
+	for _, root := range roots {
+		if strings.TrimSpace(root) == "" || !filepath.IsAbs(root) {
+			continue
+		}
+		resolved, err := resolveBindSource(root)
+		if err != nil {
+			continue
+		}
+		if pathWithin(p, resolved) {
+			return true
+		}
+	}
+	return false
+}
+
+// stagedInputsBind returns the bind mount that puts the staged inputs
+// directory into the step's working directory read-only. hostWorkDir is the
+// host directory that's mounted as the step's working directory.
+func stagedInputsBind(step *model.Step, hostWorkDir string) string {
+	return fmt.Sprintf(
+		"%s:%s:%s",
+		path.Join(hostWorkDir, INPUTSDIR),
+		path.Join(step.Component.Container.WorkingDirectory(), INPUTSDIR),
+		"ro",
+	)
+}
+
+// CreateContainerFromStep creates a container from a step in the job.
+// Returns the ID of the created container.
+func (d *Docker) CreateContainerFromStep(job *model.Job, step *model.Step) (string, error) {
+	return d.createStepContainer(
+		step,
+		job.InvocationID,
+		d.containerName(step.Component.Container.Name),
+		stepEntrypoint(step),
+		interpolateArguments(step.Arguments(), step.Environment),
+		jobDescriptionLabels(job),
+	)
+}
+
+// CreatePreCommandContainer creates a container that runs the step's
+// PreCommand. It's set up like the step's own container, so the command sees
+// the same image, environment, and working directory. Returns the ID of the
+// created container.
+func (d *Docker) CreatePreCommandContainer(job *model.Job, step *model.Step) (string, error) {
+	var name string
+	if step.Component.Container.Name != "" {
+		name = d.containerName(step.Component.Container.Name + "-pre")
+	}
+	return d.createStepContainer(
+		step,
+		job.InvocationID,
+		name,
+		interpolateArguments(step.PreCommand, step.Environment),
+		nil,
+		jobDescriptionLabels(job),
+	)
+}
+
+// createStepContainer creates a container for step named containerName that
+// runs entrypoint with cmd. jobLabels are the labels describing the job that
+// the step belongs to. Returns the ID of the created container.
+func (d *Docker) createStepContainer(step *model.Step, invID, containerName string, entrypoint, cmd []string, jobLabels map[string]string) (string, error) {
+	config := &container.Config{}
+	hostConfig := &container.HostConfig{
+		Resources: container.Resources{},
+	}
+
+	allowSocket := d.cfg.GetBool("security.allow_docker_socket")
+	socketBinds, err := dockerSocketBinds(step, allowSocket)
+	if err != nil {
+		return "", err
+	}
+
+	config.Entrypoint = entrypoint
+
+	config.Cmd = cmd
+
+	// Left empty, Docker sends SIGTERM.
+	config.StopSignal = step.Component.Container.StopSignal
+
+	hostConfig.CapAdd = step.Component.Container.CapAdd
+	hostConfig.CapDrop = step.Component.Container.CapDrop
+
+	if step.Component.Container.MemoryLimit > 0 {
+		hostConfig.Resources.Memory = step.Component.Container.MemoryLimit
+		logcabin.Info.Printf("Memory limit is %d\n", hostConfig.Resources.Memory)
+	}
+
+	if step.Component.Container.CPUShares > 0 {
+		hostConfig.Resources.CPUShares = step.Component.Container.CPUShares
+		logcabin.Info.Printf("CPUShares is %d\n", hostConfig.Resources.CPUShares)
+	}
+
+	applyNetworkMode(config, hostConfig, stepNetworkMode(step, d.cfg.GetString("job.default_network_mode")))
+
+	// Set the name of the image for the container.
+	var fullName string
+	if step.Component.Container.Image.Tag != "" {
+		fullName = fmt.Sprintf(
+			"%s:%s",
+			step.Component.Container.Image.Name,
+			step.Component.Container.Image.Tag,
+		)
+	} else {
+		fullName = step.Component.Container.Image.Name
+	}
+	config.Image = fullName
+
+	if umask := strings.TrimSpace(d.cfg.GetString("job.umask")); umask != "" {
+		if config.Entrypoint, config.Cmd, err = d.withUmask(umask, fullName, entrypoint, cmd); err != nil {
+			return "", err
+		}
+	}
+
+	for _, vf := range step.Component.Container.VolumesFrom {
+		hostConfig.VolumesFrom = append(
+			hostConfig.VolumesFrom,
+			d.containerName(fmt.Sprintf(
+				"%s-%s",
+				vf.NamePrefix,
+				invID,
+			)),
+		)
+	}
+
+	if config.Volumes == nil {
+		config.Volumes = make(map[string]struct{})
+	}
+
+	// We conflated volumes and binds. declare all of the volumes
+	// as volumes and only turn them into mounts if a source path
+	// is also set.
+	for _, vol := range step.Component.Container.Volumes {
+		// declare all of the destinations as volumes
+		config.Volumes[vol.ContainerPath] = struct{}{}
+
+		// only add the volume as a mount if the HostPath is set.
+		if vol.HostPath != "" {
+			var rw string
+			if vol.ReadOnly {
+				rw = "ro"
+			} else {
+				rw = "rw"
+			}
+			hostPath, err := d.resolveHostPath(vol.HostPath)
+			if err != nil {
+				return "", err
+			}
+			hostConfig.Binds = append(
+				hostConfig.Binds,
+				fmt.Sprintf("%s:%s:%s", hostPath, vol.ContainerPath, rw),
+			)
+		}
+	}
+
+	// Check to see if a working directory volume exists
+	hasVolume, err := d.VolumeExists(invID)
+	if err != nil {
+		return "", err
+	}
+
+	// Add the hosts working directory as a binding to the container's
+	// working directory.
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+
+	// if the working directory volume exists, use it.
+	hostWorkDir := wd
+	if hasVolume {
+		hostWorkDir = path.Join(wd, VOLUMEDIR)
+		hostConfig.Binds = append(
+			hostConfig.Binds,
+			fmt.Sprintf("%s:%s:%s", invID, step.Component.Container.WorkingDirectory(), "rw"),
+		)
+	} else {
+		// Otherwise, bind the local working directory into the container as the working directory.
+		hostConfig.Binds = append(
+			hostConfig.Binds,
+			fmt.Sprintf("%s:%s:%s", wd, step.Component.Container.WorkingDirectory(), "rw"),
+		)
+	}
+
+	if d.cfg.GetBool("transfer.stage_inputs") {
+		hostConfig.Binds = append(hostConfig.Binds, stagedInputsBind(step, hostWorkDir))
+	}
+
+	inputBinds, err := hostPathBinds(step, d.cfg.GetStringSlice("volume.host_path_roots"))
+	if err != nil {
+		return "", err
+	}
+	hostConfig.Binds = append(hostConfig.Binds, inputBinds...)
+	if err = checkSocketBinds(hostConfig.Binds, allowSocket); err != nil {
+		return "", err
+	}
+	hostConfig.Binds = append(hostConfig.Binds, socketBinds...)
+
+	logcabin.Info.Printf("Volumes: %#v", config.Volumes)
+	logcabin.Info.Printf("Binds: %#v", hostConfig.Binds)
+
+	// Add devices mounts to the container.
+	for _, dev := range step.Component.Container.Devices {
+		device := container.DeviceMapping{
+			PathOnHost:        dev.HostPath,
+			PathInContainer:   dev.ContainerPath,
+			CgroupPermissions: d.devicePermissions(dev.CgroupPermissions),
+		}
+		hostConfig.Devices = append(hostConfig.Devices, device)
+	}
+
+	// Set the default working directory in the container to the path defined in
+	// the job JSON.
+	config.WorkingDir = step.Component.Container.WorkingDirectory()
+
+	env := stripEnvironment(step.Environment, d.cfg.GetStringSlice("job.strip_env"))
+	for k, v := range env {
+		config.Env = append(config.Env, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	if gpus := step.Component.Container.GPUs; gpus > 0 {
+		if _, ok := env[gpuDevicesEnv]; !ok {
+			devices, err := gpuDevices(gpus, gpuAssigned(d.cfg))
+			if err != nil {
+				return "", err
+			}
+			config.Env = append(config.Env, fmt.Sprintf("%s=%s", gpuDevicesEnv, devices))
+		}
+		hostConfig.Runtime = gpuRuntime(d.cfg)
+	}
+
+	config.Labels = make(map[string]string)
+	config.Labels[JobLabelKey()] = invID
+	config.Labels[TypeLabelKey()] = strconv.Itoa(StepContainer)
+	if user := step.Environment["IPLANT_USER"]; user != "" {
+		config.Labels[SubmitterLabelKey()] = user
+	}
+	for k, v := range jobLabels {
+		config.Labels[k] = v
+	}
+	addCustomLabels(config.Labels, step.Labels)
+
+	hostConfig.LogConfig = logConfig(d.cfg)
+
+	logcabin.Info.Printf("hostconfig: %#v\n", hostConfig)
+	logcabin.Info.Printf("config: %#v\n", config)
+
+	response, err := d.Client.ContainerCreate(d.ctx, config, hostConfig, nil, containerName)
+	if err == nil {
+		logcabin.Info.Printf("created container %s", response.ID)
+		for _, warning := range response.Warnings {
+			logcabin.Info.Printf("Warning creating %s: %s", response.ID, warning)
+		}
+	}
+	return response.ID, err
+}
+
+// Attach will attach to a container and copy its stdout and stderr to
+// outputWriter and errorWriter. The returned channel is closed once the
+// container's output streams end and everything has been copied.
+func (d *Docker) Attach(containerID string, outputWriter, errorWriter io.Writer) (chan struct{}, error) {
+	resp, err := d.Client.ContainerAttach(
+		d.ctx,
+		containerID,
+		types.ContainerAttachOptions{
+			Stream: true,
+			Stdout: true,
+			Stderr: true,
+		},
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer resp.Close()
+		var err error
+		if _, err = stdcopy.StdCopy(outputWriter, errorWriter, resp.Reader); err != nil {
+			logcabin.Error.Print(err)
+		}
+	}()
+
+	return done, nil
+}
+
+// runContainer attaches to, starts, and waits for the container. If
+// idleTimeout is greater than zero, the container is killed if it doesn't
+// write anything to stdout or stderr for that long and ErrIdleTimeout is
+// returned. If logs.buffer_bytes is set, the output passes through buffers
+// of that size so that a slow disk drops log output instead of stalling the
+// container. If stderr is nil, both streams are written to stdout. If started
+// isn't nil, it's called once the container has started.
+func (d *Docker) runContainer(containerID string, stdout, stderr io.Writer, idleTimeout time.Duration, started func()) (int64, error) {
+	var (
+		err     error
+		watcher *idleWatcher
+	)
+
+	combined := stderr == nil
+
+	if bufferBytes := d.cfg.GetInt("logs.buffer_bytes"); bufferBytes > 0 {
+		buffers := map[string]*boundedWriter{"stdout": newBoundedWriter(stdout, bufferBytes)}
+		if !combined {
+			buffers["stderr"] = newBoundedWriter(stderr, bufferBytes)
+		}
+		defer func() {
+			for name, w := range buffers {
+				if err := w.Close(); err != nil {
+					logcabin.Error.Print(err)
+				}
+				if dropped := w.Dropped(); dropped > 0 {
+					logcabin.Warning.Printf("dropped %d bytes of %s from container %s", dropped, name, containerID)
+				}
+			}
+		}()
+		stdout = buffers["stdout"]
+		if !combined {
+			stderr = buffers["stderr"]
+		}
+	}
+
+	if combined {
+		stderr = stdout
+	}
+
+	if idleTimeout > 0 {
+		watcher = newIdleWatcher(idleTimeout, func() {
+			logcabin.Warning.Printf("container %s produced no output for %s, killing it", containerID, idleTimeout.String())
+			if err := d.Client.ContainerKill(d.ctx, containerID, "KILL"); err != nil {
+				logcabin.Error.Print(err)
+			}
+		})
+		defer watcher.Stop()
+		stdout = watcher.Writer(stdout)
+		stderr = watcher.Writer(stderr)
+	}
+
+	attached, err := d.Attach(containerID, stdout, stderr)
+	if err != nil {
+		return -1, err
+	}
+
+	//run the container
+	if err = d.Client.ContainerStart(d.ctx, containerID, types.ContainerStartOptions{}); err != nil {
+		return -1, err
+	}
+	if started != nil {
+		started()
+	}
+
+	//wait for container to exit
+	exitCode, err := d.Client.ContainerWait(d.ctx, containerID)
+
+	// The output streams end when the container exits, but the last of it may
+	// still be on its way to the writers. It has to arrive before they're
+	// closed.
+	if err == nil {
+		<-attached
+	}
+	if watcher != nil && watcher.Fired() {
+		return exitCode, ErrIdleTimeout
+	}
+	return exitCode, err
+}
+
+// StartContainer starts the container without attaching to it or waiting for
+// it to exit.
+func (d *Docker) StartContainer(containerID string) error {
+	return d.Client.ContainerStart(d.ctx, containerID, types.ContainerStartOptions{})
+}
+
+// InspectContainer returns a types.ContainerJSON with details about the container.
+func (d *Docker) InspectContainer(containerID string) (types.ContainerJSON, error) {
+	return d.Client.ContainerInspect(d.ctx, containerID)
+}
+
+// ContainerPortMapping returns a *nat.PortMap of all of the port mappings. This
+// is basically just a convenience function that calls InspectContainer and
+// roots through the return value for the port mapping.
+func (d *Docker) ContainerPortMapping(containerID string) (nat.PortMap, error) {
+	inspection, err := d.InspectContainer(containerID)
+	if err != nil {
+		return nil, err
+	}
+	if inspection.NetworkSettings == nil {
+		return nil, nil
+	}
+	return inspection.NetworkSettings.Ports, err
+}
+
+// RunStep will run the steps in a job. If a step fails, the function will
+// return with a non-zero exit code. If an error occurs, the function will
+// return with a non-zero exit code and a non-nil error. If job.idle_timeout
+// is set in the config and the step doesn't produce any output for that long,
+// the step is killed and ErrIdleTimeout is returned. ErrOOMKilled is returned
+// if the step ran out of memory. attempt starts at 1 and goes up each time the
+// step is retried. Retries append to the logs of the earlier attempts instead
+// of replacing them. If started isn't nil, it's called once the step's
+// container has started.
+func (d *Docker) RunStep(job *model.Job, step *model.Step, idx, attempt int, started func()) (int64, error) {
+	var onStart func(string)
+	if started != nil {
+		onStart = func(string) { started() }
+	}
+	return d.runStep(job, step, idx, attempt, d.cfg.GetDuration("job.idle_timeout"), onStart)
+}
+
+// RunInteractiveStep runs a step of an interactive job. It works like RunStep,
+// but the step isn't killed for being quiet, since interactive sessions can
+// go a long time without writing anything. Once the step's container has
+// started, started is called with the container's port mappings so that the
+// user can be told where to reach it.
+func (d *Docker) RunInteractiveStep(job *model.Job, step *model.Step, idx, attempt int, started func(nat.PortMap)) (int64, error) {
+	return d.runStep(job, step, idx, attempt, 0, func(containerID string) {
+		ports, err := d.ContainerPortMapping(containerID)
+		if err != nil {
+			logcabin.Error.Print(err)
+			return
+		}
+		started(ports)
+	})
+}
+
+// runStep creates and runs the step's container. If started isn't nil, it's
+// called with the container's ID once the container has started.
+func (d *Docker) runStep(job *model.Job, step *model.Step, idx, attempt int, idleTimeout time.Duration, started func(containerID string)) (int64, error) {
+	var (
+		err             error
+		wd, containerID string
+	)
+
+	if containerID, err = d.CreateContainerFromStep(job, step); err != nil {
+		return -1, err
+	}
+
+	wd, err = os.Getwd()
+	if err != nil {
+		return -1, err
+	}
+	stdoutLog, stderrLog := d.StepLogs(step, idx)
+	if d.cfg.GetBool("logs.per_step_dirs") {
+		if err = os.MkdirAll(path.Join(wd, VOLUMEDIR, StepLogDir(step, idx)), 0755); err != nil {
+			return -1, err
+		}
+	}
+	logFlags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if attempt > 1 {
+		logFlags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	stdoutpath := path.Join(wd, VOLUMEDIR, stdoutLog)
+	logcabin.Info.Printf("path to the step stdout log file: %s\n", stdoutpath)
+	stdoutFile, err := os.OpenFile(stdoutpath, logFlags, 0666)
+	if err != nil {
+		return -1, err
+	}
+	defer stdoutFile.Close()
+
+	// A nil stderr writer combines it with stdout.
+	var stderr io.Writer
+	if step.CombineOutput {
+		logcabin.Info.Printf("writing the step stderr to the stdout log file")
+	} else {
+		stderrpath := path.Join(wd, VOLUMEDIR, stderrLog)
+		logcabin.Info.Printf("path to the step stderr log file: %s\n", stderrpath)
+		stderrFile, err := os.OpenFile(stderrpath, logFlags, 0666)
+		if err != nil {
+			return -1, err
+		}
+		defer stderrFile.Close()
+		stderr = stderrFile
+	}
+
+	var onStart func()
+	if started != nil {
+		onStart = func() { started(containerID) }
+	}
+
+	exitCode, err := d.runContainer(containerID, stdoutFile, stderr, idleTimeout, onStart)
+	if err == nil && exitCode != 0 && d.oomKilled(containerID) {
+		return exitCode, ErrOOMKilled
+	}
+	return exitCode, err
+}
+
+// platformErrors are parts of the errors the Docker daemon returns when an
+// image can't be used because it was built for a different platform.
+var platformErrors = []string{
+	"does not match the specified platform",
+	"no matching manifest for",
+	"cannot be used on this platform",
+}
+
+// IsPlatformMismatch returns true if err says that a container couldn't be
+// created because its image doesn't match the node's operating system or
+// architecture.
+func IsPlatformMismatch(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, msg := range platformErrors {
+		if strings.Contains(err.Error(), msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrOOMKilled is returned when a step's container is killed because it ran
+// out of memory.
+var ErrOOMKilled = errors.New("the step's container was killed because it ran out of memory")
+
+// oomKilled returns true if the container was killed by the kernel because it
+// ran out of memory. It returns false if the container can't be inspected.
+func (d *Docker) oomKilled(containerID string) bool {
+	info, err := d.InspectContainer(containerID)
+	if err != nil {
+		logcabin.Error.Print(err)
+		return false
+	}
+	return info.ContainerJSONBase != nil && info.State != nil && info.State.OOMKilled
+}
+
+// unsafeLogDirChars matches the characters of a tool name that are left out of
+// the name of its step's log directory.
+var unsafeLogDirChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// StepLogDir returns the directory, relative to the working directory, that
+// the logs of the step at idx go in when logs are organized per step. It's
+// logs/step-<idx>-<tool name>, or logs/step-<idx> if the tool isn't named.
+func StepLogDir(step *model.Step, idx int) string {
+	dir := fmt.Sprintf("step-%d", idx)
+	if tool := strings.Trim(unsafeLogDirChars.ReplaceAllString(step.Component.Name, "_"), "_."); tool != "" {
+		dir = fmt.Sprintf("%s-%s", dir, tool)
+	}
+	return path.Join("logs", dir)
+}
+
+// StepLogs returns the paths, relative to the working directory, of the
+// stdout and stderr logs of the step at idx. If perStep is true, the logs are
+// named stdout and stderr in StepLogDir instead of sharing the logs
+// directory with every other step. Paths that the step sets itself are always
+// used as they are.
+func StepLogs(step *model.Step, idx int, perStep bool) (string, string) {
+	stepIdx := strconv.Itoa(idx)
+	stdout, stderr := step.Stdout(stepIdx), step.Stderr(stepIdx)
+	if perStep {
+		if step.StdoutPath == "" {
+			stdout = path.Join(StepLogDir(step, idx), "stdout")
+		}
+		if step.StderrPath == "" {
+			stderr = path.Join(StepLogDir(step, idx), "stderr")
+		}
+	}
+	return stdout, stderr
+}
+
+// StepLogs returns the paths, relative to the working directory, of the stdout
+// and stderr logs that the step at idx writes to, taking logs.per_step_dirs
+// into account.
+func (d *Docker) StepLogs(step *model.Step, idx int) (string, string) {
+	return StepLogs(step, idx, d.cfg.GetBool("logs.per_step_dirs"))
+}
+
+// PreCommandLog returns the path, relative to the working directory, of the
+// log file that a step's PreCommand output is written to.
+func PreCommandLog(idx int) string {
+	return path.Join("logs", fmt.Sprintf("condor-pre-command-%d", idx))
+}
+
+// SuccessCommandLog is the path, relative to the working directory, of the
+// log file that the job's SuccessCommand output is written to.
+var SuccessCommandLog = path.Join("logs", "condor-success-command")
+
+// RunSuccessCommand runs the job's SuccessCommand in a container made from
+// step, which should be the job's last step, and waits for it to finish. Its
+// stdout and stderr are written to SuccessCommandLog. If the command fails,
+// the function will return with a non-zero exit code.
+func (d *Docker) RunSuccessCommand(job *model.Job, step *model.Step) (int64, error) {
+	var name string
+	if step.Component.Container.Name != "" {
+		name = d.containerName(step.Component.Container.Name + "-success")
+	}
+	containerID, err := d.createStepContainer(
+		step,
+		job.InvocationID,
+		name,
+		interpolateArguments(job.SuccessCommand, step.Environment),
+		nil,
+		jobDescriptionLabels(job),
+	)
+	if err != nil {
+		return -1, err
+	}
+	return d.runAuxContainer(containerID, SuccessCommandLog)
+}
+
+// RunPreCommand runs the step's PreCommand in its own container and waits
+// for it to finish, writing its stdout and stderr to PreCommandLog(idx). If
+// the command fails, the function will return with a non-zero exit code.
+func (d *Docker) RunPreCommand(job *model.Job, step *model.Step, idx int) (int64, error) {
+	containerID, err := d.CreatePreCommandContainer(job, step)
+	if err != nil {
+		return -1, err
+	}
+	return d.runAuxContainer(containerID, PreCommandLog(idx))
+}
+
+// runAuxContainer runs a container that does a job's side work, like a
+// PreCommand or the SuccessCommand, and waits for it to finish. Its stdout and
+// stderr are written to logPath, which is relative to the working directory.
+func (d *Docker) runAuxContainer(containerID, logPath string) (int64, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return -1, err
+	}
+	logpath := path.Join(wd, VOLUMEDIR, logPath)
+	logcabin.Info.Printf("path to the log file for container %s: %s\n", containerID, logpath)
+	logFile, err := os.Create(logpath)
+	if err != nil {
+		return -1, err
+	}
+	defer logFile.Close()
+
+	return d.runContainer(containerID, logFile, nil, d.cfg.GetDuration("job.idle_timeout"), nil)
+}
+
+// porklockLogLevels are the porklock.log_level settings that porklock
+// understands.
+var porklockLogLevels = map[string]bool{
+	"trace": true,
+	"debug": true,
+	"info":  true,
+	"warn":  true,
+	"error": true,
+}
+
+// ValidatePorklockLogLevel returns an error if level isn't a supported
+// porklock.log_level setting. An empty level leaves porklock's default alone.
+func ValidatePorklockLogLevel(level string) error {
+	level = strings.TrimSpace(level)
+	if level != "" && !porklockLogLevels[level] {
+		return fmt.Errorf("unsupported porklock.log_level %q, must be trace, debug, info, warn, or error", level)
+	}
+	return nil
+}
+
+// porklockCommand returns a copy of args with the --log-level flag for the
+// porklock.log_level setting and the porklock.extra_args setting appended,
+// which lets sites pass flags to porklock that the job doesn't set.
+func (d *Docker) porklockCommand(args []string) []string {
+	var logLevel []string
+	if level := strings.TrimSpace(d.cfg.GetString("porklock.log_level")); level != "" {
+		logLevel = []string{"--log-level", level}
+	}
+	extra := d.cfg.GetStringSlice("porklock.extra_args")
+	retval := make([]string, 0, len(args)+len(logLevel)+len(extra))
+	retval = append(retval, args...)
+	retval = append(retval, logLevel...)
+	return append(retval, extra...)
+}
+
+// uploadModeFlags maps the supported transfer.upload_mode settings to the
+// porklock flags that select them. Overwriting is what porklock does without
+// any flags, so it's also the default when the setting is empty.
+var uploadModeFlags = map[string][]string{
+	"":              nil,
+	"overwrite":     nil,
+	"skip-existing": {"--skip-existing"},
+	"versioned":     {"--versioned"},
+}
+
+// uploadModeArgs returns the porklock flags for the transfer.upload_mode
+// setting, which decides what happens to outputs that already exist in the
+// destination. An error is returned for modes that aren't supported.
+func uploadModeArgs(mode string) ([]string, error) {
+	flags, ok := uploadModeFlags[strings.TrimSpace(mode)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported transfer.upload_mode %q, must be overwrite, skip-existing, or versioned", mode)
+	}
+	return flags, nil
+}
+
+// ValidateUploadMode returns an error if mode isn't a supported
+// transfer.upload_mode setting.
+func ValidateUploadMode(mode string) error {
+	_, err := uploadModeArgs(mode)
+	return err
+}
+
+// autoRemoveTransfers returns true if the input and output containers should
+// be removed as soon as they exit instead of being left for cleanup.
+func (d *Docker) autoRemoveTransfers() bool {
+	return d.cfg.GetBool("docker.autoremove_transfer_containers")
+}
+
+// runTransferContainer runs an input or output container with runContainer.
+// If docker.autoremove_transfer_containers is set, the container is removed
+// once its exit code has been read. Docker's AutoRemove isn't used for this,
+// since it can remove the container before the wait returns.
+func (d *Docker) runTransferContainer(containerID string, stdout, stderr io.Writer) (int64, error) {
+	exitCode, err := d.runContainer(containerID, stdout, stderr, 0, nil)
+	if d.autoRemoveTransfers() {
+		if rmErr := d.NukeContainer(containerID); rmErr != nil {
+			logcabin.Error.Print(rmErr)
+		}
+	}
+	return exitCode, err
+}
+
+// transferNetwork returns the network that the input and output containers
+// join, which is porklock.network if that's set. Sites can use it to keep the
+// transfers on an egress-controlled network that's separate from the one the
+// steps use. Docker's default network is used when it's empty.
+func (d *Docker) transferNetwork() container.NetworkMode {
+	return container.NetworkMode(strings.TrimSpace(d.cfg.GetString("porklock.network")))
+}
+
+// configDir returns the host directory mounted at CONFIGDIR in the transfer
+// containers. It's porklock.config_dir if that's set and wd otherwise. An error
+// is returned if porklock.config_dir isn't an existing directory.
+func (d *Docker) configDir(wd string) (string, error) {
+	dir := strings.TrimSpace(d.cfg.GetString("porklock.config_dir"))
+	if dir == "" {
+		return wd, nil
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return "", fmt.Errorf("porklock.config_dir: %s", err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("porklock.config_dir %s isn't a directory", dir)
+	}
+	return dir, nil
+}
+
+// PorkPull will pull the porklock image.
+func (d *Docker) PorkPull() error {
+	image := d.cfg.GetString("porklock.image")
+
+	tag := d.cfg.GetString("porklock.tag")
+
+	return d.Pull(d.ctx, image, tag)
+}
+
+// CreateDownloadContainer creates a container that can be used to download
+// input files.
+func (d *Docker) CreateDownloadContainer(job *model.Job, input *model.StepInput, idx string, attempt int) (string, error) {
+	var (
+		wd, name, image, tag string
+		response             container.ContainerCreateCreatedBody
+		err                  error
+	)
+
+	config := &container.Config{}
+	hostConfig := &container.HostConfig{
+		NetworkMode: d.transferNetwork(),
+	}
+	invID := job.InvocationID
+
+	image = d.cfg.GetString("porklock.image")
+	tag = d.cfg.GetString("porklock.tag")
+
+	if err = d.PorkPull(); err != nil {
+		return "", err
+	}
+
+	config.Image = fmt.Sprintf("%s:%s", image, tag)
+	hostConfig.LogConfig = logConfig(d.cfg)
+
+	config.WorkingDir = WORKDIR
+
+	// make sure the host working dir is mounted and make it the default
+	// working dir inside the container.
+	if wd, err = os.Getwd(); err != nil {
+		return "", err
+	}
+
+	// Check to see if a working directory volume exists
+	hasVolume, err := d.VolumeExists(invID)
+	if err != nil {
+		return "", err
+	}
+
+	// if the working directory volume exists, use it.
+	if hasVolume {
+		hostConfig.Binds = append(
+			hostConfig.Binds,
+			fmt.Sprintf("%s:%s:%s", invID, WORKDIR, "rw"),
+		)
+	} else {
+		hostConfig.Binds = append(hostConfig.Binds, fmt.Sprintf("%s:%s:%s", wd, WORKDIR, "rw"))
+	}
+
+	configDir, err := d.configDir(wd)
+	if err != nil {
+		return "", err
+	}
+	hostConfig.Binds = append(hostConfig.Binds, fmt.Sprintf("%s:%s:%s", configDir, CONFIGDIR, "rw"))
+
+	config.Labels = make(map[string]string)
+	config.Labels[JobLabelKey()] = invID
+	config.Labels[TypeLabelKey()] = strconv.Itoa(InputContainer)
+	config.Labels[SubmitterLabelKey()] = job.Submitter
+	addJobDescriptionLabels(config.Labels, job)
+	addCustomLabels(config.Labels, job.Labels)
+	if d.cfg.GetBool("transfer.stage_inputs") {
+		config.WorkingDir = path.Join(WORKDIR, INPUTSDIR)
+	}
+	args := input.Arguments(job.Submitter, job.FileMetadata)
+	if attempt > 1 && d.cfg.GetBool("transfer.resume_downloads") {
+		args = append(args, "--resume")
+	}
+	config.Cmd = d.porklockCommand(args)
+
+	logcabin.Info.Printf("hostconfig: %#v\n", hostConfig)
+	logcabin.Info.Printf("config: %#v\n", config)
+
+	name = fmt.Sprintf("input-%s-%s", idx, invID)
+	if attempt > 1 {
+		// The container from the failed attempt may not have been removed.
+		name = fmt.Sprintf("%s-retry-%d", name, attempt)
+	}
+	name = d.containerName(name)
+	if response, err = d.Client.ContainerCreate(d.ctx, config, hostConfig, nil, name); err == nil {
+		logcabin.Info.Printf("created container %s", response.ID)
+		for _, warning := range response.Warnings {
+			logcabin.Info.Printf("Warning creating %s: %s", response.ID, warning)
+		}
+	}
+	if err != nil {
+		logcabin.Error.Print(err)
+	}
+
+	return response.ID, err
+}
+
+// DownloadInputs will run the docker containers that down input files into
+// the local working directory. attempt starts at 1 and goes up each time the
+// download is retried. Retries append to the logs of the earlier attempts and
+// leave whatever those attempts downloaded in place, so that porklock can
+// resume the transfer when transfer.resume_downloads is set.
+func (d *Docker) DownloadInputs(job *model.Job, input *model.StepInput, idx, attempt int) (int64, error) {
+	var (
+		err                    error
+		wd, containerID        string
+		stdoutFile, stderrFile io.WriteCloser
+	)
+
+	inputIdx := strconv.Itoa(idx)
+
+	if containerID, err = d.CreateDownloadContainer(job, input, inputIdx, attempt); err != nil {
+		return -1, err
+	}
+
+	if wd, err = os.Getwd(); err != nil {
+		return -1, err
+	}
+
+	stdoutpath := path.Join(wd, VOLUMEDIR, input.Stdout(inputIdx))
+	logcabin.Info.Printf("creating stdout input log at %s\n", stdoutpath)
+	logFlags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if attempt > 1 {
+		logFlags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	if stdoutFile, err = os.OpenFile(stdoutpath, logFlags, 0666); err != nil {
+		return -1, err
+	}
+	defer stdoutFile.Close()
+
+	stderrpath := path.Join(wd, VOLUMEDIR, input.Stderr(inputIdx))
+	logcabin.Info.Printf("creating stderr input log at %s\n", stderrpath)
+	if stderrFile, err = os.OpenFile(stderrpath, logFlags, 0666); err != nil {
+		return -1, err
+	}
+	defer stderrFile.Close()
+
+	return d.runTransferContainer(containerID, stdoutFile, stderrFile)
+}
+
+// CreateUploadContainer will initialize a container that will be used to
+// upload job outputs into a directory in iRODS.
+func (d *Docker) CreateUploadContainer(job *model.Job) (string, error) {
+	args := job.FinalOutputArguments()
+	if d.cfg.GetBool("transfer.stage_inputs") {
+		args = excludeArguments(args, INPUTSDIR)
+	}
+	return d.createUploadContainer(job, args, fmt.Sprintf("output-%s", job.InvocationID))
+}
+
+// excludeArguments returns a copy of the porklock arguments with p added to
+// the --exclude list, which is added if it isn't there already.
+func excludeArguments(args []string, p string) []string {
+	retval := append([]string(nil), args...)
+	for i := 0; i < len(retval)-1; i++ {
+		if retval[i] == "--exclude" {
+			retval[i+1] = fmt.Sprintf("%s,%s", retval[i+1], p)
+			return retval
+		}
+	}
+	return append(retval, "--exclude", p)
+}
+
+// stepOutputArguments returns the porklock arguments for uploading a single
+// file or directory in the working directory to the job's output directory.
+func stepOutputArguments(job *model.Job, source string) []string {
+	retval := []string{
+		"put",
+		"--user", job.Submitter,
+		"--config", "/configs/irods-config",
+		"--destination", job.OutputDirectory(),
+		"--source", source,
+	}
+	for _, m := range model.MetadataArgs(job.FileMetadata).FileMetadataArguments() {
+		retval = append(retval, m)
+	}
+	if job.SkipParentMetadata {
+		retval = append(retval, "--skip-parent-meta")
+	}
+	return retval
+}
+
+// CreateStepOutputContainer will initialize a container that will be used to
+// upload a single file or directory from the working directory into the job's
+// output directory in iRODS. The source path is relative to the working
+// directory.
+func (d *Docker) CreateStepOutputContainer(job *model.Job, source, suffix string) (string, error) {
+	return d.createUploadContainer(job, stepOutputArguments(job, source), fmt.Sprintf("output-%s-%s", suffix, job.InvocationID))
+}
+
+func (d *Docker) createUploadContainer(job *model.Job, cmd []string, name string) (string, error) {
+	var (
+		err            error
+		image, tag, wd string
+		response       container.ContainerCreateCreatedBody
+	)
+
+	config := &container.Config{}
+	hostConfig := &container.HostConfig{
+		NetworkMode: d.transferNetwork(),
+	}
+	invID := job.InvocationID
+
+	image = d.cfg.GetString("porklock.image")
+	tag = d.cfg.GetString("porklock.tag")
+
+	if err = d.PorkPull(); err != nil {
+		return "", err
+	}
+
+	config.Image = fmt.Sprintf("%s:%s", image, tag)
+	hostConfig.LogConfig = logConfig(d.cfg)
+
+	config.WorkingDir = WORKDIR
+
+	if wd, err = os.Getwd(); err != nil {
+		return "", err
+	}
+
+	// Check to see if a working directory volume exists
+	hasVolume, err := d.VolumeExists(invID)
+	if err != nil {
+		return "", err
+	}
+
+	// if the working directory volume exists, use it.
+	if hasVolume {
+		hostConfig.Binds = append(
+			hostConfig.Binds,
+			fmt.Sprintf("%s:%s:%s", invID, WORKDIR, "rw"),
+		)
+	} else {
+		hostConfig.Binds = append(hostConfig.Binds, fmt.Sprintf("%s:%s:%s", wd, WORKDIR, "rw"))
+	}
+
+	configDir, err := d.configDir(wd)
+	if err != nil {
+		return "", err
+	}
+	hostConfig.Binds = append(hostConfig.Binds, fmt.Sprintf("%s:%s:%s", configDir, CONFIGDIR, "rw"))
+
+	config.Labels = make(map[string]string)
+	config.Labels[JobLabelKey()] = job.InvocationID
+	config.Labels[TypeLabelKey()] = strconv.Itoa(OutputContainer)
+	config.Labels[SubmitterLabelKey()] = job.Submitter
+	addJobDescriptionLabels(config.Labels, job)
+	addCustomLabels(config.Labels, job.Labels)
+
+	modeArgs, err := uploadModeArgs(d.cfg.GetString("transfer.upload_mode"))
+	if err != nil {
+		return "", err
+	}
+	config.Cmd = d.porklockCommand(append(append([]string(nil), cmd...), modeArgs...))
+	name = d.containerName(name)
+
+	logcabin.Info.Printf("hostconfig: %#v\n", hostConfig)
+	logcabin.Info.Printf("config: %#v\n", config)
+
+	if response, err = d.Client.ContainerCreate(d.ctx, config, hostConfig, nil, name); err == nil {
+		logcabin.Info.Printf("created container %s", response.ID)
+		for _, warning := range response.Warnings {
+			logcabin.Info.Printf("Warning creating %s: %s", response.ID, warning)
+		}
+	}
+	if err != nil {
+		logcabin.Error.Print(err)
+	}
+
+	return response.ID, err
+}
+
+// UploadOutputs will upload files to iRODS from the local working directory.
+func (d *Docker) UploadOutputs(job *model.Job) (int64, error) {
+	var (
+		err                    error
+		wd, containerID        string
+		stdoutFile, stderrFile io.WriteCloser
+	)
+	if containerID, err = d.CreateUploadContainer(job); err != nil {
+		return -1, err
+	}
+
+	if wd, err = os.Getwd(); err != nil {
+		return -1, err
+	}
+
+	stdoutpath := path.Join(wd, VOLUMEDIR, "logs", "logs-stdout-output")
+	logcabin.Info.Printf("path to the output stdout file: %s\n", stdoutpath)
+	if stdoutFile, err = os.Create(stdoutpath); err != nil {
+		return -1, err
+	}
+	defer stdoutFile.Close()
+
+	stderrpath := path.Join(wd, VOLUMEDIR, "logs", "logs-stderr-output")
+	logcabin.Info.Printf("path to the output stderr file: %s\n", stderrpath)
+	if stderrFile, err = os.Create(stderrpath); err != nil {
+		return -1, err
+	}
+	defer stderrFile.Close()
+
+	return d.runTransferContainer(containerID, stdoutFile, stderrFile)
+}
+
+// UploadStepOutput will upload a single file or directory from the local
+// working directory to the job's output directory in iRODS. The suffix is used
+// to keep the container and log file names unique within the job.
+func (d *Docker) UploadStepOutput(job *model.Job, source, suffix string) (int64, error) {
+	var (
+		err         error
+		containerID string
+	)
+	if containerID, err = d.CreateStepOutputContainer(job, source, suffix); err != nil {
+		return -1, err
+	}
+	return d.runUploadContainer(containerID, fmt.Sprintf("output-%s", suffix))
+}
+
+// runUploadContainer runs the upload container, writing its stdout and stderr
+// to logs-stdout-<logName> and logs-stderr-<logName> in the logs directory.
+func (d *Docker) runUploadContainer(containerID, logName string) (int64, error) {
+	var (
+		err                    error
+		wd                     string
+		stdoutFile, stderrFile io.WriteCloser
+	)
+
+	if wd, err = os.Getwd(); err != nil {
+		return -1, err
+	}
+
+	stdoutpath := path.Join(wd, VOLUMEDIR, "logs", fmt.Sprintf("logs-stdout-%s", logName))
+	logcabin.Info.Printf("path to the upload stdout file: %s\n", stdoutpath)
+	if stdoutFile, err = os.Create(stdoutpath); err != nil {
+		return -1, err
+	}
+	defer stdoutFile.Close()
+
+	stderrpath := path.Join(wd, VOLUMEDIR, "logs", fmt.Sprintf("logs-stderr-%s", logName))
+	logcabin.Info.Printf("path to the upload stderr file: %s\n", stderrpath)
+	if stderrFile, err = os.Create(stderrpath); err != nil {
+		return -1, err
+	}
+	defer stderrFile.Close()
+
+	return d.runTransferContainer(containerID, stdoutFile, stderrFile)
+}
+
+// debugArchiveArguments returns the porklock arguments for uploading the
+// working directory archive to dest. The archive doesn't get the job's
+// metadata since it isn't one of the job's outputs.
+func debugArchiveArguments(job *model.Job, source, dest string) []string {
+	return []string{
+		"put",
+		"--user", job.Submitter,
+		"--config", "/configs/irods-config",
+		"--destination", dest,
+		"--source", source,
+	}
+}
+
+// UploadDebugArchive uploads source, a file in the working directory, to the
+// iRODS collection dest.
+func (d *Docker) UploadDebugArchive(job *model.Job, source, dest string) (int64, error) {
+	containerID, err := d.createUploadContainer(job, debugArchiveArguments(job, source, dest), fmt.Sprintf("debug-%s", job.InvocationID))
+	if err != nil {
+		return -1, err
+	}
+	return d.runUploadContainer(containerID, "debug")
+}
+
+// CreateDataContainer will create a data container that is required for the job.
+func (d *Docker) CreateDataContainer(vf *model.VolumesFrom, invID string) (string, error) {
+	var (
+		err      error
+		name     string
+		response container.ContainerCreateCreatedBody
+	)
+
+	config := &container.Config{}
+	hostConfig := &container.HostConfig{}
+
+	config.Image = vf.ImageRef()
+	hostConfig.LogConfig = logConfig(d.cfg)
+
+	config.Labels = make(map[string]string)
+	config.Labels[JobLabelKey()] = invID
+	config.Labels[TypeLabelKey()] = strconv.Itoa(DataContainer)
+
+	binds, err := dataContainerBinds(
+		vf,
+		d.cfg.GetStringSlice("volume.host_path_roots"),
+		d.cfg.GetBool("security.allow_docker_socket"),
+	)
+	if err != nil {
+		return "", err
+	}
+	hostConfig.Binds = append(hostConfig.Binds, binds...)
+
+	// Services run the image's own command.
+	if !vf.Service {
+		config.Cmd = []string{"/bin/true"}
+	}
+	name = d.containerName(fmt.Sprintf("%s-%s", vf.NamePrefix, invID))
+	if response, err = d.Client.ContainerCreate(d.ctx, config, hostConfig, nil, name); err != nil {
+		return "", err
+	}
+	logcabin.Info.Printf("created container %s", response.ID)
+	for _, warning := range response.Warnings {
+		logcabin.Info.Printf("Warning creating %s: %s", response.ID, warning)
+	}
+
+	return response.ID, nil
+}
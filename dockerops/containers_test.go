@@ -0,0 +1,589 @@
+package dockerops
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/road-runner/model"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/spf13/viper"
+)
+
+func TestInterpolateArguments(t *testing.T) {
+	env := model.StepEnvironment{
+		"IPLANT_USER":         "ipcdev",
+		"IPLANT_EXECUTION_ID": "07b04ce2",
+	}
+
+	t.Run("known variables are expanded", func(t *testing.T) {
+		actual := interpolateArguments([]string{"--user", "${IPLANT_USER}", "out-${IPLANT_EXECUTION_ID}.txt"}, env)
+		expected := []string{"--user", "ipcdev", "out-07b04ce2.txt"}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("arguments were %#v instead of %#v", actual, expected)
+		}
+	})
+
+	t.Run("unknown variables are left alone", func(t *testing.T) {
+		actual := interpolateArguments([]string{"${HOME}/${IPLANT_USER}", "$IPLANT_USER"}, env)
+		expected := []string{"${HOME}/ipcdev", "$IPLANT_USER"}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("arguments were %#v instead of %#v", actual, expected)
+		}
+	})
+}
+
+func TestDirMode(t *testing.T) {
+	cases := []struct {
+		setting  string
+		expected os.FileMode
+		valid    bool
+	}{
+		{"", defaultDirMode, true},
+		{"0775", 0775, true},
+		{"700", 0700, true},
+		{"0999", 0, false},
+		{"rwxr-xr-x", 0, false},
+		{"01777", 0, false},
+	}
+	for _, c := range cases {
+		cfg := viper.New()
+		cfg.Set("volume.dir_mode", c.setting)
+		actual, err := dirMode(cfg)
+		if c.valid && err != nil {
+			t.Errorf("dir_mode %q returned an error: %s", c.setting, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("dir_mode %q didn't return an error", c.setting)
+		}
+		if actual != c.expected {
+			t.Errorf("dir_mode %q was parsed as %o instead of %o", c.setting, actual, c.expected)
+		}
+	}
+}
+
+func TestMakeVolumeDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockerops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := viper.New()
+	cfg.Set("volume.dir_mode", "0770")
+	mode, err := dirMode(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := path.Join(dir, VOLUMEDIR)
+	if err = makeVolumeDir(p, mode); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0770 {
+		t.Errorf("mode was %o instead of %o", info.Mode().Perm(), 0770)
+	}
+}
+
+func TestLogConfig(t *testing.T) {
+	t.Run("defaults to none", func(t *testing.T) {
+		lc := logConfig(viper.New())
+		if lc.Type != "none" || lc.Config != nil {
+			t.Errorf("log config was %#v", lc)
+		}
+	})
+
+	t.Run("options are ignored without a driver", func(t *testing.T) {
+		cfg := viper.New()
+		cfg.Set("docker.log_opts", map[string]string{"max-size": "10m"})
+		lc := logConfig(cfg)
+		if lc.Type != "none" || lc.Config != nil {
+			t.Errorf("log config was %#v", lc)
+		}
+	})
+
+	t.Run("driver and options", func(t *testing.T) {
+		cfg := viper.New()
+		cfg.Set("docker.log_driver", "json-file")
+		cfg.Set("docker.log_opts", map[string]string{"max-size": "10m"})
+		lc := logConfig(cfg)
+		expected := container.LogConfig{Type: "json-file", Config: map[string]string{"max-size": "10m"}}
+		if !reflect.DeepEqual(lc, expected) {
+			t.Errorf("log config was %#v instead of %#v", lc, expected)
+		}
+	})
+}
+
+func TestGPUDevices(t *testing.T) {
+	cases := []struct {
+		count    int
+		assigned string
+		expected string
+	}{
+		{1, "", "0"},
+		{3, "", "0,1,2"},
+		{1, "2,3", "2"},
+		{2, "2, 3", "2,3"},
+		{2, "CUDA1,CUDA3", "1,3"},
+		{1, "GPU-5f3a,GPU-9c1e", "GPU-5f3a"},
+	}
+	for _, c := range cases {
+		actual, err := gpuDevices(c.count, c.assigned)
+		if err != nil {
+			t.Errorf("gpuDevices(%d, %q) returned %s", c.count, c.assigned, err)
+			continue
+		}
+		if actual != c.expected {
+			t.Errorf("gpuDevices(%d, %q) was %q instead of %q", c.count, c.assigned, actual, c.expected)
+		}
+	}
+	if _, err := gpuDevices(2, "1"); err == nil {
+		t.Error("requesting more GPUs than were assigned didn't return an error")
+	}
+}
+
+func TestGPURuntime(t *testing.T) {
+	cfg := viper.New()
+	if actual := gpuRuntime(cfg); actual != "nvidia" {
+		t.Errorf("default runtime was %q instead of %q", actual, "nvidia")
+	}
+	cfg.Set("gpu.runtime", "nvidia-experimental")
+	if actual := gpuRuntime(cfg); actual != "nvidia-experimental" {
+		t.Errorf("runtime was %q instead of %q", actual, "nvidia-experimental")
+	}
+}
+
+func TestStepNetworkMode(t *testing.T) {
+	step := &model.Step{}
+	if actual := stepNetworkMode(step, "none"); actual != "none" {
+		t.Errorf("network mode was %q instead of the default", actual)
+	}
+	if actual := stepNetworkMode(step, ""); actual != "" {
+		t.Errorf("network mode was %q instead of empty", actual)
+	}
+
+	step.Component.Container.NetworkMode = "bridge"
+	if actual := stepNetworkMode(step, "none"); actual != "bridge" {
+		t.Errorf("network mode was %q instead of the step's mode", actual)
+	}
+}
+
+func TestApplyNetworkMode(t *testing.T) {
+	cases := []struct {
+		mode            string
+		expectedMode    container.NetworkMode
+		disabled        bool
+		publishAllPorts bool
+	}{
+		{"", "", false, true},
+		{"bridge", "bridge", false, true},
+		{"none", "none", true, false},
+	}
+	for _, c := range cases {
+		config := &container.Config{}
+		hostConfig := &container.HostConfig{}
+		applyNetworkMode(config, hostConfig, c.mode)
+		if hostConfig.NetworkMode != c.expectedMode {
+			t.Errorf("%q: NetworkMode was %q instead of %q", c.mode, hostConfig.NetworkMode, c.expectedMode)
+		}
+		if config.NetworkDisabled != c.disabled {
+			t.Errorf("%q: NetworkDisabled was %t instead of %t", c.mode, config.NetworkDisabled, c.disabled)
+		}
+		if hostConfig.PublishAllPorts != c.publishAllPorts {
+			t.Errorf("%q: PublishAllPorts was %t instead of %t", c.mode, hostConfig.PublishAllPorts, c.publishAllPorts)
+		}
+	}
+}
+
+func TestResolveRelativeHostPath(t *testing.T) {
+	cases := []struct {
+		hostPath string
+		strict   bool
+		expected string
+		fails    bool
+	}{
+		{"data", false, "/work/data", false},
+		{"./data/refs", true, "/work/data/refs", false},
+		{"data/../refs", true, "/work/refs", false},
+		{"../etc", false, "/etc", false},
+		{"../etc", true, "", true},
+		{"data/../../etc", true, "", true},
+		{"..", true, "", true},
+	}
+	for _, c := range cases {
+		actual, err := resolveRelativeHostPath(c.hostPath, "/work", c.strict)
+		if c.fails {
+			if err == nil {
+				t.Errorf("%s wasn't rejected in strict mode", c.hostPath)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s returned an error: %s", c.hostPath, err)
+		}
+		if actual != c.expected {
+			t.Errorf("%s resolved to %s instead of %s", c.hostPath, actual, c.expected)
+		}
+	}
+}
+
+func TestHostPathBinds(t *testing.T) {
+	step := &model.Step{}
+	step.Config.Inputs = []model.StepInput{
+		{Type: model.HostPathType, Value: "/nfs/datasets/reads.fq"},
+		{Type: "FileInput", Value: "/iplant/home/ipcdev/other.txt"},
+	}
+	actual, err := hostPathBinds(step, []string{"/scratch", "/nfs/datasets"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"/nfs/datasets/reads.fq:/de-app-work/reads.fq:ro"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("binds were %#v instead of %#v", actual, expected)
+	}
+
+	for _, roots := range [][]string{nil, {"/nfs/datasets/reads"}, {"nfs"}} {
+		if _, err = hostPathBinds(step, roots); err == nil {
+			t.Errorf("the input was allowed with the roots %#v", roots)
+		}
+	}
+}
+
+func TestDataContainerBinds(t *testing.T) {
+	vf := &model.VolumesFrom{HostPath: "/nfs/reference", ContainerPath: "/reference", ReadOnly: true}
+	actual, err := dataContainerBinds(vf, []string{"/nfs"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"/nfs/reference:/reference:ro"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("binds were %#v instead of %#v", actual, expected)
+	}
+
+	for _, roots := range [][]string{nil, {"/nfs/reference/genomes"}, {"nfs"}} {
+		if _, err = dataContainerBinds(vf, roots, false); err == nil {
+			t.Errorf("the host path was allowed with the roots %#v", roots)
+		}
+	}
+
+	if actual, err = dataContainerBinds(&model.VolumesFrom{Name: "discoenv/blast-db"}, nil, false); err != nil || actual != nil {
+		t.Errorf("a data container without a host path got the binds %#v and error %v", actual, err)
+	}
+}
+
+func TestHostPathBindsSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "host-paths")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(dir, "datasets")
+	if err = os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(root, "reads.fq"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "secret"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink(filepath.Join(root, "reads.fq"), filepath.Join(dir, "reads-link.fq")); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink("../secret", filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	step := &model.Step{}
+	step.Config.Inputs = []model.StepInput{{Type: model.HostPathType, Value: filepath.Join(dir, "reads-link.fq")}}
+	actual, err := hostPathBinds(step, []string{root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{filepath.Join(root, "reads.fq") + ":/de-app-work/reads-link.fq:ro"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("binds were %#v instead of %#v", actual, expected)
+	}
+
+	step.Config.Inputs[0].Value = filepath.Join(root, "escape")
+	if _, err = hostPathBinds(step, []string{root}); err == nil {
+		t.Error("a symlink out of the root was allowed")
+	}
+}
+
+func TestResolveBindSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bind-source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink(filepath.Join(dir, "missing", "target"), filepath.Join(dir, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink("loop", filepath.Join(dir, "loop")); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		path     string
+		expected string
+		fails    bool
+	}{
+		{"/", "/", false},
+		{filepath.Join(dir, "new", "dir"), filepath.Join(dir, "new", "dir"), false},
+		{filepath.Join(dir, "dangling"), filepath.Join(dir, "missing", "target"), false},
+		{filepath.Join(dir, "dangling", "..", "x"), filepath.Join(dir, "x"), false},
+		{filepath.Join(dir, "loop"), "", true},
+	}
+	for _, c := range cases {
+		actual, err := resolveBindSource(c.path)
+		if (err != nil) != c.fails {
+			t.Errorf("%s: err was %v", c.path, err)
+		}
+		if actual != c.expected {
+			t.Errorf("%s resolved to %q instead of %q", c.path, actual, c.expected)
+		}
+	}
+}
+
+func TestCreateContainerFromStepStopSignal(t *testing.T) {
+	daemon := newFakeDaemon(map[string]string{
+		"GET /volumes":            `{"Volumes": []}`,
+		"POST /containers/create": `{"Id": "step-container"}`,
+	})
+	defer daemon.Close()
+	d := newTestDocker(t, daemon, nil)
+
+	step := &model.Step{}
+	step.Component.Container.StopSignal = "SIGINT"
+	if _, err := d.CreateContainerFromStep(&model.Job{InvocationID: "invocation"}, step); err != nil {
+		t.Fatal(err)
+	}
+
+	req, ok := daemon.request("POST", "/containers/create")
+	if !ok {
+		t.Fatal("container wasn't created")
+	}
+	var body struct {
+		StopSignal string
+	}
+	if err := json.Unmarshal(req.Body, &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.StopSignal != "SIGINT" {
+		t.Errorf("StopSignal was %q instead of %q", body.StopSignal, "SIGINT")
+	}
+}
+
+func TestCreateVolumeRetries(t *testing.T) {
+	defer func(b time.Duration) { volumeCreateBackoff = b }(volumeCreateBackoff)
+	volumeCreateBackoff = time.Millisecond
+
+	daemon := newFakeDaemon(map[string]string{
+		"POST /volumes/create": `{"Name": "invocation", "Driver": "local"}`,
+	})
+	daemon.failures["POST /volumes/create"] = 1
+	defer daemon.Close()
+	d := newTestDocker(t, daemon, nil)
+
+	v, err := d.createVolume(volume.VolumesCreateBody{Name: "invocation", Driver: "local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Name != "invocation" {
+		t.Errorf("volume name was %q instead of %q", v.Name, "invocation")
+	}
+	if n := daemon.count("POST", "/volumes/create"); n != 2 {
+		t.Errorf("VolumeCreate was called %d times instead of 2", n)
+	}
+}
+
+func TestCreateVolumeGivesUp(t *testing.T) {
+	defer func(b time.Duration) { volumeCreateBackoff = b }(volumeCreateBackoff)
+	volumeCreateBackoff = time.Millisecond
+
+	daemon := newFakeDaemon(nil)
+	daemon.failures["POST /volumes/create"] = volumeCreateAttempts + 1
+	defer daemon.Close()
+	d := newTestDocker(t, daemon, nil)
+
+	if _, err := d.createVolume(volume.VolumesCreateBody{Name: "invocation"}); err == nil {
+		t.Error("no error was returned after every attempt failed")
+	}
+	if n := daemon.count("POST", "/volumes/create"); n != volumeCreateAttempts {
+		t.Errorf("VolumeCreate was called %d times instead of %d", n, volumeCreateAttempts)
+	}
+}
+
+func TestCreateVolumeAlreadyExists(t *testing.T) {
+	daemon := newFakeDaemon(map[string]string{
+		"POST /volumes/create":    `{"message": "volume invocation already exists"}`,
+		"GET /volumes/invocation": `{"Name": "invocation", "Driver": "local"}`,
+	})
+	daemon.statuses["POST /volumes/create"] = http.StatusConflict
+	defer daemon.Close()
+	d := newTestDocker(t, daemon, nil)
+
+	v, err := d.createVolume(volume.VolumesCreateBody{Name: "invocation"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Name != "invocation" {
+		t.Errorf("volume name was %q instead of %q", v.Name, "invocation")
+	}
+	if n := daemon.count("POST", "/volumes/create"); n != 1 {
+		t.Errorf("VolumeCreate was called %d times instead of once", n)
+	}
+}
+
+func TestCreateDataContainerImageRef(t *testing.T) {
+	cases := []struct {
+		vf       model.VolumesFrom
+		expected string
+	}{
+		{model.VolumesFrom{Name: "discoenv/ref-genome", Tag: "latest", Digest: "sha256:locked"}, "discoenv/ref-genome@sha256:locked"},
+		{model.VolumesFrom{Name: "discoenv/blast-db", Tag: "1.0"}, "discoenv/blast-db:1.0"},
+	}
+	for _, c := range cases {
+		daemon := newFakeDaemon(map[string]string{
+			"POST /containers/create": `{"Id": "data-container"}`,
+		})
+		d := newTestDocker(t, daemon, nil)
+
+		if _, err := d.CreateDataContainer(&c.vf, "invocation"); err != nil {
+			t.Fatal(err)
+		}
+		req, ok := daemon.request("POST", "/containers/create")
+		if !ok {
+			t.Fatal("container wasn't created")
+		}
+		var body struct {
+			Image string
+		}
+		if err := json.Unmarshal(req.Body, &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Image != c.expected {
+			t.Errorf("image was %q instead of %q", body.Image, c.expected)
+		}
+		daemon.Close()
+	}
+}
+
+func TestCreateWorkingDirVolumeDriver(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "volume-driver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	cases := []struct {
+		settings map[string]interface{}
+		driver   string
+		opts     map[string]string
+	}{
+		{
+			nil,
+			"local",
+			map[string]string{"type": "none", "device": path.Join(dir, VOLUMEDIR), "o": "bind"},
+		},
+		{
+			map[string]interface{}{
+				"volume.driver":      "nfs-csi",
+				"volume.driver_opts": map[string]interface{}{"share": "/exports/jobs", "server": "nfs.example.org"},
+			},
+			"nfs-csi",
+			map[string]string{"share": "/exports/jobs", "server": "nfs.example.org"},
+		},
+	}
+	for _, c := range cases {
+		daemon := newFakeDaemon(map[string]string{
+			"POST /volumes/create": `{"Name": "invocation"}`,
+		})
+		cfg := viper.New()
+		for k, v := range c.settings {
+			cfg.Set(k, v)
+		}
+		d := newTestDocker(t, daemon, cfg)
+
+		if _, err = d.CreateWorkingDirVolume("invocation"); err != nil {
+			t.Fatal(err)
+		}
+		req, ok := daemon.request("POST", "/volumes/create")
+		if !ok {
+			t.Fatal("the volume wasn't created")
+		}
+		var body volume.VolumesCreateBody
+		if err = json.Unmarshal(req.Body, &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Driver != c.driver {
+			t.Errorf("driver was %q instead of %q", body.Driver, c.driver)
+		}
+		if !reflect.DeepEqual(body.DriverOpts, c.opts) {
+			t.Errorf("driver options were %#v instead of %#v", body.DriverOpts, c.opts)
+		}
+		daemon.Close()
+	}
+}
+
+func TestCreateDataContainerService(t *testing.T) {
+	daemon := newFakeDaemon(map[string]string{
+		"POST /containers/create": `{"Id": "data-container"}`,
+	})
+	defer daemon.Close()
+	cfg := viper.New()
+	cfg.Set("docker.autoremove_transfer_containers", true)
+	d := newTestDocker(t, daemon, cfg)
+
+	vf := &model.VolumesFrom{Name: "postgres", Tag: "9.6", Service: true}
+	if _, err := d.CreateDataContainer(vf, "invocation"); err != nil {
+		t.Fatal(err)
+	}
+	req, ok := daemon.request("POST", "/containers/create")
+	if !ok {
+		t.Fatal("container wasn't created")
+	}
+	var body struct {
+		Cmd        []string
+		HostConfig struct {
+			AutoRemove bool
+		}
+	}
+	if err := json.Unmarshal(req.Body, &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Cmd) != 0 {
+		t.Errorf("the service's command was overridden with %#v", body.Cmd)
+	}
+	if body.HostConfig.AutoRemove {
+		t.Error("the service container is removed automatically")
+	}
+}
@@ -0,0 +1,118 @@
+package dockerops
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// apiVersion matches the version prefix that the docker client adds to paths.
+var apiVersion = regexp.MustCompile(`^/v[0-9.]+`)
+
+// daemonRequest is a request received by the fakeDaemon.
+type daemonRequest struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Body   []byte
+}
+
+// fakeDaemon is a stand-in for the Docker daemon's HTTP API. Requests are
+// recorded and answered with the canned response for "METHOD /path", or with
+// an empty JSON object when there isn't one. The status code for a route can
+// be set in statuses; it defaults to 200. A route with a count in failures
+// returns a 500 error that many times before it starts succeeding.
+type fakeDaemon struct {
+	server    *httptest.Server
+	responses map[string]string
+	statuses  map[string]int
+	failures  map[string]int
+	mutex     sync.Mutex
+	requests  []daemonRequest
+}
+
+func newFakeDaemon(responses map[string]string) *fakeDaemon {
+	f := &fakeDaemon{responses: responses, statuses: make(map[string]int), failures: make(map[string]int)}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	return f
+}
+
+func (f *fakeDaemon) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	p := apiVersion.ReplaceAllString(r.URL.Path, "")
+
+	route := r.Method + " " + p
+
+	f.mutex.Lock()
+	f.requests = append(f.requests, daemonRequest{Method: r.Method, Path: p, Query: r.URL.Query(), Body: body})
+	failing := f.failures[route] > 0
+	if failing {
+		f.failures[route]--
+	}
+	f.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if failing {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message": "driver is busy"}`))
+		return
+	}
+	if status, ok := f.statuses[route]; ok {
+		w.WriteHeader(status)
+	}
+	if resp, ok := f.responses[route]; ok {
+		w.Write([]byte(resp))
+		return
+	}
+	w.Write([]byte("{}"))
+}
+
+// count returns the number of requests received for the method and path.
+func (f *fakeDaemon) count(method, p string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var n int
+	for _, r := range f.requests {
+		if r.Method == method && r.Path == p {
+			n++
+		}
+	}
+	return n
+}
+
+// request returns the first recorded request matching the method and path.
+func (f *fakeDaemon) request(method, p string) (daemonRequest, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, r := range f.requests {
+		if r.Method == method && r.Path == p {
+			return r, true
+		}
+	}
+	return daemonRequest{}, false
+}
+
+// Close shuts down the fake daemon.
+func (f *fakeDaemon) Close() {
+	f.server.Close()
+}
+
+// newTestDocker returns a *Docker that talks to the fake daemon.
+func newTestDocker(t *testing.T, f *fakeDaemon, cfg *viper.Viper) *Docker {
+	if cfg == nil {
+		cfg = viper.New()
+	}
+	cl, err := NewDockerClient("tcp://"+strings.TrimPrefix(f.server.URL, "http://"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewDocker(context.Background(), cfg, cl)
+}
@@ -0,0 +1,79 @@
+package dockerops
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrIdleTimeout is returned when a container is killed because it didn't
+// write anything to stdout or stderr within the configured idle timeout.
+var ErrIdleTimeout = errors.New("container produced no output within the idle timeout")
+
+// idleWatcher calls a function when none of the writers that it wraps have
+// been written to within the timeout. Every write resets the clock.
+type idleWatcher struct {
+	timeout time.Duration
+	timer   *time.Timer
+	mutex   sync.Mutex
+	fired   bool
+	stopped bool
+}
+
+// newIdleWatcher returns a started *idleWatcher that calls onIdle once if
+// nothing is written for the duration of timeout.
+func newIdleWatcher(timeout time.Duration, onIdle func()) *idleWatcher {
+	w := &idleWatcher{timeout: timeout}
+	w.timer = time.AfterFunc(timeout, func() {
+		w.mutex.Lock()
+		if w.stopped {
+			w.mutex.Unlock()
+			return
+		}
+		w.fired = true
+		w.mutex.Unlock()
+		onIdle()
+	})
+	return w
+}
+
+// touch resets the idle clock.
+func (w *idleWatcher) touch() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.fired || w.stopped {
+		return
+	}
+	w.timer.Reset(w.timeout)
+}
+
+// Stop prevents the watcher from firing.
+func (w *idleWatcher) Stop() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.stopped = true
+	w.timer.Stop()
+}
+
+// Fired returns true if the watcher called its idle function.
+func (w *idleWatcher) Fired() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.fired
+}
+
+// Writer wraps dst so that writes to it reset the idle clock.
+func (w *idleWatcher) Writer(dst io.Writer) io.Writer {
+	return &activityWriter{watcher: w, dst: dst}
+}
+
+type activityWriter struct {
+	watcher *idleWatcher
+	dst     io.Writer
+}
+
+func (a *activityWriter) Write(p []byte) (int, error) {
+	a.watcher.touch()
+	return a.dst.Write(p)
+}
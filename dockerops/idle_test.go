@@ -0,0 +1,55 @@
+package dockerops
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestIdleWatcher(t *testing.T) {
+	t.Run("fires when the pipe goes silent", func(t *testing.T) {
+		reader, writer := io.Pipe()
+		defer reader.Close()
+		go io.Copy(ioutil.Discard, reader)
+
+		idle := make(chan bool, 1)
+		watcher := newIdleWatcher(100*time.Millisecond, func() {
+			idle <- true
+		})
+		defer watcher.Stop()
+		w := watcher.Writer(writer)
+
+		for i := 0; i < 5; i++ {
+			if _, err := w.Write([]byte("output\n")); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		if watcher.Fired() {
+			t.Fatal("watcher fired while output was still being written")
+		}
+
+		select {
+		case <-idle:
+		case <-time.After(3 * time.Second):
+			t.Fatal("idle timeout wasn't triggered")
+		}
+		if !watcher.Fired() {
+			t.Error("Fired() returned false after the idle function was called")
+		}
+	})
+
+	t.Run("stopped watcher doesn't fire", func(t *testing.T) {
+		idle := make(chan bool, 1)
+		watcher := newIdleWatcher(50*time.Millisecond, func() {
+			idle <- true
+		})
+		watcher.Stop()
+		select {
+		case <-idle:
+			t.Error("stopped watcher fired")
+		case <-time.After(200 * time.Millisecond):
+		}
+	})
+}
@@ -0,0 +1,131 @@
+package dockerops
+
+import (
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/cyverse-de/logcabin"
+	"github.com/cyverse-de/road-runner/model"
+)
+
+// DefaultLabelNamespace is the prefix of the label keys applied to containers
+// when labels.namespace isn't set.
+const DefaultLabelNamespace = "org.iplantc"
+
+var (
+	labelNamespace      = DefaultLabelNamespace
+	labelNamespaceMutex sync.RWMutex
+)
+
+// SetLabelNamespace sets the prefix of the label keys applied to containers
+// and used to find them again. An empty namespace restores the default.
+func SetLabelNamespace(ns string) {
+	if ns == "" {
+		ns = DefaultLabelNamespace
+	}
+	labelNamespaceMutex.Lock()
+	defer labelNamespaceMutex.Unlock()
+	labelNamespace = ns
+}
+
+func namespaced(key string) string {
+	labelNamespaceMutex.RLock()
+	defer labelNamespaceMutex.RUnlock()
+	return labelNamespace + "." + key
+}
+
+// JobLabelKey returns the key of the label that holds the invocation ID of
+// the job a container belongs to. In the default namespace it's the same as
+// model.DockerLabelKey.
+func JobLabelKey() string {
+	return namespaced("analysis")
+}
+
+// TypeLabelKey returns the key of the label that holds the container type.
+func TypeLabelKey() string {
+	return namespaced("containertype")
+}
+
+// SubmitterLabelKey returns the key of the label that holds the username of
+// the user who submitted the job a container belongs to.
+func SubmitterLabelKey() string {
+	return namespaced("submitter")
+}
+
+// JobNameLabelKey returns the key of the label that holds the name of the job a
+// container belongs to.
+func JobNameLabelKey() string {
+	return namespaced("job_name")
+}
+
+// AppNameLabelKey returns the key of the label that holds the name of the app
+// the job a container belongs to was launched from.
+func AppNameLabelKey() string {
+	return namespaced("app_name")
+}
+
+// maxLabelValueLength is the longest label value, in bytes, that's set from a
+// job. Names are free text entered by users, so they're cut down to keep the
+// container's metadata small enough for Docker and the tools that read it.
+const maxLabelValueLength = 255
+
+// labelValue returns s with control characters replaced by spaces, leading and
+// trailing space trimmed, and the result truncated to maxLabelValueLength
+// without splitting a multi-byte character.
+func labelValue(s string) string {
+	s = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, s))
+	if len(s) <= maxLabelValueLength {
+		return s
+	}
+	end := maxLabelValueLength
+	for end > 0 && !utf8.RuneStart(s[end]) {
+		end--
+	}
+	return s[:end]
+}
+
+// jobDescriptionLabels returns the labels that describe the job to anyone
+// looking at its containers. Labels for names that aren't set are left out.
+func jobDescriptionLabels(job *model.Job) map[string]string {
+	labels := make(map[string]string)
+	if name := labelValue(job.Name); name != "" {
+		labels[JobNameLabelKey()] = name
+	}
+	if app := labelValue(job.AppName); app != "" {
+		labels[AppNameLabelKey()] = app
+	}
+	return labels
+}
+
+// addJobDescriptionLabels adds the labels that describe the job to labels.
+func addJobDescriptionLabels(labels map[string]string, job *model.Job) {
+	for k, v := range jobDescriptionLabels(job) {
+		labels[k] = v
+	}
+}
+
+// isReservedLabel returns true if key is in the label namespace that
+// road-runner uses for its own labels.
+func isReservedLabel(key string) bool {
+	return strings.HasPrefix(key, namespaced(""))
+}
+
+// addCustomLabels copies the labels from a job or step into labels. Labels in
+// road-runner's namespace are skipped so that containers can't be hidden from
+// cleanup or attributed to another job.
+func addCustomLabels(labels, custom map[string]string) {
+	for k, v := range custom {
+		if isReservedLabel(k) {
+			logcabin.Warning.Printf("not setting the reserved label %s", k)
+			continue
+		}
+		labels[k] = v
+	}
+}
@@ -0,0 +1,177 @@
+package dockerops
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/cyverse-de/road-runner/model"
+)
+
+func TestDefaultLabelKeys(t *testing.T) {
+	SetLabelNamespace("")
+	if JobLabelKey() != model.DockerLabelKey {
+		t.Errorf("job label key was %q instead of %q", JobLabelKey(), model.DockerLabelKey)
+	}
+	if TypeLabelKey() != "org.iplantc.containertype" {
+		t.Errorf("type label key was %q", TypeLabelKey())
+	}
+	if SubmitterLabelKey() != "org.iplantc.submitter" {
+		t.Errorf("submitter label key was %q", SubmitterLabelKey())
+	}
+}
+
+func TestLabelNamespace(t *testing.T) {
+	SetLabelNamespace("org.example")
+	defer SetLabelNamespace("")
+
+	daemon := newFakeDaemon(map[string]string{
+		"GET /volumes":            `{"Volumes": []}`,
+		"POST /containers/create": `{"Id": "step-container"}`,
+		"GET /containers/json":    `[]`,
+	})
+	defer daemon.Close()
+	d := newTestDocker(t, daemon, nil)
+
+	if _, err := d.CreateContainerFromStep(&model.Job{InvocationID: "invocation"}, &model.Step{}); err != nil {
+		t.Fatal(err)
+	}
+	req, ok := daemon.request("POST", "/containers/create")
+	if !ok {
+		t.Fatal("container wasn't created")
+	}
+	var body struct {
+		Labels map[string]string
+	}
+	if err := json.Unmarshal(req.Body, &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Labels["org.example.analysis"] != "invocation" {
+		t.Errorf("job label was missing from %#v", body.Labels)
+	}
+	if body.Labels["org.example.containertype"] != "3" {
+		t.Errorf("type label was missing from %#v", body.Labels)
+	}
+
+	if err := d.NukeContainersByLabel(JobLabelKey(), "invocation"); err != nil {
+		t.Fatal(err)
+	}
+	req, ok = daemon.request("GET", "/containers/json")
+	if !ok {
+		t.Fatal("containers weren't listed")
+	}
+	if filters := req.Query.Get("filters"); !strings.Contains(filters, "org.example.analysis=invocation") {
+		t.Errorf("nuke filter %q didn't use the namespace", filters)
+	}
+}
+
+func TestCustomLabels(t *testing.T) {
+	d, cl := newFakeClientDocker(nil)
+	job := &model.Job{
+		InvocationID: "invocation",
+		Submitter:    "alice",
+		Labels: map[string]string{
+			"experiment":        "exp-42",
+			JobLabelKey():       "someone-elses-job",
+			SubmitterLabelKey(): "mallory",
+		},
+	}
+	if _, err := d.CreateUploadContainer(job); err != nil {
+		t.Fatal(err)
+	}
+	if cl.config.Labels["experiment"] != "exp-42" {
+		t.Errorf("upload labels %#v don't include the custom label", cl.config.Labels)
+	}
+	if cl.config.Labels[JobLabelKey()] != "invocation" || cl.config.Labels[SubmitterLabelKey()] != "alice" {
+		t.Errorf("reserved upload labels were overwritten: %#v", cl.config.Labels)
+	}
+
+	step := &model.Step{Labels: map[string]string{
+		"cohort":        "b",
+		TypeLabelKey():  "0",
+		namespaced("x"): "y",
+	}}
+	if _, err := d.CreateContainerFromStep(&model.Job{InvocationID: "invocation"}, step); err != nil {
+		t.Fatal(err)
+	}
+	if cl.config.Labels["cohort"] != "b" {
+		t.Errorf("step labels %#v don't include the custom label", cl.config.Labels)
+	}
+	if cl.config.Labels[TypeLabelKey()] != strconv.Itoa(StepContainer) {
+		t.Errorf("the step container type label was overwritten: %#v", cl.config.Labels)
+	}
+	if _, ok := cl.config.Labels[namespaced("x")]; ok {
+		t.Errorf("a label in the reserved namespace was set: %#v", cl.config.Labels)
+	}
+}
+
+func TestJobDescriptionLabels(t *testing.T) {
+	SetLabelNamespace("")
+	if JobNameLabelKey() != "org.iplantc.job_name" {
+		t.Errorf("job name label key was %q", JobNameLabelKey())
+	}
+	if AppNameLabelKey() != "org.iplantc.app_name" {
+		t.Errorf("app name label key was %q", AppNameLabelKey())
+	}
+
+	d, cl := newFakeClientDocker(nil)
+	job := &model.Job{
+		InvocationID: "invocation",
+		Submitter:    "alice",
+		Name:         "Word count\n\"run\" #1",
+		AppName:      strings.Repeat("é", maxLabelValueLength),
+	}
+
+	check := func(kind string, labels map[string]string) {
+		if labels[JobNameLabelKey()] != "Word count \"run\" #1" {
+			t.Errorf("%s job name label was %q", kind, labels[JobNameLabelKey()])
+		}
+		app := labels[AppNameLabelKey()]
+		if len(app) > maxLabelValueLength {
+			t.Errorf("%s app name label was %d bytes long", kind, len(app))
+		}
+		if !utf8.ValidString(app) {
+			t.Errorf("%s app name label %q isn't valid UTF-8", kind, app)
+		}
+		if !strings.HasPrefix(job.AppName, app) || app == "" {
+			t.Errorf("%s app name label %q isn't a prefix of the app name", kind, app)
+		}
+	}
+
+	if _, err := d.CreateUploadContainer(job); err != nil {
+		t.Fatal(err)
+	}
+	check("upload", cl.config.Labels)
+
+	if _, err := d.CreateContainerFromStep(job, &model.Step{}); err != nil {
+		t.Fatal(err)
+	}
+	check("step", cl.config.Labels)
+
+	if _, err := d.CreateUploadContainer(&model.Job{InvocationID: "invocation"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{JobNameLabelKey(), AppNameLabelKey()} {
+		if _, ok := cl.config.Labels[key]; ok {
+			t.Errorf("label %s was set for a job without names: %#v", key, cl.config.Labels)
+		}
+	}
+}
+
+func TestLabelValue(t *testing.T) {
+	tests := []struct {
+		value, expected string
+	}{
+		{"  Word count  ", "Word count"},
+		{"tab\tand\r\nnewline", "tab and  newline"},
+		{strings.Repeat("a", maxLabelValueLength+10), strings.Repeat("a", maxLabelValueLength)},
+		{"a" + strings.Repeat("é", maxLabelValueLength), "a" + strings.Repeat("é", (maxLabelValueLength-1)/2)},
+	}
+	for _, test := range tests {
+		if actual := labelValue(test.value); actual != test.expected {
+			t.Errorf("labelValue(%q) was %q instead of %q", test.value, actual, test.expected)
+		}
+	}
+}
@@ -1,65 +1,180 @@
 package main
 
 import (
+	"fmt"
 	"strconv"
+	"strings"
+	"time"
 
-	"github.com/cyverse-de/dockerops"
 	"github.com/cyverse-de/logcabin"
-	"github.com/cyverse-de/messaging"
-	"github.com/cyverse-de/model"
+	"github.com/cyverse-de/road-runner/dockerops"
+	"github.com/cyverse-de/road-runner/messaging"
+	"github.com/docker/docker/client"
 )
 
-func cleanup(job *model.Job) {
-	logcabin.Info.Printf("Performing aggressive clean up routine...")
+// containerLister is the subset of *dockerops.Docker needed to find a job's
+// containers.
+type containerLister interface {
+	ContainersWithLabel(key, value string, all bool) ([]string, error)
+}
 
-	logcabin.Info.Println("Finding all input containers")
-	inputContainers, err := dckr.ContainersWithLabel(dockerops.TypeLabel, strconv.Itoa(dockerops.InputContainer), true)
+// cleaner is the subset of *dockerops.Docker needed to clean up after a job.
+type cleaner interface {
+	containerLister
+	StopContainer(id string, grace time.Duration) error
+	NukeContainer(id string) error
+	VolumeExists(volumeID string) (bool, error)
+	RemoveVolume(volumeID string) error
+}
+
+// jobContainersOfType returns the IDs of the containers of the given type that
+// belong to the job with the given invocation ID. Containers of the same type
+// that belong to other jobs running on the node are left out.
+func jobContainersOfType(d containerLister, invID string, containerType int) ([]string, error) {
+	jobContainers, err := d.ContainersWithLabel(dockerops.JobLabelKey(), invID, true)
 	if err != nil {
-		logcabin.Error.Print(err)
-		inputContainers = []string{}
+		return nil, err
 	}
-	for _, ic := range inputContainers {
-		logcabin.Info.Printf("Nuking input container %s", ic)
-		err = dckr.NukeContainer(ic)
-		if err != nil {
-			logcabin.Error.Print(err)
-		}
+	inJob := make(map[string]bool)
+	for _, id := range jobContainers {
+		inJob[id] = true
 	}
 
-	logcabin.Info.Println("Finding all step containers")
-	stepContainers, err := dckr.ContainersWithLabel(dockerops.TypeLabel, strconv.Itoa(dockerops.StepContainer), true)
+	typeContainers, err := d.ContainersWithLabel(dockerops.TypeLabelKey(), strconv.Itoa(containerType), true)
 	if err != nil {
-		logcabin.Error.Print(err)
+		return nil, err
+	}
+	var retval []string
+	for _, id := range typeContainers {
+		if inJob[id] {
+			retval = append(retval, id)
+		}
+	}
+	return retval, nil
+}
+
+// gracePeriods are how long cleanup waits for containers to stop before they
+// are killed. Step containers may need time to shut down cleanly, while the
+// input and data containers can stop right away.
+type gracePeriods struct {
+	step  time.Duration
+	other time.Duration
+}
+
+// cleanupBackoff is how long to wait after the first failed removal. It
+// doubles after each failure.
+var cleanupBackoff = 500 * time.Millisecond
+
+// nothingToRemove returns true if err says that the thing being removed is
+// already gone, which means there's nothing left to clean up.
+func nothingToRemove(err error) bool {
+	return client.IsErrNotFound(err) || strings.Contains(err.Error(), "No such")
+}
+
+// retryRemoval calls remove until it succeeds, reports that there's nothing to
+// remove, or has been retried the given number of times. The last error is
+// returned.
+func retryRemoval(what string, retries int, remove func() error) error {
+	backoff := cleanupBackoff
+	for attempt := 0; ; attempt++ {
+		err := remove()
+		if err == nil {
+			return nil
+		}
+		if nothingToRemove(err) {
+			logcabin.Info.Printf("%s was already removed", what)
+			return nil
+		}
+		if attempt >= retries {
+			return err
+		}
+		logcabin.Warning.Printf("error removing %s, retrying in %s: %s", what, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// cleanup removes the input, step, and data containers along with the working
+// directory volume that belong to the job with the given invocation ID.
+func cleanup(d cleaner, invID string, opts cleanupOptions) {
+	logcabin.Info.Printf("Performing aggressive clean up routine...")
+
+	containerTypes := []struct {
+		name          string
+		containerType int
+		grace         time.Duration
+	}{
+		{"input", dockerops.InputContainer, opts.grace.other},
+		{"step", dockerops.StepContainer, opts.grace.step},
+		{"data", dockerops.DataContainer, opts.grace.other},
 	}
-	for _, sc := range stepContainers {
-		logcabin.Info.Printf("Nuking step container %s", sc)
-		err = dckr.NukeContainer(sc)
+
+	for _, ct := range containerTypes {
+		logcabin.Info.Printf("Finding all %s containers for %s", ct.name, invID)
+		containers, err := jobContainersOfType(d, invID, ct.containerType)
 		if err != nil {
 			logcabin.Error.Print(err)
 		}
+		for _, c := range containers {
+			logcabin.Info.Printf("Stopping %s container %s with a grace period of %s", ct.name, c, ct.grace)
+			if err = d.StopContainer(c, ct.grace); err != nil {
+				logcabin.Error.Print(err)
+			}
+			logcabin.Info.Printf("Nuking %s container %s", ct.name, c)
+			id := c
+			if err = retryRemoval(fmt.Sprintf("%s container %s", ct.name, id), opts.retries, func() error { return d.NukeContainer(id) }); err != nil {
+				logcabin.Error.Print(err)
+			}
+		}
 	}
 
-	logcabin.Info.Println("Finding all data containers")
-	dataContainers, err := dckr.ContainersWithLabel(dockerops.TypeLabel, strconv.Itoa(dockerops.DataContainer), true)
+	hasVolume, err := d.VolumeExists(invID)
 	if err != nil {
 		logcabin.Error.Print(err)
 	}
-	for _, dc := range dataContainers {
-		logcabin.Info.Printf("Nuking data container %s", dc)
-		err = dckr.NukeContainer(dc)
-		if err != nil {
+	if hasVolume {
+		logcabin.Info.Printf("removing volume: %s", invID)
+		if err = retryRemoval(fmt.Sprintf("volume %s", invID), opts.retries, func() error { return d.RemoveVolume(invID) }); err != nil {
 			logcabin.Error.Print(err)
 		}
 	}
+}
 
-	var hasVolume bool
-	hasVolume, err = dckr.VolumeExists(job.InvocationID)
+// pruner is the subset of *dockerops.Docker needed to remove dangling images.
+type pruner interface {
+	DanglingImages() ([]string, error)
+	SafelyRemoveImageByID(id string) error
+}
+
+// imageInUse returns true if err says that an image couldn't be removed
+// because a container is still using it.
+func imageInUse(err error) bool {
+	msg := err.Error()
+	for _, phrase := range []string{"is being used", "is using", "in use"} {
+		if strings.Contains(msg, phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneDanglingImages removes the dangling images on the node. Images that are
+// still in use, by another job for example, are skipped.
+func pruneDanglingImages(d pruner) {
+	logcabin.Info.Print("Finding dangling images")
+	images, err := d.DanglingImages()
 	if err != nil {
 		logcabin.Error.Print(err)
+		return
 	}
-	if hasVolume {
-		logcabin.Info.Printf("removing volume: %s", job.InvocationID)
-		if err = dckr.RemoveVolume(job.InvocationID); err != nil {
+	for _, id := range images {
+		err = d.SafelyRemoveImageByID(id)
+		switch {
+		case err == nil:
+			logcabin.Info.Printf("Pruned dangling image %s", id)
+		case imageInUse(err), nothingToRemove(err):
+			logcabin.Info.Printf("Skipped dangling image %s: %s", id, err)
+		default:
 			logcabin.Error.Print(err)
 		}
 	}
@@ -69,7 +184,8 @@ func cleanup(job *model.Job) {
 // should be created with timer.AfterFunc(). exit is the channel that this
 // function reads from, finalExit is the channel that this channel writes to
 // when it's done doing its thing.
-func Exit(exit, finalExit chan messaging.StatusCode) {
+func Exit(rc *RunContext, exit, finalExit chan messaging.StatusCode) {
+	job := rc.Job
 	var err error
 	exitCode := <-exit
 	switch exitCode {
@@ -79,52 +195,77 @@ func Exit(exit, finalExit chan messaging.StatusCode) {
 		//containers should force the Run() function to 'fall through' to any clean
 		//up steps.
 		logcabin.Warning.Printf("Received an exit code of %d, cleaning up", int(exitCode))
+
+		// Run doesn't get to push the metrics when the job is torn down
+		// underneath it.
+		if rc.config.metricsURL != "" {
+			if err = rc.metrics.push(rc.config.metricsURL, job, exitCode, time.Now()); err != nil {
+				logcabin.Error.Print(err)
+			}
+		}
+
 		for _, dc := range job.DataContainers() {
-			logcabin.Info.Printf("Nuking image %s:%s", dc.Name, dc.Tag)
-			err = dckr.NukeImage(dc.Name, dc.Tag)
+			logcabin.Info.Printf("Nuking image %s", dc.ImageRef())
+			err = dckr.NukeImage(dc.ImageRef())
 			if err != nil {
 				logcabin.Error.Print(err)
 			}
 		}
 
-		cleanup(job)
+		cleanup(dckr, job.InvocationID, rc.config.cleanup)
 
 		//Aggressively clean up the rest of the job.
-		logcabin.Info.Printf("Nuking all containers with the label %s=%s", model.DockerLabelKey, job.InvocationID)
-		err = dckr.NukeContainersByLabel(model.DockerLabelKey, job.InvocationID)
+		logcabin.Info.Printf("Nuking all containers with the label %s=%s", dockerops.JobLabelKey(), job.InvocationID)
+		err = dckr.NukeContainersByLabel(dockerops.JobLabelKey(), job.InvocationID)
 		if err != nil {
 			logcabin.Error.Print(err)
 		}
 
 	default:
 		logcabin.Warning.Printf("Received an exit code of %d, cleaning up", int(exitCode))
+		cleanupJob(dckr, job.InvocationID, rc.config.cleanup)
+	}
 
-		logcabin.Info.Printf("Finding all containers with the label %s=%s", model.DockerLabelKey, job.InvocationID)
-		jobContainers, err := dckr.ContainersWithLabel(model.DockerLabelKey, job.InvocationID, true)
-		if err != nil {
-			logcabin.Error.Print(err)
-			jobContainers = []string{}
-		}
-		for _, jc := range jobContainers {
-			logcabin.Info.Printf("Nuking container %s", jc)
-			err = dckr.NukeContainer(jc)
-			if err != nil {
-				logcabin.Error.Print(err)
-			}
-		}
+	if rc.config.cleanup.pruneDangling {
+		pruneDanglingImages(dckr)
+	}
 
-		var hasVolume bool
-		hasVolume, err = dckr.VolumeExists(job.InvocationID)
-		if err != nil {
+	finalExit <- exitCode
+}
+
+// cleanupJob removes everything that the job with the given invocation ID
+// leaves on the node: its output containers, which have finished by the time
+// it's called, and everything that cleanup removes. Like the other
+// containers, the output containers are stopped with a grace period before
+// they're nuked.
+func cleanupJob(d cleaner, invID string, opts cleanupOptions) {
+	logcabin.Info.Printf("Finding all output containers for %s", invID)
+	containers, err := jobContainersOfType(d, invID, dockerops.OutputContainer)
+	if err != nil {
+		logcabin.Error.Print(err)
+	}
+	for _, c := range containers {
+		logcabin.Info.Printf("Stopping output container %s with a grace period of %s", c, opts.grace.other)
+		if err = d.StopContainer(c, opts.grace.other); err != nil {
 			logcabin.Error.Print(err)
 		}
-		if hasVolume {
-			logcabin.Info.Printf("removing volume: %s", job.InvocationID)
-			if err = dckr.RemoveVolume(job.InvocationID); err != nil {
-				logcabin.Error.Print(err)
-			}
+		logcabin.Info.Printf("Nuking output container %s", c)
+		id := c
+		if err = retryRemoval(fmt.Sprintf("output container %s", id), opts.retries, func() error { return d.NukeContainer(id) }); err != nil {
+			logcabin.Error.Print(err)
 		}
 	}
 
-	finalExit <- exitCode
+	cleanup(d, invID, opts)
+}
+
+// cleanupInvocation removes everything a job with the given invocation ID may
+// have left behind on the node, including its output containers and the job
+// files staged in writeTo. It's meant for cleaning up after runs that crashed
+// before Exit could do it.
+func cleanupInvocation(d cleaner, invID, writeTo string, opts cleanupOptions) {
+	cleanupJob(d, invID, opts)
+
+	logcabin.Info.Printf("Deleting job file for %s from %s", invID, writeTo)
+	deleteJobFiles(invID, writeTo)
 }
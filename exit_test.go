@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/road-runner/dockerops"
+)
+
+type fakeCleaner struct {
+	labels         map[string]map[string]string
+	volumes        map[string]bool
+	stopped        map[string]time.Duration
+	nuked          []string
+	removedVolumes []string
+	volumeFailures int
+	nukeFailures   map[string]int
+}
+
+func (f *fakeCleaner) ContainersWithLabel(key, value string, all bool) ([]string, error) {
+	var ids []string
+	for id, labels := range f.labels {
+		if labels[key] == value {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (f *fakeCleaner) StopContainer(id string, grace time.Duration) error {
+	if f.stopped == nil {
+		f.stopped = make(map[string]time.Duration)
+	}
+	f.stopped[id] = grace
+	return nil
+}
+
+func (f *fakeCleaner) NukeContainer(id string) error {
+	if f.nukeFailures[id] > 0 {
+		f.nukeFailures[id]--
+		return errors.New("daemon is busy")
+	}
+	f.nuked = append(f.nuked, id)
+	return nil
+}
+
+func (f *fakeCleaner) VolumeExists(volumeID string) (bool, error) {
+	return f.volumes[volumeID], nil
+}
+
+func (f *fakeCleaner) RemoveVolume(volumeID string) error {
+	if f.volumeFailures > 0 {
+		f.volumeFailures--
+		return errors.New("daemon is busy")
+	}
+	f.removedVolumes = append(f.removedVolumes, volumeID)
+	return nil
+}
+
+func containerLabels(invID string, containerType int) map[string]string {
+	return map[string]string{
+		dockerops.JobLabelKey():  invID,
+		dockerops.TypeLabelKey(): strconv.Itoa(containerType),
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	f := &fakeCleaner{
+		labels: map[string]map[string]string{
+			"mine-input":  containerLabels("mine", dockerops.InputContainer),
+			"mine-step":   containerLabels("mine", dockerops.StepContainer),
+			"mine-data":   containerLabels("mine", dockerops.DataContainer),
+			"other-input": containerLabels("other", dockerops.InputContainer),
+			"other-step":  containerLabels("other", dockerops.StepContainer),
+		},
+		volumes: map[string]bool{"mine": true, "other": true},
+	}
+
+	cleanup(f, "mine", defaultRunConfig().cleanup)
+
+	sort.Strings(f.nuked)
+	expected := []string{"mine-data", "mine-input", "mine-step"}
+	if !reflect.DeepEqual(f.nuked, expected) {
+		t.Errorf("nuked %v instead of %v", f.nuked, expected)
+	}
+	if !reflect.DeepEqual(f.removedVolumes, []string{"mine"}) {
+		t.Errorf("removed volumes %v instead of [mine]", f.removedVolumes)
+	}
+	grace := defaultRunConfig().cleanup.grace
+	expectedGrace := map[string]time.Duration{
+		"mine-input": grace.other,
+		"mine-step":  grace.step,
+		"mine-data":  grace.other,
+	}
+	if !reflect.DeepEqual(f.stopped, expectedGrace) {
+		t.Errorf("stopped %v instead of %v", f.stopped, expectedGrace)
+	}
+	if grace.step <= grace.other {
+		t.Errorf("step grace period %s isn't longer than %s", grace.step, grace.other)
+	}
+}
+
+func TestCleanupJob(t *testing.T) {
+	defer func(b time.Duration) { cleanupBackoff = b }(cleanupBackoff)
+	cleanupBackoff = 0
+
+	f := &fakeCleaner{
+		labels: map[string]map[string]string{
+			"mine-input":  containerLabels("mine", dockerops.InputContainer),
+			"mine-step":   containerLabels("mine", dockerops.StepContainer),
+			"mine-data":   containerLabels("mine", dockerops.DataContainer),
+			"mine-output": containerLabels("mine", dockerops.OutputContainer),
+			"other-step":  containerLabels("other", dockerops.StepContainer),
+		},
+		volumes:        map[string]bool{"mine": true},
+		volumeFailures: 1,
+		nukeFailures:   map[string]int{"mine-output": 1, "mine-step": 1},
+	}
+
+	cleanupJob(f, "mine", defaultRunConfig().cleanup)
+
+	sort.Strings(f.nuked)
+	expected := []string{"mine-data", "mine-input", "mine-output", "mine-step"}
+	if !reflect.DeepEqual(f.nuked, expected) {
+		t.Errorf("nuked %v instead of %v", f.nuked, expected)
+	}
+	if !reflect.DeepEqual(f.removedVolumes, []string{"mine"}) {
+		t.Errorf("removed volumes %v instead of [mine]", f.removedVolumes)
+	}
+	grace := defaultRunConfig().cleanup.grace
+	expectedGrace := map[string]time.Duration{
+		"mine-input":  grace.other,
+		"mine-step":   grace.step,
+		"mine-data":   grace.other,
+		"mine-output": grace.other,
+	}
+	if !reflect.DeepEqual(f.stopped, expectedGrace) {
+		t.Errorf("stopped %v instead of %v", f.stopped, expectedGrace)
+	}
+}
+
+func TestCleanupInvocation(t *testing.T) {
+	f := &fakeCleaner{
+		labels: map[string]map[string]string{
+			"mine-input":  containerLabels("mine", dockerops.InputContainer),
+			"mine-step":   containerLabels("mine", dockerops.StepContainer),
+			"mine-data":   containerLabels("mine", dockerops.DataContainer),
+			"mine-output": containerLabels("mine", dockerops.OutputContainer),
+			"other-step":  containerLabels("other", dockerops.StepContainer),
+		},
+		volumes: map[string]bool{"mine": true},
+	}
+	writeTo, err := ioutil.TempDir("", "cleanup-invocation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(writeTo)
+	jobPath := path.Join(writeTo, "mine.json")
+	if err = ioutil.WriteFile(jobPath, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cleanupInvocation(f, "mine", writeTo, defaultRunConfig().cleanup)
+
+	sort.Strings(f.nuked)
+	expected := []string{"mine-data", "mine-input", "mine-output", "mine-step"}
+	if !reflect.DeepEqual(f.nuked, expected) {
+		t.Errorf("nuked %v instead of %v", f.nuked, expected)
+	}
+	if !reflect.DeepEqual(f.removedVolumes, []string{"mine"}) {
+		t.Errorf("removed volumes %v instead of [mine]", f.removedVolumes)
+	}
+	if _, err = os.Stat(jobPath); !os.IsNotExist(err) {
+		t.Errorf("job file %s wasn't deleted", jobPath)
+	}
+}
+
+func TestCleanupRetriesRemovals(t *testing.T) {
+	defer func(b time.Duration) { cleanupBackoff = b }(cleanupBackoff)
+	cleanupBackoff = 0
+
+	f := &fakeCleaner{volumes: map[string]bool{"mine": true}, volumeFailures: 1}
+	cleanup(f, "mine", defaultRunConfig().cleanup)
+	if !reflect.DeepEqual(f.removedVolumes, []string{"mine"}) {
+		t.Errorf("removed volumes %v instead of [mine]", f.removedVolumes)
+	}
+}
+
+func TestRetryRemoval(t *testing.T) {
+	defer func(b time.Duration) { cleanupBackoff = b }(cleanupBackoff)
+	cleanupBackoff = 0
+
+	t.Run("retries until it succeeds", func(t *testing.T) {
+		calls := 0
+		err := retryRemoval("volume mine", 3, func() error {
+			calls++
+			if calls == 1 {
+				return errors.New("daemon is busy")
+			}
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		if calls != 2 {
+			t.Errorf("remove was called %d times instead of 2", calls)
+		}
+	})
+
+	t.Run("nothing to remove isn't retried", func(t *testing.T) {
+		calls := 0
+		err := retryRemoval("container mine", 3, func() error {
+			calls++
+			return errors.New("Error response from daemon: No such container: mine")
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		if calls != 1 {
+			t.Errorf("remove was called %d times instead of 1", calls)
+		}
+	})
+
+	t.Run("gives up after the retries", func(t *testing.T) {
+		calls := 0
+		err := retryRemoval("volume mine", 3, func() error {
+			calls++
+			return errors.New("daemon is busy")
+		})
+		if err == nil {
+			t.Error("no error was returned")
+		}
+		if calls != 4 {
+			t.Errorf("remove was called %d times instead of 4", calls)
+		}
+	})
+}
+
+type fakePruner struct {
+	dangling []string
+	failures map[string]error
+	removed  []string
+	attempts []string
+}
+
+func (f *fakePruner) DanglingImages() ([]string, error) {
+	return f.dangling, nil
+}
+
+func (f *fakePruner) SafelyRemoveImageByID(id string) error {
+	f.attempts = append(f.attempts, id)
+	if err := f.failures[id]; err != nil {
+		return err
+	}
+	f.removed = append(f.removed, id)
+	return nil
+}
+
+func TestPruneDanglingImages(t *testing.T) {
+	f := &fakePruner{
+		dangling: []string{"sha256:unused", "sha256:busy", "sha256:other"},
+		failures: map[string]error{
+			"sha256:busy": errors.New("Error response from daemon: conflict: unable to delete sha256:busy (cannot be forced) - image is being used by running container 1234"),
+		},
+	}
+	pruneDanglingImages(f)
+
+	if !reflect.DeepEqual(f.attempts, f.dangling) {
+		t.Errorf("removal attempts were %#v instead of %#v", f.attempts, f.dangling)
+	}
+	expected := []string{"sha256:unused", "sha256:other"}
+	if !reflect.DeepEqual(f.removed, expected) {
+		t.Errorf("removed images were %#v instead of %#v", f.removed, expected)
+	}
+}
+
+func TestImageInUse(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{errors.New("conflict: unable to delete 1234 (must be forced) - image is being used by stopped container 5678"), true},
+		{errors.New("conflict: unable to remove repository reference \"alpine\" (must force) - container 5678 is using its referenced image 1234"), true},
+		{errors.New("image 1234 is in use"), true},
+		{errors.New("daemon is busy"), false},
+	}
+	for _, test := range tests {
+		if actual := imageInUse(test.err); actual != test.expected {
+			t.Errorf("imageInUse(%q) was %t instead of %t", test.err, actual, test.expected)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// FileSystem describes the file system operations road-runner needs. It exists
+// so that the code that reads and writes files can be tested without touching
+// the disk.
+type FileSystem interface {
+	Open(name string) (ReadSeekCloser, error)
+	Create(name string) (io.WriteCloser, error)
+	Glob(pattern string) ([]string, error)
+	Remove(name string) error
+}
+
+// ReadSeekCloser is a file opened for reading. It can be seeked so that the end
+// of a large file can be read without reading all of it.
+type ReadSeekCloser interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+// osFileSystem is the FileSystem implementation backed by the os package.
+type osFileSystem struct{}
+
+// Open opens the named file for reading.
+func (osFileSystem) Open(name string) (ReadSeekCloser, error) {
+	return os.Open(name)
+}
+
+// Create creates or truncates the named file.
+func (osFileSystem) Create(name string) (io.WriteCloser, error) {
+	return os.Create(name)
+}
+
+// Glob returns the names of the files matching pattern.
+func (osFileSystem) Glob(pattern string) ([]string, error) {
+	return filepath.Glob(pattern)
+}
+
+// Remove removes the named file or empty directory.
+func (osFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"sort"
+)
+
+// memFileSystem is an in-memory FileSystem used by the tests.
+type memFileSystem struct {
+	files map[string][]byte
+}
+
+func newMemFileSystem() *memFileSystem {
+	return &memFileSystem{files: make(map[string][]byte)}
+}
+
+type memFile struct {
+	bytes.Buffer
+	name string
+	fs   *memFileSystem
+}
+
+func (f *memFile) Close() error {
+	f.fs.files[f.name] = f.Bytes()
+	return nil
+}
+
+// memReader is a file in a memFileSystem opened for reading.
+type memReader struct {
+	*bytes.Reader
+}
+
+func (memReader) Close() error {
+	return nil
+}
+
+func (m *memFileSystem) Open(name string) (ReadSeekCloser, error) {
+	contents, ok := m.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return memReader{bytes.NewReader(contents)}, nil
+}
+
+func (m *memFileSystem) Create(name string) (io.WriteCloser, error) {
+	m.files[name] = []byte{}
+	return &memFile{name: name, fs: m}, nil
+}
+
+func (m *memFileSystem) Glob(pattern string) ([]string, error) {
+	var matches []string
+	for name := range m.files {
+		matched, err := path.Match(pattern, name)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			matches = append(matches, name)
+		}
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+func (m *memFileSystem) Remove(name string) error {
+	if _, ok := m.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(m.files, name)
+	return nil
+}
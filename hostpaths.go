@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// checkHostPath returns an error if the host path of a volume doesn't exist or
+// isn't a directory. Docker creates missing host paths as empty directories,
+// so a typo silently hides the data the tool expects. Relative paths are
+// checked against wd, the same as when the volume is mounted.
+func checkHostPath(hostPath, wd string) error {
+	if !filepath.IsAbs(hostPath) {
+		hostPath = filepath.Join(wd, hostPath)
+	}
+	info, err := os.Stat(hostPath)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("host path %s isn't a directory", hostPath)
+	}
+	return nil
+}
+
+// verifyHostPaths checks the host path of each of the steps' volumes. A
+// warning is published for each bad path, or an error is returned for the
+// first one if r.requireHosts is set.
+func (r *JobRunner) verifyHostPaths() error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	for idx, step := range r.job.Steps {
+		for _, vol := range step.Component.Container.Volumes {
+			if vol.HostPath == "" {
+				continue
+			}
+			if err = checkHostPath(vol.HostPath, wd); err == nil {
+				continue
+			}
+			msg := fmt.Sprintf("step %d mounts %s at %s: %s", idx, vol.HostPath, vol.ContainerPath, err)
+			if r.requireHosts {
+				return fmt.Errorf("%s", msg)
+			}
+			r.running(fmt.Sprintf("Warning: %s", msg))
+		}
+	}
+	return nil
+}
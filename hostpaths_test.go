@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/cyverse-de/road-runner/model"
+)
+
+func TestCheckHostPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "host-paths")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = os.Mkdir(path.Join(dir, "data"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(path.Join(dir, "file.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = checkHostPath(path.Join(dir, "data"), "/"); err != nil {
+		t.Errorf("present directory: %s", err)
+	}
+	if err = checkHostPath("data", dir); err != nil {
+		t.Errorf("relative directory: %s", err)
+	}
+	if err = checkHostPath(path.Join(dir, "missing"), "/"); !os.IsNotExist(err) {
+		t.Errorf("missing directory returned %v", err)
+	}
+	if err = checkHostPath(path.Join(dir, "file.txt"), "/"); err == nil {
+		t.Error("a file was accepted as a directory")
+	}
+}
+
+func TestVerifyHostPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "host-paths")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	vols := []model.Volume{
+		{HostPath: dir, ContainerPath: "/present"},
+		{HostPath: path.Join(dir, "typo"), ContainerPath: "/missing"},
+		{ContainerPath: "/anonymous"},
+	}
+
+	t.Run("missing paths warn", func(t *testing.T) {
+		runner, _, p := newTestRunner(t)
+		runner.job.Steps[0].Component.Container.Volumes = vols
+		if err := runner.verifyHostPaths(); err != nil {
+			t.Error(err)
+		}
+		if len(p.updates) != 1 || !strings.Contains(p.updates[0].Message, "/missing") {
+			t.Errorf("updates were %#v", p.updates)
+		}
+	})
+
+	t.Run("missing paths fail when required", func(t *testing.T) {
+		runner, _, _ := newTestRunner(t)
+		runner.requireHosts = true
+		runner.job.Steps[0].Component.Container.Volumes = vols
+		if err := runner.verifyHostPaths(); err == nil {
+			t.Error("a missing host path was accepted")
+		}
+	})
+
+	t.Run("present paths pass when required", func(t *testing.T) {
+		runner, _, p := newTestRunner(t)
+		runner.requireHosts = true
+		runner.job.Steps[0].Component.Container.Volumes = vols[:1]
+		if err := runner.verifyHostPaths(); err != nil {
+			t.Error(err)
+		}
+		if len(p.updates) != 0 {
+			t.Errorf("updates were %#v", p.updates)
+		}
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/cyverse-de/road-runner/messaging"
+	"github.com/cyverse-de/road-runner/model"
+	"github.com/docker/go-connections/nat"
+)
+
+// runStep runs the step, as an interactive step if the job is interactive.
+// attempt starts at 1 and goes up each time the step is retried. started is
+// called once the step's container has started.
+func (r *JobRunner) runStep(step *model.Step, idx, attempt int, started func()) (int64, error) {
+	if !r.job.Interactive {
+		return r.dckr.RunStep(r.job, step, idx, attempt, started)
+	}
+	return r.dckr.RunInteractiveStep(r.job, step, idx, attempt, func(ports nat.PortMap) {
+		started()
+		r.reportAccessURLs(idx, ports)
+	})
+}
+
+// accessURLs returns the URLs that the published ports in the mapping can be
+// reached at, sorted so they're always listed in the same order. Ports bound
+// to all interfaces are reached through host.
+func accessURLs(host string, ports nat.PortMap) []string {
+	var urls []string
+	seen := make(map[string]bool)
+	for _, bindings := range ports {
+		for _, b := range bindings {
+			if b.HostPort == "" {
+				continue
+			}
+			ip := b.HostIP
+			if ip == "" || ip == "0.0.0.0" || ip == "::" {
+				ip = host
+			}
+			u := fmt.Sprintf("http://%s", net.JoinHostPort(ip, b.HostPort))
+			if !seen[u] {
+				seen[u] = true
+				urls = append(urls, u)
+			}
+		}
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+// reportAccessURLs tells the user where the interactive step can be reached.
+func (r *JobRunner) reportAccessURLs(idx int, ports nat.PortMap) {
+	urls := accessURLs(hostname(), ports)
+	if len(urls) == 0 {
+		r.runningStep("The interactive step doesn't publish any ports", idx, messaging.RunningState, 0)
+		return
+	}
+	for _, u := range urls {
+		r.runningStep(fmt.Sprintf("The interactive step is available at %s", u), idx, messaging.RunningState, 0)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/cyverse-de/road-runner/messaging"
+	"github.com/cyverse-de/road-runner/model"
+	"github.com/docker/go-connections/nat"
+)
+
+func TestInteractiveJobSkipsTransfers(t *testing.T) {
+	runner, d, _ := newTestRunner(t)
+	runner.job.Interactive = true
+	runner.job.Steps[0].Input = []model.StepInput{{Value: "/iplant/home/test/input.txt"}}
+
+	if err := runner.downloadInputs(); err != nil {
+		t.Fatal(err)
+	}
+	if err := runner.transferOutputs(); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.calls) != 0 {
+		t.Errorf("calls were %#v instead of none", d.calls)
+	}
+}
+
+func TestInteractiveJobSkipsStepAndDebugUploads(t *testing.T) {
+	runner, d, dir := newDebugRunner(t)
+	defer os.RemoveAll(dir)
+	runner.job.Interactive = true
+	if err := ioutil.WriteFile(path.Join(dir, "out.txt"), []byte("1 2 3"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	step := runner.job.Steps[0]
+	step.OutputGlobs = []string{"*.txt"}
+
+	runner.uploadStepOutputs(&step, 0)
+	runner.status = messaging.StatusStepFailed
+	if err := runner.uploadWorkdir(); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.calls) != 0 {
+		t.Errorf("calls were %#v instead of none", d.calls)
+	}
+}
+
+func TestInteractiveJobReportsPorts(t *testing.T) {
+	runner, d, p := newTestRunner(t)
+	runner.job.Interactive = true
+	d.ports = nat.PortMap{
+		"8888/tcp": []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: "32768"}},
+		"22/tcp":   []nat.PortBinding{{HostIP: "10.0.0.5", HostPort: "32769"}},
+	}
+
+	if err := runner.runAllSteps(runner.exit); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"RunInteractiveStep 0"}
+	if !reflect.DeepEqual(d.calls, expected) {
+		t.Errorf("calls were %#v instead of %#v", d.calls, expected)
+	}
+
+	var reported []string
+	for _, u := range p.updates {
+		if strings.HasPrefix(u.Message, "The interactive step is available at ") {
+			reported = append(reported, strings.TrimPrefix(u.Message, "The interactive step is available at "))
+		}
+	}
+	urls := []string{"http://10.0.0.5:32769", "http://" + hostname() + ":32768"}
+	sort.Strings(urls)
+	if !reflect.DeepEqual(reported, urls) {
+		t.Errorf("reported URLs were %#v instead of %#v", reported, urls)
+	}
+}
+
+func TestAccessURLs(t *testing.T) {
+	ports := nat.PortMap{
+		"80/tcp":   []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: "32770"}, {HostIP: "::", HostPort: "32770"}},
+		"443/tcp":  []nat.PortBinding{{HostIP: "fe80::1", HostPort: "32771"}},
+		"9000/tcp": nil,
+	}
+	expected := []string{
+		"http://[fe80::1]:32771",
+		"http://node-1:32770",
+	}
+	if actual := accessURLs("node-1", ports); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("URLs were %#v instead of %#v", actual, expected)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// removeStaleLocks removes the files in dir that match any of the globs and
+// returns the paths of the files it removed. Globs that are absolute or that
+// lead out of dir are rejected so that a bad setting can't remove files
+// elsewhere on the node.
+func removeStaleLocks(fs FileSystem, dir string, globs []string) ([]string, error) {
+	var removed []string
+	for _, glob := range globs {
+		glob = strings.TrimSpace(glob)
+		if glob == "" {
+			continue
+		}
+		clean := filepath.Clean(glob)
+		if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+			return removed, fmt.Errorf("stale lock glob %s isn't inside the working directory", glob)
+		}
+		matches, err := fs.Glob(filepath.Join(dir, clean))
+		if err != nil {
+			return removed, err
+		}
+		for _, m := range matches {
+			if err = fs.Remove(m); err != nil {
+				return removed, err
+			}
+			removed = append(removed, m)
+		}
+	}
+	return removed, nil
+}
+
+// removeStaleLocksFromVolume removes stale lock files from a reused working
+// directory volume. Fresh volumes can't have any, and removing files from
+// them could remove inputs that happen to match.
+func (r *JobRunner) removeStaleLocksFromVolume() {
+	if !r.reuse || len(r.lockGlobs) == 0 {
+		return
+	}
+	removed, err := removeStaleLocks(r.fs, r.volumeDir, r.lockGlobs)
+	for _, m := range removed {
+		r.log.Infof("removed stale lock file %s", m)
+	}
+	if err != nil {
+		r.log.Errorf("error removing stale lock files: %s", err)
+	}
+}
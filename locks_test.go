@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRemoveStaleLocks(t *testing.T) {
+	fs := newMemFileSystem()
+	for _, name := range []string{
+		"/volume/.lock",
+		"/volume/index.lock",
+		"/volume/db/LOCK",
+		"/volume/results.txt",
+		"/volume/db/data",
+		"/other/.lock",
+	} {
+		fs.files[name] = []byte("x")
+	}
+
+	removed, err := removeStaleLocks(fs, "/volume", []string{"*.lock", " db/LOCK ", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"/volume/.lock", "/volume/index.lock", "/volume/db/LOCK"}
+	if !reflect.DeepEqual(removed, expected) {
+		t.Errorf("removed %#v instead of %#v", removed, expected)
+	}
+	for _, name := range []string{"/volume/results.txt", "/volume/db/data", "/other/.lock"} {
+		if _, ok := fs.files[name]; !ok {
+			t.Errorf("%s was removed", name)
+		}
+	}
+}
+
+func TestRemoveStaleLocksOutsideDir(t *testing.T) {
+	for _, glob := range []string{"../*.lock", "/etc/*.lock", "db/../../x"} {
+		fs := newMemFileSystem()
+		fs.files["/other/.lock"] = []byte("x")
+		if _, err := removeStaleLocks(fs, "/volume", []string{glob}); err == nil {
+			t.Errorf("glob %s was accepted", glob)
+		}
+	}
+}
+
+func TestRemoveStaleLocksFromVolumeOnlyWhenReused(t *testing.T) {
+	runner, _, _ := newTestRunner(t)
+	fs := newMemFileSystem()
+	fs.files["/volume/.lock"] = []byte("x")
+	runner.fs = fs
+	runner.volumeDir = "/volume"
+	runner.lockGlobs = []string{"*.lock"}
+
+	runner.removeStaleLocksFromVolume()
+	if _, ok := fs.files["/volume/.lock"]; !ok {
+		t.Error("a lock file was removed from a fresh volume")
+	}
+
+	runner.reuse = true
+	runner.removeStaleLocksFromVolume()
+	if _, ok := fs.files["/volume/.lock"]; ok {
+		t.Error("the lock file wasn't removed from a reused volume")
+	}
+}
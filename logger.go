@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/cyverse-de/logcabin"
+)
+
+// logFormatter formats the logs. It's set from the --log-format flag in main.
+var logFormatter logrus.Formatter = &logcabinFormatter{}
+
+// logcabinFormatter writes logrus entries as JSON with logcabin's keys and
+// level names.
+type logcabinFormatter struct{}
+
+// logcabinLevels are logcabin's names for the logrus levels.
+var logcabinLevels = map[logrus.Level]string{
+	logrus.DebugLevel: "TRACE",
+	logrus.InfoLevel:  "INFO",
+	logrus.WarnLevel:  "WARN",
+	logrus.ErrorLevel: "ERR",
+	logrus.FatalLevel: "ERR",
+	logrus.PanicLevel: "ERR",
+}
+
+// Format implements logrus.Formatter.
+func (f *logcabinFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	data := make(logrus.Fields, len(entry.Data)+3)
+	for k, v := range entry.Data {
+		if err, ok := v.(error); ok {
+			data[k] = err.Error()
+		} else {
+			data[k] = v
+		}
+	}
+	data["level"] = logcabinLevels[entry.Level]
+	data["timeMillis"] = entry.Time.UnixNano() / int64(time.Millisecond)
+	data["message"] = entry.Message
+
+	serialized, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal the log entry to JSON: %s", err)
+	}
+	return append(serialized, '\n'), nil
+}
+
+// newLogFormatter returns the logrus formatter for a --log-format value.
+func newLogFormatter(format string) (logrus.Formatter, error) {
+	switch format {
+	case "json":
+		return &logcabinFormatter{}, nil
+	case "text":
+		return &logrus.TextFormatter{}, nil
+	default:
+		return nil, fmt.Errorf("log format %q isn't one of json or text", format)
+	}
+}
+
+// newJobLogger returns a logger that writes to out using logFormatter. Every
+// line carries logcabin's service, art-id, and group-id fields along with the
+// invocation ID of the job. Callers add the phase and step_index fields as
+// they go, using the same phase names as the job's running updates.
+func newJobLogger(out io.Writer, invID string) *logrus.Entry {
+	l := logrus.New()
+	l.Out = out
+	l.Formatter = logFormatter
+	return l.WithFields(logrus.Fields{
+		"service":       "road-runner",
+		"art-id":        "road-runner",
+		"group-id":      "org.iplantc",
+		"invocation_id": invID,
+	})
+}
+
+// logcabinWriter writes each of logcabin's messages to log at one level.
+type logcabinWriter struct {
+	log   *logrus.Entry
+	level logrus.Level
+}
+
+// Write implements io.Writer.
+func (w *logcabinWriter) Write(buf []byte) (int, error) {
+	msg := strings.TrimSuffix(string(buf), "\n")
+	switch w.level {
+	case logrus.DebugLevel:
+		w.log.Debug(msg)
+	case logrus.InfoLevel:
+		w.log.Info(msg)
+	case logrus.WarnLevel:
+		w.log.Warn(msg)
+	default:
+		w.log.Error(msg)
+	}
+	return len(buf), nil
+}
+
+// initLogcabin replaces logcabin's loggers with ones that write to out using
+// formatter, so that road-runner's own logs follow --log-format too.
+func initLogcabin(out io.Writer, formatter logrus.Formatter) {
+	l := logrus.New()
+	l.Out = out
+	l.Formatter = formatter
+	l.Level = logrus.DebugLevel
+	entry := l.WithFields(logrus.Fields{
+		"service":  logcabin.Service,
+		"art-id":   logcabin.Artifact,
+		"group-id": "org.iplantc",
+	})
+	logcabin.Trace = log.New(&logcabinWriter{entry, logrus.DebugLevel}, "", log.Lshortfile)
+	logcabin.Info = log.New(&logcabinWriter{entry, logrus.InfoLevel}, "", log.Lshortfile)
+	logcabin.Warning = log.New(&logcabinWriter{entry, logrus.WarnLevel}, "", log.Lshortfile)
+	logcabin.Error = log.New(&logcabinWriter{entry, logrus.ErrorLevel}, "", log.Lshortfile)
+}
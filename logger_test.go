@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/cyverse-de/logcabin"
+)
+
+func TestNewLogFormatter(t *testing.T) {
+	f, err := newLogFormatter("json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.(*logcabinFormatter); !ok {
+		t.Errorf("json selected a %T", f)
+	}
+
+	f, err = newLogFormatter("text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.(*logrus.TextFormatter); !ok {
+		t.Errorf("text selected a %T", f)
+	}
+
+	if _, err = newLogFormatter("xml"); err == nil {
+		t.Error("an unknown format didn't return an error")
+	}
+}
+
+func TestInitLogcabin(t *testing.T) {
+	defer logcabin.Init("road-runner", "road-runner")
+	logcabin.Init("road-runner", "road-runner")
+
+	var buf bytes.Buffer
+	initLogcabin(&buf, &logrus.TextFormatter{DisableTimestamp: true})
+	logcabin.Warning.Print("disk is almost full")
+
+	out := buf.String()
+	for _, expected := range []string{"level=warning", "disk is almost full", "service=road-runner"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("%q wasn't in %q", expected, out)
+		}
+	}
+	if strings.HasPrefix(out, "{") {
+		t.Errorf("logcabin still wrote JSON: %q", out)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/road-runner/model"
+)
+
+// logFollowInterval is how often the log of a running step is checked for new
+// output while it's being streamed.
+var logFollowInterval = time.Second
+
+// logServer serves the logs of the job's steps at /logs/<step index>. The
+// stdout log is served by default and the stderr log is served when the
+// stream query parameter is set to stderr. The log of the step that's running
+// is streamed until the step finishes or the requester goes away.
+type logServer struct {
+	job  *model.Job
+	dir  string
+	logs stepLogger
+
+	mu      sync.Mutex
+	current int
+}
+
+// stepLogger tells where the logs of a step are written.
+type stepLogger interface {
+	StepLogs(step *model.Step, idx int) (string, string)
+}
+
+// newLogServer returns a *logServer for the logs of the job's steps in the
+// working directory dir. logs tells it where each step's logs are.
+func newLogServer(job *model.Job, dir string, logs stepLogger) *logServer {
+	return &logServer{job: job, dir: dir, logs: logs, current: -1}
+}
+
+// setCurrent records the index of the step that's running. It's -1 when no
+// step is running.
+func (s *logServer) setCurrent(idx int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current = idx
+}
+
+// running returns true if the step at idx is running.
+func (s *logServer) running(idx int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.current == idx
+}
+
+// logPath returns the path to the requested log of the step at idx. An error
+// is returned if the log isn't in the logs directory, since steps may write
+// their output anywhere in the working directory.
+func (s *logServer) logPath(idx int, stream string) (string, error) {
+	rel, stderrLog := s.logs.StepLogs(&s.job.Steps[idx], idx)
+	if stream == "stderr" {
+		rel = stderrLog
+	}
+
+	logsDir, err := filepath.EvalSymlinks(filepath.Join(s.dir, "logs"))
+	if err != nil {
+		return "", err
+	}
+	logPath, err := filepath.EvalSymlinks(filepath.Join(s.dir, rel))
+	if err != nil {
+		return "", err
+	}
+	inLogs, err := filepath.Rel(logsDir, logPath)
+	if err != nil {
+		return "", err
+	}
+	if inLogs == ".." || strings.HasPrefix(inLogs, ".."+string(filepath.Separator)) {
+		return "", os.ErrPermission
+	}
+	return logPath, nil
+}
+
+func (s *logServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	idx, err := strconv.Atoi(strings.TrimPrefix(req.URL.Path, "/logs/"))
+	if err != nil || idx < 0 || idx >= len(s.job.Steps) {
+		http.NotFound(w, req)
+		return
+	}
+	stream := req.URL.Query().Get("stream")
+	if stream != "" && stream != "stdout" && stream != "stderr" {
+		http.Error(w, "stream must be stdout or stderr", http.StatusBadRequest)
+		return
+	}
+
+	logPath, err := s.logPath(idx, stream)
+	if os.IsPermission(err) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	f, err := os.Open(logPath)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	flusher, _ := w.(http.Flusher)
+	for {
+		// Checking before copying means that whatever the step wrote before it
+		// finished is still sent.
+		running := s.running(idx)
+		if _, err = io.Copy(w, f); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if !running {
+			return
+		}
+		select {
+		case <-req.Context().Done():
+			return
+		case <-time.After(logFollowInterval):
+		}
+	}
+}
+
+// serve listens on addr and serves the logs until the listener fails.
+func (s *logServer) serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/logs/", s)
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// newTestLogServer returns a *logServer for the test job with its logs in a
+// temporary working directory.
+func newTestLogServer(t *testing.T) (*logServer, string) {
+	j := _inittests(t, false)
+	dir, err := ioutil.TempDir("", "road-runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(path.Join(dir, "logs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return newLogServer(j, dir, &fakeDocker{}), dir
+}
+
+// getLog returns the status code and body of a request to the server.
+func getLog(t *testing.T, url string) (int, string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestLogServer(t *testing.T) {
+	s, dir := newTestLogServer(t)
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(path.Join(dir, "logs", "condor-stdout-0"), []byte("1 2 3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "logs", "condor-stderr-0"), []byte("oops\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		url    string
+		status int
+		body   string
+	}{
+		{"stdout", "/logs/0", http.StatusOK, "1 2 3\n"},
+		{"stderr", "/logs/0?stream=stderr", http.StatusOK, "oops\n"},
+		{"bad stream", "/logs/0?stream=stdin", http.StatusBadRequest, ""},
+		{"bad index", "/logs/7", http.StatusNotFound, ""},
+		{"not an index", "/logs/../secret", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		status, body := getLog(t, server.URL+test.url)
+		if status != test.status {
+			t.Errorf("%s: status was %d instead of %d", test.name, status, test.status)
+		}
+		if test.status == http.StatusOK && body != test.body {
+			t.Errorf("%s: body was %q instead of %q", test.name, body, test.body)
+		}
+	}
+}
+
+func TestLogServerOnlyServesLogsDirectory(t *testing.T) {
+	s, dir := newTestLogServer(t)
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(path.Join(dir, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.job.Steps[0].StdoutPath = "secret"
+	defer func() { s.job.Steps[0].StdoutPath = "" }()
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	status, body := getLog(t, server.URL+"/logs/0")
+	if status != http.StatusForbidden {
+		t.Errorf("status was %d instead of %d", status, http.StatusForbidden)
+	}
+	if body == "secret" {
+		t.Error("a file outside of the logs directory was served")
+	}
+}
+
+func TestLogServerStreamsRunningStep(t *testing.T) {
+	defer func(interval time.Duration) { logFollowInterval = interval }(logFollowInterval)
+	logFollowInterval = time.Millisecond
+
+	s, dir := newTestLogServer(t)
+	defer os.RemoveAll(dir)
+	logPath := path.Join(dir, "logs", "condor-stdout-0")
+	if err := ioutil.WriteFile(logPath, []byte("first\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	s.setCurrent(0)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0644)
+		if err == nil {
+			f.WriteString("second\n")
+			f.Close()
+		}
+		s.setCurrent(-1)
+	}()
+
+	_, body := getLog(t, server.URL+"/logs/0")
+	if body != "first\nsecond\n" {
+		t.Errorf("body was %q instead of %q", body, "first\nsecond\n")
+	}
+}
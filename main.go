@@ -17,81 +17,24 @@ import (
 	"os"
 	"os/signal"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/cyverse-de/configurate"
-	"github.com/cyverse-de/dockerops"
 	"github.com/cyverse-de/logcabin"
-	"github.com/cyverse-de/messaging"
-	"github.com/cyverse-de/model"
+	"github.com/cyverse-de/road-runner/dockerops"
+	"github.com/cyverse-de/road-runner/messaging"
+	"github.com/cyverse-de/road-runner/model"
 	"github.com/cyverse-de/version"
 	"github.com/streadway/amqp"
 
 	"github.com/spf13/viper"
 )
 
-var (
-	job              *model.Job
-	dckr             *dockerops.Docker
-	client           *messaging.Client
-	amqpExchangeName string
-	amqpExchangeType string
-)
-
-func hostname() string {
-	h, err := os.Hostname()
-	if err != nil {
-		logcabin.Error.Printf("Couldn't get the hostname: %s", err.Error())
-		return ""
-	}
-	return h
-}
-
-func fail(client *messaging.Client, job *model.Job, msg string) error {
-	logcabin.Error.Print(msg)
-	return client.PublishJobUpdate(&messaging.UpdateMessage{
-		Job:     job,
-		State:   messaging.FailedState,
-		Message: msg,
-		Sender:  hostname(),
-	})
-}
-
-func success(client *messaging.Client, job *model.Job) error {
-	logcabin.Info.Print("Job success")
-	return client.PublishJobUpdate(&messaging.UpdateMessage{
-		Job:    job,
-		State:  messaging.SucceededState,
-		Sender: hostname(),
-	})
-}
-
-func running(client *messaging.Client, job *model.Job, msg string) {
-	err := client.PublishJobUpdate(&messaging.UpdateMessage{
-		Job:     job,
-		State:   messaging.RunningState,
-		Message: msg,
-		Sender:  hostname(),
-	})
-	if err != nil {
-		logcabin.Error.Print(err)
-	}
-	logcabin.Info.Print(msg)
-}
-
-func impendingCancellation(client *messaging.Client, job *model.Job, msg string) {
-	err := client.PublishJobUpdate(&messaging.UpdateMessage{
-		Job:     job,
-		State:   messaging.ImpendingCancellationState,
-		Message: msg,
-		Sender:  hostname(),
-	})
-	if err != nil {
-		logcabin.Error.Print(err)
-	}
-	logcabin.Info.Print(msg)
-}
+var dckr *dockerops.Docker
 
 // TimeTracker tracks when road-runner should exit.
 type TimeTracker struct {
@@ -116,7 +59,7 @@ func (t *TimeTracker) ApplyDelta(deltaDuration time.Duration) error {
 	newEndDate := t.EndDate.Add(deltaDuration)
 
 	//create a new duration that is the difference between the new end date and now.
-	newDuration := t.EndDate.Sub(time.Now())
+	newDuration := newEndDate.Sub(time.Now())
 
 	//modify the Timer to use the new duration.
 	wasActive := t.Timer.Reset(newDuration)
@@ -130,63 +73,76 @@ func (t *TimeTracker) ApplyDelta(deltaDuration time.Duration) error {
 	return nil
 }
 
+// NewWallTimeTracker returns a *TimeTracker that limits the run time of the
+// whole job, including the image pulls and the file transfers. When it
+// expires, a stop with StatusTimeLimit is requested on rc.Stop, so Run aborts
+// what it's doing and uploads the outputs before the job is cleaned up.
+func (rc *RunContext) NewWallTimeTracker(d time.Duration) *TimeTracker {
+	return NewTimeTracker(d, func() {
+		rc.running(fmt.Sprintf("Job exceeded the maximum wall time of %s", d.String()))
+		rc.requestStop(messaging.StatusTimeLimit)
+	})
+}
+
 // RegisterTimeLimitDeltaListener sets a function that listens for TimeLimitDelta
-// messages on the given client.
-func RegisterTimeLimitDeltaListener(client *messaging.Client, timeTracker *TimeTracker, invID string) {
-	client.AddDeletableConsumer(
-		amqpExchangeName,
-		amqpExchangeType,
+// messages for the context's job.
+func (rc *RunContext) RegisterTimeLimitDeltaListener(timeTracker *TimeTracker) {
+	invID := rc.Job.InvocationID
+	rc.Client.AddDeletableConsumer(
+		rc.ExchangeName,
+		rc.ExchangeType,
 		messaging.TimeLimitDeltaQueueName(invID),
 		messaging.TimeLimitDeltaRequestKey(invID),
 		func(d amqp.Delivery) {
 			d.Ack(false)
 
-			running(client, job, "Received delta request")
+			rc.running("Received delta request")
 
 			deltaMsg := &messaging.TimeLimitDelta{}
 			err := json.Unmarshal(d.Body, deltaMsg)
 			if err != nil {
-				running(client, job, fmt.Sprintf("Failed to unmarshal time limit delta: %s", err.Error()))
+				rc.running(fmt.Sprintf("Failed to unmarshal time limit delta: %s", err.Error()))
 				return
 			}
 
 			newDuration, err := time.ParseDuration(deltaMsg.Delta)
 			if err != nil {
-				running(client, job, fmt.Sprintf("Failed to parse duration string from message: %s", err.Error()))
+				rc.running(fmt.Sprintf("Failed to parse duration string from message: %s", err.Error()))
 				return
 			}
 
 			err = timeTracker.ApplyDelta(newDuration)
 			if err != nil {
-				running(client, job, fmt.Sprintf("Failed to apply time limit delta: %s", err.Error()))
+				rc.running(fmt.Sprintf("Failed to apply time limit delta: %s", err.Error()))
 				return
 			}
 
-			running(client, job, fmt.Sprintf("Applied time delta of %s. New end date is %s", deltaMsg.Delta, timeTracker.EndDate.UTC().String()))
+			rc.running(fmt.Sprintf("Applied time delta of %s. New end date is %s", deltaMsg.Delta, timeTracker.EndDate.UTC().String()))
 		})
 }
 
 // RegisterTimeLimitRequestListener sets a function that listens for
-// TimeLimitRequest messages on the given client.
-func RegisterTimeLimitRequestListener(client *messaging.Client, timeTracker *TimeTracker, invID string) {
-	client.AddDeletableConsumer(
-		amqpExchangeName,
-		amqpExchangeType,
+// TimeLimitRequest messages for the context's job.
+func (rc *RunContext) RegisterTimeLimitRequestListener(timeTracker *TimeTracker) {
+	invID := rc.Job.InvocationID
+	rc.Client.AddDeletableConsumer(
+		rc.ExchangeName,
+		rc.ExchangeType,
 		messaging.TimeLimitRequestQueueName(invID),
 		messaging.TimeLimitRequestKey(invID),
 		func(d amqp.Delivery) {
 			d.Ack(false)
 
-			running(client, job, "Received time limit request")
+			rc.running("Received time limit request")
 
 			timeLeft := int64(timeTracker.EndDate.Sub(time.Now())) / int64(time.Millisecond)
-			err := client.SendTimeLimitResponse(invID, timeLeft)
+			err := rc.Client.SendTimeLimitResponse(invID, timeLeft)
 			if err != nil {
-				running(client, job, fmt.Sprintf("Failed to send time limit response: %s", err.Error()))
+				rc.running(fmt.Sprintf("Failed to send time limit response: %s", err.Error()))
 				return
 			}
 
-			running(client, job, fmt.Sprintf("Sent message saying that time left is %dms", timeLeft))
+			rc.running(fmt.Sprintf("Sent message saying that time left is %dms", timeLeft))
 		})
 }
 
@@ -194,10 +150,11 @@ func RegisterTimeLimitRequestListener(client *messaging.Client, timeTracker *Tim
 // are sent on the jobs exchange with the key for time limit responses. This
 // service doesn't need these messages, this is just here to force the queue
 // to get cleaned up when road-runner exits.
-func RegisterTimeLimitResponseListener(client *messaging.Client, invID string) {
-	client.AddDeletableConsumer(
-		amqpExchangeName,
-		amqpExchangeType,
+func (rc *RunContext) RegisterTimeLimitResponseListener() {
+	invID := rc.Job.InvocationID
+	rc.Client.AddDeletableConsumer(
+		rc.ExchangeName,
+		rc.ExchangeType,
 		messaging.TimeLimitResponsesQueueName(invID),
 		messaging.TimeLimitResponsesKey(invID),
 		func(d amqp.Delivery) {
@@ -207,46 +164,163 @@ func RegisterTimeLimitResponseListener(client *messaging.Client, invID string) {
 }
 
 // RegisterStopRequestListener sets a function that responses to StopRequest
-// messages.
-func RegisterStopRequestListener(client *messaging.Client, exit chan messaging.StatusCode, invID string) {
-	client.AddDeletableConsumer(
-		amqpExchangeName,
-		amqpExchangeType,
+// messages. cancelPulls is called before the exit status is sent so that any
+// image pulls that are in progress are aborted.
+func (rc *RunContext) RegisterStopRequestListener(exit chan messaging.StatusCode, cancelPulls context.CancelFunc) {
+	invID := rc.Job.InvocationID
+	rc.Client.AddDeletableConsumer(
+		rc.ExchangeName,
+		rc.ExchangeType,
 		messaging.StopQueueName(invID),
 		messaging.StopRequestKey(invID),
 		func(d amqp.Delivery) {
 			d.Ack(false)
-			running(client, job, "Received stop request")
+			rc.running("Received stop request")
+			cancelPulls()
 			exit <- messaging.StatusKilled
 		})
 }
 
-func copyJobFile(uuid, from, toDir string) error {
+// The schemes for naming the staged job file. By default the file is named
+// <uuid>.json, which collides with the file from an earlier attempt at the
+// same invocation if that file wasn't cleaned up. The other schemes add a
+// suffix so that each attempt gets its own file.
+const (
+	jobFileNamingTimestamp = "timestamp"
+	jobFileNamingAttempt   = "attempt"
+)
+
+// validateJobFileNaming returns an error if naming isn't a known scheme for
+// naming the staged job file.
+func validateJobFileNaming(naming string) error {
+	switch naming {
+	case "", jobFileNamingTimestamp, jobFileNamingAttempt:
+		return nil
+	default:
+		return fmt.Errorf("job.file_naming must be %s or %s, not %q", jobFileNamingTimestamp, jobFileNamingAttempt, naming)
+	}
+}
+
+// jobFileSuffix returns the suffix that's added to the name of the job file
+// staged in toDir under the given naming scheme. It's computed once so that
+// the file is deleted under the same name it was copied to.
+func jobFileSuffix(naming, uuid, toDir string, now time.Time) string {
+	switch naming {
+	case jobFileNamingTimestamp:
+		return now.UTC().Format("20060102T150405.000000000Z")
+	case jobFileNamingAttempt:
+		for attempt := 1; ; attempt++ {
+			suffix := strconv.Itoa(attempt)
+			if _, err := os.Stat(jobFilePath(uuid, suffix, toDir)); err != nil {
+				return suffix
+			}
+		}
+	default:
+		return ""
+	}
+}
+
+// jobFilePath returns the path to the job file staged in toDir, which is
+// <toDir>/<uuid>.json or <toDir>/<uuid>-<suffix>.json.
+func jobFilePath(uuid, suffix, toDir string) string {
+	if suffix == "" {
+		return path.Join(toDir, fmt.Sprintf("%s.json", uuid))
+	}
+	return path.Join(toDir, fmt.Sprintf("%s-%s.json", uuid, suffix))
+}
+
+// copyJobFile copies the job file to the path returned by jobFilePath. The
+// copy is written to a temporary file in toDir first and renamed into place,
+// so a partially written job file is never visible to the image janitor.
+func copyJobFile(uuid, suffix, from, toDir string) error {
 	inputReader, err := os.Open(from)
 	if err != nil {
 		return err
 	}
+	defer inputReader.Close()
 
-	outputFilePath := path.Join(toDir, fmt.Sprintf("%s.json", uuid))
-	outputWriter, err := os.Create(outputFilePath)
+	tmpFile, err := ioutil.TempFile(toDir, fmt.Sprintf(".%s-", uuid))
 	if err != nil {
 		return err
 	}
+	tmpPath := tmpFile.Name()
+
+	if _, err = io.Copy(tmpFile, inputReader); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err = tmpFile.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
 
-	if _, err := io.Copy(outputWriter, inputReader); err != nil {
+	if err = os.Rename(tmpPath, jobFilePath(uuid, suffix, toDir)); err != nil {
+		os.Remove(tmpPath)
 		return err
 	}
+	return nil
+}
 
+// validateIRODSPath returns an error if p isn't a clean, absolute iRODS path
+// that includes at least a zone and a collection.
+func validateIRODSPath(p string) error {
+	if !strings.HasPrefix(p, "/") {
+		return fmt.Errorf("iRODS path %q is not absolute", p)
+	}
+	trimmed := strings.TrimSuffix(p, "/")
+	if path.Clean(trimmed) != trimmed {
+		return fmt.Errorf("iRODS path %q is not a clean path", p)
+	}
+	if strings.Count(trimmed, "/") < 2 {
+		return fmt.Errorf("iRODS path %q must include a zone and a collection", p)
+	}
 	return nil
 }
 
-func deleteJobFile(uuid, toDir string) {
-	filePath := path.Join(toDir, fmt.Sprintf("%s.json", uuid))
-	if err := os.Remove(filePath); err != nil {
+// overrideOutputDir sends the job's outputs to dir instead of the directory
+// given in the job submission. The upload commands are generated from the
+// job's output directory, so they pick up the override.
+func overrideOutputDir(job *model.Job, dir string) error {
+	if err := validateIRODSPath(dir); err != nil {
+		return err
+	}
+	job.OutputDir = dir
+	job.CreateOutputSubdir = false
+	return nil
+}
+
+// deleteJobFile deletes the job file that copyJobFile staged in toDir.
+func deleteJobFile(uuid, suffix, toDir string) {
+	if err := os.Remove(jobFilePath(uuid, suffix, toDir)); err != nil {
 		logcabin.Error.Print(err)
 	}
 }
 
+// deleteJobFiles deletes every job file staged in toDir for the invocation,
+// whatever naming scheme was used for it.
+func deleteJobFiles(uuid, toDir string) {
+	paths, err := filepath.Glob(jobFilePath(uuid, "*", toDir))
+	if err != nil {
+		logcabin.Error.Print(err)
+	}
+	for _, p := range append(paths, jobFilePath(uuid, "", toDir)) {
+		if err = os.Remove(p); err != nil && !os.IsNotExist(err) {
+			logcabin.Error.Print(err)
+		}
+	}
+}
+
+// newDockerClient connects to the Docker daemon at uri, using the HTTP
+// timeouts from the docker section of the config.
+func newDockerClient(cfg *viper.Viper, uri string) (dockerops.DockerClient, error) {
+	return dockerops.NewDockerClient(
+		uri,
+		cfg.GetDuration("docker.http_timeout"),
+		cfg.GetDuration("docker.keepalive_interval"),
+	)
+}
+
 func main() {
 	logcabin.Init("road-runner", "road-runner")
 
@@ -254,6 +328,9 @@ func main() {
 
 	sighandler := InitSignalHandler()
 
+	// Filled in once the job file is read and the AMQP client is set up.
+	rc := &RunContext{Stop: make(chan messaging.StatusCode, 1)}
+
 	sighandler.Receive(
 		sigquitter,
 		func(sig os.Signal) {
@@ -263,19 +340,23 @@ func main() {
 				logcabin.Warning.Println("Docker client is nil, can't clean up. Probably don't need to.")
 			}
 
-			if job == nil {
+			if rc.Job == nil {
 				logcabin.Warning.Println("Info didn't get parsed from the job file, can't clean up. Probably don't need to.")
 			}
 
-			if dckr != nil && job != nil {
-				cleanup(job)
+			// The step's exit code has to be read before cleanup removes its
+			// container.
+			exitCode := -1
+			if dckr != nil && rc.Job != nil {
+				exitCode = signalExitCode(dckr, rc.Job.InvocationID, rc.config.preserveExit)
+				cleanup(dckr, rc.Job.InvocationID, rc.config.cleanup)
 			}
 
-			if client != nil && job != nil {
-				fail(client, job, fmt.Sprintf("Received signal %s", sig))
+			if rc.Publisher != nil && rc.Job != nil {
+				fail(rc.Publisher, rc.Job, &messaging.ExitCode{Status: messaging.StatusKilled}, fmt.Sprintf("Received signal %s", sig))
 			}
 
-			os.Exit(-1)
+			os.Exit(exitCode)
 		},
 		func() {
 			logcabin.Info.Println("Signal handler is quitting")
@@ -297,6 +378,10 @@ func main() {
 		cfgPath     = flag.String("config", "", "The path to the config file")
 		writeTo     = flag.String("write-to", "/opt/image-janitor", "The directory to copy job files to.")
 		dockerURI   = flag.String("docker", "unix:///var/run/docker.sock", "The URI for connecting to docker.")
+		outputDir   = flag.String("output-dir", "", "The iRODS path to upload outputs to, overriding the job's output directory.")
+		logFormat   = flag.String("log-format", "json", "The format of the logs, either json or text.")
+		preflight   = flag.Bool("preflight", false, "Check that Docker, AMQP, and the porklock image are available, then exit without running a job.")
+		cleanupInv  = flag.String("cleanup-invocation", "", "Remove the containers, volume, and job file left behind by the given invocation ID, then exit without running a job.")
 		err         error
 		cfg         *viper.Viper
 	)
@@ -308,6 +393,11 @@ func main() {
 		os.Exit(0)
 	}
 
+	if logFormatter, err = newLogFormatter(*logFormat); err != nil {
+		logcabin.Error.Fatal(err)
+	}
+	initLogcabin(os.Stdout, logFormatter)
+
 	if *cfgPath == "" {
 		logcabin.Error.Fatal("--config must be set.")
 	}
@@ -322,6 +412,39 @@ func main() {
 	}
 	logcabin.Info.Printf("Done reading config from %s", *cfgPath)
 
+	dockerops.SetLabelNamespace(cfg.GetString("labels.namespace"))
+
+	if rc.config, err = newRunConfig(cfg); err != nil {
+		logcabin.Error.Fatal(err)
+	}
+
+	if *preflight {
+		dockerClient, err := newDockerClient(cfg, *dockerURI)
+		if err != nil {
+			logcabin.Error.Fatal(err)
+		}
+		dckr = dockerops.NewDocker(context.Background(), cfg, dockerClient)
+		checks := []preflightCheck{
+			{"docker", dockerCheck(dckr.Client)},
+			{"amqp", amqpCheck(amqpURI(cfg), dialAMQP)},
+			{"porklock image", porklockCheck(dckr)},
+		}
+		if err = runPreflight(os.Stdout, checks); err != nil {
+			logcabin.Error.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	if *cleanupInv != "" {
+		dockerClient, err := newDockerClient(cfg, *dockerURI)
+		if err != nil {
+			logcabin.Error.Fatal(err)
+		}
+		dckr = dockerops.NewDocker(context.Background(), cfg, dockerClient)
+		cleanupInvocation(dckr, *cleanupInv, *writeTo, rc.config.cleanup)
+		os.Exit(0)
+	}
+
 	if *jobFile == "" {
 		logcabin.Error.Fatal("--job must be set.")
 	}
@@ -331,36 +454,98 @@ func main() {
 		logcabin.Error.Fatal(err)
 	}
 
-	job, err = model.NewFromData(cfg, data)
+	job, err := model.NewFromData(cfg, data)
 	if err != nil {
 		logcabin.Error.Fatal(err)
 	}
 
+	if *outputDir != "" {
+		if err = overrideOutputDir(job, *outputDir); err != nil {
+			logcabin.Error.Fatal(err)
+		}
+		logcabin.Info.Printf("Uploading outputs to %s", job.OutputDirectory())
+	}
+
 	if _, err = os.Open(*writeTo); err != nil {
 		logcabin.Error.Fatal(err)
 	}
 
-	if err = copyJobFile(job.InvocationID, *jobFile, *writeTo); err != nil {
+	jobFileNaming := cfg.GetString("job.file_naming")
+	if err = validateJobFileNaming(jobFileNaming); err != nil {
+		logcabin.Error.Fatal(err)
+	}
+	stagedSuffix := jobFileSuffix(jobFileNaming, job.InvocationID, *writeTo, time.Now())
+	if err = copyJobFile(job.InvocationID, stagedSuffix, *jobFile, *writeTo); err != nil {
 		logcabin.Error.Fatal(err)
 	}
 
-	uri := cfg.GetString("amqp.uri")
-	amqpExchangeName = cfg.GetString("amqp.exchange.name")
-	amqpExchangeType = cfg.GetString("amqp.exchange.type")
+	var archived chan struct{}
+	if endpoint := cfg.GetString("archive.endpoint"); endpoint != "" {
+		archived = archiveJob(newS3Uploader(
+			endpoint,
+			cfg.GetString("archive.bucket"),
+			cfg.GetString("archive.region"),
+			cfg.GetString("archive.access_key"),
+			cfg.GetString("archive.secret_key"),
+		), data, job)
+	}
 
-	client, err = messaging.NewClient(uri, true)
+	if err = dockerops.ValidateUploadMode(cfg.GetString("transfer.upload_mode")); err != nil {
+		logcabin.Error.Fatal(err)
+	}
+	if err = dockerops.ValidatePorklockLogLevel(cfg.GetString("porklock.log_level")); err != nil {
+		logcabin.Error.Fatal(err)
+	}
+	if err = dockerops.ValidateUmask(strings.TrimSpace(cfg.GetString("job.umask"))); err != nil {
+		logcabin.Error.Fatal(err)
+	}
+
+	uri := amqpURI(cfg)
+	exchangeName := cfg.GetString("amqp.exchange.name")
+	logcabin.Info.Printf("Connecting to AMQP at %s", redactURI(uri))
+
+	client, err := messaging.NewClient(uri, true)
 	if err != nil {
 		logcabin.Error.Fatal(err)
 	}
 	defer client.Close()
 
-	client.SetupPublishing(amqpExchangeName)
+	client.SetupPublishing(exchangeName)
+	var publisher JobUpdatePublisher = client
+
+	// Mirror job updates to a second exchange if one is configured. The mirror
+	// is best-effort, so problems setting it up don't stop the job.
+	if mirrorExchange := cfg.GetString("amqp.mirror_exchange"); mirrorExchange != "" {
+		mirrorClient, err := messaging.NewClient(uri, false)
+		if err != nil {
+			logcabin.Error.Printf("not mirroring job updates to %s: %s", mirrorExchange, err)
+		} else {
+			defer mirrorClient.Close()
+			if err = mirrorClient.SetupPublishing(mirrorExchange); err != nil {
+				logcabin.Error.Printf("not mirroring job updates to %s: %s", mirrorExchange, err)
+			} else {
+				publisher = &mirroredPublisher{primary: client, mirror: mirrorClient}
+			}
+		}
+	}
+
+	// Keep chatty steps from flooding the broker with running updates.
+	if rate := cfg.GetFloat64("amqp.update_rate"); rate > 0 {
+		publisher = newThrottledPublisher(publisher, rate)
+	}
+
+	rc.Job = job
+	rc.Client = client
+	rc.Publisher = publisher
+	rc.ExchangeName = exchangeName
+	rc.ExchangeType = cfg.GetString("amqp.exchange.type")
 
-	dckr, err = dockerops.NewDocker(context.Background(), cfg, *dockerURI)
+	dockerClient, err := newDockerClient(cfg, *dockerURI)
 	if err != nil {
-		fail(client, job, "Failed to connect to local docker socket")
+		fail(publisher, job, nil, "Failed to connect to local docker socket")
 		logcabin.Error.Fatal(err)
 	}
+	dckr = dockerops.NewDocker(context.Background(), cfg, dockerClient)
 
 	// The channel that the exit code will be passed along on.
 	exit := make(chan messaging.StatusCode)
@@ -369,17 +554,32 @@ func main() {
 	finalExit := make(chan messaging.StatusCode)
 
 	// Launch the go routine that will handle job exits by signal or timer.
-	go Exit(exit, finalExit)
+	go Exit(rc, exit, finalExit)
 
 	go client.Listen()
 
-	RegisterStopRequestListener(client, exit, job.InvocationID)
+	// Cancelled when a stop request arrives so that pulls don't run to completion.
+	pullCtx, cancelPulls := context.WithCancel(context.Background())
+	defer cancelPulls()
+
+	rc.RegisterStopRequestListener(exit, cancelPulls)
+
+	if maxWallTime := cfg.GetDuration("job.max_wall_time"); maxWallTime > 0 {
+		timeTracker := rc.NewWallTimeTracker(maxWallTime)
+		rc.RegisterTimeLimitDeltaListener(timeTracker)
+		rc.RegisterTimeLimitRequestListener(timeTracker)
+		rc.RegisterTimeLimitResponseListener()
+	}
 
-	go Run(client, dckr, exit)
+	go Run(pullCtx, rc, dckr, exit)
 
 	exitCode := <-finalExit
 
-	deleteJobFile(job.InvocationID, *writeTo)
+	deleteJobFile(job.InvocationID, stagedSuffix, *writeTo)
+
+	if !waitForArchive(archived, archiveTimeout) {
+		logcabin.Warning.Printf("gave up waiting for the job to be archived after %s", archiveTimeout)
+	}
 
-	os.Exit(int(exitCode))
+	os.Exit(exitCodeFor(exitCode))
 }
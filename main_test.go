@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -10,16 +11,17 @@ import (
 	"time"
 
 	"github.com/cyverse-de/configurate"
-	"github.com/cyverse-de/messaging"
-	"github.com/cyverse-de/model"
+	"github.com/cyverse-de/road-runner/messaging"
+	"github.com/cyverse-de/road-runner/model"
 	"github.com/streadway/amqp"
 
 	"github.com/spf13/viper"
 )
 
 var (
-	s   *model.Job
-	cfg *viper.Viper
+	s          *model.Job
+	cfg        *viper.Viper
+	testClient *messaging.Client
 )
 
 func shouldrun() bool {
@@ -46,51 +48,71 @@ func JSONData() ([]byte, error) {
 }
 
 func _inittests(t *testing.T, memoize bool) *model.Job {
-	var err error
 	if s == nil || !memoize {
-		cfg, err = configurate.Init("test/test_config.yaml")
-		if err != nil {
-			t.Fatal(err)
-		}
-		cfg.Set("irods.base", "/path/to/irodsbase")
-		cfg.Set("irods.host", "hostname")
-		cfg.Set("irods.port", "1247")
-		cfg.Set("irods.user", "user")
-		cfg.Set("irods.pass", "pass")
-		cfg.Set("irods.zone", "test")
-		cfg.Set("irods.resc", "")
-		cfg.Set("condor.log_path", "/path/to/logs")
-		cfg.Set("condor.porklock_tag", "test")
-		cfg.Set("condor.filter_files", "foo,bar,baz,blippy")
-		cfg.Set("condor.request_disk", "0")
-		data, err := JSONData()
-		if err != nil {
-			t.Error(err)
-		}
-		s, err = model.NewFromData(cfg, data)
-		if err != nil {
-			t.Error(err)
-		}
+		s = newTestJob(t)
 	}
 	return s
 }
 
+// newTestJob returns a new copy of the test job, which tests are free to
+// change without affecting any other test.
+func newTestJob(t *testing.T) *model.Job {
+	var err error
+	cfg, err = configurate.Init("test/test_config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Set("irods.base", "/path/to/irodsbase")
+	cfg.Set("irods.host", "hostname")
+	cfg.Set("irods.port", "1247")
+	cfg.Set("irods.user", "user")
+	cfg.Set("irods.pass", "pass")
+	cfg.Set("irods.zone", "test")
+	cfg.Set("irods.resc", "")
+	cfg.Set("condor.log_path", "/path/to/logs")
+	cfg.Set("condor.porklock_tag", "test")
+	cfg.Set("condor.filter_files", "foo,bar,baz,blippy")
+	cfg.Set("condor.request_disk", "0")
+	data, err := JSONData()
+	if err != nil {
+		t.Error(err)
+	}
+	job, err := model.NewFromData(cfg, data)
+	if err != nil {
+		t.Error(err)
+	}
+	return job
+}
+
 func inittests(t *testing.T) *model.Job {
 	return _inittests(t, true)
 }
 
 func GetClient(t *testing.T) *messaging.Client {
 	var err error
-	if client != nil {
-		return client
+	if testClient != nil {
+		return testClient
 	}
-	client, err = messaging.NewClient(messagingURI(), false)
+	testClient, err = messaging.NewClient(messagingURI(), false)
 	if err != nil {
 		t.Error(err)
 	}
-	client.SetupPublishing(messagingExchangeName())
-	go client.Listen()
-	return client
+	testClient.SetupPublishing(messagingExchangeName())
+	go testClient.Listen()
+	return testClient
+}
+
+// testRunContext returns a *RunContext for the invocation ID that uses the
+// test AMQP client.
+func testRunContext(t *testing.T, invID string) *RunContext {
+	client := GetClient(t)
+	return &RunContext{
+		Job:          &model.Job{InvocationID: invID},
+		Client:       client,
+		Publisher:    client,
+		ExchangeName: messagingExchangeName(),
+		ExchangeType: messagingExchangeType(),
+	}
 }
 
 func messagingURI() string {
@@ -123,7 +145,7 @@ func TestRegisterTimeLimitDeltaListener(t *testing.T) {
 	timeTracker := NewTimeTracker(defaultDuration, exitFunc)
 	unwanted := timeTracker.EndDate
 	invID := "test_inv"
-	RegisterTimeLimitDeltaListener(client, timeTracker, invID)
+	testRunContext(t, invID).RegisterTimeLimitDeltaListener(timeTracker)
 	client.SendTimeLimitDelta(invID, "9h")
 	time.Sleep(1000 * time.Millisecond)
 	if timeTracker.EndDate == unwanted {
@@ -159,7 +181,7 @@ func TestRegisterTimeLimitRequestListener(t *testing.T) {
 	client.AddConsumer(messagingExchangeName(), messagingExchangeType(), "yay", key, handler)
 
 	// Listen for time limit requests
-	RegisterTimeLimitRequestListener(client, timeTracker, invID)
+	testRunContext(t, invID).RegisterTimeLimitRequestListener(timeTracker)
 
 	// Send a time limit request
 	err = client.SendTimeLimitRequest(invID)
@@ -187,7 +209,8 @@ func TestRegisterStopRequestListener(t *testing.T) {
 	client := GetClient(t)
 	invID := "test"
 	exit := make(chan messaging.StatusCode)
-	RegisterStopRequestListener(client, exit, invID)
+	ctx, cancel := context.WithCancel(context.Background())
+	testRunContext(t, invID).RegisterStopRequestListener(exit, cancel)
 	err := client.SendStopRequest(invID, "test", "this is a test")
 	if err != nil {
 		t.Error(err)
@@ -196,6 +219,9 @@ func TestRegisterStopRequestListener(t *testing.T) {
 	if actual != messaging.StatusKilled {
 		t.Errorf("StatusCode was %d instead of %d", int64(actual), int64(messaging.StatusKilled))
 	}
+	if ctx.Err() == nil {
+		t.Error("stop request didn't cancel the pull context")
+	}
 }
 
 func TestNewTimeTracker(t *testing.T) {
@@ -220,6 +246,25 @@ func TestNewTimeTracker(t *testing.T) {
 	}
 }
 
+func TestNewWallTimeTracker(t *testing.T) {
+	p := &fakePublisher{}
+	rc := &RunContext{Job: inittests(t), Publisher: p, Stop: make(chan messaging.StatusCode, 1)}
+
+	rc.NewWallTimeTracker(50 * time.Millisecond)
+
+	select {
+	case actual := <-rc.Stop:
+		if actual != messaging.StatusTimeLimit {
+			t.Errorf("StatusCode was %d instead of %d", int64(actual), int64(messaging.StatusTimeLimit))
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("the wall time limit wasn't enforced")
+	}
+	if len(p.updates) != 1 {
+		t.Errorf("%d updates were sent instead of 1", len(p.updates))
+	}
+}
+
 func TestApplyDelta(t *testing.T) {
 	defaultDuration, err := time.ParseDuration("10s")
 	if err != nil {
@@ -241,11 +286,35 @@ func TestApplyDelta(t *testing.T) {
 	}
 }
 
+func TestApplyDeltaDelaysTheTimeLimit(t *testing.T) {
+	p := &fakePublisher{}
+	rc := &RunContext{Job: inittests(t), Publisher: p, Stop: make(chan messaging.StatusCode, 1)}
+
+	tt := rc.NewWallTimeTracker(50 * time.Millisecond)
+	if err := tt.ApplyDelta(250 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-rc.Stop:
+		t.Fatal("the time limit was enforced at the old end date")
+	case <-time.After(200 * time.Millisecond):
+	}
+	select {
+	case actual := <-rc.Stop:
+		if actual != messaging.StatusTimeLimit {
+			t.Errorf("StatusCode was %d instead of %d", int64(actual), int64(messaging.StatusTimeLimit))
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("the extended time limit wasn't enforced")
+	}
+}
+
 func TestCopyJobFile(t *testing.T) {
 	uuid := "00000000-0000-0000-0000-000000000000"
 	from := path.Join("test", fmt.Sprintf("%s.json", uuid))
 	to := "/tmp"
-	err := copyJobFile(uuid, from, to)
+	err := copyJobFile(uuid, "", from, to)
 	if err != nil {
 		t.Error(err)
 	}
@@ -259,21 +328,129 @@ func TestCopyJobFile(t *testing.T) {
 	}
 }
 
+func TestCopyJobFileFailure(t *testing.T) {
+	uuid := "00000000-0000-0000-0000-000000000000"
+	to, err := ioutil.TempDir("", "road-runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(to)
+
+	// Reading from a directory fails partway through the copy.
+	if err = copyJobFile(uuid, "", "test", to); err == nil {
+		t.Error("copying a directory didn't return an error")
+	}
+	entries, err := ioutil.ReadDir(to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("%s was left behind after a failed copy", e.Name())
+	}
+}
+
 func TestDeleteJobFile(t *testing.T) {
 	uuid := "00000000-0000-0000-0000-000000000000"
 	from := path.Join("test", fmt.Sprintf("%s.json", uuid))
 	to := "/tmp"
-	err := copyJobFile(uuid, from, to)
+	err := copyJobFile(uuid, "", from, to)
 	if err != nil {
 		t.Error(err)
 	}
-	deleteJobFile(uuid, to)
+	deleteJobFile(uuid, "", to)
 	tmpPath := path.Join(to, fmt.Sprintf("%s.json", uuid))
 	if _, err := os.Open(tmpPath); err == nil {
 		t.Errorf("tmpPath %s existed after deleteJobFile() was called", tmpPath)
 	}
 }
 
+func TestJobFileNaming(t *testing.T) {
+	uuid := "00000000-0000-0000-0000-000000000000"
+	from := path.Join("test", fmt.Sprintf("%s.json", uuid))
+	now := time.Date(2017, 3, 14, 15, 9, 26, 535897932, time.UTC)
+
+	tests := []struct {
+		naming   string
+		expected []string
+	}{
+		{"", []string{uuid + ".json"}},
+		{jobFileNamingTimestamp, []string{uuid + "-20170314T150926.535897932Z.json"}},
+		{jobFileNamingAttempt, []string{uuid + "-1.json", uuid + "-2.json"}},
+	}
+	for _, test := range tests {
+		to, err := ioutil.TempDir("", "road-runner")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(to)
+
+		// Each attempt is staged while the files from earlier attempts linger.
+		var suffixes []string
+		for i, expected := range test.expected {
+			suffix := jobFileSuffix(test.naming, uuid, to, now)
+			suffixes = append(suffixes, suffix)
+			if err = copyJobFile(uuid, suffix, from, to); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = os.Stat(path.Join(to, expected)); err != nil {
+				t.Errorf("%q: attempt %d wasn't staged as %s: %s", test.naming, i+1, expected, err)
+			}
+		}
+
+		for _, suffix := range suffixes {
+			deleteJobFile(uuid, suffix, to)
+		}
+		entries, err := ioutil.ReadDir(to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			t.Errorf("%q: %s was left behind after deleteJobFile() was called", test.naming, e.Name())
+		}
+	}
+}
+
+func TestDeleteJobFiles(t *testing.T) {
+	uuid := "00000000-0000-0000-0000-000000000000"
+	to, err := ioutil.TempDir("", "road-runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(to)
+	names := []string{uuid + ".json", uuid + "-1.json", uuid + "-20170314T150926Z.json", "other.json"}
+	for _, name := range names {
+		if err = ioutil.WriteFile(path.Join(to, name), []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deleteJobFiles(uuid, to)
+
+	entries, err := ioutil.ReadDir(to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() != "other.json" {
+			t.Errorf("%s was left behind", e.Name())
+		}
+	}
+	if _, err = os.Stat(path.Join(to, "other.json")); err != nil {
+		t.Errorf("another invocation's job file was deleted: %s", err)
+	}
+}
+
+func TestValidateJobFileNaming(t *testing.T) {
+	for _, naming := range []string{"", "timestamp", "attempt"} {
+		if err := validateJobFileNaming(naming); err != nil {
+			t.Errorf("%q: %s", naming, err)
+		}
+	}
+	if err := validateJobFileNaming("uuid"); err == nil {
+		t.Error("err was nil for an unknown scheme")
+	}
+}
+
 func TestJobWithoutCancellationWarning(t *testing.T) {
 	if determineCancellationWarningBuffer(59*time.Second) != 0 {
 		t.Error("A timeout warning message would be produced when it shouldn't")
@@ -316,3 +493,41 @@ func TestJobWithMaximumWarningBuffer(t *testing.T) {
 		)
 	}
 }
+
+func TestValidateIRODSPath(t *testing.T) {
+	valid := []string{"/iplant/home/ipcdev", "/iplant/home/ipcdev/analyses/"}
+	for _, p := range valid {
+		if err := validateIRODSPath(p); err != nil {
+			t.Errorf("%q returned an error: %s", p, err)
+		}
+	}
+	invalid := []string{"", "iplant/home/ipcdev", "/iplant", "/iplant/home/../ipcdev", "/iplant//home"}
+	for _, p := range invalid {
+		if err := validateIRODSPath(p); err == nil {
+			t.Errorf("%q didn't return an error", p)
+		}
+	}
+}
+
+func TestOverrideOutputDir(t *testing.T) {
+	j := _inittests(t, false)
+	dir := "/iplant/home/ipcdev/redirected"
+	if err := overrideOutputDir(j, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	args := j.FinalOutputArguments()
+	var destination string
+	for i, arg := range args {
+		if arg == "--destination" && i+1 < len(args) {
+			destination = args[i+1]
+		}
+	}
+	if destination != dir {
+		t.Errorf("upload destination was %q instead of %q", destination, dir)
+	}
+
+	if err := overrideOutputDir(j, "relative/dir"); err == nil {
+		t.Error("an invalid output directory was accepted")
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/cyverse-de/logcabin"
+)
+
+// verifyMemory compares the memory limit of each of the job's steps with the
+// node's total memory. Steps asking for more than the node has can't start, so
+// a warning is published for each of them, or an error is returned if
+// r.strictMemory is set. The check is skipped if the node's memory can't be
+// read.
+func (r *JobRunner) verifyMemory() error {
+	nodeMemory, err := r.dckr.NodeMemory()
+	if err != nil {
+		logcabin.Error.Printf("not checking step memory limits: %s", err)
+		return nil
+	}
+	if nodeMemory <= 0 {
+		return nil
+	}
+	for idx, step := range r.job.Steps {
+		limit := step.Component.Container.MemoryLimit
+		if limit <= nodeMemory {
+			continue
+		}
+		msg := fmt.Sprintf("step %d requests %d bytes of memory, but the node only has %d", idx, limit, nodeMemory)
+		if r.strictMemory {
+			return fmt.Errorf("%s", msg)
+		}
+		r.running(fmt.Sprintf("Warning: %s", msg))
+	}
+	return nil
+}
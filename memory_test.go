@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVerifyMemory(t *testing.T) {
+	t.Run("limit within node memory passes", func(t *testing.T) {
+		runner, d, p := newTestRunner(t)
+		d.nodeMemory = 1024
+		runner.job.Steps[0].Component.Container.MemoryLimit = 1024
+		if err := runner.verifyMemory(); err != nil {
+			t.Error(err)
+		}
+		if len(p.updates) != 0 {
+			t.Errorf("updates were published: %#v", p.updates)
+		}
+	})
+
+	t.Run("limit over node memory warns", func(t *testing.T) {
+		runner, d, p := newTestRunner(t)
+		d.nodeMemory = 1024
+		runner.job.Steps[0].Component.Container.MemoryLimit = 4096
+		if err := runner.verifyMemory(); err != nil {
+			t.Error(err)
+		}
+		if len(p.updates) != 1 || !strings.HasPrefix(p.updates[0].Message, "Warning: step 0 requests 4096 bytes") {
+			t.Errorf("updates were %#v", p.updates)
+		}
+	})
+
+	t.Run("limit over node memory fails when strict", func(t *testing.T) {
+		runner, d, _ := newTestRunner(t)
+		d.nodeMemory = 1024
+		runner.strictMemory = true
+		runner.job.Steps[0].Component.Container.MemoryLimit = 4096
+		if err := runner.verifyMemory(); err == nil {
+			t.Error("a step asking for more memory than the node has passed")
+		}
+	})
+}
@@ -12,12 +12,12 @@ import (
 	"time"
 
 	"github.com/cyverse-de/logcabin"
-	"github.com/cyverse-de/model"
+	"github.com/cyverse-de/road-runner/model"
 
 	"github.com/streadway/amqp"
 )
 
-//Command is tells the receiver of a JobRequest which action to perform
+// Command is tells the receiver of a JobRequest which action to perform
 type Command int
 
 // JobState defines a valid state for a job.
@@ -143,8 +143,27 @@ type UpdateMessage struct {
 	Version int
 	State   JobState
 	Message string
-	SentOn  string // Should be the milliseconds since the epoch
-	Sender  string // Should be the hostname of the box sending the message.
+	SentOn  string      // Should be the milliseconds since the epoch
+	Sender  string      // Should be the hostname of the box sending the message.
+	Phase   string      `json:",omitempty"` // The part of the job in progress, e.g. "preparing".
+	Step    *StepStatus `json:",omitempty"` // Set on updates about a single step.
+
+	// Set on the final update of a job so that consumers don't have to parse
+	// the message to find out how the job ended.
+	ExitCode *ExitCode `json:",omitempty"`
+}
+
+// ExitCode describes how a job ended in its final UpdateMessage.
+type ExitCode struct {
+	Status StatusCode // The job's final status.
+	Step   int64      `json:",omitempty"` // The exit code of the step that failed, if it exited with one.
+}
+
+// StepStatus describes the state of one of a job's steps in an UpdateMessage.
+type StepStatus struct {
+	Index    int      // The position of the step in the job, starting at 0.
+	State    JobState // Running, Succeeded, or Failed.
+	Duration int64    `json:",omitempty"` // Milliseconds the step ran for, once it's done.
 }
 
 // TimeLimitRequest is the message that is sent to road-runner to get it to
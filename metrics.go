@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/road-runner/dockerops"
+	"github.com/cyverse-de/road-runner/messaging"
+	"github.com/cyverse-de/road-runner/model"
+)
+
+// metricsPushTimeout is how long pushing the metrics may take.
+var metricsPushTimeout = 10 * time.Second
+
+// jobMetrics are the measurements taken while the job runs.
+type jobMetrics struct {
+	started     time.Time
+	inputBytes  int64
+	outputBytes int64
+}
+
+// metricsRecorder holds a job's metrics where both Run and Exit can reach
+// them, so that a job that's killed or times out before Run finishes still has
+// its metrics pushed. Only the first push goes through.
+type metricsRecorder struct {
+	mu     sync.Mutex
+	m      jobMetrics
+	pushed bool
+}
+
+// update calls f with the metrics while holding the lock.
+func (r *metricsRecorder) update(f func(m *jobMetrics)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f(&r.m)
+}
+
+// push pushes the metrics to the Pushgateway at base unless they've already
+// been pushed or the job never started.
+func (r *metricsRecorder) push(base string, job *model.Job, status messaging.StatusCode, finished time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pushed || r.m.started.IsZero() {
+		return nil
+	}
+	r.pushed = true
+	return pushMetrics(base, job, status, r.m, finished)
+}
+
+// labelEscaper escapes label values for the Prometheus text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatMetrics returns the job's final metrics in the Prometheus text
+// format. Every metric is labeled with the ID of the job's app, so that jobs
+// can be aggregated by app.
+func formatMetrics(job *model.Job, status messaging.StatusCode, m jobMetrics, finished time.Time) []byte {
+	appID := labelEscaper.Replace(job.AppID)
+	var buf bytes.Buffer
+	gauge := func(name, help, labels string, value interface{}) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(&buf, "# TYPE %s gauge\n", name)
+		fmt.Fprintf(&buf, "%s{app_id=\"%s\"%s} %v\n", name, appID, labels, value)
+	}
+	gauge("road_runner_job_duration_seconds", "How long the job ran.", "", finished.Sub(m.started).Seconds())
+	gauge("road_runner_job_steps", "The number of steps in the job.", "", len(job.Steps))
+	gauge("road_runner_job_input_bytes", "The size of the working directory after the inputs were downloaded.", "", m.inputBytes)
+	gauge("road_runner_job_output_bytes", "The number of bytes the final upload transferred.", "", m.outputBytes)
+	gauge(
+		"road_runner_job_status",
+		"The final status code of the job.",
+		fmt.Sprintf(",status=\"%s\"", labelEscaper.Replace(statusDescription(status))),
+		int(status),
+	)
+	return buf.Bytes()
+}
+
+// metricsGroupURL returns the Pushgateway URL for the job's metrics. They're
+// grouped by invocation, so jobs of the same app running at the same time
+// don't replace each other's metrics. The invocation ID is base64 encoded so
+// that an empty ID can be used in the path.
+func metricsGroupURL(base string, job *model.Job) string {
+	invID := base64.URLEncoding.EncodeToString([]byte(job.InvocationID))
+	if invID == "" {
+		invID = "="
+	}
+	return fmt.Sprintf("%s/metrics/job/road-runner/invocation_id@base64/%s", strings.TrimRight(base, "/"), invID)
+}
+
+// pushMetrics pushes the job's final metrics to the Pushgateway at base.
+func pushMetrics(base string, job *model.Job, status messaging.StatusCode, m jobMetrics, finished time.Time) error {
+	req, err := http.NewRequest(http.MethodPut, metricsGroupURL(base, job), bytes.NewReader(formatMetrics(job, status, m, finished)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	client := &http.Client{Timeout: metricsPushTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("pushing metrics failed with status %s", resp.Status)
+	}
+	return nil
+}
+
+// workdirBytes returns the size of the job's working directory, or zero if it
+// can't be read.
+func (r *JobRunner) workdirBytes() int64 {
+	size, err := workdirSize(r.volumeDir)
+	if err != nil {
+		r.log.Error(err)
+		return 0
+	}
+	return size
+}
+
+// uploadBytes returns the size of the files in the working directory that the
+// final upload transfers, leaving out the files it's told to exclude. Zero is
+// returned if the working directory can't be read.
+func (r *JobRunner) uploadBytes() int64 {
+	excluded := make(map[string]bool)
+	args := r.job.ExcludeArguments()
+	if len(args) == 2 {
+		for _, p := range strings.Split(args[1], ",") {
+			excluded[strings.Trim(p, "/")] = true
+		}
+	}
+	if r.stageInputs {
+		excluded[dockerops.INPUTSDIR] = true
+	}
+
+	var size int64
+	err := filepath.Walk(r.volumeDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(r.volumeDir, p)
+		if err != nil {
+			return err
+		}
+		if excluded[rel] || excluded[info.Name()] {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		r.log.Error(err)
+		return 0
+	}
+	return size
+}
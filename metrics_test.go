@@ -0,0 +1,152 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/road-runner/messaging"
+	"github.com/cyverse-de/road-runner/model"
+)
+
+func TestPushMetrics(t *testing.T) {
+	var (
+		method, path, contentType string
+		body                      []byte
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		path = r.URL.Path
+		contentType = r.Header.Get("Content-Type")
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	job := &model.Job{
+		InvocationID: "07b04ce2-7757-4b21-9e15-0b4c2f44be26",
+		AppID:        "c7f05682-23c8-4182-b9a2-e09650a5f49b",
+		Steps:        make([]model.Step, 2),
+	}
+	started := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := jobMetrics{started: started, inputBytes: 1024, outputBytes: 4096}
+	if err := pushMetrics(server.URL+"/", job, messaging.StatusStepFailed, m, started.Add(90*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	if method != http.MethodPut {
+		t.Errorf("method was %s instead of PUT", method)
+	}
+	expectedPath := "/metrics/job/road-runner/invocation_id@base64/MDdiMDRjZTItNzc1Ny00YjIxLTllMTUtMGI0YzJmNDRiZTI2"
+	if path != expectedPath {
+		t.Errorf("path was %s instead of %s", path, expectedPath)
+	}
+	if !strings.HasPrefix(contentType, "text/plain") {
+		t.Errorf("content type was %s", contentType)
+	}
+
+	label := `app_id="c7f05682-23c8-4182-b9a2-e09650a5f49b"`
+	expected := []string{
+		"road_runner_job_duration_seconds{" + label + "} 90\n",
+		"road_runner_job_steps{" + label + "} 2\n",
+		"road_runner_job_input_bytes{" + label + "} 1024\n",
+		"road_runner_job_output_bytes{" + label + "} 4096\n",
+		"road_runner_job_status{" + label + `,status="` + statusDescription(messaging.StatusStepFailed) + `"} ` + "4\n",
+		"# TYPE road_runner_job_duration_seconds gauge\n",
+	}
+	for _, line := range expected {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("pushed metrics didn't include %q:\n%s", line, body)
+		}
+	}
+}
+
+func TestPushMetricsFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	if err := pushMetrics(server.URL, &model.Job{}, messaging.Success, jobMetrics{started: time.Now()}, time.Now()); err == nil {
+		t.Error("err was nil")
+	}
+}
+
+func TestFormatMetricsEscapesLabels(t *testing.T) {
+	job := &model.Job{AppID: "a\"b\\c\nd"}
+	body := string(formatMetrics(job, messaging.Success, jobMetrics{}, time.Time{}))
+	if !strings.Contains(body, `app_id="a\"b\\c\nd"`) {
+		t.Errorf("app ID wasn't escaped:\n%s", body)
+	}
+}
+
+func TestMetricsGroupURLEmptyInvocationID(t *testing.T) {
+	actual := metricsGroupURL("http://pushgateway:9091", &model.Job{})
+	expected := "http://pushgateway:9091/metrics/job/road-runner/invocation_id@base64/="
+	if actual != expected {
+		t.Errorf("URL was %s instead of %s", actual, expected)
+	}
+}
+
+func TestMetricsRecorderPushesOnce(t *testing.T) {
+	pushes := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushes++
+	}))
+	defer server.Close()
+
+	var r metricsRecorder
+	if err := r.push(server.URL, &model.Job{}, messaging.StatusKilled, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if pushes != 0 {
+		t.Errorf("the metrics of a job that never started were pushed")
+	}
+
+	r.update(func(m *jobMetrics) { m.started = time.Now() })
+	for _, status := range []messaging.StatusCode{messaging.StatusKilled, messaging.StatusTimeLimit} {
+		if err := r.push(server.URL, &model.Job{}, status, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pushes != 1 {
+		t.Errorf("the metrics were pushed %d times instead of once", pushes)
+	}
+}
+
+func TestUploadBytes(t *testing.T) {
+	runner, _, _ := newTestRunner(t)
+	dir, err := ioutil.TempDir("", "road-runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	runner.volumeDir = dir
+	runner.stageInputs = true
+	runner.job.ArchiveLogs = false
+	runner.job.FilterFiles = []string{"filtered.txt"}
+
+	files := map[string]int{
+		"output.txt":                         100,
+		path.Join("inputs", "staged.txt"):    1000,
+		path.Join("logs", "condor-stdout-0"): 10,
+		"filtered.txt":                       10000,
+	}
+	for name, size := range files {
+		p := path.Join(dir, name)
+		if err = os.MkdirAll(path.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(p, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if actual := runner.uploadBytes(); actual != 100 {
+		t.Errorf("upload bytes were %d instead of 100", actual)
+	}
+}
@@ -1,5 +1,7 @@
 package model
 
+import "fmt"
+
 // Volume describes how a local path is mounted into a container.
 type Volume struct {
 	HostPath      string `json:"host_path"`
@@ -25,6 +27,22 @@ type VolumesFrom struct {
 	HostPath      string `json:"host_path"`
 	ContainerPath string `json:"container_path"`
 	ReadOnly      bool   `json:"read_only"`
+	Digest        string `json:"digest"`
+
+	// Service marks a data container that runs its image's command, like a
+	// database, instead of only providing volumes. Steps that use it wait for
+	// it to be running and healthy before they start.
+	Service bool `json:"service"`
+}
+
+// ImageRef returns the reference used to pull the data container's image. It's
+// name@digest when the digest is set so that the same data is used every
+// time, and name:tag otherwise.
+func (v *VolumesFrom) ImageRef() string {
+	if v.Digest != "" {
+		return fmt.Sprintf("%s@%s", v.Name, v.Digest)
+	}
+	return fmt.Sprintf("%s:%s", v.Name, v.Tag)
 }
 
 // ContainerImage describes a docker container image.
@@ -49,6 +67,12 @@ type Container struct {
 	Image       ContainerImage `json:"image"`
 	EntryPoint  string         `json:"entrypoint"`
 	WorkingDir  string         `json:"working_directory"`
+	StopSignal  string         `json:"stop_signal"`
+	CapAdd      []string       `json:"cap_add"`
+	CapDrop     []string       `json:"cap_drop"`
+	GPUs        int            `json:"gpus"`
+
+	MountDockerSocket bool `json:"mount_docker_socket"`
 }
 
 // WorkingDirectory returns the container's working directory. Defaults to
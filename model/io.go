@@ -6,6 +6,11 @@ import (
 	"strings"
 )
 
+// HostPathType is the input type for files that are already available on the
+// node, such as NFS-mounted datasets. The Value of the input is the absolute
+// path to the file on the host.
+const HostPathType = "HostPath"
+
 // StepInput describes a single input for a job step.
 type StepInput struct {
 	ID           string `json:"id"`
@@ -17,6 +22,12 @@ type StepInput struct {
 	Value        string `json:"value"`
 }
 
+// IsHostPath returns true if the input is a path on the host rather than a
+// file in iRODS.
+func (i *StepInput) IsHostPath() bool {
+	return i.Type == HostPathType
+}
+
 // IRODSPath returns a string containing the iRODS path to an input file.
 func (i *StepInput) IRODSPath() string {
 	if i.Multiplicity == "collection" {
@@ -10,7 +10,7 @@ import (
 	"strings"
 	"time"
 
-	"github.com/cyverse-de/model/submitfile"
+	"github.com/cyverse-de/road-runner/model/submitfile"
 	"github.com/spf13/viper"
 )
 
@@ -96,14 +96,28 @@ type Job struct {
 	UserID             string         `json:"user_id"`
 	UserGroups         []string       `json:"user_groups"`
 	WikiURL            string         `json:"wiki_url"`
+
+	// Labels are added to the containers of all of the job's steps and
+	// transfers.
+	Labels map[string]string `json:"labels"`
+
+	// Interactive jobs, like VICE sessions, don't transfer any files. Their
+	// steps run until they're stopped, and users reach them through the ports
+	// their containers publish.
+	Interactive bool `json:"interactive"`
+
+	// SuccessCommand is run after all of the steps succeed, in a container
+	// that's made from the last step's image and shares the working
+	// directory. The job fails if it does.
+	SuccessCommand []string `json:"success_command"`
 }
 
 // New returns a pointer to a newly instantiated Job with NowDate set.
 // Accesses the following configuration settings:
-//  * condor.request_disk
-//  * condor.log_path
-//  * condor.filter_files
-//  * irods.base
+//   - condor.request_disk
+//   - condor.log_path
+//   - condor.filter_files
+//   - irods.base
 func New(cfg *viper.Viper) *Job {
 	n := time.Now().Format(nowfmt)
 	rq := cfg.GetString("condor.request_disk")
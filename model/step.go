@@ -35,6 +35,17 @@ type Step struct {
 	Environment StepEnvironment `json:"environment"`
 	Input       []StepInput     `json:"input"`
 	Output      []StepOutput    `json:"output"`
+	OutputGlobs []string        `json:"output_globs"` // uploaded as soon as the step succeeds
+
+	// CombineOutput sends stderr to the stdout log so the two are interleaved.
+	CombineOutput bool `json:"combine_output"`
+
+	// Labels are added to the step's container.
+	Labels map[string]string `json:"labels"`
+
+	// PreCommand is run in a separate container before the step, using the
+	// step's image and working directory. The step fails if it fails.
+	PreCommand []string `json:"pre_command"`
 }
 
 // EnvOptions returns a string containing the docker command-line options
@@ -141,9 +152,13 @@ type StepConfig struct {
 
 // Parameters returns the StepParams associated with a Step in the correct order.
 // Use this to get the list of Params rather than accessing the field directory.
+// The returned slice is a sorted copy. Params with the same Order keep the
+// order they were submitted in, so the command line is the same every time.
 func (c *StepConfig) Parameters() []StepParam {
-	sort.Sort(ByOrder(c.Params))
-	return c.Params
+	params := make([]StepParam, len(c.Params))
+	copy(params, c.Params)
+	sort.Stable(ByOrder(params))
+	return params
 }
 
 // StepParam is where the params for a step are located.
@@ -179,7 +194,7 @@ type PreviewableStepParam []StepParam
 
 func (p PreviewableStepParam) String() string {
 	var buffer bytes.Buffer
-	sort.Sort(ByOrder(p))
+	sort.Stable(ByOrder(p))
 	for _, param := range p {
 		buffer.WriteString(fmt.Sprintf("%s %s ", param.Name, param.Value))
 	}
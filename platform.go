@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/cyverse-de/logcabin"
+	"github.com/cyverse-de/road-runner/model"
+)
+
+// verifyPlatform returns an error if the local image name:tag was built for a
+// different operating system or architecture than the node's. Images like that
+// fail with confusing exec errors when they're run. The check is skipped if
+// the node's platform can't be read, and fields that the image or node leave
+// empty aren't compared.
+func (r *JobRunner) verifyPlatform(name, tag string) error {
+	nodeOS, nodeArch, err := r.dckr.NodePlatform()
+	if err != nil {
+		logcabin.Error.Printf("not checking the platform of %s:%s: %s", name, tag, err)
+		return nil
+	}
+	ref := fmt.Sprintf("%s:%s", name, tag)
+	inspection, err := r.dckr.InspectImage(ref)
+	if err != nil {
+		return err
+	}
+	if mismatched(inspection.Os, nodeOS) || mismatched(inspection.Architecture, nodeArch) {
+		return fmt.Errorf(
+			"image %s is built for %s/%s, but this node is %s/%s",
+			ref, inspection.Os, inspection.Architecture, nodeOS, nodeArch,
+		)
+	}
+	return nil
+}
+
+// mismatched returns true if both values are set and they differ.
+func mismatched(image, node string) bool {
+	return image != "" && node != "" && image != node
+}
+
+// reportPlatformMismatch publishes a running update suggesting that the
+// step's image was built for a different platform than the node's, which is
+// what the errors Docker returns for it don't make clear.
+func (r *JobRunner) reportPlatformMismatch(step *model.Step) {
+	ref := fmt.Sprintf("%s:%s", step.Component.Container.Image.Name, step.Component.Container.Image.Tag)
+	nodeOS, nodeArch, err := r.dckr.NodePlatform()
+	if err != nil {
+		r.running(fmt.Sprintf("Image %s doesn't appear to match the platform of this node", ref))
+		return
+	}
+	r.running(fmt.Sprintf("Image %s doesn't appear to match the platform of this node, which is %s/%s", ref, nodeOS, nodeArch))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestVerifyPlatform(t *testing.T) {
+	t.Run("matching platform passes", func(t *testing.T) {
+		runner, d, _ := newTestRunner(t)
+		d.nodePlatform = platform{"linux", "amd64"}
+		d.imagePlatforms = map[string]platform{"wc:latest": {"linux", "amd64"}}
+		if err := runner.verifyPlatform("wc", "latest"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("mismatched architecture fails", func(t *testing.T) {
+		runner, d, _ := newTestRunner(t)
+		d.nodePlatform = platform{"linux", "arm64"}
+		d.imagePlatforms = map[string]platform{"wc:latest": {"linux", "amd64"}}
+		err := runner.verifyPlatform("wc", "latest")
+		if err == nil {
+			t.Fatal("an amd64 image passed on an arm64 node")
+		}
+		if !strings.Contains(err.Error(), "linux/amd64") || !strings.Contains(err.Error(), "linux/arm64") {
+			t.Errorf("error didn't name both platforms: %s", err)
+		}
+	})
+
+	t.Run("unknown image platform passes", func(t *testing.T) {
+		runner, d, _ := newTestRunner(t)
+		d.nodePlatform = platform{"linux", "arm64"}
+		if err := runner.verifyPlatform("wc", "latest"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestPullStepImagesPlatformMismatch(t *testing.T) {
+	runner, d, p := newTestRunner(t)
+	images := runner.job.ContainerImages()
+	if len(images) == 0 {
+		t.Fatal("the test job doesn't have any images")
+	}
+	ref := images[0].Name + ":" + images[0].Tag
+	d.nodePlatform = platform{"linux", "arm64"}
+	d.imagePlatforms = map[string]platform{ref: {"linux", "amd64"}}
+
+	if err := runner.pullStepImages(); err == nil {
+		t.Fatal("pulling an image for the wrong architecture didn't fail")
+	}
+	if runner.status != StatusPlatformMismatch {
+		t.Errorf("status was %d instead of %d", runner.status, StatusPlatformMismatch)
+	}
+	last := p.updates[len(p.updates)-1]
+	if !strings.Contains(last.Message, "is built for linux/amd64") {
+		t.Errorf("last update was %q", last.Message)
+	}
+}
+
+func TestRunAllStepsPlatformMismatch(t *testing.T) {
+	runner, d, p := newTestRunner(t)
+	d.nodePlatform = platform{"linux", "arm64"}
+	d.runStepErr = errors.New("Error response from daemon: image with reference discoenv/wc:latest was found but does not match the specified platform: wanted linux/arm64, actual: linux/amd64")
+
+	if err := runner.runAllSteps(runner.exit); err == nil {
+		t.Fatal("err was nil")
+	}
+	if runner.status != StatusPlatformMismatch {
+		t.Errorf("status was %d instead of %d", runner.status, StatusPlatformMismatch)
+	}
+	var reported bool
+	for _, u := range p.updates {
+		if strings.Contains(u.Message, "doesn't appear to match the platform of this node, which is linux/arm64") {
+			reported = true
+		}
+	}
+	if !reported {
+		t.Error("the platform mismatch wasn't reported")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/docker/docker/api/types"
+	"github.com/streadway/amqp"
+	"golang.org/x/net/context"
+)
+
+// preflightCheck is a named check of something road-runner needs in order to
+// run a job.
+type preflightCheck struct {
+	name  string
+	check func() error
+}
+
+// runPreflight runs each of the checks, writing the status of each one to w.
+// All of the checks are run even if one fails. A non-nil error is returned if
+// any of them failed.
+func runPreflight(w io.Writer, checks []preflightCheck) error {
+	var failed int
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			failed++
+			fmt.Fprintf(w, "%s: FAILED: %s\n", c.name, err.Error())
+		} else {
+			fmt.Fprintf(w, "%s: OK\n", c.name)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d preflight checks failed", failed, len(checks))
+	}
+	return nil
+}
+
+// pinger is implemented by the Docker API client.
+type pinger interface {
+	Ping(ctx context.Context) (types.Ping, error)
+}
+
+// dockerCheck returns a check that verifies the Docker daemon responds.
+func dockerCheck(p pinger) func() error {
+	return func() error {
+		_, err := p.Ping(context.Background())
+		return err
+	}
+}
+
+// dialAMQP connects to the AMQP broker at uri.
+func dialAMQP(uri string) (io.Closer, error) {
+	return amqp.Dial(uri)
+}
+
+// amqpCheck returns a check that verifies a connection can be made to the AMQP
+// broker.
+func amqpCheck(uri string, dial func(string) (io.Closer, error)) func() error {
+	return func() error {
+		conn, err := dial(uri)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// porkPuller is implemented by *dockerops.Docker.
+type porkPuller interface {
+	PorkPull() error
+}
+
+// porklockCheck returns a check that verifies the porklock image can be
+// pulled.
+func porklockCheck(p porkPuller) func() error {
+	return p.PorkPull
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"golang.org/x/net/context"
+)
+
+type fakePinger struct {
+	err error
+}
+
+func (f *fakePinger) Ping(ctx context.Context) (types.Ping, error) {
+	return types.Ping{}, f.err
+}
+
+type fakeCloser struct {
+	closed bool
+}
+
+func (f *fakeCloser) Close() error {
+	f.closed = true
+	return nil
+}
+
+type fakePorkPuller struct {
+	err error
+}
+
+func (f *fakePorkPuller) PorkPull() error {
+	return f.err
+}
+
+func TestDockerCheck(t *testing.T) {
+	if err := dockerCheck(&fakePinger{})(); err != nil {
+		t.Error(err)
+	}
+	if err := dockerCheck(&fakePinger{err: errors.New("no daemon")})(); err == nil {
+		t.Error("error was nil when the daemon didn't respond")
+	}
+}
+
+func TestAMQPCheck(t *testing.T) {
+	conn := &fakeCloser{}
+	var dialed string
+	dial := func(uri string) (io.Closer, error) {
+		dialed = uri
+		return conn, nil
+	}
+	if err := amqpCheck("amqp://rabbit", dial)(); err != nil {
+		t.Error(err)
+	}
+	if dialed != "amqp://rabbit" {
+		t.Errorf("dialed %s instead of amqp://rabbit", dialed)
+	}
+	if !conn.closed {
+		t.Error("connection wasn't closed")
+	}
+
+	failingDial := func(uri string) (io.Closer, error) {
+		return nil, errors.New("connection refused")
+	}
+	if err := amqpCheck("amqp://rabbit", failingDial)(); err == nil {
+		t.Error("error was nil when the dial failed")
+	}
+}
+
+func TestPorklockCheck(t *testing.T) {
+	if err := porklockCheck(&fakePorkPuller{})(); err != nil {
+		t.Error(err)
+	}
+	if err := porklockCheck(&fakePorkPuller{err: errors.New("not found")})(); err == nil {
+		t.Error("error was nil when the pull failed")
+	}
+}
+
+func TestRunPreflight(t *testing.T) {
+	var out bytes.Buffer
+	checks := []preflightCheck{
+		{"docker", dockerCheck(&fakePinger{})},
+		{"amqp", func() error { return errors.New("connection refused") }},
+		{"porklock", porklockCheck(&fakePorkPuller{})},
+	}
+	if err := runPreflight(&out, checks); err == nil {
+		t.Error("error was nil when a check failed")
+	}
+	expected := "docker: OK\namqp: FAILED: connection refused\nporklock: OK\n"
+	if out.String() != expected {
+		t.Errorf("output was:\n%s\ninstead of:\n%s", out.String(), expected)
+	}
+
+	out.Reset()
+	if err := runPreflight(&out, checks[:1]); err != nil {
+		t.Error(err)
+	}
+	if !strings.Contains(out.String(), "docker: OK") {
+		t.Errorf("output was %s", out.String())
+	}
+}
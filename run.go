@@ -1,16 +1,23 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/cyverse-de/dockerops"
-	"github.com/cyverse-de/logcabin"
-	"github.com/cyverse-de/messaging"
-	"github.com/cyverse-de/model"
+	"github.com/Sirupsen/logrus"
+	"github.com/cyverse-de/road-runner/dockerops"
+	"github.com/cyverse-de/road-runner/messaging"
+	"github.com/cyverse-de/road-runner/model"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/go-connections/nat"
 )
 
 // The cancellation buffer is the time between the job cancellation warning message and
@@ -58,17 +65,18 @@ func (r *JobRunner) getTicker(timeLimit int, exit chan messaging.StatusCode) (ch
 	// Create the cancellation ticker and a channel to accept a command to stop the tickers.
 	stepTicker := time.NewTicker(stepDuration)
 	quitTicker := make(chan int)
+	log := r.log.WithField("phase", PhaseRunning)
 
 	go func(stepTicker *time.Ticker) {
 		_ = <-stepTicker.C
-		logcabin.Info.Print("ticker received message to exit")
+		log.Info("ticker received message to exit")
 		exit <- messaging.StatusTimeLimit
 	}(stepTicker)
 
 	if warnTicker != nil {
 		go func(warnTicker *time.Ticker, cancellationWarningBuffer time.Duration) {
 			_ = <-warnTicker.C
-			logcabin.Info.Print("ticker received message to warn user of impending cancellation")
+			log.Info("ticker received message to warn user of impending cancellation")
 			impendingCancellation(r.client, r.job, fmt.Sprintf(
 				"Job will be canceled if the current step does not complete in %s",
 				cancellationWarningBuffer.String(),
@@ -82,145 +90,593 @@ func (r *JobRunner) getTicker(timeLimit int, exit chan messaging.StatusCode) (ch
 		if warnTicker != nil {
 			warnTicker.Stop()
 		}
-		logcabin.Info.Print("received message to stop tickers")
+		log.Info("received message to stop tickers")
 	}(stepTicker, warnTicker, quitTicker)
 
 	return quitTicker, nil
 }
 
+// StatusIdleTimeout is the exit code when a step is killed because it stopped
+// producing output. It follows the status codes defined in the messaging
+// package.
+const StatusIdleTimeout = messaging.StatusBadDuration + 1
+
+// StatusPlatformMismatch is the exit code when a step's image was built for a
+// different platform than the node's, whether that's found when the image is
+// pulled or when its container is created.
+const StatusPlatformMismatch = StatusIdleTimeout + 1
+
+// DockerOperator is the set of Docker operations that a JobRunner performs.
+// *dockerops.Docker satisfies it.
+type DockerOperator interface {
+	Pull(ctx context.Context, name, tag string) error
+	PullAuthenticated(ctx context.Context, name, tag, auth string) error
+	PullDigest(ctx context.Context, name, digest, auth string) error
+	CreateDataContainer(vf *model.VolumesFrom, invID string) (string, error)
+	CreateWorkingDirVolume(volumeID string) (types.Volume, error)
+	VolumeExists(volumeID string) (bool, error)
+	RemoveVolume(volumeID string) error
+	DownloadInputs(job *model.Job, input *model.StepInput, idx, attempt int) (int64, error)
+	RunStep(job *model.Job, step *model.Step, idx, attempt int, started func()) (int64, error)
+	StepLogs(step *model.Step, idx int) (string, string)
+	RunPreCommand(job *model.Job, step *model.Step, idx int) (int64, error)
+	RunSuccessCommand(job *model.Job, step *model.Step) (int64, error)
+	RunInteractiveStep(job *model.Job, step *model.Step, idx, attempt int, started func(nat.PortMap)) (int64, error)
+	StartContainer(containerID string) error
+	UploadStepOutput(job *model.Job, source, suffix string) (int64, error)
+	UploadDebugArchive(job *model.Job, source, dest string) (int64, error)
+	UploadOutputs(job *model.Job) (int64, error)
+	ContainersWithLabel(key, value string, all bool) ([]string, error)
+	InspectContainer(containerID string) (types.ContainerJSON, error)
+	InspectImage(id string) (types.ImageInspect, error)
+	StopContainer(id string, grace time.Duration) error
+	NodeMemory() (int64, error)
+	NodePlatform() (string, string, error)
+	DaemonVersion() (types.Version, error)
+}
+
+// jitterRand is the source of the pull jitter. It's seeded from the clock so
+// that jobs started at the same moment on different nodes don't pick the same
+// delay.
+var jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// pullJitter returns a random duration in [0, max), or zero if max isn't
+// positive.
+func pullJitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(jitterRand.Int63n(int64(max)))
+}
+
+// waitForPullJitter sleeps for a random duration up to r.jitter. It returns
+// early with the context's error if the job is stopped while it's waiting.
+func (r *JobRunner) waitForPullJitter() error {
+	delay := pullJitter(r.jitter)
+	if delay == 0 {
+		return nil
+	}
+	r.log.Infof("waiting %s before pulling images", delay)
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+}
+
+// downloadBackoff is how long to wait before the second attempt at an input.
+// It doubles after each failed attempt.
+var downloadBackoff = 5 * time.Second
+
+// jobLimits are the largest numbers of inputs and steps that a job may have.
+// Zero means there's no limit.
+type jobLimits struct {
+	inputs int
+	steps  int
+}
+
 // JobRunner provides the functionality needed to run jobs.
 type JobRunner struct {
-	client *messaging.Client
-	dckr   *dockerops.Docker
-	exit   chan messaging.StatusCode
-	job    *model.Job
-	status messaging.StatusCode
+	runConfig
+	ctx       context.Context
+	client    JobUpdatePublisher
+	dckr      DockerOperator
+	exit      chan messaging.StatusCode
+	job       *model.Job
+	status    messaging.StatusCode
+	volumeDir string
+	log       *logrus.Entry
+	phase     string
+	fs        FileSystem
+	failTail  string
+	stepExit  int64
+	services  map[string]string
+	metrics   *metricsRecorder
+	logs      *logServer
+	daemon    types.Version
+	stop      chan messaging.StatusCode
+	stopMu    sync.Mutex
+	stopped   messaging.StatusCode
+}
+
+// running publishes a running update tagged with the runner's current phase.
+func (r *JobRunner) running(msg string) {
+	runningInPhase(r.client, r.job, r.phase, msg)
+}
+
+// runningStep is running, but the update also carries the state of the step
+// at idx. The duration is only included once it's greater than zero.
+func (r *JobRunner) runningStep(msg string, idx int, state messaging.JobState, duration time.Duration) {
+	publishRunning(r.client, &messaging.UpdateMessage{
+		Job:     r.job,
+		Message: msg,
+		Phase:   r.phase,
+		Step: &messaging.StepStatus{
+			Index:    idx,
+			State:    state,
+			Duration: int64(duration / time.Millisecond),
+		},
+	})
 }
 
 func (r *JobRunner) pullDataImages() error {
+	r.phase = PhasePreparing
 	var err error
 	for _, dc := range r.job.DataContainers() {
-		running(r.client, r.job, fmt.Sprintf("Pulling container image %s:%s", dc.Name, dc.Tag))
-		if strings.TrimSpace(dc.Auth) == "" {
-			err = r.dckr.Pull(dc.Name, dc.Tag)
+		ref := dc.ImageRef()
+		r.running(fmt.Sprintf("Pulling container image %s", ref))
+		if strings.TrimSpace(dc.Auth) != "" {
+			r.running(fmt.Sprintf("Using auth for pull of %s", ref))
+		}
+		switch {
+		case dc.Digest != "":
+			err = r.dckr.PullDigest(r.ctx, dc.Name, dc.Digest, strings.TrimSpace(dc.Auth))
+		case strings.TrimSpace(dc.Auth) == "":
+			err = r.dckr.Pull(r.ctx, dc.Name, dc.Tag)
+		default:
+			err = r.dckr.PullAuthenticated(r.ctx, dc.Name, dc.Tag, dc.Auth)
+		}
+		if err != nil && r.ctx.Err() != nil {
+			r.status = messaging.StatusKilled
+			r.running(fmt.Sprintf("Aborted pulling container image %s because of a stop request", ref))
+			return err
+		}
+		if err != nil {
+			r.status = messaging.StatusDockerPullFailed
+			r.running(fmt.Sprintf("Error pulling container image '%s': %s", ref, err.Error()))
+			return err
+		}
+		if dc.Digest != "" {
+			err = r.verifyDataImage(&dc)
 		} else {
-			running(r.client, r.job, fmt.Sprintf("Using auth for pull of %s:%s", dc.Name, dc.Tag))
-			err = r.dckr.PullAuthenticated(dc.Name, dc.Tag, dc.Auth)
+			err = r.verifyImage(dc.Name, dc.Tag)
 		}
 		if err != nil {
 			r.status = messaging.StatusDockerPullFailed
-			running(r.client, r.job, fmt.Sprintf("Error pulling container image '%s:%s': %s", dc.Name, dc.Tag, err.Error()))
+			r.running(fmt.Sprintf("Error verifying container image '%s': %s", ref, err.Error()))
 			return err
 		}
-		running(r.client, r.job, fmt.Sprintf("Done pulling container image %s:%s", dc.Name, dc.Tag))
+		r.running(fmt.Sprintf("Done pulling container image %s", ref))
 	}
 	return err
 }
 
+// createDataContainers creates the job's data containers and then starts the
+// ones that are services. All of them are created before any service starts,
+// so a data container that Docker or dockerops rejects fails the job before
+// anything runs.
 func (r *JobRunner) createDataContainers() error {
-	var err error
+	r.phase = PhasePreparing
+	type service struct {
+		name, containerID string
+	}
+	var services []service
 	for _, dc := range r.job.DataContainers() {
-		running(r.client, r.job, fmt.Sprintf("Creating data container %s-%s", dc.NamePrefix, job.InvocationID))
-		_, err = r.dckr.CreateDataContainer(&dc, r.job.InvocationID)
-		if err != nil {
+		name := fmt.Sprintf("%s-%s", dc.NamePrefix, r.job.InvocationID)
+		r.running(fmt.Sprintf("Creating data container %s", name))
+		var err error
+		if dc.Service, err = r.isService(&dc); err != nil {
 			r.status = messaging.StatusDockerPullFailed
-			running(r.client, r.job, fmt.Sprintf("Error creating data container %s-%s", dc.NamePrefix, job.InvocationID))
+			r.running(fmt.Sprintf("Error inspecting the image for data container %s", name))
+			return err
+		}
+		containerID, err := r.dckr.CreateDataContainer(&dc, r.job.InvocationID)
+		if err != nil {
+			r.status = messaging.StatusDockerCreateFailed
+			r.running(fmt.Sprintf("Error creating data container %s: %s", name, err))
+			return err
+		}
+		if dc.Service {
+			services = append(services, service{dc.NamePrefix, containerID})
+		}
+		r.running(fmt.Sprintf("Done creating data container %s", name))
+	}
+	for _, svc := range services {
+		if err := r.dckr.StartContainer(svc.containerID); err != nil {
+			r.status = messaging.StatusDockerCreateFailed
+			r.running(fmt.Sprintf("Error starting service data container %s-%s: %s", svc.name, r.job.InvocationID, err))
+			return err
+		}
+		if r.services == nil {
+			r.services = make(map[string]string)
+		}
+		r.services[svc.name] = svc.containerID
+	}
+	return nil
+}
+
+// createWorkingDirVolume creates the job's working directory volume. A volume
+// with the same name may be left over from an earlier attempt at the job. It's
+// reused if r.reuse is set and removed and recreated otherwise.
+func (r *JobRunner) createWorkingDirVolume() error {
+	volumeID := r.job.InvocationID
+	exists, err := r.dckr.VolumeExists(volumeID)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if r.reuse {
+			r.log.Infof("reusing the existing working directory volume %s", volumeID)
+			return nil
+		}
+		r.log.Infof("removing the existing working directory volume %s", volumeID)
+		if err = r.dckr.RemoveVolume(volumeID); err != nil {
 			return err
 		}
-		running(r.client, r.job, fmt.Sprintf("Done creating data container %s-%s", dc.NamePrefix, job.InvocationID))
 	}
+	_, err = r.dckr.CreateWorkingDirVolume(volumeID)
 	return err
 }
 
 func (r *JobRunner) pullStepImages() error {
+	r.phase = PhasePreparing
 	var err error
 	for _, ci := range r.job.ContainerImages() {
-		running(r.client, r.job, fmt.Sprintf("Pulling tool container %s:%s", ci.Name, ci.Tag))
+		r.running(fmt.Sprintf("Pulling tool container %s:%s", ci.Name, ci.Tag))
 		if strings.TrimSpace(ci.Auth) == "" {
-			err = r.dckr.Pull(ci.Name, ci.Tag)
+			err = r.dckr.Pull(r.ctx, ci.Name, ci.Tag)
 		} else {
-			running(r.client, r.job, fmt.Sprintf("Using auth for pull of %s:%s", ci.Name, ci.Tag))
-			err = r.dckr.PullAuthenticated(ci.Name, ci.Tag, ci.Auth)
+			r.running(fmt.Sprintf("Using auth for pull of %s:%s", ci.Name, ci.Tag))
+			err = r.dckr.PullAuthenticated(r.ctx, ci.Name, ci.Tag, ci.Auth)
+		}
+		if err != nil && r.ctx.Err() != nil {
+			r.status = messaging.StatusKilled
+			r.running(fmt.Sprintf("Aborted pulling tool container %s:%s because of a stop request", ci.Name, ci.Tag))
+			return err
 		}
 		if err != nil {
 			r.status = messaging.StatusDockerPullFailed
-			running(r.client, r.job, fmt.Sprintf("Error pulling tool container '%s:%s': %s", ci.Name, ci.Tag, err.Error()))
+			r.running(fmt.Sprintf("Error pulling tool container '%s:%s': %s", ci.Name, ci.Tag, err.Error()))
+			return err
+		}
+		if err = r.verifyImage(ci.Name, ci.Tag); err != nil {
+			r.status = messaging.StatusDockerPullFailed
+			r.running(fmt.Sprintf("Error verifying tool container '%s:%s': %s", ci.Name, ci.Tag, err.Error()))
 			return err
 		}
-		running(r.client, r.job, fmt.Sprintf("Done pulling tool container %s:%s", ci.Name, ci.Tag))
+		if err = r.verifyPlatform(ci.Name, ci.Tag); err != nil {
+			r.status = StatusPlatformMismatch
+			r.running(fmt.Sprintf("Error verifying tool container '%s:%s': %s", ci.Name, ci.Tag, err.Error()))
+			return err
+		}
+		r.running(fmt.Sprintf("Done pulling tool container %s:%s", ci.Name, ci.Tag))
+	}
+	return err
+}
+
+// stageLocalInput makes sure that a host path input is available on the
+// node and, once its symlinks are resolved, is inside one of roots. The file
+// itself is bind-mounted into the step containers, so nothing is transferred.
+func stageLocalInput(input *model.StepInput, roots []string) error {
+	if !path.IsAbs(input.Value) {
+		return fmt.Errorf("host path input %s is not an absolute path", input.Value)
+	}
+	source, err := dockerops.CheckHostPathInput(input.Value, roots)
+	if err != nil {
+		return err
 	}
+	_, err = os.Stat(source)
 	return err
 }
 
 func (r *JobRunner) downloadInputs() error {
+	r.phase = PhasePreparing
 	var err error
 	var exitCode int64
+	if r.job.Interactive {
+		r.running("Not downloading inputs for an interactive job")
+		return nil
+	}
+	if r.stageInputs {
+		// Create the staging directory up front so that it isn't created by
+		// Docker, owned by root, when it's mounted into the containers.
+		if err = os.MkdirAll(path.Join(r.volumeDir, dockerops.INPUTSDIR), 0755); err != nil {
+			r.running(fmt.Sprintf("Error creating the input staging directory: %s", err.Error()))
+			r.status = messaging.StatusInputFailed
+			return err
+		}
+	}
 	for idx, input := range r.job.Inputs() {
-		running(r.client, r.job, fmt.Sprintf("Downloading %s", input.IRODSPath()))
-		exitCode, err = dckr.DownloadInputs(r.job, &input, idx)
-		if exitCode != 0 || err != nil {
+		if !r.proceed() {
+			return errStopped
+		}
+		if input.IsHostPath() {
+			r.running(fmt.Sprintf("Using host path %s", input.Value))
+			if err = stageLocalInput(&input, r.hostPathRoots); err != nil {
+				r.running(fmt.Sprintf("Error staging %s: %s", input.Value, err.Error()))
+				r.status = messaging.StatusInputFailed
+				return err
+			}
+			continue
+		}
+		r.running(fmt.Sprintf("Downloading %s", input.IRODSPath()))
+		backoff := downloadBackoff
+		for attempt := 1; ; attempt++ {
+			exitCode, err = r.dckr.DownloadInputs(r.job, &input, idx, attempt)
+			if exitCode == 0 && err == nil {
+				break
+			}
 			if err != nil {
-				running(r.client, r.job, fmt.Sprintf("Error downloading %s: %s", input.IRODSPath(), err.Error()))
+				r.running(fmt.Sprintf("Error downloading %s: %s", input.IRODSPath(), err.Error()))
 			} else {
-				running(r.client, r.job, fmt.Sprintf("Error downloading %s: Transfer utility exited with %d", input.IRODSPath(), exitCode))
+				r.running(fmt.Sprintf("Error downloading %s: Transfer utility exited with %d", input.IRODSPath(), exitCode))
 			}
-			r.status = messaging.StatusInputFailed
-			return err
+			if attempt >= r.dlAttempts {
+				r.status = messaging.StatusInputFailed
+				return err
+			}
+			select {
+			case <-time.After(backoff):
+			case <-r.ctx.Done():
+				r.status = messaging.StatusKilled
+				r.running(fmt.Sprintf("Aborted downloading %s because of a stop request", input.IRODSPath()))
+				return r.ctx.Err()
+			}
+			backoff *= 2
+			r.running(fmt.Sprintf("Retrying the download of %s, attempt %d of %d", input.IRODSPath(), attempt+1, r.dlAttempts))
 		}
-		running(r.client, r.job, fmt.Sprintf("Finished downloading %s", input.IRODSPath()))
+		r.running(fmt.Sprintf("Finished downloading %s", input.IRODSPath()))
 	}
 	return err
 }
 
+// increaseMemory raises the memory limit of a step that ran out of memory by
+// r.oomRetry, up to the node's memory, and returns true if the step should be
+// retried. Steps without a memory limit ran out of the node's memory, so a
+// retry wouldn't help them, and neither would one for a step whose limit can't
+// be raised.
+// The retried container gets a new name, if the step names its container, so
+// that it doesn't clash with the one that was killed.
+func (r *JobRunner) increaseMemory(step *model.Step, idx int) bool {
+	limit := step.Component.Container.MemoryLimit
+	if r.oomRetry <= 1 || limit <= 0 {
+		return false
+	}
+	newLimit := int64(float64(limit) * r.oomRetry)
+	log := r.log.WithFields(logrus.Fields{"phase": PhaseRunning, "step_index": idx})
+
+	// There's no point in asking for more memory than the node has.
+	nodeMemory, err := r.dckr.NodeMemory()
+	if err != nil {
+		log.Errorf("not retrying the step, the node's memory couldn't be read: %s", err)
+		return false
+	}
+	if nodeMemory > 0 && newLimit > nodeMemory {
+		newLimit = nodeMemory
+	}
+	if newLimit <= limit {
+		log.Warnf("not retrying the step, its memory limit of %d bytes can't be raised on this node", limit)
+		return false
+	}
+	step.Component.Container.MemoryLimit = newLimit
+	if step.Component.Container.Name != "" {
+		step.Component.Container.Name += "-oom-retry"
+	}
+	msg := fmt.Sprintf("Step ran out of memory with a limit of %d bytes, retrying with a limit of %d bytes", limit, newLimit)
+	log.Warn(msg)
+	r.runningStep(msg, idx, messaging.RunningState, 0)
+	return true
+}
+
+// runPreCommand runs the step's PreCommand, if it has one, and returns an
+// error if it couldn't be run or exited with a non-zero code.
+func (r *JobRunner) runPreCommand(step *model.Step, idx int) error {
+	if len(step.PreCommand) == 0 {
+		return nil
+	}
+	command := strings.Join(step.PreCommand, " ")
+	r.runningStep(fmt.Sprintf("Running pre-command '%s'", command), idx, messaging.RunningState, 0)
+	exitCode, err := r.dckr.RunPreCommand(r.job, step, idx)
+	if err != nil {
+		return fmt.Errorf("Error running pre-command '%s': %s", command, err)
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("Pre-command '%s' exited with code: %d", command, exitCode)
+	}
+	return nil
+}
+
+// mergeLabels returns a new map with the job's labels and the step's labels.
+// The step's labels win when both set the same key.
+func mergeLabels(job, step map[string]string) map[string]string {
+	if len(job) == 0 && len(step) == 0 {
+		return nil
+	}
+	retval := make(map[string]string, len(job)+len(step))
+	for k, v := range job {
+		retval[k] = v
+	}
+	for k, v := range step {
+		retval[k] = v
+	}
+	return retval
+}
+
+// validateJob runs the checks a job has to pass before anything is pulled or
+// created for it and returns the first error.
+func (r *JobRunner) validateJob() error {
+	validators := []func() error{
+		r.verifySteps,
+		r.verifyLimits,
+		r.verifyContainerNames,
+		r.verifyCapabilities,
+		r.verifyMemory,
+		r.verifyHostPaths,
+	}
+	for _, validate := range validators {
+		if err := validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifySteps returns an error if the job has no steps and jobs without steps
+// aren't allowed.
+func (r *JobRunner) verifySteps() error {
+	if len(r.job.Steps) == 0 && !r.allowEmpty {
+		return errors.New("the job doesn't have any steps and job.allow_zero_steps is false")
+	}
+	return nil
+}
+
+// verifyLimits returns an error if the job has more inputs or steps than
+// r.limits allows.
+func (r *JobRunner) verifyLimits() error {
+	if inputs := len(r.job.Inputs()); r.limits.inputs > 0 && inputs > r.limits.inputs {
+		return fmt.Errorf("the job has %d inputs, which is more than the limit of %d", inputs, r.limits.inputs)
+	}
+	if steps := len(r.job.Steps); r.limits.steps > 0 && steps > r.limits.steps {
+		return fmt.Errorf("the job has %d steps, which is more than the limit of %d", steps, r.limits.steps)
+	}
+	return nil
+}
+
+// verifyContainerNames returns an error naming the first container name that
+// the job would use for two different containers, since Docker refuses to
+// create the second one with an error that doesn't point back at the job.
+// Steps can share a data container, so a data container is only a duplicate
+// if its name is reused for a different image or for a step.
+func (r *JobRunner) verifyContainerNames() error {
+	dataImages := make(map[string]string)
+	for _, vf := range r.job.DataContainers() {
+		name := fmt.Sprintf("%s-%s", vf.NamePrefix, r.job.InvocationID)
+		if image, ok := dataImages[name]; ok && image != vf.ImageRef() {
+			return fmt.Errorf("container name %s is used for data containers with different images", name)
+		}
+		dataImages[name] = vf.ImageRef()
+	}
+
+	stepNames := make(map[string]int)
+	for idx, step := range r.job.Steps {
+		name := step.Component.Container.Name
+		if name == "" {
+			continue
+		}
+		if other, ok := stepNames[name]; ok {
+			return fmt.Errorf("container name %s is used by steps %d and %d", name, other, idx)
+		}
+		if _, ok := dataImages[name]; ok {
+			return fmt.Errorf("container name %s of step %d is also used by a data container", name, idx)
+		}
+		stepNames[name] = idx
+	}
+	return nil
+}
+
 func (r *JobRunner) runAllSteps(exit chan messaging.StatusCode) error {
+	r.phase = PhaseRunning
 	var err error
 	var exitCode int64
 
 	for idx, step := range r.job.Steps {
-		running(r.client, r.job,
+		if !r.proceed() {
+			return errStopped
+		}
+		log := r.log.WithFields(logrus.Fields{"phase": PhaseRunning, "step_index": idx})
+
+		r.runningStep(
 			fmt.Sprintf(
 				"Running tool container %s:%s with arguments: %s",
 				step.Component.Container.Image.Name,
 				step.Component.Container.Image.Tag,
 				strings.Join(step.Arguments(), " "),
 			),
+			idx, messaging.RunningState, 0,
 		)
 
-		step.Environment["IPLANT_USER"] = job.Submitter
-		step.Environment["IPLANT_EXECUTION_ID"] = job.InvocationID
+		step.Environment["IPLANT_USER"] = r.job.Submitter
+		step.Environment["IPLANT_EXECUTION_ID"] = r.job.InvocationID
+		step.Labels = mergeLabels(r.job.Labels, step.Labels)
+
+		if err = r.waitForServices(&step, idx); err != nil {
+			r.runningStep(err.Error(), idx, messaging.FailedState, 0)
+			r.status = messaging.StatusStepFailed
+			return err
+		}
 
 		// TimeLimits set to 0 mean that there isn't a time limit.
 		var timeLimitEnabled bool
 		if step.Component.TimeLimit > 0 {
-			logcabin.Info.Printf("Time limit is set to %d", step.Component.TimeLimit)
+			log.Infof("Time limit is set to %d", step.Component.TimeLimit)
 			timeLimitEnabled = true
 		} else {
-			logcabin.Info.Print("time limit is disabled")
+			log.Info("time limit is disabled")
 		}
 
-		// Start up the ticker
+		// Start up the ticker. The PreCommand counts against the step's time
+		// limit, so it's started first.
 		var tickerQuit chan int
 		if timeLimitEnabled {
 			tickerQuit, err = r.getTicker(step.Component.TimeLimit, exit)
 			if err != nil {
-				logcabin.Error.Print(err)
+				log.Error(err)
 				timeLimitEnabled = false
 			} else {
-				logcabin.Info.Print("started up time limit ticker")
+				log.Info("started up time limit ticker")
 			}
 		}
 
-		exitCode, err = dckr.RunStep(&step, r.job.InvocationID, idx)
+		if err = r.runPreCommand(&step, idx); err != nil {
+			if timeLimitEnabled {
+				tickerQuit <- 1
+			}
+			r.runningStep(err.Error(), idx, messaging.FailedState, 0)
+			r.status = messaging.StatusStepFailed
+			return err
+		}
+
+		// Start watching the dead man's switch file
+		var deadmanQuit chan int
+		if r.deadman.file != "" {
+			deadmanQuit = r.watchDeadman(r.deadman)
+		}
+
+		// The duration runs from when the step's container starts until it
+		// exits, so it leaves out creating the container.
+		started := time.Now()
+		onStart := func() { started = time.Now() }
+		r.logs.setCurrent(idx)
+		exitCode, err = r.runStep(&step, idx, 1, onStart)
+		if err == dockerops.ErrOOMKilled && r.increaseMemory(&step, idx) {
+			exitCode, err = r.runStep(&step, idx, 2, onStart)
+		}
+		r.logs.setCurrent(-1)
+		elapsed := time.Since(started)
 
 		// Shut down the ticker
 		if timeLimitEnabled {
 			tickerQuit <- 1
-			logcabin.Info.Print("sent message to stop time limit ticker")
+			log.Info("sent message to stop time limit ticker")
+		}
+		if deadmanQuit != nil {
+			deadmanQuit <- 1
 		}
 
 		if exitCode != 0 || err != nil {
 			if err != nil {
-				running(r.client, r.job,
+				r.runningStep(
 					fmt.Sprintf(
 						"Error running tool container %s:%s with arguments '%s': %s",
 						step.Component.Container.Image.Name,
@@ -228,6 +684,7 @@ func (r *JobRunner) runAllSteps(exit chan messaging.StatusCode) error {
 						strings.Join(step.Arguments(), " "),
 						err.Error(),
 					),
+					idx, messaging.FailedState, elapsed,
 				)
 			} else {
 				err = fmt.Errorf(
@@ -237,159 +694,421 @@ func (r *JobRunner) runAllSteps(exit chan messaging.StatusCode) error {
 					strings.Join(step.Arguments(), " "),
 					exitCode,
 				)
-				running(r.client, r.job, err.Error())
+				r.runningStep(err.Error(), idx, messaging.FailedState, elapsed)
+			}
+			r.failTail = r.stderrTail(&step, idx)
+			r.stepExit = exitCode
+			if err == dockerops.ErrIdleTimeout {
+				r.status = StatusIdleTimeout
+			} else if dockerops.IsPlatformMismatch(err) {
+				r.reportPlatformMismatch(&step)
+				r.status = StatusPlatformMismatch
+			} else {
+				r.status = messaging.StatusStepFailed
 			}
-			r.status = messaging.StatusStepFailed
 			return err
 		}
-		running(r.client, r.job,
+		r.runningStep(
 			fmt.Sprintf("Tool container %s:%s with arguments '%s' finished successfully",
 				step.Component.Container.Image.Name,
 				step.Component.Container.Image.Tag,
 				strings.Join(step.Arguments(), " "),
 			),
+			idx, messaging.SucceededState, elapsed,
 		)
+
+		r.uploadStepOutputs(&step, idx)
+	}
+
+	if err = r.runSuccessCommand(); err != nil {
+		r.running(err.Error())
+		r.status = messaging.StatusStepFailed
 	}
 	return err
 }
 
+// runSuccessCommand runs the job's SuccessCommand, if it has one, once all of
+// the steps have succeeded. It runs in a container made from the last step,
+// so it sees the same working directory and environment.
+func (r *JobRunner) runSuccessCommand() error {
+	if len(r.job.SuccessCommand) == 0 {
+		return nil
+	}
+	command := strings.Join(r.job.SuccessCommand, " ")
+	if len(r.job.Steps) == 0 {
+		return fmt.Errorf("Can't run success command '%s' because the job doesn't have any steps to take an image from", command)
+	}
+	step := r.job.Steps[len(r.job.Steps)-1]
+	step.Labels = mergeLabels(r.job.Labels, step.Labels)
+
+	r.running(fmt.Sprintf("Running success command '%s'", command))
+	exitCode, err := r.dckr.RunSuccessCommand(r.job, &step)
+	if err != nil {
+		return fmt.Errorf("Error running success command '%s': %s", command, err)
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("Success command '%s' exited with code: %d", command, exitCode)
+	}
+	r.running(fmt.Sprintf("Success command '%s' finished successfully", command))
+	return nil
+}
+
+// uploadStepOutputs uploads the files matching the step's output globs as soon
+// as the step finishes. Files that are uploaded successfully are excluded from
+// the final output upload. Failures are reported but aren't fatal, since
+// anything that doesn't get uploaded here is picked up by the final upload.
+// Nothing is uploaded for interactive jobs.
+func (r *JobRunner) uploadStepOutputs(step *model.Step, idx int) {
+	if r.job.Interactive {
+		return
+	}
+	var sources []string
+	for _, glob := range step.OutputGlobs {
+		matches, err := filepath.Glob(filepath.Join(r.volumeDir, glob))
+		if err != nil {
+			r.running(fmt.Sprintf("Bad output glob '%s' for step %d: %s", glob, idx, err.Error()))
+			continue
+		}
+		for _, m := range matches {
+			rel, err := filepath.Rel(r.volumeDir, m)
+			if err != nil {
+				r.log.WithFields(logrus.Fields{"phase": PhaseRunning, "step_index": idx}).Error(err)
+				continue
+			}
+			sources = append(sources, rel)
+		}
+	}
+
+	for n, source := range sources {
+		r.running(fmt.Sprintf("Uploading %s to %s", source, r.job.OutputDirectory()))
+		exitCode, err := r.dckr.UploadStepOutput(r.job, source, fmt.Sprintf("%d-%d", idx, n))
+		if err != nil {
+			r.running(fmt.Sprintf("Error uploading %s, it will be retried with the rest of the outputs: %s", source, err.Error()))
+			continue
+		}
+		if exitCode != 0 {
+			r.running(fmt.Sprintf("Transfer utility exited with a code of %d when uploading %s, it will be retried with the rest of the outputs", exitCode, source))
+			continue
+		}
+		r.job.FilterFiles = append(r.job.FilterFiles, source)
+		r.running(fmt.Sprintf("Done uploading %s to %s", source, r.job.OutputDirectory()))
+	}
+}
+
+// errUploadDeadline is returned by uploadOutputs when the upload after a
+// failed job is abandoned.
+var errUploadDeadline = errors.New("the output upload didn't finish before the upload deadline")
+
+// transferOutputs uploads the job's outputs. The upload is skipped for
+// interactive jobs, and when an input failed to download and uploads after
+// input failures are turned off.
+func (r *JobRunner) transferOutputs() error {
+	if r.job.Interactive {
+		r.running("Not uploading outputs for an interactive job")
+		return nil
+	}
+	if r.status == messaging.StatusInputFailed && !r.uploadOnFail {
+		r.running(fmt.Sprintf("Skipping the upload of outputs to %s because the inputs failed to download", r.job.OutputDirectory()))
+		return nil
+	}
+	r.phase = PhaseUploading
+	r.running(fmt.Sprintf("Beginning to upload outputs to %s", r.job.OutputDirectory()))
+	return r.uploadOutputs()
+}
+
+// uploadWithDeadline runs UploadOutputs, giving up after r.deadline if the
+// job has already failed. The upload container is left running in that case;
+// it's removed with the rest of the job's containers when road-runner exits.
+func (r *JobRunner) uploadWithDeadline() (int64, error) {
+	if r.deadline <= 0 || r.status == messaging.Success {
+		return r.dckr.UploadOutputs(r.job)
+	}
+
+	type result struct {
+		exitCode int64
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		exitCode, err := r.dckr.UploadOutputs(r.job)
+		done <- result{exitCode, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.exitCode, res.err
+	case <-time.After(r.deadline):
+		return -1, errUploadDeadline
+	}
+}
+
 func (r *JobRunner) uploadOutputs() error {
+	r.phase = PhaseUploading
 	var (
 		err      error
 		exitCode int64
 	)
 
-	exitCode, err = dckr.UploadOutputs(r.job)
+	exitCode, err = r.uploadWithDeadline()
+	if err == errUploadDeadline {
+		r.running(fmt.Sprintf("Abandoned the upload of outputs to %s after %s", r.job.OutputDirectory(), r.deadline.String()))
+		return err
+	}
 	if exitCode != 0 || err != nil {
 		if err != nil {
-			running(r.client, r.job, fmt.Sprintf("Error uploading outputs to %s: %s", r.job.OutputDirectory(), err.Error()))
+			r.running(fmt.Sprintf("Error uploading outputs to %s: %s", r.job.OutputDirectory(), err.Error()))
 		} else {
 			if r.client == nil {
-				logcabin.Warning.Println("client is nil")
+				r.log.WithField("phase", PhaseUploading).Warn("client is nil")
 			}
 			if r.job == nil {
-				logcabin.Warning.Println("job is nil")
+				r.log.WithField("phase", PhaseUploading).Warn("job is nil")
 			}
 			od := r.job.OutputDirectory()
-			running(r.client, r.job, fmt.Sprintf("Transfer utility exited with a code of %d when uploading outputs to %s", exitCode, od))
+			r.running(fmt.Sprintf("Transfer utility exited with a code of %d when uploading outputs to %s", exitCode, od))
 		}
 		r.status = messaging.StatusOutputFailed
 	}
 
-	running(r.client, r.job, fmt.Sprintf("Done uploading outputs to %s", r.job.OutputDirectory()))
+	r.running(fmt.Sprintf("Done uploading outputs to %s", r.job.OutputDirectory()))
 
 	return err
 }
 
-// Run executes the job, and returns the exit code on the exit channel.
-func Run(client *messaging.Client, dckr *dockerops.Docker, exit chan messaging.StatusCode) {
+// reportStatus publishes the final status of the job, retrying if the publish
+// fails. Failure messages include the end of the failed step's stderr when it
+// was captured, and the exit code of the failed step when it exited with one.
+func (r *JobRunner) reportStatus() {
+	var err error
+	if r.status == messaging.Success {
+		err = publishTerminal(func() error {
+			return success(r.client, r.job)
+		})
+	} else {
+		msg := fmt.Sprintf("Job exited with a status of %d", r.status)
+		if r.failTail != "" {
+			msg = fmt.Sprintf("%s. The end of the failed step's stderr was:\n%s", msg, r.failTail)
+		}
+		exit := &messaging.ExitCode{Status: r.status, Step: r.stepExit}
+		err = publishTerminal(func() error {
+			return fail(r.client, r.job, exit, msg)
+		})
+	}
+	if err != nil {
+		r.log.WithField("phase", PhaseUploading).Errorf("giving up on publishing the final job status: %s", err)
+	}
+}
+
+// Run executes the job in rc, publishing updates with rc.Publisher, and returns
+// the exit code on the exit channel. Cancelling ctx aborts any image pulls that
+// are in progress. A stop requested on rc.Stop ends the job early, but the
+// outputs are still uploaded.
+func Run(ctx context.Context, rc *RunContext, dckr DockerOperator, exit chan messaging.StatusCode) {
+	job := rc.Job
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	runner := &JobRunner{
-		client: client,
-		dckr:   dckr,
-		exit:   exit,
-		job:    job,
-		status: messaging.Success,
+		runConfig: rc.config,
+		ctx:       ctx,
+		client:    rc.Publisher,
+		dckr:      dckr,
+		exit:      exit,
+		job:       job,
+		status:    messaging.Success,
+		volumeDir: dockerops.VOLUMEDIR,
+		log:       newJobLogger(os.Stdout, job.InvocationID),
+		phase:     PhasePreparing,
+		fs:        osFileSystem{},
+		metrics:   &rc.metrics,
+		stop:      rc.Stop,
+	}
+	runner.metrics.update(func(m *jobMetrics) { m.started = time.Now() })
+	go runner.watchStop(cancel)
+	log := runner.log.WithField("phase", PhasePreparing)
+
+	if runner.logsAddr != "" {
+		runner.logs = newLogServer(job, runner.volumeDir, dckr)
+		go func() {
+			if err := runner.logs.serve(runner.logsAddr); err != nil {
+				log.Errorf("not serving step logs on %s: %s", runner.logsAddr, err)
+			}
+		}()
 	}
 
 	host, err := os.Hostname()
 	if err != nil {
-		logcabin.Error.Print(err)
+		log.Error(err)
 		host = "UNKNOWN"
 	}
 
 	// let everyone know the job is running
-	running(runner.client, runner.job, fmt.Sprintf("Job %s is running on host %s", runner.job.InvocationID, host))
+	runner.running(fmt.Sprintf("Job %s is running on host %s", runner.job.InvocationID, host))
+
+	// The daemon version goes into the job summary to help track down
+	// problems that only show up on some nodes.
+	if runner.daemon, err = dckr.DaemonVersion(); err != nil {
+		log.Error(err)
+	} else {
+		log.Infof("Docker daemon version %s on %s", runner.daemon.Version, nodeOS(runner.daemon))
+	}
 
 	transferTrigger, err := os.Create("logs/de-transfer-trigger.log")
 	if err != nil {
-		logcabin.Error.Print(err)
+		log.Error(err)
 	} else {
 		_, err = transferTrigger.WriteString("This is only used to force HTCondor to transfer files.")
 		if err != nil {
-			logcabin.Error.Print(err)
+			log.Error(err)
 		}
 	}
 
 	if _, err = os.Stat("iplant.cmd"); err != nil {
 		if err = os.Rename("iplant.cmd", "logs/iplant.cmd"); err != nil {
-			logcabin.Error.Print(err)
+			log.Error(err)
+		}
+	}
+
+	if err = runner.validateJob(); err != nil {
+		log.Error(err)
+		runner.status = messaging.StatusDockerCreateFailed
+		runner.running(fmt.Sprintf("Error validating the job: %s", err.Error()))
+	}
+
+	if runner.proceed() {
+		if err = checkJobDiskSpace(runner.job, runner.volumesPath); err != nil {
+			log.Error(err)
+			runner.status = messaging.StatusDockerCreateFailed
+			runner.running(fmt.Sprintf("Error checking the disk space for the job: %s", err.Error()))
 		}
 	}
 
 	// Pull the data container images
-	if err = runner.pullDataImages(); err != nil {
-		logcabin.Error.Print(err)
+	log = runner.log.WithField("phase", PhasePreparing)
+	if runner.proceed() {
+		if err = runner.waitForPullJitter(); err != nil {
+			log.Error(err)
+			runner.status = messaging.StatusKilled
+			runner.running("Aborted pulling images because of a stop request")
+		}
+	}
+	if runner.proceed() {
+		if err = runner.pullDataImages(); err != nil {
+			log.Error(err)
+		}
 	}
 
 	// Create the data containers
-	if runner.status == messaging.Success {
+	log = runner.log.WithField("phase", PhasePreparing)
+	if runner.proceed() {
 		if err = runner.createDataContainers(); err != nil {
-			logcabin.Error.Print(err)
+			log.Error(err)
 		}
 	}
 
 	// Pull the job step containers
-	if runner.status == messaging.Success {
+	log = runner.log.WithField("phase", PhasePreparing)
+	if runner.proceed() {
 		if err = runner.pullStepImages(); err != nil {
-			logcabin.Error.Print(err)
+			log.Error(err)
 		}
 	}
 
 	// // Create the working directory volume
-	if runner.status == messaging.Success {
-		if _, err = runner.dckr.CreateWorkingDirVolume(job.InvocationID); err != nil {
-			logcabin.Error.Print(err)
+	log = runner.log.WithField("phase", PhasePreparing)
+	if runner.proceed() {
+		if err = runner.createWorkingDirVolume(); err != nil {
+			log.Error(err)
 		}
 	}
 
+	log = runner.log.WithField("phase", PhasePreparing)
 	wd, err := os.Getwd()
 	if err != nil {
-		logcabin.Error.Print(err)
+		log.Error(err)
 	} else {
-		voldir := path.Join(wd, dockerops.VOLUMEDIR, "logs")
-		logcabin.Info.Printf("path to the volume directory: %s\n", voldir)
+		runner.volumeDir = path.Join(wd, dockerops.VOLUMEDIR)
+		voldir := path.Join(runner.volumeDir, "logs")
+		log.Infof("path to the volume directory: %s", voldir)
 		err = os.Mkdir(voldir, 0755)
 		if err != nil {
-			logcabin.Error.Print(err)
+			log.Error(err)
 		}
 
-		if err = writeJobSummary(voldir, job); err != nil {
-			logcabin.Error.Print(err)
+		if err = writeJobSummary(voldir, runner.job, runner.daemon); err != nil {
+			log.Error(err)
 		}
 
-		if err = writeJobParameters(voldir, job); err != nil {
-			logcabin.Error.Print(err)
+		if err = writeJobParameters(voldir, runner.job); err != nil {
+			log.Error(err)
 		}
 	}
+
 	// If pulls didn't succeed then we can't guarantee that we've got the
 	// correct versions of the tools. Don't bother pulling in data in that case,
 	// things are already screwed up.
-	if runner.status == messaging.Success {
+	log = runner.log.WithField("phase", PhasePreparing)
+	if runner.proceed() {
+		// Stale locks go before the downloads, which could otherwise be
+		// blocked by them or have freshly downloaded inputs removed.
+		runner.removeStaleLocksFromVolume()
 		if err = runner.downloadInputs(); err != nil {
-			logcabin.Error.Print(err)
+			log.Error(err)
+		}
+		if runner.metricsURL != "" {
+			size := runner.workdirBytes()
+			runner.metrics.update(func(m *jobMetrics) { m.inputBytes = size })
 		}
 	}
 
 	// Only attempt to run the steps if the input downloads succeeded. No reason
 	// to run the steps if there's no/corrupted data to operate on.
-	if runner.status == messaging.Success {
+	log = runner.log.WithField("phase", PhaseRunning)
+	if runner.proceed() {
 		if err = runner.runAllSteps(exit); err != nil {
-			logcabin.Error.Print(err)
+			log.Error(err)
 		}
 	}
 
-	// Always attempt to transfer outputs. There might be logs that can help
-	// debug issues when the job fails.
-	running(runner.client, runner.job, fmt.Sprintf("Beginning to upload outputs to %s", runner.job.OutputDirectory()))
-	if err = runner.uploadOutputs(); err != nil {
-		logcabin.Error.Print(err)
+	// Bundle up everything support staff needs to debug the failure before the
+	// outputs are transferred so that the bundle goes along with them.
+	log = runner.log.WithField("phase", PhaseUploading)
+	if !runner.proceed() {
+		if err = writeDiagnostics(runner.fs, runner.dckr, runner.volumeDir, runner.job); err != nil {
+			log.Error(err)
+		}
+	}
+
+	// The archive has to be uploaded before cleanup removes the volume.
+	if err = runner.uploadWorkdir(); err != nil {
+		log.Error(err)
+	}
+
+	// Transfer outputs even if the job failed, unless it's configured not to
+	// when the inputs failed. There might be logs that can help debug issues
+	// when the job fails.
+	log = runner.log.WithField("phase", PhaseUploading)
+	if runner.metricsURL != "" {
+		size := runner.uploadBytes()
+		runner.metrics.update(func(m *jobMetrics) { m.outputBytes = size })
+	}
+	if err = runner.transferOutputs(); err != nil {
+		log.Error(err)
 	}
 
 	// Always inform upstream of the job status.
-	if runner.status != messaging.Success {
-		fail(runner.client, runner.job, fmt.Sprintf("Job exited with a status of %d", runner.status))
-	} else {
-		success(runner.client, runner.job)
+	runner.proceed()
+	runner.reportStatus()
+
+	// HTCondor post-scripts read the final status from the logs directory.
+	log = runner.log.WithField("phase", PhaseUploading)
+	if err = writeExitStatus(runner.fs, "logs", runner.status); err != nil {
+		log.Error(err)
+	}
+
+	if runner.metricsURL != "" {
+		if err = runner.metrics.push(runner.metricsURL, runner.job, runner.status, time.Now()); err != nil {
+			log.Error(err)
+		}
 	}
 
 	exit <- runner.status
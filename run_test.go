@@ -0,0 +1,1118 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/road-runner/dockerops"
+	"github.com/cyverse-de/road-runner/messaging"
+	"github.com/cyverse-de/road-runner/model"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+)
+
+// fakeDocker is a DockerOperator that records the operations performed on it.
+type fakeDocker struct {
+	mu              sync.Mutex
+	calls           []string
+	runStepExitCode int64
+	runStepErr      error
+	runStepDelay    time.Duration
+	startDelay      time.Duration
+	perStepDirs     bool
+	preCommandExit  int64
+	preCommandDelay time.Duration
+	successExit     int64
+	healthchecked   map[string]bool
+	serviceStates   []types.ContainerState
+	oomRuns         int
+	memoryLimits    []int64
+	ports           nat.PortMap
+	pullBlocks      bool
+	repoDigests     map[string][]string
+	volumes         map[string]bool
+	uploadBlocks    chan struct{}
+	nodeMemory      int64
+	nodePlatform    platform
+	imagePlatforms  map[string]platform
+	downloadExits   []int64
+	dataErrs        map[string]error
+}
+
+// platform is an operating system and architecture pair.
+type platform struct {
+	os, arch string
+}
+
+func (f *fakeDocker) record(format string, args ...interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, fmt.Sprintf(format, args...))
+}
+
+func (f *fakeDocker) Pull(ctx context.Context, name, tag string) error {
+	f.record("Pull %s:%s", name, tag)
+	if f.pullBlocks {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (f *fakeDocker) PullAuthenticated(ctx context.Context, name, tag, auth string) error {
+	f.record("PullAuthenticated %s:%s", name, tag)
+	if f.pullBlocks {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (f *fakeDocker) PullDigest(ctx context.Context, name, digest, auth string) error {
+	f.record("PullDigest %s@%s", name, digest)
+	return nil
+}
+
+func (f *fakeDocker) InspectImage(id string) (types.ImageInspect, error) {
+	p := f.imagePlatforms[id]
+	inspection := types.ImageInspect{RepoDigests: f.repoDigests[id], Os: p.os, Architecture: p.arch}
+	if f.healthchecked[id] {
+		inspection.Config = &container.Config{
+			Healthcheck: &container.HealthConfig{Test: []string{"CMD", "pg_isready"}},
+		}
+	}
+	return inspection, nil
+}
+
+func (f *fakeDocker) NodeMemory() (int64, error) {
+	return f.nodeMemory, nil
+}
+
+func (f *fakeDocker) NodePlatform() (string, string, error) {
+	return f.nodePlatform.os, f.nodePlatform.arch, nil
+}
+
+func (f *fakeDocker) DaemonVersion() (types.Version, error) {
+	return types.Version{Version: "17.03.1-ce", Os: "linux", Arch: "amd64", KernelVersion: "4.4.0"}, nil
+}
+
+func (f *fakeDocker) CreateDataContainer(vf *model.VolumesFrom, invID string) (string, error) {
+	f.record("CreateDataContainer %s", vf.NamePrefix)
+	if err := f.dataErrs[vf.NamePrefix]; err != nil {
+		return "", err
+	}
+	return vf.NamePrefix, nil
+}
+
+func (f *fakeDocker) CreateWorkingDirVolume(volumeID string) (types.Volume, error) {
+	f.record("CreateWorkingDirVolume %s", volumeID)
+	return types.Volume{Name: volumeID}, nil
+}
+
+func (f *fakeDocker) VolumeExists(volumeID string) (bool, error) {
+	return f.volumes[volumeID], nil
+}
+
+func (f *fakeDocker) RemoveVolume(volumeID string) error {
+	f.record("RemoveVolume %s", volumeID)
+	delete(f.volumes, volumeID)
+	return nil
+}
+
+func (f *fakeDocker) DownloadInputs(job *model.Job, input *model.StepInput, idx, attempt int) (int64, error) {
+	if attempt > 1 {
+		f.record("DownloadInputs %d attempt %d", idx, attempt)
+	} else {
+		f.record("DownloadInputs %d", idx)
+	}
+	if len(f.downloadExits) > 0 {
+		exitCode := f.downloadExits[0]
+		f.downloadExits = f.downloadExits[1:]
+		if exitCode != 0 {
+			return exitCode, nil
+		}
+	}
+	return 0, nil
+}
+
+func (f *fakeDocker) RunStep(job *model.Job, step *model.Step, idx, attempt int, started func()) (int64, error) {
+	f.record("RunStep %d", idx)
+	f.memoryLimits = append(f.memoryLimits, step.Component.Container.MemoryLimit)
+	time.Sleep(f.startDelay)
+	if started != nil {
+		started()
+	}
+	time.Sleep(f.runStepDelay)
+	if f.oomRuns > 0 {
+		f.oomRuns--
+		return 137, dockerops.ErrOOMKilled
+	}
+	return f.runStepExitCode, f.runStepErr
+}
+
+func (f *fakeDocker) StepLogs(step *model.Step, idx int) (string, string) {
+	return dockerops.StepLogs(step, idx, f.perStepDirs)
+}
+
+func (f *fakeDocker) RunInteractiveStep(job *model.Job, step *model.Step, idx, attempt int, started func(nat.PortMap)) (int64, error) {
+	f.record("RunInteractiveStep %d", idx)
+	started(f.ports)
+	return f.runStepExitCode, f.runStepErr
+}
+
+func (f *fakeDocker) RunPreCommand(job *model.Job, step *model.Step, idx int) (int64, error) {
+	f.record("RunPreCommand %d %s", idx, strings.Join(step.PreCommand, " "))
+	time.Sleep(f.preCommandDelay)
+	return f.preCommandExit, nil
+}
+
+func (f *fakeDocker) RunSuccessCommand(job *model.Job, step *model.Step) (int64, error) {
+	f.record("RunSuccessCommand %s %s", step.Component.Container.Image.Name, strings.Join(job.SuccessCommand, " "))
+	return f.successExit, nil
+}
+
+func (f *fakeDocker) UploadStepOutput(job *model.Job, source, suffix string) (int64, error) {
+	f.record("UploadStepOutput %s %s", source, suffix)
+	return 0, nil
+}
+
+func (f *fakeDocker) UploadDebugArchive(job *model.Job, source, dest string) (int64, error) {
+	f.record("UploadDebugArchive %s %s", source, dest)
+	return 0, nil
+}
+
+func (f *fakeDocker) UploadOutputs(job *model.Job) (int64, error) {
+	f.record("UploadOutputs")
+	if f.uploadBlocks != nil {
+		<-f.uploadBlocks
+	}
+	return 0, nil
+}
+
+func (f *fakeDocker) ContainersWithLabel(key, value string, all bool) ([]string, error) {
+	return nil, nil
+}
+
+func (f *fakeDocker) StopContainer(id string, grace time.Duration) error {
+	f.record("StopContainer %s", id)
+	return nil
+}
+
+func (f *fakeDocker) StartContainer(containerID string) error {
+	f.record("StartContainer %s", containerID)
+	return nil
+}
+
+// InspectContainer returns the next of f.serviceStates each time it's called,
+// repeating the last one once they run out.
+func (f *fakeDocker) InspectContainer(containerID string) (types.ContainerJSON, error) {
+	if len(f.serviceStates) == 0 {
+		return types.ContainerJSON{}, nil
+	}
+	f.record("InspectContainer %s", containerID)
+	state := f.serviceStates[0]
+	if len(f.serviceStates) > 1 {
+		f.serviceStates = f.serviceStates[1:]
+	}
+	return types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{State: &state}}, nil
+}
+
+// newTestRunner returns a *JobRunner for the test job that uses fakes for
+// Docker and the AMQP publisher.
+// newTestRunner returns a runner for its own copy of the test job, along with
+// the fakes it uses.
+func newTestRunner(t *testing.T) (*JobRunner, *fakeDocker, *fakePublisher) {
+	j := newTestJob(t)
+	d := &fakeDocker{}
+	p := &fakePublisher{}
+	return &JobRunner{
+		runConfig: defaultRunConfig(),
+		ctx:       context.Background(),
+		client:    p,
+		dckr:      d,
+		exit:      make(chan messaging.StatusCode, 1),
+		stop:      make(chan messaging.StatusCode, 1),
+		job:       j,
+		status:    messaging.Success,
+		log:       newJobLogger(ioutil.Discard, j.InvocationID),
+		fs:        osFileSystem{},
+	}, d, p
+}
+
+func TestRunAllStepsUploadsStepOutputs(t *testing.T) {
+	runner, d, _ := newTestRunner(t)
+
+	dir, err := ioutil.TempDir("", "road-runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(path.Join(dir, "wc_out.txt"), []byte("1 2 3"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runner.volumeDir = dir
+	runner.job.Steps[0].OutputGlobs = []string{"*.txt"}
+
+	if err = runner.runAllSteps(runner.exit); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"RunStep 0",
+		"UploadStepOutput wc_out.txt 0-0",
+	}
+	if !reflect.DeepEqual(d.calls, expected) {
+		t.Errorf("calls were %#v instead of %#v", d.calls, expected)
+	}
+
+	var excluded bool
+	for _, f := range runner.job.FilterFiles {
+		if f == "wc_out.txt" {
+			excluded = true
+		}
+	}
+	if !excluded {
+		t.Error("uploaded output wasn't excluded from the final upload")
+	}
+}
+
+func TestRunAllStepsLogsStepContext(t *testing.T) {
+	runner, _, _ := newTestRunner(t)
+
+	var buf bytes.Buffer
+	runner.log = newJobLogger(&buf, runner.job.InvocationID)
+
+	if err := runner.runAllSteps(runner.exit); err != nil {
+		t.Fatal(err)
+	}
+
+	var found bool
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var entry map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("log line %q isn't JSON: %s", scanner.Text(), err)
+		}
+		if _, ok := entry["step_index"]; !ok {
+			continue
+		}
+		found = true
+		expected := map[string]interface{}{
+			"invocation_id": runner.job.InvocationID,
+			"phase":         PhaseRunning,
+			"step_index":    float64(0),
+			"service":       "road-runner",
+			"art-id":        "road-runner",
+			"group-id":      "org.iplantc",
+		}
+		for k, v := range expected {
+			if entry[k] != v {
+				t.Errorf("field %s was %#v instead of %#v", k, entry[k], v)
+			}
+		}
+		for _, k := range []string{"level", "timeMillis", "message"} {
+			if _, ok := entry[k]; !ok {
+				t.Errorf("field %s is missing", k)
+			}
+		}
+	}
+	if !found {
+		t.Error("no log lines contained a step_index field")
+	}
+}
+
+func TestRunAllStepsSuccessCommand(t *testing.T) {
+	t.Run("runs after all of the steps succeed", func(t *testing.T) {
+		runner, d, _ := newTestRunner(t)
+		runner.job.SuccessCommand = []string{"make-report", "out"}
+		if err := runner.runAllSteps(runner.exit); err != nil {
+			t.Fatal(err)
+		}
+		last := runner.job.Steps[len(runner.job.Steps)-1]
+		expected := fmt.Sprintf("RunSuccessCommand %s make-report out", last.Component.Container.Image.Name)
+		if len(d.calls) == 0 || d.calls[len(d.calls)-1] != expected {
+			t.Errorf("calls were %#v instead of ending with %q", d.calls, expected)
+		}
+	})
+
+	t.Run("doesn't run when a step fails", func(t *testing.T) {
+		runner, d, _ := newTestRunner(t)
+		d.runStepExitCode = 1
+		runner.job.SuccessCommand = []string{"make-report", "out"}
+		if err := runner.runAllSteps(runner.exit); err == nil {
+			t.Error("err was nil")
+		}
+		for _, call := range d.calls {
+			if strings.HasPrefix(call, "RunSuccessCommand") {
+				t.Error("the success command ran after a step failed")
+			}
+		}
+	})
+
+	t.Run("failed success command fails the job", func(t *testing.T) {
+		runner, d, _ := newTestRunner(t)
+		d.successExit = 2
+		runner.job.SuccessCommand = []string{"make-report", "out"}
+		if err := runner.runAllSteps(runner.exit); err == nil {
+			t.Error("err was nil")
+		}
+		if runner.status != messaging.StatusStepFailed {
+			t.Errorf("status was %d instead of %d", runner.status, messaging.StatusStepFailed)
+		}
+	})
+}
+
+func TestRunAllStepsPreCommand(t *testing.T) {
+	t.Run("pre-command runs before the step", func(t *testing.T) {
+		runner, d, _ := newTestRunner(t)
+		runner.job.Steps[0].PreCommand = []string{"mkdir", "-p", "out"}
+		if err := runner.runAllSteps(runner.exit); err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{"RunPreCommand 0 mkdir -p out", "RunStep 0"}
+		if !reflect.DeepEqual(d.calls, expected) {
+			t.Errorf("calls were %#v instead of %#v", d.calls, expected)
+		}
+	})
+
+	t.Run("failed pre-command fails the step", func(t *testing.T) {
+		runner, d, _ := newTestRunner(t)
+		d.preCommandExit = 1
+		runner.job.Steps[0].PreCommand = []string{"false"}
+		if err := runner.runAllSteps(runner.exit); err == nil {
+			t.Error("err was nil")
+		}
+		expected := []string{"RunPreCommand 0 false"}
+		if !reflect.DeepEqual(d.calls, expected) {
+			t.Errorf("calls were %#v instead of %#v", d.calls, expected)
+		}
+		if runner.status != messaging.StatusStepFailed {
+			t.Errorf("status was %d instead of %d", runner.status, messaging.StatusStepFailed)
+		}
+	})
+
+	t.Run("pre-command counts against the time limit", func(t *testing.T) {
+		runner, d, _ := newTestRunner(t)
+		d.preCommandDelay = 1500 * time.Millisecond
+		runner.job.Steps[0].PreCommand = []string{"sleep", "2"}
+		runner.job.Steps[0].Component.TimeLimit = 1
+		if err := runner.runAllSteps(runner.exit); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case status := <-runner.exit:
+			if status != messaging.StatusTimeLimit {
+				t.Errorf("status was %d instead of %d", status, messaging.StatusTimeLimit)
+			}
+		default:
+			t.Error("the time limit didn't expire during the pre-command")
+		}
+	})
+
+	t.Run("no pre-command", func(t *testing.T) {
+		runner, d, _ := newTestRunner(t)
+		if err := runner.runAllSteps(runner.exit); err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{"RunStep 0"}
+		if !reflect.DeepEqual(d.calls, expected) {
+			t.Errorf("calls were %#v instead of %#v", d.calls, expected)
+		}
+	})
+}
+
+func TestPullStepImagesCancelled(t *testing.T) {
+	runner, d, p := newTestRunner(t)
+	d.pullBlocks = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runner.ctx = ctx
+
+	done := make(chan error, 1)
+	go func() {
+		done <- runner.pullStepImages()
+	}()
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("error was %v instead of %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pull wasn't aborted after the context was cancelled")
+	}
+
+	if runner.status != messaging.StatusKilled {
+		t.Errorf("status was %d instead of %d", runner.status, messaging.StatusKilled)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	last := p.updates[len(p.updates)-1]
+	if !strings.HasPrefix(last.Message, "Aborted pulling tool container") {
+		t.Errorf("last update was %q", last.Message)
+	}
+}
+
+func TestStageLocalInput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "road-runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	present := path.Join(dir, "dataset.txt")
+	if err = ioutil.WriteFile(present, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	roots := []string{dir}
+
+	input := &model.StepInput{Type: model.HostPathType, Value: present}
+	if err = stageLocalInput(input, roots); err != nil {
+		t.Errorf("present path returned an error: %s", err)
+	}
+
+	input.Value = path.Join(dir, "missing.txt")
+	if err = stageLocalInput(input, roots); !os.IsNotExist(err) {
+		t.Errorf("missing path returned %v instead of a not-exist error", err)
+	}
+
+	input.Value = present
+	if err = stageLocalInput(input, []string{path.Join(dir, "other")}); err == nil {
+		t.Error("path outside the roots didn't return an error")
+	}
+	if err = stageLocalInput(input, nil); err == nil {
+		t.Error("path without any roots didn't return an error")
+	}
+
+	input.Value = "dataset.txt"
+	if err = stageLocalInput(input, roots); err == nil {
+		t.Error("relative path didn't return an error")
+	}
+}
+
+func TestDownloadInputsSkipsHostPaths(t *testing.T) {
+	runner, d, _ := newTestRunner(t)
+
+	dir, err := ioutil.TempDir("", "road-runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	runner.hostPathRoots = []string{dir}
+
+	runner.job.Steps = runner.job.Steps[:1]
+	runner.job.Steps[0].Config.Inputs = []model.StepInput{
+		{Type: model.HostPathType, Value: dir},
+	}
+	if err = runner.downloadInputs(); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.calls) != 0 {
+		t.Errorf("transfers were run for a host path input: %#v", d.calls)
+	}
+
+	runner.job.Steps[0].Config.Inputs[0].Value = path.Join(dir, "missing")
+	if err = runner.downloadInputs(); err == nil {
+		t.Error("missing host path didn't return an error")
+	}
+	if runner.status != messaging.StatusInputFailed {
+		t.Errorf("status was %d instead of %d", runner.status, messaging.StatusInputFailed)
+	}
+}
+
+func TestDownloadInputsStagesInputs(t *testing.T) {
+	runner, d, _ := newTestRunner(t)
+
+	dir, err := ioutil.TempDir("", "road-runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	runner.volumeDir = dir
+	runner.stageInputs = true
+
+	if err = runner.downloadInputs(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path.Join(dir, dockerops.INPUTSDIR))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() {
+		t.Errorf("%s isn't a directory", info.Name())
+	}
+	if len(d.calls) != len(runner.job.Inputs()) {
+		t.Errorf("calls were %#v", d.calls)
+	}
+}
+
+func TestUpdatePhases(t *testing.T) {
+	runner, _, p := newTestRunner(t)
+
+	if err := runner.pullStepImages(); err != nil {
+		t.Fatal(err)
+	}
+	if err := runner.runAllSteps(runner.exit); err != nil {
+		t.Fatal(err)
+	}
+	if err := runner.uploadOutputs(); err != nil {
+		t.Fatal(err)
+	}
+
+	var phases []string
+	for _, u := range p.updates {
+		if u.State != messaging.RunningState {
+			t.Errorf("update %q has state %s", u.Message, u.State)
+		}
+		if len(phases) == 0 || phases[len(phases)-1] != u.Phase {
+			phases = append(phases, u.Phase)
+		}
+	}
+	expected := []string{PhasePreparing, PhaseRunning, PhaseUploading}
+	if !reflect.DeepEqual(phases, expected) {
+		t.Errorf("phases were %#v instead of %#v", phases, expected)
+	}
+}
+
+func TestFailureIncludesStderrTail(t *testing.T) {
+	runner, d, p := newTestRunner(t)
+	d.runStepExitCode = 1
+
+	fs := newMemFileSystem()
+	runner.fs = fs
+	runner.volumeDir = "/volume"
+	runner.tailLines = 2
+	fs.files["/volume/"+runner.job.Steps[0].Stderr("0")] = []byte("starting\nreading input\nsegmentation fault\n" + strings.Repeat("x", 300) + "\n")
+
+	if err := runner.runAllSteps(runner.exit); err == nil {
+		t.Fatal("failing step didn't return an error")
+	}
+	runner.reportStatus()
+
+	last := p.updates[len(p.updates)-1]
+	if last.State != messaging.FailedState {
+		t.Fatalf("last update had state %s instead of %s", last.State, messaging.FailedState)
+	}
+	if !strings.Contains(last.Message, "segmentation fault\n"+strings.Repeat("x", maxTailLineLength)+"...") {
+		t.Errorf("failure message didn't include the stderr tail: %q", last.Message)
+	}
+	if strings.Contains(last.Message, "reading input") {
+		t.Errorf("failure message included more than the last two lines: %q", last.Message)
+	}
+}
+
+func TestRunAllStepsReportsStepStatus(t *testing.T) {
+	runner, d, p := newTestRunner(t)
+	runner.job.Steps = runner.job.Steps[:1]
+	d.runStepDelay = 5 * time.Millisecond
+
+	if err := runner.runAllSteps(runner.exit); err != nil {
+		t.Fatal(err)
+	}
+
+	var steps []*messaging.StepStatus
+	for _, u := range p.updates {
+		if u.Step != nil {
+			steps = append(steps, u.Step)
+		}
+	}
+	if len(steps) != 2 {
+		t.Fatalf("%d step updates were sent instead of 2", len(steps))
+	}
+	if steps[0].State != messaging.RunningState || steps[0].Duration != 0 {
+		t.Errorf("first step update was %#v", steps[0])
+	}
+	if steps[1].State != messaging.SucceededState || steps[1].Index != 0 {
+		t.Errorf("last step update was %#v", steps[1])
+	}
+	if steps[1].Duration < 5 {
+		t.Errorf("step duration was %dms, which is less than the 5ms it ran for", steps[1].Duration)
+	}
+}
+
+func TestRunAllStepsDurationStartsWithTheContainer(t *testing.T) {
+	runner, d, p := newTestRunner(t)
+	d.startDelay = 200 * time.Millisecond
+
+	if err := runner.runAllSteps(runner.exit); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range p.updates {
+		if u.Step != nil && u.Step.State == messaging.SucceededState && u.Step.Duration >= 200 {
+			t.Errorf("step duration was %dms, which includes the time before the container started", u.Step.Duration)
+		}
+	}
+}
+
+func TestStderrTailCombinedOutput(t *testing.T) {
+	runner, _, _ := newTestRunner(t)
+	fs := newMemFileSystem()
+	runner.fs = fs
+	runner.volumeDir = "/volume"
+	runner.tailLines = 1
+	step := &model.Step{CombineOutput: true}
+	fs.files["/volume/"+step.Stdout("0")] = []byte("out\nerr\n")
+
+	if tail := runner.stderrTail(step, 0); tail != "err" {
+		t.Errorf("tail was %q instead of %q", tail, "err")
+	}
+}
+
+func TestStderrTailPerStepDirs(t *testing.T) {
+	runner, d, _ := newTestRunner(t)
+	d.perStepDirs = true
+	fs := newMemFileSystem()
+	runner.fs = fs
+	runner.volumeDir = "/volume"
+	runner.tailLines = 1
+	step := &runner.job.Steps[0]
+	fs.files[path.Join("/volume", dockerops.StepLogDir(step, 0), "stderr")] = []byte("err\n")
+
+	if tail := runner.stderrTail(step, 0); tail != "err" {
+		t.Errorf("tail was %q instead of %q", tail, "err")
+	}
+}
+
+func TestPullDataImagesDigests(t *testing.T) {
+	runner, d, _ := newTestRunner(t)
+	runner.job.Steps = runner.job.Steps[:1]
+	runner.job.Steps[0].Component.Container.VolumesFrom = []model.VolumesFrom{
+		{Name: "discoenv/ref-genome", Tag: "latest", Digest: "sha256:locked"},
+		{Name: "discoenv/blast-db", Tag: "1.0"},
+	}
+	d.repoDigests = map[string][]string{
+		"discoenv/ref-genome@sha256:locked": {"discoenv/ref-genome@sha256:locked"},
+	}
+
+	if err := runner.pullDataImages(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"PullDigest discoenv/ref-genome@sha256:locked",
+		"Pull discoenv/blast-db:1.0",
+	}
+	if !reflect.DeepEqual(d.calls, expected) {
+		t.Errorf("calls were %#v instead of %#v", d.calls, expected)
+	}
+}
+
+func TestPullDataImagesDigestMismatch(t *testing.T) {
+	runner, d, _ := newTestRunner(t)
+	runner.job.Steps = runner.job.Steps[:1]
+	runner.job.Steps[0].Component.Container.VolumesFrom = []model.VolumesFrom{
+		{Name: "discoenv/ref-genome", Tag: "latest", Digest: "sha256:locked"},
+	}
+	d.repoDigests = map[string][]string{
+		"discoenv/ref-genome@sha256:locked": {"discoenv/ref-genome@sha256:other"},
+	}
+
+	if err := runner.pullDataImages(); err == nil {
+		t.Error("data image with the wrong digest was accepted")
+	}
+	if runner.status != messaging.StatusDockerPullFailed {
+		t.Errorf("status was %d instead of %d", runner.status, messaging.StatusDockerPullFailed)
+	}
+}
+
+func TestCreateWorkingDirVolume(t *testing.T) {
+	cases := []struct {
+		name     string
+		exists   bool
+		reuse    bool
+		expected []string
+	}{
+		{"new volume", false, false, []string{"CreateWorkingDirVolume %s"}},
+		{"new volume with reuse set", false, true, []string{"CreateWorkingDirVolume %s"}},
+		{"existing volume is recreated", true, false, []string{"RemoveVolume %s", "CreateWorkingDirVolume %s"}},
+		{"existing volume is reused", true, true, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			runner, d, _ := newTestRunner(t)
+			invID := runner.job.InvocationID
+			d.volumes = map[string]bool{invID: c.exists}
+			runner.reuse = c.reuse
+
+			if err := runner.createWorkingDirVolume(); err != nil {
+				t.Fatal(err)
+			}
+			var expected []string
+			for _, e := range c.expected {
+				expected = append(expected, fmt.Sprintf(e, invID))
+			}
+			if !reflect.DeepEqual(d.calls, expected) {
+				t.Errorf("calls were %#v instead of %#v", d.calls, expected)
+			}
+		})
+	}
+}
+
+func TestVerifySteps(t *testing.T) {
+	if !defaultRunConfig().allowEmpty {
+		t.Error("jobs without steps are rejected by default")
+	}
+
+	runner, _, _ := newTestRunner(t)
+	if err := runner.verifySteps(); err != nil {
+		t.Errorf("job with steps was rejected: %s", err)
+	}
+
+	runner.job.Steps = nil
+	runner.allowEmpty = true
+	if err := runner.verifySteps(); err != nil {
+		t.Errorf("job without steps was rejected when they're allowed: %s", err)
+	}
+
+	runner.allowEmpty = false
+	if err := runner.verifySteps(); err == nil {
+		t.Error("job without steps wasn't rejected")
+	}
+}
+
+func TestValidateJob(t *testing.T) {
+	runner, _, _ := newTestRunner(t)
+	if err := runner.validateJob(); err != nil {
+		t.Errorf("valid job was rejected: %s", err)
+	}
+
+	runner.limits = jobLimits{steps: 1}
+	runner.job.Steps = append(runner.job.Steps, runner.job.Steps...)
+	if err := runner.validateJob(); err == nil {
+		t.Error("job over the step limit wasn't rejected")
+	}
+}
+
+func TestVerifyLimits(t *testing.T) {
+	runner, _, _ := newTestRunner(t)
+	step := runner.job.Steps[0]
+	if len(step.Config.Inputs) != 1 {
+		t.Fatalf("the test step has %d inputs instead of 1", len(step.Config.Inputs))
+	}
+
+	tests := []struct {
+		name   string
+		steps  int
+		limits jobLimits
+		fails  bool
+	}{
+		{"no limits", 3, jobLimits{}, false},
+		{"below the input limit", 1, jobLimits{inputs: 2}, false},
+		{"at the input limit", 2, jobLimits{inputs: 2}, false},
+		{"above the input limit", 3, jobLimits{inputs: 2}, true},
+		{"below the step limit", 1, jobLimits{steps: 2}, false},
+		{"at the step limit", 2, jobLimits{steps: 2}, false},
+		{"above the step limit", 3, jobLimits{steps: 2}, true},
+	}
+	for _, test := range tests {
+		runner.job.Steps = nil
+		for i := 0; i < test.steps; i++ {
+			runner.job.Steps = append(runner.job.Steps, step)
+		}
+		runner.limits = test.limits
+		err := runner.verifyLimits()
+		if (err != nil) != test.fails {
+			t.Errorf("%s: err was %v", test.name, err)
+		}
+	}
+}
+
+func TestVerifyContainerNames(t *testing.T) {
+	runner, _, _ := newTestRunner(t)
+	invID := runner.job.InvocationID
+	blast := model.VolumesFrom{Name: "discoenv/blast-db", Tag: "1.0", NamePrefix: "blast"}
+
+	tests := []struct {
+		name  string
+		steps []model.Step
+		fails bool
+	}{
+		{"unique names", []model.Step{namedStep("wc", blast), namedStep("sort", blast)}, false},
+		{"unnamed steps", []model.Step{namedStep(""), namedStep("")}, false},
+		{"reused step name", []model.Step{namedStep("wc"), namedStep("sort"), namedStep("wc")}, true},
+		{
+			"data container name reused for another image",
+			[]model.Step{
+				namedStep("wc", blast),
+				namedStep("sort", model.VolumesFrom{Name: "discoenv/other-db", Tag: "1.0", NamePrefix: "blast"}),
+			},
+			true,
+		},
+		{"step named like a data container", []model.Step{namedStep("blast-"+invID, blast)}, true},
+	}
+	for _, test := range tests {
+		runner.job.Steps = test.steps
+		err := runner.verifyContainerNames()
+		if (err != nil) != test.fails {
+			t.Errorf("%s: err was %v", test.name, err)
+		}
+	}
+}
+
+// namedStep returns a step whose container has the given name and data
+// containers.
+func namedStep(name string, vfs ...model.VolumesFrom) model.Step {
+	var step model.Step
+	step.Component.Container.Name = name
+	step.Component.Container.VolumesFrom = vfs
+	return step
+}
+
+func TestUploadOutputsDeadline(t *testing.T) {
+	t.Run("stuck upload after a failure is abandoned", func(t *testing.T) {
+		runner, d, _ := newTestRunner(t)
+		d.uploadBlocks = make(chan struct{})
+		defer close(d.uploadBlocks)
+		runner.status = messaging.StatusStepFailed
+		runner.deadline = 50 * time.Millisecond
+
+		done := make(chan error, 1)
+		go func() {
+			done <- runner.uploadOutputs()
+		}()
+		select {
+		case err := <-done:
+			if err != errUploadDeadline {
+				t.Errorf("error was %v instead of %v", err, errUploadDeadline)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("the upload wasn't abandoned")
+		}
+		if runner.status != messaging.StatusStepFailed {
+			t.Errorf("status was %d instead of %d", runner.status, messaging.StatusStepFailed)
+		}
+	})
+
+	t.Run("successful jobs aren't limited", func(t *testing.T) {
+		runner, d, _ := newTestRunner(t)
+		d.uploadBlocks = make(chan struct{})
+		runner.deadline = 10 * time.Millisecond
+		time.AfterFunc(50*time.Millisecond, func() { close(d.uploadBlocks) })
+		if err := runner.uploadOutputs(); err != nil {
+			t.Error(err)
+		}
+		if runner.status != messaging.Success {
+			t.Errorf("status was %d instead of %d", runner.status, messaging.Success)
+		}
+	})
+}
+
+func TestPullJitter(t *testing.T) {
+	if d := pullJitter(0); d != 0 {
+		t.Errorf("jitter with a zero bound was %s", d)
+	}
+	max := 50 * time.Millisecond
+	for i := 0; i < 1000; i++ {
+		if d := pullJitter(max); d < 0 || d >= max {
+			t.Fatalf("jitter %s isn't within [0, %s)", d, max)
+		}
+	}
+}
+
+func TestWaitForPullJitterStops(t *testing.T) {
+	runner, _, _ := newTestRunner(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	runner.ctx = ctx
+	runner.jitter = time.Hour
+	cancel()
+	if err := runner.waitForPullJitter(); err != context.Canceled {
+		t.Errorf("error was %v instead of %v", err, context.Canceled)
+	}
+}
+
+func TestMergeLabels(t *testing.T) {
+	job := map[string]string{"experiment": "exp-42", "cohort": "a"}
+	step := map[string]string{"cohort": "b"}
+	expected := map[string]string{"experiment": "exp-42", "cohort": "b"}
+	if actual := mergeLabels(job, step); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("labels were %#v instead of %#v", actual, expected)
+	}
+	if job["cohort"] != "a" {
+		t.Error("the job's labels were changed")
+	}
+	if actual := mergeLabels(nil, nil); actual != nil {
+		t.Errorf("labels were %#v instead of nil", actual)
+	}
+}
+
+func TestTransferOutputsAfterInputFailure(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       messaging.StatusCode
+		uploadOnFail bool
+		expected     []string
+	}{
+		{"upload enabled", messaging.StatusInputFailed, true, []string{"UploadOutputs"}},
+		{"upload disabled", messaging.StatusInputFailed, false, nil},
+		{"step failure", messaging.StatusStepFailed, false, []string{"UploadOutputs"}},
+		{"success", messaging.Success, false, []string{"UploadOutputs"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runner, d, _ := newTestRunner(t)
+			runner.status = test.status
+			runner.uploadOnFail = test.uploadOnFail
+			if err := runner.transferOutputs(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(d.calls, test.expected) {
+				t.Errorf("calls were %#v instead of %#v", d.calls, test.expected)
+			}
+			if runner.status != test.status {
+				t.Errorf("status was %d instead of %d", runner.status, test.status)
+			}
+		})
+	}
+}
+
+func TestRunAllStepsOOMRetry(t *testing.T) {
+	t.Run("retried with more memory", func(t *testing.T) {
+		runner, d, _ := newTestRunner(t)
+		runner.job.Steps[0].Component.Container.MemoryLimit = 1024
+		runner.oomRetry = 1.5
+		d.oomRuns = 1
+		if err := runner.runAllSteps(runner.exit); err != nil {
+			t.Fatal(err)
+		}
+		expected := []int64{1024, 1536}
+		if !reflect.DeepEqual(d.memoryLimits, expected) {
+			t.Errorf("memory limits were %#v instead of %#v", d.memoryLimits, expected)
+		}
+		if runner.status != messaging.Success {
+			t.Errorf("status was %d instead of %d", runner.status, messaging.Success)
+		}
+		if runner.job.Steps[0].Component.Container.MemoryLimit != 1024 {
+			t.Error("the job's memory limit was changed")
+		}
+	})
+
+	t.Run("retried only once", func(t *testing.T) {
+		runner, d, _ := newTestRunner(t)
+		runner.job.Steps[0].Component.Container.MemoryLimit = 1024
+		runner.oomRetry = 2
+		d.oomRuns = 2
+		if err := runner.runAllSteps(runner.exit); err != dockerops.ErrOOMKilled {
+			t.Errorf("err was %v instead of %v", err, dockerops.ErrOOMKilled)
+		}
+		expected := []int64{1024, 2048}
+		if !reflect.DeepEqual(d.memoryLimits, expected) {
+			t.Errorf("memory limits were %#v instead of %#v", d.memoryLimits, expected)
+		}
+		if runner.status != messaging.StatusStepFailed {
+			t.Errorf("status was %d instead of %d", runner.status, messaging.StatusStepFailed)
+		}
+	})
+
+	t.Run("capped at the node's memory", func(t *testing.T) {
+		runner, d, _ := newTestRunner(t)
+		runner.job.Steps[0].Component.Container.MemoryLimit = 1024
+		runner.oomRetry = 2
+		d.nodeMemory = 1536
+		d.oomRuns = 1
+		if err := runner.runAllSteps(runner.exit); err != nil {
+			t.Fatal(err)
+		}
+		expected := []int64{1024, 1536}
+		if !reflect.DeepEqual(d.memoryLimits, expected) {
+			t.Errorf("memory limits were %#v instead of %#v", d.memoryLimits, expected)
+		}
+	})
+
+	t.Run("not retried when the limit is the node's memory", func(t *testing.T) {
+		runner, d, _ := newTestRunner(t)
+		runner.job.Steps[0].Component.Container.MemoryLimit = 1024
+		runner.oomRetry = 2
+		d.nodeMemory = 1024
+		d.oomRuns = 1
+		if err := runner.runAllSteps(runner.exit); err != dockerops.ErrOOMKilled {
+			t.Errorf("err was %v instead of %v", err, dockerops.ErrOOMKilled)
+		}
+		if len(d.memoryLimits) != 1 {
+			t.Errorf("the step was run %d times", len(d.memoryLimits))
+		}
+	})
+
+	t.Run("not retried when disabled or unlimited", func(t *testing.T) {
+		for _, c := range []struct {
+			limit    int64
+			multiple float64
+		}{{1024, 0}, {1024, 1}, {0, 2}} {
+			runner, d, _ := newTestRunner(t)
+			runner.job.Steps[0].Component.Container.MemoryLimit = c.limit
+			runner.oomRetry = c.multiple
+			d.oomRuns = 1
+			if err := runner.runAllSteps(runner.exit); err == nil {
+				t.Error("err was nil")
+			}
+			if len(d.memoryLimits) != 1 {
+				t.Errorf("limit %d with multiplier %g ran the step %d times", c.limit, c.multiple, len(d.memoryLimits))
+			}
+		}
+	})
+}
+
+func TestDownloadInputsRetries(t *testing.T) {
+	defer func(b time.Duration) { downloadBackoff = b }(downloadBackoff)
+	downloadBackoff = 0
+
+	tests := []struct {
+		name     string
+		attempts int
+		exits    []int64
+		expected []string
+		fails    bool
+	}{
+		{"retries turned off", 0, []int64{1}, []string{"DownloadInputs 0"}, true},
+		{"second attempt succeeds", 3, []int64{1, 0}, []string{"DownloadInputs 0", "DownloadInputs 0 attempt 2"}, false},
+		{"every attempt fails", 2, []int64{1, 1}, []string{"DownloadInputs 0", "DownloadInputs 0 attempt 2"}, true},
+	}
+	for _, test := range tests {
+		runner, d, _ := newTestRunner(t)
+		runner.dlAttempts = test.attempts
+		d.downloadExits = test.exits
+
+		runner.downloadInputs()
+		if !reflect.DeepEqual(d.calls, test.expected) {
+			t.Errorf("%s: calls were %#v instead of %#v", test.name, d.calls, test.expected)
+		}
+		failed := runner.status == messaging.StatusInputFailed
+		if failed != test.fails {
+			t.Errorf("%s: status was %d", test.name, runner.status)
+		}
+	}
+}
+
+func TestDownloadInputsRetryStopsWhenCancelled(t *testing.T) {
+	defer func(b time.Duration) { downloadBackoff = b }(downloadBackoff)
+	downloadBackoff = time.Hour
+
+	runner, d, _ := newTestRunner(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	runner.ctx = ctx
+	runner.dlAttempts = 3
+	d.downloadExits = []int64{1, 0}
+
+	if err := runner.downloadInputs(); err == nil {
+		t.Error("err was nil")
+	}
+	if expected := []string{"DownloadInputs 0"}; !reflect.DeepEqual(d.calls, expected) {
+		t.Errorf("calls were %#v instead of %#v", d.calls, expected)
+	}
+	if runner.status != messaging.StatusKilled {
+		t.Errorf("status was %d instead of %d", runner.status, messaging.StatusKilled)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"github.com/cyverse-de/road-runner/messaging"
+	"github.com/cyverse-de/road-runner/model"
+)
+
+// RunContext holds the job being run and the messaging state used to report
+// on it and receive requests about it. It's threaded through the listeners
+// and Run instead of living in package variables, so more than one job's
+// state can exist in the same process.
+type RunContext struct {
+	Job          *model.Job
+	Client       *messaging.Client
+	Publisher    JobUpdatePublisher
+	ExchangeName string
+	ExchangeType string
+
+	// Stop carries requests to end the job early without skipping the output
+	// upload. Run watches it for the whole job. It should be buffered so that
+	// a request made before Run starts isn't lost.
+	Stop chan messaging.StatusCode
+
+	config  runConfig
+	metrics metricsRecorder
+}
+
+// requestStop asks Run to stop the job with the given status. It never blocks;
+// if a request is already pending, the new one is dropped.
+func (rc *RunContext) requestStop(status messaging.StatusCode) {
+	requestStop(rc.Stop, status)
+}
+
+// running publishes a running update for the context's job.
+func (rc *RunContext) running(msg string) {
+	running(rc.Publisher, rc.Job, msg)
+}
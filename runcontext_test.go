@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/road-runner/messaging"
+	"github.com/cyverse-de/road-runner/model"
+)
+
+func TestRunContextsAreIndependent(t *testing.T) {
+	first := &RunContext{
+		Job:       &model.Job{InvocationID: "first"},
+		Publisher: &fakePublisher{},
+		Stop:      make(chan messaging.StatusCode, 1),
+	}
+	second := &RunContext{
+		Job:       &model.Job{InvocationID: "second"},
+		Publisher: &fakePublisher{},
+		Stop:      make(chan messaging.StatusCode, 1),
+	}
+
+	first.NewWallTimeTracker(10 * time.Millisecond)
+	second.NewWallTimeTracker(time.Hour).Timer.Stop()
+
+	select {
+	case <-first.Stop:
+	case <-time.After(3 * time.Second):
+		t.Fatal("the first context's tracker didn't fire")
+	}
+	select {
+	case <-second.Stop:
+		t.Error("the second context received a stop request")
+	default:
+	}
+
+	updates := first.Publisher.(*fakePublisher).updates
+	if len(updates) != 1 || updates[0].Job.InvocationID != "first" {
+		t.Errorf("the first context's updates were %#v", updates)
+	}
+	if n := len(second.Publisher.(*fakePublisher).updates); n != 0 {
+		t.Errorf("the second context received %d updates", n)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cyverse-de/road-runner/messaging"
+	"github.com/cyverse-de/road-runner/model"
+	"github.com/docker/docker/api/types"
+)
+
+// servicePollInterval is how often the state of a service data container is
+// checked while steps wait for it.
+var servicePollInterval = time.Second
+
+// hasHealthcheck returns true if the image defines a healthcheck that isn't
+// disabled.
+func hasHealthcheck(image types.ImageInspect) bool {
+	if image.Config == nil || image.Config.Healthcheck == nil {
+		return false
+	}
+	test := image.Config.Healthcheck.Test
+	return len(test) > 0 && test[0] != "NONE"
+}
+
+// isService returns true if the data container runs as a service instead of
+// only providing volumes, either because the job says so or because its image
+// defines a healthcheck.
+func (r *JobRunner) isService(vf *model.VolumesFrom) (bool, error) {
+	if vf.Service {
+		return true, nil
+	}
+	image, err := r.dckr.InspectImage(vf.ImageRef())
+	if err != nil {
+		return false, err
+	}
+	return hasHealthcheck(image), nil
+}
+
+// serviceReady returns true if a service container in the given state can be
+// used. Containers with a healthcheck have to be healthy, and containers
+// without one only have to be running. An error is returned if the container
+// exited or became unhealthy, since it isn't going to become ready.
+func serviceReady(state *types.ContainerState) (bool, error) {
+	if state.Health != nil && state.Health.Status == types.Unhealthy {
+		return false, errors.New("it's unhealthy")
+	}
+	if !state.Running {
+		if state.Status == "exited" || state.Status == "dead" {
+			return false, fmt.Errorf("it exited with code %d", state.ExitCode)
+		}
+		return false, nil
+	}
+	if state.Health != nil && state.Health.Status != types.NoHealthcheck {
+		return state.Health.Status == types.Healthy, nil
+	}
+	return true, nil
+}
+
+// waitForService polls the service container until it's ready, it fails, the
+// r.serviceWait passes, or the job is stopped.
+func (r *JobRunner) waitForService(name, containerID string) error {
+	deadline := time.Now().Add(r.serviceWait)
+	for {
+		info, err := r.dckr.InspectContainer(containerID)
+		if err != nil {
+			return err
+		}
+		if info.ContainerJSONBase != nil && info.State != nil {
+			ready, err := serviceReady(info.State)
+			if err != nil {
+				return fmt.Errorf("service %s won't become ready: %s", name, err)
+			}
+			if ready {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("service %s wasn't ready after %s", name, r.serviceWait)
+		}
+		select {
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		case <-time.After(servicePollInterval):
+		}
+	}
+}
+
+// waitForServices waits for the service data containers that the step uses to
+// become ready. Services that have been ready once aren't checked again.
+func (r *JobRunner) waitForServices(step *model.Step, idx int) error {
+	for _, vf := range step.Component.Container.VolumesFrom {
+		containerID, ok := r.services[vf.NamePrefix]
+		if !ok {
+			continue
+		}
+		name := fmt.Sprintf("%s-%s", vf.NamePrefix, r.job.InvocationID)
+		r.runningStep(fmt.Sprintf("Waiting for service %s to become ready", name), idx, messaging.RunningState, 0)
+		if err := r.waitForService(name, containerID); err != nil {
+			return err
+		}
+		delete(r.services, vf.NamePrefix)
+	}
+	return nil
+}
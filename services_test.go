@@ -0,0 +1,143 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/road-runner/dockerops"
+	"github.com/cyverse-de/road-runner/messaging"
+	"github.com/cyverse-de/road-runner/model"
+	"github.com/docker/docker/api/types"
+)
+
+func TestCreateDataContainersStartsServices(t *testing.T) {
+	runner, d, _ := newTestRunner(t)
+	d.healthchecked = map[string]bool{"postgres:9.6": true}
+	runner.job.Steps[0].Component.Container.VolumesFrom = []model.VolumesFrom{
+		{Name: "discoenv/blast-db", Tag: "1.0", NamePrefix: "blast"},
+		{Name: "postgres", Tag: "9.6", NamePrefix: "db"},
+		{Name: "redis", Tag: "3", NamePrefix: "cache", Service: true},
+	}
+
+	if err := runner.createDataContainers(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"CreateDataContainer blast",
+		"CreateDataContainer db",
+		"CreateDataContainer cache",
+		"StartContainer db",
+		"StartContainer cache",
+	}
+	if !reflect.DeepEqual(d.calls, expected) {
+		t.Errorf("calls were %#v instead of %#v", d.calls, expected)
+	}
+	services := map[string]string{"db": "db", "cache": "cache"}
+	if !reflect.DeepEqual(runner.services, services) {
+		t.Errorf("services were %#v instead of %#v", runner.services, services)
+	}
+}
+
+func TestCreateDataContainersFailsBeforeStartingServices(t *testing.T) {
+	runner, d, _ := newTestRunner(t)
+	d.dataErrs = map[string]error{"socket": dockerops.ErrDockerSocketNotAllowed}
+	runner.job.Steps[0].Component.Container.VolumesFrom = []model.VolumesFrom{
+		{Name: "redis", Tag: "3", NamePrefix: "cache", Service: true},
+		{Name: "discoenv/data", Tag: "1.0", NamePrefix: "socket", HostPath: "/var/run/docker.sock"},
+	}
+
+	if err := runner.createDataContainers(); err != dockerops.ErrDockerSocketNotAllowed {
+		t.Errorf("err was %v instead of %v", err, dockerops.ErrDockerSocketNotAllowed)
+	}
+	if runner.status != messaging.StatusDockerCreateFailed {
+		t.Errorf("status was %d instead of %d", runner.status, messaging.StatusDockerCreateFailed)
+	}
+	for _, call := range d.calls {
+		if call == "StartContainer cache" {
+			t.Error("the service was started")
+		}
+	}
+}
+
+func TestRunAllStepsWaitsForServices(t *testing.T) {
+	defer func(interval time.Duration) { servicePollInterval = interval }(servicePollInterval)
+	servicePollInterval = time.Millisecond
+
+	t.Run("service becomes healthy on the second poll", func(t *testing.T) {
+		runner, d, _ := newTestRunner(t)
+		runner.job.Steps[0].Component.Container.VolumesFrom = []model.VolumesFrom{{Name: "postgres", Tag: "9.6", NamePrefix: "db", Service: true}}
+		runner.services = map[string]string{"db": "db-container"}
+		d.serviceStates = []types.ContainerState{
+			{Status: "running", Running: true, Health: &types.Health{Status: types.Starting}},
+			{Status: "running", Running: true, Health: &types.Health{Status: types.Healthy}},
+		}
+
+		if err := runner.runAllSteps(runner.exit); err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{
+			"InspectContainer db-container",
+			"InspectContainer db-container",
+			"RunStep 0",
+		}
+		if !reflect.DeepEqual(d.calls, expected) {
+			t.Errorf("calls were %#v instead of %#v", d.calls, expected)
+		}
+	})
+
+	t.Run("service that exits fails the step", func(t *testing.T) {
+		runner, d, _ := newTestRunner(t)
+		runner.job.Steps[0].Component.Container.VolumesFrom = []model.VolumesFrom{{Name: "postgres", Tag: "9.6", NamePrefix: "db", Service: true}}
+		runner.services = map[string]string{"db": "db-container"}
+		d.serviceStates = []types.ContainerState{{Status: "exited", ExitCode: 1}}
+
+		if err := runner.runAllSteps(runner.exit); err == nil {
+			t.Error("err was nil")
+		}
+		if runner.status != messaging.StatusStepFailed {
+			t.Errorf("status was %d instead of %d", runner.status, messaging.StatusStepFailed)
+		}
+		for _, call := range d.calls {
+			if call == "RunStep 0" {
+				t.Error("the step ran without its service")
+			}
+		}
+	})
+
+	t.Run("service that never becomes ready times out", func(t *testing.T) {
+		runner, d, _ := newTestRunner(t)
+		runner.serviceWait = 10 * time.Millisecond
+		runner.services = map[string]string{"db": "db-container"}
+		d.serviceStates = []types.ContainerState{{Status: "created"}}
+		if err := runner.waitForService("db-invocation", "db-container"); err == nil {
+			t.Error("err was nil")
+		}
+	})
+}
+
+func TestServiceReady(t *testing.T) {
+	tests := []struct {
+		name  string
+		state types.ContainerState
+		ready bool
+		fails bool
+	}{
+		{"created", types.ContainerState{Status: "created"}, false, false},
+		{"running", types.ContainerState{Status: "running", Running: true}, true, false},
+		{"starting", types.ContainerState{Status: "running", Running: true, Health: &types.Health{Status: types.Starting}}, false, false},
+		{"healthy", types.ContainerState{Status: "running", Running: true, Health: &types.Health{Status: types.Healthy}}, true, false},
+		{"unhealthy", types.ContainerState{Status: "running", Running: true, Health: &types.Health{Status: types.Unhealthy}}, false, true},
+		{"exited", types.ContainerState{Status: "exited", ExitCode: 2}, false, true},
+	}
+	for _, test := range tests {
+		state := test.state
+		ready, err := serviceReady(&state)
+		if ready != test.ready {
+			t.Errorf("%s: ready was %t instead of %t", test.name, ready, test.ready)
+		}
+		if (err != nil) != test.fails {
+			t.Errorf("%s: err was %v", test.name, err)
+		}
+	}
+}
@@ -1,6 +1,13 @@
 package main
 
-import "os"
+import (
+	"os"
+	"time"
+
+	"github.com/cyverse-de/logcabin"
+	"github.com/cyverse-de/road-runner/dockerops"
+	"github.com/docker/docker/api/types"
+)
 
 // SignalHandler provides the logic for handling various process-ending signals.
 type SignalHandler struct {
@@ -39,3 +46,58 @@ func (s *SignalHandler) Receive(quit chan bool, f SignalProcessor, q QuitProcess
 		}
 	}()
 }
+
+// exitInspector is the subset of *dockerops.Docker needed to find the exit
+// code of a job's step.
+type exitInspector interface {
+	containerLister
+	InspectContainer(containerID string) (types.ContainerJSON, error)
+}
+
+// stepExitCode returns the exit code of the job's step container that exited
+// last. ok is false if a step container is still running, since that's the
+// step the job was on, or if no step container has exited.
+func stepExitCode(d exitInspector, invID string) (code int, ok bool) {
+	containers, err := jobContainersOfType(d, invID, dockerops.StepContainer)
+	if err != nil {
+		logcabin.Error.Print(err)
+		return 0, false
+	}
+	var last time.Time
+	for _, id := range containers {
+		info, err := d.InspectContainer(id)
+		if err != nil {
+			logcabin.Error.Print(err)
+			continue
+		}
+		if info.ContainerJSONBase == nil || info.State == nil {
+			continue
+		}
+		if info.State.Running || info.State.Status != "exited" {
+			return 0, false
+		}
+		finished, err := time.Parse(time.RFC3339Nano, info.State.FinishedAt)
+		if err != nil {
+			logcabin.Error.Print(err)
+			continue
+		}
+		if !ok || finished.After(last) {
+			code, last, ok = info.State.ExitCode, finished, true
+		}
+	}
+	return code, ok
+}
+
+// signalExitCode returns the code road-runner exits with after it's stopped
+// by a signal. It's -1 unless preserve is true and the job's last step exited
+// with a non-zero code. A step that exited with 0 doesn't count, since the
+// signal may have arrived between steps, during a pre-command, or during the
+// upload, and a killed job must never look successful.
+func signalExitCode(d exitInspector, invID string, preserve bool) int {
+	if preserve {
+		if code, ok := stepExitCode(d, invID); ok && code != 0 {
+			return code
+		}
+	}
+	return -1
+}
@@ -4,6 +4,9 @@ import (
 	"os"
 	"testing"
 	"time"
+
+	"github.com/cyverse-de/road-runner/dockerops"
+	"github.com/docker/docker/api/types"
 )
 
 func TestInitSignalHandler(t *testing.T) {
@@ -66,3 +69,83 @@ func TestReceive(t *testing.T) {
 		}
 	})
 }
+
+// fakeExitInspector reports the states of the containers it knows about.
+type fakeExitInspector struct {
+	fakeCleaner
+	states map[string]types.ContainerState
+}
+
+func (f *fakeExitInspector) InspectContainer(id string) (types.ContainerJSON, error) {
+	state := f.states[id]
+	return types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{ID: id, State: &state}}, nil
+}
+
+func TestSignalExitCode(t *testing.T) {
+	exited := func(code int, finished string) types.ContainerState {
+		return types.ContainerState{Status: "exited", ExitCode: code, FinishedAt: finished}
+	}
+	tests := []struct {
+		name     string
+		preserve bool
+		states   map[string]types.ContainerState
+		expected int
+	}{
+		{
+			"step exited",
+			true,
+			map[string]types.ContainerState{"step-0": exited(3, "2017-03-14T15:09:26.5Z")},
+			3,
+		},
+		{
+			"last step to exit",
+			true,
+			map[string]types.ContainerState{
+				"step-0": exited(0, "2017-03-14T15:09:26.5Z"),
+				"step-1": exited(137, "2017-03-14T15:10:00Z"),
+			},
+			137,
+		},
+		{
+			"step still running",
+			true,
+			map[string]types.ContainerState{
+				"step-0": exited(0, "2017-03-14T15:09:26.5Z"),
+				"step-1": {Status: "running", Running: true},
+			},
+			-1,
+		},
+		{
+			"last step succeeded",
+			true,
+			map[string]types.ContainerState{
+				"step-0": exited(2, "2017-03-14T15:09:26.5Z"),
+				"step-1": exited(0, "2017-03-14T15:10:00Z"),
+			},
+			-1,
+		},
+		{"no steps", true, nil, -1},
+		{
+			"not preserved",
+			false,
+			map[string]types.ContainerState{"step-0": exited(3, "2017-03-14T15:09:26.5Z")},
+			-1,
+		},
+	}
+	for _, test := range tests {
+		f := &fakeExitInspector{
+			fakeCleaner: fakeCleaner{labels: map[string]map[string]string{
+				"input": containerLabels("mine", dockerops.InputContainer),
+				"other": containerLabels("other", dockerops.StepContainer),
+			}},
+			states: map[string]types.ContainerState{"other": exited(42, "2017-03-14T16:00:00Z")},
+		}
+		for id, state := range test.states {
+			f.labels[id] = containerLabels("mine", dockerops.StepContainer)
+			f.states[id] = state
+		}
+		if code := signalExitCode(f, "mine", test.preserve); code != test.expected {
+			t.Errorf("%s: exit code was %d instead of %d", test.name, code, test.expected)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/logcabin"
+	"github.com/cyverse-de/road-runner/messaging"
+	"github.com/cyverse-de/road-runner/model"
+)
+
+// exitStatusFile is the name of the file in the logs directory that holds the
+// job's final status for the HTCondor wrapper scripts.
+const exitStatusFile = "exit_status"
+
+// statusDescriptions are the human readable versions of the job status codes.
+var statusDescriptions = map[messaging.StatusCode]string{
+	messaging.Success:                  "success",
+	messaging.StatusDockerPullFailed:   "docker pull failed",
+	messaging.StatusDockerCreateFailed: "docker create failed",
+	messaging.StatusInputFailed:        "input download failed",
+	messaging.StatusStepFailed:         "step failed",
+	messaging.StatusOutputFailed:       "output upload failed",
+	messaging.StatusKilled:             "killed",
+	messaging.StatusTimeLimit:          "time limit reached",
+	messaging.StatusBadDuration:        "bad time limit duration",
+	StatusIdleTimeout:                  "step idle timeout",
+	StatusPlatformMismatch:             "image platform mismatch",
+}
+
+// exitCodes maps the job status codes to road-runner's process exit codes.
+// The known statuses keep their numeric values, which are already small and
+// distinct, so wrappers that read the exit code see what they always have.
+var exitCodes = map[messaging.StatusCode]int{
+	messaging.Success:                  0,
+	messaging.StatusDockerPullFailed:   1,
+	messaging.StatusDockerCreateFailed: 2,
+	messaging.StatusInputFailed:        3,
+	messaging.StatusStepFailed:         4,
+	messaging.StatusOutputFailed:       5,
+	messaging.StatusKilled:             6,
+	messaging.StatusTimeLimit:          7,
+	messaging.StatusBadDuration:        8,
+	StatusIdleTimeout:                  9,
+	StatusPlatformMismatch:             10,
+}
+
+// exitCodeUnknown is the exit code for statuses that aren't in exitCodes. It's
+// the largest code that shells don't reserve for themselves.
+const exitCodeUnknown = 125
+
+// exitCodeFor returns the process exit code for the status. Unlike the raw
+// status value, it's always between 0 and 125.
+func exitCodeFor(sc messaging.StatusCode) int {
+	if code, ok := exitCodes[sc]; ok {
+		return code
+	}
+	return exitCodeUnknown
+}
+
+func hostname() string {
+	h, err := os.Hostname()
+	if err != nil {
+		logcabin.Error.Printf("Couldn't get the hostname: %s", err.Error())
+		return ""
+	}
+	return h
+}
+
+// JobUpdatePublisher is the interface for objects that send job status updates.
+// *messaging.Client satisfies it.
+type JobUpdatePublisher interface {
+	PublishJobUpdate(u *messaging.UpdateMessage) error
+}
+
+// fail publishes the failure of the job. exit is left out of the update when
+// it's nil, which is the case when the job fails before it has a status.
+func fail(client JobUpdatePublisher, job *model.Job, exit *messaging.ExitCode, msg string) error {
+	logcabin.Error.Print(msg)
+	return client.PublishJobUpdate(&messaging.UpdateMessage{
+		Job:      job,
+		State:    messaging.FailedState,
+		Message:  msg,
+		Sender:   hostname(),
+		ExitCode: exit,
+	})
+}
+
+func success(client JobUpdatePublisher, job *model.Job) error {
+	logcabin.Info.Print("Job success")
+	return client.PublishJobUpdate(&messaging.UpdateMessage{
+		Job:      job,
+		State:    messaging.SucceededState,
+		Sender:   hostname(),
+		ExitCode: &messaging.ExitCode{Status: messaging.Success},
+	})
+}
+
+// terminalPublishAttempts is the number of times the final success or failure
+// update is sent before giving up. Losing it leaves the job looking like it's
+// still running, so it gets more chances than the running updates do.
+const terminalPublishAttempts = 5
+
+// terminalPublishBackoff is how long to wait after the first failed attempt
+// to send the final update. It doubles after each failure.
+var terminalPublishBackoff = 500 * time.Millisecond
+
+// publishTerminal calls publish until it succeeds or has been tried
+// terminalPublishAttempts times. The last error is returned.
+func publishTerminal(publish func() error) error {
+	backoff := terminalPublishBackoff
+	for attempt := 1; ; attempt++ {
+		err := publish()
+		if err == nil || attempt == terminalPublishAttempts {
+			return err
+		}
+		logcabin.Warning.Printf("error publishing the final job status, retrying in %s: %s", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// The phases of a job reported in the Phase field of running updates. The
+// State stays RunningState for all of them so that consumers that don't know
+// about phases see the same updates as before.
+const (
+	PhasePreparing = "preparing"
+	PhaseRunning   = "running"
+	PhaseUploading = "uploading"
+)
+
+func running(client JobUpdatePublisher, job *model.Job, msg string) {
+	runningInPhase(client, job, "", msg)
+}
+
+// runningInPhase is running, but the update also says which phase of the job
+// is in progress.
+func runningInPhase(client JobUpdatePublisher, job *model.Job, phase, msg string) {
+	publishRunning(client, &messaging.UpdateMessage{
+		Job:     job,
+		Message: msg,
+		Phase:   phase,
+	})
+}
+
+// publishRunning sets the state and sender of u and publishes it as a running
+// update.
+func publishRunning(client JobUpdatePublisher, u *messaging.UpdateMessage) {
+	u.State = messaging.RunningState
+	u.Sender = hostname()
+	if err := client.PublishJobUpdate(u); err != nil {
+		logcabin.Error.Print(err)
+	}
+	logcabin.Info.Print(u.Message)
+}
+
+func impendingCancellation(client JobUpdatePublisher, job *model.Job, msg string) {
+	err := client.PublishJobUpdate(&messaging.UpdateMessage{
+		Job:     job,
+		State:   messaging.ImpendingCancellationState,
+		Message: msg,
+		Sender:  hostname(),
+	})
+	if err != nil {
+		logcabin.Error.Print(err)
+	}
+	logcabin.Info.Print(msg)
+}
+
+// mirroredPublisher sends every job update to the primary publisher and then
+// to the mirror. Errors from the mirror are logged but are otherwise ignored so
+// that they don't affect the delivery of updates to the primary exchange.
+type mirroredPublisher struct {
+	primary JobUpdatePublisher
+	mirror  JobUpdatePublisher
+}
+
+// PublishJobUpdate publishes u to both exchanges and returns the error from
+// the primary exchange.
+func (m *mirroredPublisher) PublishJobUpdate(u *messaging.UpdateMessage) error {
+	err := m.primary.PublishJobUpdate(u)
+	if merr := m.mirror.PublishJobUpdate(u); merr != nil {
+		logcabin.Error.Printf("error publishing job update to the mirror exchange: %s", merr)
+	}
+	return err
+}
+
+// statusDescription returns a human readable description of the status code.
+func statusDescription(status messaging.StatusCode) string {
+	if desc, ok := statusDescriptions[status]; ok {
+		return desc
+	}
+	return "unknown status"
+}
+
+// writeExitStatus writes the numeric status code and its description on a
+// single line to the exit status file in dir.
+func writeExitStatus(fs FileSystem, dir string, status messaging.StatusCode) error {
+	w, err := fs.Create(path.Join(dir, exitStatusFile))
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(w, "%d %s\n", status, statusDescription(status)); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// tokenBucket allows up to burst events at once and refills at rate tokens per
+// second.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+	mutex  sync.Mutex
+}
+
+// newTokenBucket returns a full *tokenBucket. The burst size is the number of
+// tokens added in a second, but never less than one.
+func newTokenBucket(rate float64, now func() time.Time) *tokenBucket {
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   now(),
+		now:    now,
+	}
+}
+
+// take removes a token from the bucket and returns true if one was available.
+func (b *tokenBucket) take() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	current := b.now()
+	b.tokens += current.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = current
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// throttledPublisher limits the rate at which running updates are published,
+// as set by amqp.update_rate. Running updates over the limit are dropped; they
+// are still in the road-runner logs. Every other kind of update, including the
+// terminal failed and completed updates, is published immediately.
+type throttledPublisher struct {
+	next   JobUpdatePublisher
+	bucket *tokenBucket
+}
+
+func newThrottledPublisher(next JobUpdatePublisher, rate float64) *throttledPublisher {
+	return &throttledPublisher{
+		next:   next,
+		bucket: newTokenBucket(rate, time.Now),
+	}
+}
+
+// PublishJobUpdate publishes u unless it's a running update and the rate limit
+// has been reached.
+func (t *throttledPublisher) PublishJobUpdate(u *messaging.UpdateMessage) error {
+	if u.State == messaging.RunningState && !t.bucket.take() {
+		return nil
+	}
+	return t.next.PublishJobUpdate(u)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/road-runner/messaging"
+)
+
+// fakePublisher records the job updates that are published. If err is set it's
+// returned from PublishJobUpdate after the update is recorded. The first
+// failFirst publishes fail regardless.
+type fakePublisher struct {
+	mutex     sync.Mutex
+	updates   []*messaging.UpdateMessage
+	err       error
+	failFirst int
+}
+
+func (f *fakePublisher) PublishJobUpdate(u *messaging.UpdateMessage) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.updates = append(f.updates, u)
+	if f.failFirst > 0 {
+		f.failFirst--
+		return errors.New("connection reset")
+	}
+	return f.err
+}
+
+func TestMirroredPublisher(t *testing.T) {
+	primary := &fakePublisher{}
+	mirror := &fakePublisher{}
+	p := &mirroredPublisher{primary: primary, mirror: mirror}
+
+	running(p, nil, "first")
+	running(p, nil, "second")
+
+	for name, f := range map[string]*fakePublisher{"primary": primary, "mirror": mirror} {
+		if len(f.updates) != 2 {
+			t.Fatalf("%s received %d updates instead of 2", name, len(f.updates))
+		}
+		if f.updates[0].Message != "first" || f.updates[1].Message != "second" {
+			t.Errorf("%s received %q and %q", name, f.updates[0].Message, f.updates[1].Message)
+		}
+	}
+}
+
+func TestMirroredPublisherMirrorFailure(t *testing.T) {
+	primary := &fakePublisher{}
+	mirror := &fakePublisher{err: errors.New("mirror is down")}
+	p := &mirroredPublisher{primary: primary, mirror: mirror}
+
+	if err := p.PublishJobUpdate(&messaging.UpdateMessage{Message: "test"}); err != nil {
+		t.Errorf("mirror failure was returned: %s", err)
+	}
+	if len(primary.updates) != 1 {
+		t.Errorf("primary received %d updates instead of 1", len(primary.updates))
+	}
+}
+
+func TestMirroredPublisherPrimaryFailure(t *testing.T) {
+	expected := errors.New("primary is down")
+	primary := &fakePublisher{err: expected}
+	mirror := &fakePublisher{}
+	p := &mirroredPublisher{primary: primary, mirror: mirror}
+
+	if err := p.PublishJobUpdate(&messaging.UpdateMessage{Message: "test"}); err != expected {
+		t.Errorf("error was %v instead of %v", err, expected)
+	}
+	if len(mirror.updates) != 1 {
+		t.Errorf("mirror received %d updates instead of 1", len(mirror.updates))
+	}
+}
+
+func TestWriteExitStatus(t *testing.T) {
+	cases := []struct {
+		status   messaging.StatusCode
+		expected string
+	}{
+		{messaging.Success, "0 success\n"},
+		{messaging.StatusStepFailed, "4 step failed\n"},
+		{messaging.StatusCode(99), "99 unknown status\n"},
+	}
+	for _, c := range cases {
+		fs := newMemFileSystem()
+		if err := writeExitStatus(fs, "logs", c.status); err != nil {
+			t.Fatal(err)
+		}
+		actual := string(fs.files["logs/exit_status"])
+		if actual != c.expected {
+			t.Errorf("exit status file was %q instead of %q", actual, c.expected)
+		}
+	}
+}
+
+func TestThrottledPublisher(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	next := &fakePublisher{}
+	p := &throttledPublisher{next: next, bucket: newTokenBucket(2, clock)}
+
+	for i := 0; i < 10; i++ {
+		running(p, nil, fmt.Sprintf("burst %d", i))
+	}
+	if len(next.updates) != 2 {
+		t.Errorf("%d running updates were published instead of 2", len(next.updates))
+	}
+
+	if err := success(p, nil); err != nil {
+		t.Fatal(err)
+	}
+	last := next.updates[len(next.updates)-1]
+	if last.State != messaging.SucceededState {
+		t.Errorf("terminal update wasn't published, last state was %s", last.State)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	before := len(next.updates)
+	running(p, nil, "after half a second")
+	running(p, nil, "also after half a second")
+	if len(next.updates)-before != 1 {
+		t.Errorf("%d running updates were published after refilling instead of 1", len(next.updates)-before)
+	}
+}
+
+func TestExitCodeFor(t *testing.T) {
+	expected := map[messaging.StatusCode]int{
+		messaging.Success:                  0,
+		messaging.StatusDockerPullFailed:   1,
+		messaging.StatusDockerCreateFailed: 2,
+		messaging.StatusInputFailed:        3,
+		messaging.StatusStepFailed:         4,
+		messaging.StatusOutputFailed:       5,
+		messaging.StatusKilled:             6,
+		messaging.StatusTimeLimit:          7,
+		messaging.StatusBadDuration:        8,
+		StatusIdleTimeout:                  9,
+		StatusPlatformMismatch:             10,
+		messaging.StatusCode(300):          125,
+		messaging.StatusCode(-1):           125,
+	}
+	seen := make(map[int]messaging.StatusCode)
+	for status, code := range expected {
+		actual := exitCodeFor(status)
+		if actual != code {
+			t.Errorf("status %d mapped to %d instead of %d", status, actual, code)
+		}
+		if actual < 0 || actual > 125 {
+			t.Errorf("status %d mapped to %d, which is outside of 0-125", status, actual)
+		}
+		if other, ok := seen[actual]; ok && actual != 125 {
+			t.Errorf("statuses %d and %d both map to %d", status, other, actual)
+		}
+		seen[actual] = status
+	}
+}
+
+func TestReportStatusRetries(t *testing.T) {
+	oldBackoff := terminalPublishBackoff
+	terminalPublishBackoff = time.Millisecond
+	defer func() { terminalPublishBackoff = oldBackoff }()
+
+	t.Run("a failed publish is retried", func(t *testing.T) {
+		runner, _, p := newTestRunner(t)
+		runner.status = messaging.StatusStepFailed
+		p.failFirst = 1
+		runner.reportStatus()
+		if len(p.updates) != 2 {
+			t.Fatalf("%d updates were sent instead of 2", len(p.updates))
+		}
+		if p.updates[1].State != messaging.FailedState {
+			t.Errorf("state of the retry was %s instead of %s", p.updates[1].State, messaging.FailedState)
+		}
+	})
+
+	t.Run("retries are bounded", func(t *testing.T) {
+		runner, _, p := newTestRunner(t)
+		p.err = errors.New("broker is down")
+		runner.reportStatus()
+		if len(p.updates) != terminalPublishAttempts {
+			t.Errorf("%d updates were sent instead of %d", len(p.updates), terminalPublishAttempts)
+		}
+	})
+}
+
+func TestReportStatusExitCode(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		runner, _, p := newTestRunner(t)
+		runner.reportStatus()
+		last := p.updates[len(p.updates)-1]
+		expected := &messaging.ExitCode{Status: messaging.Success}
+		if !reflect.DeepEqual(last.ExitCode, expected) {
+			t.Errorf("exit code was %#v instead of %#v", last.ExitCode, expected)
+		}
+	})
+
+	t.Run("failed step", func(t *testing.T) {
+		runner, d, p := newTestRunner(t)
+		d.runStepExitCode = 3
+		if err := runner.runAllSteps(runner.exit); err == nil {
+			t.Fatal("err was nil")
+		}
+		runner.reportStatus()
+		last := p.updates[len(p.updates)-1]
+		if last.State != messaging.FailedState {
+			t.Errorf("state was %s instead of %s", last.State, messaging.FailedState)
+		}
+		expected := &messaging.ExitCode{Status: messaging.StatusStepFailed, Step: 3}
+		if !reflect.DeepEqual(last.ExitCode, expected) {
+			t.Errorf("exit code was %#v instead of %#v", last.ExitCode, expected)
+		}
+	})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/cyverse-de/road-runner/dockerops"
+	"github.com/cyverse-de/road-runner/messaging"
+)
+
+// errStopped is returned by the phases of a job that end early because a stop
+// was requested.
+var errStopped = errors.New("the job was stopped")
+
+// requestStop sends status on stop unless a request is already pending there.
+func requestStop(stop chan messaging.StatusCode, status messaging.StatusCode) {
+	select {
+	case stop <- status:
+	default:
+	}
+}
+
+// watchStop waits for a stop request on r.stop until r.ctx is done. When one
+// arrives, its status is recorded for proceed, cancel is called to abort any
+// image pulls, and the job's input and step containers are stopped so that Run
+// falls through to uploading the outputs.
+func (r *JobRunner) watchStop(cancel context.CancelFunc) {
+	select {
+	case status := <-r.stop:
+		r.stopMu.Lock()
+		r.stopped = status
+		r.stopMu.Unlock()
+		cancel()
+		r.stopContainers()
+	case <-r.ctx.Done():
+	}
+}
+
+// stopContainers stops the job's running input and step containers.
+func (r *JobRunner) stopContainers() {
+	containerTypes := []struct {
+		containerType int
+		grace         time.Duration
+	}{
+		{dockerops.InputContainer, r.cleanup.grace.other},
+		{dockerops.StepContainer, r.cleanup.grace.step},
+	}
+	for _, ct := range containerTypes {
+		ids, err := jobContainersOfType(r.dckr, r.job.InvocationID, ct.containerType)
+		if err != nil {
+			r.log.Error(err)
+			continue
+		}
+		for _, id := range ids {
+			r.log.Infof("stopping container %s", id)
+			if err = r.dckr.StopContainer(id, ct.grace); err != nil {
+				r.log.Error(err)
+			}
+		}
+	}
+}
+
+// proceed returns true if the job should go on to its next phase. Once a stop
+// has been requested, the job's status is replaced with the stop's, so the job
+// is reported as stopped rather than as a failure of whatever the stop
+// interrupted.
+func (r *JobRunner) proceed() bool {
+	r.stopMu.Lock()
+	stopped := r.stopped
+	r.stopMu.Unlock()
+	if stopped != messaging.Success {
+		r.status = stopped
+	}
+	return r.status == messaging.Success
+}
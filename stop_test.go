@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/road-runner/messaging"
+)
+
+func TestRunWallTimeLimitUploadsOutputs(t *testing.T) {
+	job := _inittests(t, false)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "road-runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err = os.Mkdir("logs", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// The pulls block until they're cancelled, so no step is running when
+	// the wall time runs out.
+	d := &fakeDocker{pullBlocks: true}
+	rc := &RunContext{Job: job, Publisher: &fakePublisher{}, Stop: make(chan messaging.StatusCode, 1)}
+	exit := make(chan messaging.StatusCode, 1)
+	rc.NewWallTimeTracker(50 * time.Millisecond)
+	go Run(context.Background(), rc, d, exit)
+
+	select {
+	case status := <-exit:
+		if status != messaging.StatusTimeLimit {
+			t.Errorf("status was %d instead of %d", status, messaging.StatusTimeLimit)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't finish after the wall time ran out")
+	}
+	if !containsCall(d.calls, "UploadOutputs") {
+		t.Errorf("the outputs weren't uploaded, calls were %#v", d.calls)
+	}
+	if containsCall(d.calls, "RunStep 0") {
+		t.Errorf("a step was run after the wall time ran out, calls were %#v", d.calls)
+	}
+}
+
+func TestRequestStopDoesNotBlock(t *testing.T) {
+	rc := &RunContext{Stop: make(chan messaging.StatusCode, 1)}
+	rc.requestStop(messaging.StatusTimeLimit)
+	rc.requestStop(messaging.StatusKilled)
+	if status := <-rc.Stop; status != messaging.StatusTimeLimit {
+		t.Errorf("status was %d instead of %d", status, messaging.StatusTimeLimit)
+	}
+}
+
+// containsCall returns true if call was recorded in calls.
+func containsCall(calls []string, call string) bool {
+	for _, c := range calls {
+		if c == call {
+			return true
+		}
+	}
+	return false
+}
@@ -2,11 +2,15 @@ package main
 
 import (
 	"encoding/csv"
+	"fmt"
 	"io"
 	"os"
 	"path"
+	"strings"
 
-	"github.com/cyverse-de/model"
+	"github.com/cyverse-de/road-runner/dockerops"
+	"github.com/cyverse-de/road-runner/model"
+	"github.com/docker/docker/api/types"
 )
 
 func writeCSV(fileWriter io.Writer, records [][]string) (err error) {
@@ -20,7 +24,20 @@ func writeCSV(fileWriter io.Writer, records [][]string) (err error) {
 	return writer.Error()
 }
 
-func writeJobSummary(outputDir string, job *model.Job) error {
+// nodeOS describes the operating system of the node the Docker daemon runs
+// on.
+func nodeOS(v types.Version) string {
+	desc := strings.TrimSpace(fmt.Sprintf("%s %s", v.Os, v.KernelVersion))
+	if v.Arch != "" {
+		desc = fmt.Sprintf("%s (%s)", desc, v.Arch)
+	}
+	return desc
+}
+
+// writeJobSummary writes JobSummary.csv to outputDir. The Docker daemon's
+// version and the node's operating system are included when the daemon
+// reported them.
+func writeJobSummary(outputDir string, job *model.Job, daemon types.Version) error {
 	outputPath := path.Join(outputDir, "JobSummary.csv")
 
 	fileWriter, err := os.Create(outputPath)
@@ -36,10 +53,41 @@ func writeJobSummary(outputDir string, job *model.Job) error {
 		{"Application Name", job.AppName},
 		{"Submitted By", job.Submitter},
 	}
+	if daemon.Version != "" {
+		records = append(records,
+			[]string{"Docker Version", daemon.Version},
+			[]string{"Node OS", nodeOS(daemon)},
+		)
+	}
 
 	return writeCSV(fileWriter, records)
 }
 
+// shellQuote returns arg quoted so that a POSIX shell treats it as a single
+// word. Arguments made up entirely of safe characters are left alone.
+func shellQuote(arg string) string {
+	if arg == "" {
+		return "''"
+	}
+	if strings.IndexFunc(arg, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:=@%+,", r))
+	}) < 0 {
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", `'"'"'`, -1) + "'"
+}
+
+// commandLine returns the step's command line as it would be typed into a
+// shell.
+func commandLine(step *model.Step) string {
+	argv := dockerops.StepCommand(step)
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
 func stepToRecord(step *model.Step) [][]string {
 	var retval [][]string
 
@@ -51,6 +99,11 @@ func stepToRecord(step *model.Step) [][]string {
 			p.Value,
 		})
 	}
+	retval = append(retval, []string{
+		step.Executable(),
+		"Command Line",
+		commandLine(step),
+	})
 
 	return retval
 }
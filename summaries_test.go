@@ -5,7 +5,11 @@ import (
 	"os"
 	"path"
 	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/cyverse-de/road-runner/model"
+	"github.com/docker/docker/api/types"
 )
 
 func TestWriteCSV(t *testing.T) {
@@ -47,7 +51,7 @@ Application ID,c7f05682-23c8-4182-b9a2-e09650a5f49b
 Application Name,Word Count
 Submitted By,test_this_is_a_test
 `
-	if err := writeJobSummary("test", s); err != nil {
+	if err := writeJobSummary("test", s, types.Version{}); err != nil {
 		t.Error(err)
 	}
 	outPath := "test/JobSummary.csv"
@@ -64,21 +68,80 @@ Submitted By,test_this_is_a_test
 	}
 }
 
+func TestWriteJobSummaryDaemonVersion(t *testing.T) {
+	inittests(t)
+	dir, err := ioutil.TempDir("", "road-runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	daemon := types.Version{Version: "17.03.1-ce", Os: "linux", Arch: "amd64", KernelVersion: "4.4.0-72-generic"}
+	if err = writeJobSummary(dir, s, daemon); err != nil {
+		t.Fatal(err)
+	}
+	input, err := ioutil.ReadFile(path.Join(dir, "JobSummary.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `Submitted By,test_this_is_a_test
+Docker Version,17.03.1-ce
+Node OS,linux 4.4.0-72-generic (amd64)
+`
+	if !strings.HasSuffix(string(input), expected) {
+		t.Errorf("JobSummary.csv was:\n%s\n\tinstead of ending with:\n%s\n", input, expected)
+	}
+}
+
 func TestStepToRecord(t *testing.T) {
 	inittests(t)
 	actual := stepToRecord(&s.Steps[0])
 	expected := [][]string{
 		{"", "", "This is a test"},
+		{"", "Command Line", "/bin/echo 'This is a test'"},
 	}
 	if !reflect.DeepEqual(actual, expected) {
 		t.Errorf("Record %#v does not equal %#v", actual, expected)
 	}
 }
 
+func TestStepToRecordParamOrder(t *testing.T) {
+	step := &model.Step{}
+	step.Component.Container.EntryPoint = "blastn"
+	step.Config.Params = []model.StepParam{
+		{Name: "-out", Value: "out.txt", Order: 3},
+		{Name: "-query", Value: "query.fa", Order: 1},
+		{Name: "-evalue", Value: "10", Order: 2},
+		{Name: "-db", Value: "nt", Order: 1},
+	}
+	submitted := append([]model.StepParam(nil), step.Config.Params...)
+
+	actual := stepToRecord(step)
+	expected := [][]string{
+		{"", "-query", "query.fa"},
+		{"", "-db", "nt"},
+		{"", "-evalue", "10"},
+		{"", "-out", "out.txt"},
+		{"", "Command Line", "blastn -query query.fa -db nt -evalue 10 -out out.txt"},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("records were %#v instead of %#v", actual, expected)
+	}
+
+	argv := []string{"-query", "query.fa", "-db", "nt", "-evalue", "10", "-out", "out.txt"}
+	if args := step.Arguments(); !reflect.DeepEqual(args, argv) {
+		t.Errorf("arguments were %#v instead of %#v", args, argv)
+	}
+	if !reflect.DeepEqual(step.Config.Params, submitted) {
+		t.Errorf("the submitted params were reordered: %#v", step.Config.Params)
+	}
+}
+
 func TestWriteJobParameters(t *testing.T) {
 	inittests(t)
 	expected := `Executable,Argument Option,Argument Value
 ,,This is a test
+,Command Line,/bin/echo 'This is a test'
 `
 	if err := writeJobParameters("test", s); err != nil {
 		t.Error(err)
@@ -96,3 +159,38 @@ func TestWriteJobParameters(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestShellQuote(t *testing.T) {
+	cases := map[string]string{
+		"":                "''",
+		"--output":        "--output",
+		"/de-app-work/in": "/de-app-work/in",
+		"two words":       "'two words'",
+		"it's":            `'it'"'"'s'`,
+		"$HOME":           "'$HOME'",
+	}
+	for arg, expected := range cases {
+		if actual := shellQuote(arg); actual != expected {
+			t.Errorf("shellQuote(%q) was %q instead of %q", arg, actual, expected)
+		}
+	}
+}
+
+func TestCommandLine(t *testing.T) {
+	step := &model.Step{
+		Component: model.StepComponent{
+			Container: model.Container{EntryPoint: "wc"},
+		},
+		Config: model.StepConfig{
+			Params: []model.StepParam{
+				{Name: "--files0-from", Value: "my inputs.txt", Order: 1},
+				{Name: "-l", Order: 0},
+				{Value: "it's", Order: 2},
+			},
+		},
+	}
+	expected := `wc -l --files0-from 'my inputs.txt' 'it'"'"'s'`
+	if actual := commandLine(step); actual != expected {
+		t.Errorf("command line was %s instead of %s", actual, expected)
+	}
+}
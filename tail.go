@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/cyverse-de/road-runner/model"
+)
+
+// maxTailLineLength is the longest line from a failed step's stderr that's
+// included in the failure message. Longer lines are truncated.
+const maxTailLineLength = 200
+
+// tailChunkSize is how much of the file tailLines reads at a time while it
+// looks backwards from the end for the start of the last lines.
+const tailChunkSize = 4096
+
+// tailLines returns the last n lines of r. The file is read backwards from
+// the end in chunks, and at most maxLen bytes of each line are kept, so the
+// memory used doesn't depend on the size of the file or the length of its
+// lines. Lines longer than maxLen are truncated on a rune boundary.
+func tailLines(r io.ReadSeeker, n, maxLen int) ([]string, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil || n <= 0 || size == 0 {
+		return nil, err
+	}
+
+	// A newline at the very end terminates the last line rather than
+	// starting an empty one.
+	end := size
+	last := make([]byte, 1)
+	if _, err = r.Seek(size-1, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err = io.ReadFull(r, last); err != nil {
+		return nil, err
+	}
+	if last[0] == '\n' {
+		end--
+	}
+
+	// Find where the last n lines start and end, newest first.
+	var starts, ends []int64
+	lineEnd := end
+	pos := end
+	buf := make([]byte, tailChunkSize)
+	for pos > 0 && len(starts) < n {
+		chunk := int64(len(buf))
+		if pos < chunk {
+			chunk = pos
+		}
+		pos -= chunk
+		if _, err = r.Seek(pos, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err = io.ReadFull(r, buf[:chunk]); err != nil {
+			return nil, err
+		}
+		for i := chunk - 1; i >= 0 && len(starts) < n; i-- {
+			if buf[i] == '\n' {
+				starts = append(starts, pos+i+1)
+				ends = append(ends, lineEnd)
+				lineEnd = pos + i
+			}
+		}
+	}
+	if len(starts) < n {
+		starts = append(starts, 0)
+		ends = append(ends, lineEnd)
+	}
+
+	lines := make([]string, 0, len(starts))
+	line := make([]byte, maxLen+1)
+	for i := len(starts) - 1; i >= 0; i-- {
+		length := ends[i] - starts[i]
+		if length > int64(len(line)) {
+			length = int64(len(line))
+		}
+		if _, err = r.Seek(starts[i], io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err = io.ReadFull(r, line[:length]); err != nil {
+			return nil, err
+		}
+		lines = append(lines, truncateLine(line[:length], maxLen))
+	}
+	return lines, nil
+}
+
+// truncateLine returns b as a string without a trailing carriage return. If
+// it's longer than maxLen bytes, it's cut at the last rune boundary that
+// leaves it no longer than that and "..." is added to the end.
+func truncateLine(b []byte, maxLen int) string {
+	if len(b) <= maxLen {
+		return strings.TrimSuffix(string(b), "\r")
+	}
+	cut := maxLen
+	for cut > 0 && !utf8.RuneStart(b[cut]) {
+		cut--
+	}
+	return string(b[:cut]) + "..."
+}
+
+// stderrTail returns the end of the stderr log of the step at idx, or an
+// empty string if the feature is off or the log can't be read. The stdout log
+// is used for steps that combine their output.
+func (r *JobRunner) stderrTail(step *model.Step, idx int) string {
+	if r.tailLines <= 0 {
+		return ""
+	}
+	stdoutLog, logPath := r.dckr.StepLogs(step, idx)
+	if step.CombineOutput {
+		logPath = stdoutLog
+	}
+	f, err := r.fs.Open(path.Join(r.volumeDir, logPath))
+	if err != nil {
+		r.log.WithField("phase", PhaseRunning).Error(err)
+		return ""
+	}
+	defer f.Close()
+	lines, err := tailLines(f, r.tailLines, maxTailLineLength)
+	if err != nil {
+		r.log.WithField("phase", PhaseRunning).Error(err)
+	}
+	return strings.Join(lines, "\n")
+}
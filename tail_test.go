@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTailLines(t *testing.T) {
+	long := strings.Repeat("x", 100*1024)
+	tests := []struct {
+		name     string
+		contents string
+		n        int
+		expected []string
+	}{
+		{"empty", "", 2, nil},
+		{"fewer lines than asked for", "one\ntwo\n", 5, []string{"one", "two"}},
+		{"last lines", "one\ntwo\nthree\n", 2, []string{"two", "three"}},
+		{"no trailing newline", "one\ntwo\nthree", 2, []string{"two", "three"}},
+		{"empty lines", "one\n\n\n", 2, []string{"", ""}},
+		{"leading newline", "\none", 2, []string{"", "one"}},
+		{"carriage returns", "one\r\ntwo\r\n", 2, []string{"one", "two"}},
+		{"line longer than the scanner buffer", "one\n" + long + "\ntwo\n", 2, []string{"xxxxxxx...", "two"}},
+		{"lines spanning chunks", strings.Repeat("y", tailChunkSize+10) + "\nz\n", 2, []string{"yyyyyyy...", "z"}},
+		{"truncated on a rune boundary", "abééééé\n", 1, []string{"abéé..."}},
+		{"nothing asked for", "one\n", 0, nil},
+	}
+	for _, test := range tests {
+		lines, err := tailLines(bytes.NewReader([]byte(test.contents)), test.n, 7)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(lines, test.expected) {
+			t.Errorf("%s: lines were %#v instead of %#v", test.name, lines, test.expected)
+		}
+	}
+}